@@ -17,6 +17,7 @@ limitations under the License.
 package v1alpha1
 
 import (
+	core_v1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 )
 
@@ -30,6 +31,64 @@ type PodRetrieval struct {
 	// +operator-sdk:csv:customresourcedefinitions:type=spec,displayName="Indicate namespace for pod retrieval"
 	// +optional
 	Namespace string `json:"namespace,omitempty"`
+	// LabelSelector allows restricting the list of pods to those matching the selector
+	// +operator-sdk:csv:customresourcedefinitions:type=spec,displayName="Indicate label selector for pod retrieval"
+	// +optional
+	LabelSelector string `json:"labelselector,omitempty"`
+	// FieldSelector allows restricting the list of pods to those matching the selector, e.g. "status.phase=Running"
+	// +operator-sdk:csv:customresourcedefinitions:type=spec,displayName="Indicate field selector for pod retrieval"
+	// +optional
+	FieldSelector string `json:"fieldselector,omitempty"`
+}
+
+// PodAttestation struct defines different information required for pod attestation
+type PodAttestation struct {
+	// Namespace allows specifying namespace of the pod to attest. Attestation namespace is used if not specified
+	// +operator-sdk:csv:customresourcedefinitions:type=spec,displayName="Indicate namespace of the pod to attest"
+	// +optional
+	Namespace string `json:"namespace,omitempty"`
+	// PodName allows specifying the name of the pod to attest
+	// +operator-sdk:csv:customresourcedefinitions:type=spec,displayName="Indicate name of the pod to attest"
+	// +optional
+	PodName string `json:"podname,omitempty"`
+	// ContainerName allows specifying the container where attestation command is executed.
+	// If not specified, the container declared by the pod in the attestation.io/container annotation is used,
+	// or the single container of the pod if it does not declare any. When admission webhooks are enabled and the
+	// pod exists, it defaults to the container declared by the annotation, or the first container of the pod
+	// +operator-sdk:csv:customresourcedefinitions:type=spec,displayName="Indicate container where attestation command is executed"
+	// +optional
+	ContainerName string `json:"containername,omitempty"`
+	// InitContainer indicates ContainerName is an init container of the pod, e.g. an agent completing before the
+	// workload starts. Attestation command is executed while the init container runs. Once it has terminated,
+	// its logs are used as the quote instead, and so they can not include the nonce of the challenge
+	// +operator-sdk:csv:customresourcedefinitions:type=spec,displayName="Indicate container where attestation command is executed is an init container"
+	// +optional
+	InitContainer bool `json:"initcontainer,omitempty"`
+	// Command allows specifying the command (and its arguments) executed to attest the pod. A fresh nonce is
+	// delivered to the command as specified by NonceDelivery, and its output must include the nonce in a line
+	// prefixed by "nonce:"
+	// +operator-sdk:csv:customresourcedefinitions:type=spec,displayName="Indicate attestation command"
+	// +optional
+	Command []string `json:"command,omitempty"`
+	// NonceDelivery allows specifying how the nonce is delivered to the attestation command: either through its
+	// input (stdin, the default), or written to a temporary file in the pod whose path is appended to the command
+	// as its last argument (file), for agents reading the nonce from a file
+	// +operator-sdk:csv:customresourcedefinitions:type=spec,displayName="Indicate how the nonce is delivered to the attestation command"
+	// +kubebuilder:validation:Enum=stdin;file
+	// +optional
+	NonceDelivery string `json:"noncedelivery,omitempty"`
+	// VerificationPolicy allows specifying how the quote returned by the attestation command is verified: either
+	// only checking it includes the nonce of the challenge (nonce), or also verifying it with the verifier
+	// configured in the operator (verifier, the default)
+	// +operator-sdk:csv:customresourcedefinitions:type=spec,displayName="Indicate how the quote is verified"
+	// +kubebuilder:validation:Enum=nonce;verifier
+	// +optional
+	VerificationPolicy string `json:"verificationpolicy,omitempty"`
+	// CleanupCommand allows specifying the command (and its arguments) executed to clean up attestation
+	// artifacts in the pod when the attestation is deleted
+	// +operator-sdk:csv:customresourcedefinitions:type=spec,displayName="Indicate cleanup command"
+	// +optional
+	CleanupCommand []string `json:"cleanupcommand,omitempty"`
 }
 
 // AttestationSpec defines the desired state of Attestation
@@ -38,6 +97,58 @@ type AttestationSpec struct {
 	// +operator-sdk:csv:customresourcedefinitions:type=spec,displayName="Information for pod list retrieval"
 	// +optional
 	PodRetrievalInfo *PodRetrieval `json:"podretrieval,omitempty"`
+	// PodAttestationInfo allows specifying information required to attest a pod
+	// +operator-sdk:csv:customresourcedefinitions:type=spec,displayName="Information for pod attestation"
+	// +optional
+	PodAttestationInfo *PodAttestation `json:"podattestation,omitempty"`
+	// IntervalSeconds allows specifying the period, in seconds, to attest the pod again after a successful attestation.
+	// Zero value means the pod is attested once. Defaults to DefaultIntervalSeconds when admission webhooks are enabled
+	// +operator-sdk:csv:customresourcedefinitions:type=spec,displayName="Indicate attestation interval in seconds"
+	// +kubebuilder:validation:Minimum=0
+	// +optional
+	IntervalSeconds *int `json:"intervalseconds,omitempty"`
+	// PodSelector allows attesting all the pods matching the selector, in the namespace of PodAttestationInfo,
+	// instead of the single pod named there. Attestation is verified only if all the pods matched are verified
+	// +operator-sdk:csv:customresourcedefinitions:type=spec,displayName="Indicate selector of the pods to attest"
+	// +optional
+	PodSelector *metav1.LabelSelector `json:"podselector,omitempty"`
+	// PreExecCommand allows specifying a command (and its arguments) executed in the pod to attest before the
+	// attestation command, e.g. to prepare the agent. Attestation command is not executed if it fails
+	// +operator-sdk:csv:customresourcedefinitions:type=spec,displayName="Indicate command executed before attestation"
+	// +optional
+	PreExecCommand []string `json:"preexeccommand,omitempty"`
+	// PostExecCommand allows specifying a command (and its arguments) executed in the pod to attest after the
+	// attestation command, e.g. to clean up the agent. It is executed even if previous commands fail
+	// +operator-sdk:csv:customresourcedefinitions:type=spec,displayName="Indicate command executed after attestation"
+	// +optional
+	PostExecCommand []string `json:"postexeccommand,omitempty"`
+	// TimeoutSeconds allows specifying the maximum duration, in seconds, of each command executed in the pod to
+	// attest, overriding the default exec timeout of the operator. It must not exceed the maximum exec timeout
+	// configured in the operator
+	// +operator-sdk:csv:customresourcedefinitions:type=spec,displayName="Indicate timeout in seconds of commands executed"
+	// +kubebuilder:validation:Minimum=1
+	// +optional
+	TimeoutSeconds int `json:"timeoutseconds,omitempty"`
+	// CommandSecretRef allows specifying the attestation command in a key of a Secret in the namespace of the
+	// attestation, instead of podattestation.command, so that it is not exposed in the spec. The key holds the
+	// command (and its arguments) either as a JSON array or one per line
+	// +operator-sdk:csv:customresourcedefinitions:type=spec,displayName="Indicate Secret key holding the attestation command"
+	// +optional
+	CommandSecretRef *core_v1.SecretKeySelector `json:"commandsecretref,omitempty"`
+	// Schedule allows restricting attestations to the minutes matched by a cron expression, e.g. "* 2-3 * * 6" for
+	// a maintenance window from 2:00 to 3:59 on Saturdays, in the time zone of the operator unless prefixed by
+	// CRON_TZ=. Outside of the schedule, attestation is postponed until the next minute matched
+	// +operator-sdk:csv:customresourcedefinitions:type=spec,displayName="Indicate cron schedule of the attestations"
+	// +optional
+	Schedule string `json:"schedule,omitempty"`
+}
+
+// GetIntervalSeconds returns the attestation interval in seconds, or zero if not specified
+func (s *AttestationSpec) GetIntervalSeconds() int {
+	if s.IntervalSeconds == nil {
+		return 0
+	}
+	return *s.IntervalSeconds
 }
 
 // PodInformation contains different information related to pods retrieved
@@ -62,10 +173,130 @@ type AttestationStatus struct {
 	// +operator-sdk:csv:customresourcedefinitions:type=status,xDescriptors="urn:alm:descriptor:text",displayName="Version"
 	// +optional
 	Version string `json:"version,omitempty"`
+	// Conditions contains the different conditions of the attestation, such as Ready, Quoted or Verified
+	// +operator-sdk:csv:customresourcedefinitions:type=status,xDescriptors="urn:alm:descriptor:io.kubernetes.conditions",displayName="Conditions"
+	// +patchMergeKey=type
+	// +patchStrategy=merge
+	// +listType=map
+	// +listMapKey=type
+	// +optional
+	Conditions []metav1.Condition `json:"conditions,omitempty" patchStrategy:"merge" patchMergeKey:"type"`
+	// ConsecutiveFailures contains the number of consecutive failed attestations, which drives requeue backoff
+	// +operator-sdk:csv:customresourcedefinitions:type=status,xDescriptors="urn:alm:descriptor:text",displayName="Consecutive Failures"
+	// +optional
+	ConsecutiveFailures int `json:"consecutivefailures,omitempty"`
+	// LastFailureReason contains the reason of the last failed attestation
+	// +operator-sdk:csv:customresourcedefinitions:type=status,xDescriptors="urn:alm:descriptor:text",displayName="Last Failure Reason"
+	// +optional
+	LastFailureReason string `json:"lastfailurereason,omitempty"`
+	// ObservedGeneration contains the generation of the attestation spec last reconciled successfully
+	// +operator-sdk:csv:customresourcedefinitions:type=status,xDescriptors="urn:alm:descriptor:text",displayName="Observed Generation"
+	// +optional
+	ObservedGeneration int64 `json:"observedgeneration,omitempty"`
+	// LastAttestationTime contains the time of the last successful attestation
+	// +operator-sdk:csv:customresourcedefinitions:type=status,xDescriptors="urn:alm:descriptor:text",displayName="Last Attestation Time"
+	// +optional
+	LastAttestationTime *metav1.Time `json:"lastattestationtime,omitempty"`
+	// Verified is true if the last attestation succeeded, mirroring the Verified condition
+	// +operator-sdk:csv:customresourcedefinitions:type=status,xDescriptors="urn:alm:descriptor:text",displayName="Verified"
+	// +optional
+	Verified bool `json:"verified"`
+	// TargetPod contains the pod attested, as namespace/name, or the namespace and pod selector of the pods
+	// attested if a pod selector is specified
+	// +operator-sdk:csv:customresourcedefinitions:type=status,xDescriptors="urn:alm:descriptor:text",displayName="Target Pod"
+	// +optional
+	TargetPod string `json:"targetpod,omitempty"`
+	// Nonce contains the nonce sent on the last attestation challenge, to correlate it with its verification
+	// +operator-sdk:csv:customresourcedefinitions:type=status,xDescriptors="urn:alm:descriptor:text",displayName="Nonce"
+	// +optional
+	Nonce string `json:"nonce,omitempty"`
+	// Output contains the output of the last successful attestation command, truncated if too long. Full output
+	// is stored in the evidence Secret, if evidence persistence is enabled. It is not set for pod selectors, whose
+	// outputs are only stored in the evidence Secret, one set of keys per pod
+	// +operator-sdk:csv:customresourcedefinitions:type=status,xDescriptors="urn:alm:descriptor:text",displayName="Output"
+	// +optional
+	Output string `json:"output,omitempty"`
+	// HookOutputs contains the results of the commands executed before and after the attestation command
+	// +operator-sdk:csv:customresourcedefinitions:type=status,xDescriptors="urn:alm:descriptor:text",displayName="Hook Outputs"
+	// +optional
+	HookOutputs []HookOutput `json:"hookoutputs,omitempty"`
+	// PodResults contains the result of the attestation of each of the pods matching the pod selector
+	// +operator-sdk:csv:customresourcedefinitions:type=status,xDescriptors="urn:alm:descriptor:text",displayName="Pod Results"
+	// +optional
+	PodResults []PodAttestationResult `json:"podresults,omitempty"`
 }
 
+// PodAttestationResult contains the result of the attestation of a pod matching the pod selector
+type PodAttestationResult struct {
+	// PodName contains the name of the pod attested
+	// +operator-sdk:csv:customresourcedefinitions:type=status,xDescriptors="urn:alm:descriptor:text",displayName="Pod Name"
+	PodName string `json:"podname"`
+	// Verified is true if the pod was attested successfully
+	// +operator-sdk:csv:customresourcedefinitions:type=status,xDescriptors="urn:alm:descriptor:text",displayName="Verified"
+	Verified bool `json:"verified"`
+	// Timestamp contains the time of the attestation of the pod
+	// +operator-sdk:csv:customresourcedefinitions:type=status,xDescriptors="urn:alm:descriptor:text",displayName="Timestamp"
+	Timestamp metav1.Time `json:"timestamp"`
+	// Reason contains the reason of the failure, if the pod was not attested successfully
+	// +operator-sdk:csv:customresourcedefinitions:type=status,xDescriptors="urn:alm:descriptor:text",displayName="Reason"
+	// +optional
+	Reason string `json:"reason,omitempty"`
+	// Nonce contains the nonce sent on the attestation challenge of the pod
+	// +operator-sdk:csv:customresourcedefinitions:type=status,xDescriptors="urn:alm:descriptor:text",displayName="Nonce"
+	// +optional
+	Nonce string `json:"nonce,omitempty"`
+}
+
+// HookOutput contains the result of a command executed before or after the attestation command
+type HookOutput struct {
+	// Hook contains the hook executed, either pre or post
+	// +operator-sdk:csv:customresourcedefinitions:type=status,xDescriptors="urn:alm:descriptor:text",displayName="Hook"
+	Hook string `json:"hook"`
+	// Output contains the output of the command, truncated if too long
+	// +operator-sdk:csv:customresourcedefinitions:type=status,xDescriptors="urn:alm:descriptor:text",displayName="Output"
+	// +optional
+	Output string `json:"output,omitempty"`
+	// ExitCode contains the exit code of the command
+	// +operator-sdk:csv:customresourcedefinitions:type=status,xDescriptors="urn:alm:descriptor:text",displayName="Exit Code"
+	// +optional
+	ExitCode int `json:"exitcode,omitempty"`
+	// Error contains the error that prevented the command from being executed, if any
+	// +operator-sdk:csv:customresourcedefinitions:type=status,xDescriptors="urn:alm:descriptor:text",displayName="Error"
+	// +optional
+	Error string `json:"error,omitempty"`
+}
+
+const (
+	// ConditionReady indicates the attestation has been reconciled
+	ConditionReady = "Ready"
+	// ConditionQuoted indicates the attestation command has been executed in the pod to attest
+	ConditionQuoted = "Quoted"
+	// ConditionVerified indicates the pod attestation completed successfully
+	ConditionVerified = "Verified"
+)
+
+const (
+	// NonceDeliveryStdin delivers the nonce to the attestation command through its input
+	NonceDeliveryStdin = "stdin"
+	// NonceDeliveryFile delivers the nonce to the attestation command in a file, whose path is its last argument
+	NonceDeliveryFile = "file"
+)
+
+const (
+	// VerificationPolicyNonce only checks the quote includes the nonce of the attestation challenge
+	VerificationPolicyNonce = "nonce"
+	// VerificationPolicyVerifier checks the nonce of the quote, and verifies it with the verifier of the operator
+	VerificationPolicyVerifier = "verifier"
+)
+
 //+kubebuilder:object:root=true
 //+kubebuilder:subresource:status
+//+kubebuilder:printcolumn:name="Verified",type=boolean,JSONPath=`.status.verified`,description="Whether the last attestation succeeded"
+//+kubebuilder:printcolumn:name="Last-Attested",type=date,JSONPath=`.status.lastattestationtime`,description="Time of the last successful attestation"
+//+kubebuilder:printcolumn:name="Target-Pod",type=string,JSONPath=`.status.targetpod`,description="Pod or pod selector attested"
+//+kubebuilder:printcolumn:name="Failures",type=integer,JSONPath=`.status.consecutivefailures`,description="Consecutive failed attestations"
+//+kubebuilder:printcolumn:name="Last-Failure",type=string,JSONPath=`.status.lastfailurereason`,description="Reason of the last failed attestation"
+//+kubebuilder:printcolumn:name="Age",type=date,JSONPath=`.metadata.creationTimestamp`
 
 // Attestation is the Schema for the attestations API
 type Attestation struct {
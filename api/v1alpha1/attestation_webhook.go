@@ -0,0 +1,234 @@
+/*
+Copyright 2023.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha1
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/robfig/cron/v3"
+	core_v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	logf "sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/webhook"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+)
+
+// DefaultIntervalSeconds is the attestation interval set by the defaulting webhook when not specified
+const DefaultIntervalSeconds = 300
+
+// AllowDeleteAnnotation allows deleting verified attestations when set to "true"
+const AllowDeleteAnnotation = "attestation.io/allow-delete"
+
+// ContainerAnnotation allows pods to declare the container to attest, when no container name is specified
+const ContainerAnnotation = "attestation.io/container"
+
+// log is for logging in this package.
+var attestationlog = logf.Log.WithName("attestation-resource")
+
+// SetupWebhookWithManager registers the attestation webhooks in the manager. Attestations are defaulted by
+// attestationDefaulter, which reads the pods to attest with the API reader of the manager
+func (r *Attestation) SetupWebhookWithManager(mgr ctrl.Manager) error {
+	return ctrl.NewWebhookManagedBy(mgr).
+		For(r).
+		WithDefaulter(&attestationDefaulter{reader: mgr.GetAPIReader()}).
+		Complete()
+}
+
+//+kubebuilder:webhook:path=/mutate-keylime-redhat-com-v1alpha1-attestation,mutating=true,failurePolicy=fail,sideEffects=None,groups=keylime.redhat.com,resources=attestations,verbs=create;update,versions=v1alpha1,name=mattestation.kb.io,admissionReviewVersions=v1
+
+var _ webhook.Defaulter = &Attestation{}
+
+// Default implements webhook.Defaulter so a webhook will be registered for the type.
+// Only fields not specified are defaulted, so that explicit values, including zero values, are preserved
+func (r *Attestation) Default() {
+	attestationlog.Info("default", "name", r.Name)
+	if r.Spec.IntervalSeconds == nil {
+		interval := DefaultIntervalSeconds
+		r.Spec.IntervalSeconds = &interval
+	}
+	if r.Spec.PodAttestationInfo != nil && r.Spec.PodAttestationInfo.VerificationPolicy == "" {
+		r.Spec.PodAttestationInfo.VerificationPolicy = VerificationPolicyVerifier
+	}
+}
+
+// attestationDefaulter defaults attestations as Default does, and also defaults the container name of the pod
+// to attest, which requires reading the pod
+type attestationDefaulter struct {
+	reader client.Reader
+}
+
+var _ admission.CustomDefaulter = &attestationDefaulter{}
+
+// Default implements admission.CustomDefaulter. Container name is defaulted to the container declared by the pod
+// in the ContainerAnnotation, or its first container otherwise. It is not defaulted for pod selectors, init
+// containers, or if the pod can not be read, e.g. because it does not exist yet, as the reconciler resolves the
+// container when attesting the pod then
+func (d *attestationDefaulter) Default(ctx context.Context, obj runtime.Object) error {
+	attestation, ok := obj.(*Attestation)
+	if !ok {
+		return fmt.Errorf("expected an Attestation, got %T", obj)
+	}
+	attestation.Default()
+	info := attestation.Spec.PodAttestationInfo
+	if info == nil || info.ContainerName != "" || info.InitContainer || info.PodName == "" {
+		return nil
+	}
+	namespace := info.Namespace
+	if namespace == "" {
+		namespace = attestation.Namespace
+	}
+	pod := &core_v1.Pod{}
+	if err := d.reader.Get(ctx, client.ObjectKey{Namespace: namespace, Name: info.PodName}, pod); err != nil {
+		attestationlog.Info("container name not defaulted, unable to read pod", "name", attestation.Name,
+			"namespace", namespace, "pod", info.PodName, "error", err.Error())
+		return nil
+	}
+	info.ContainerName = defaultContainerName(pod)
+	return nil
+}
+
+// defaultContainerName returns the name of the container declared by the pod in the ContainerAnnotation, or the
+// name of its first container, or an empty string if the pod has no containers
+func defaultContainerName(pod *core_v1.Pod) string {
+	if annotated := pod.Annotations[ContainerAnnotation]; annotated != "" {
+		return annotated
+	}
+	if len(pod.Spec.Containers) == 0 {
+		return ""
+	}
+	return pod.Spec.Containers[0].Name
+}
+
+//+kubebuilder:webhook:path=/validate-keylime-redhat-com-v1alpha1-attestation,mutating=false,failurePolicy=fail,sideEffects=None,groups=keylime.redhat.com,resources=attestations,verbs=create;update;delete,versions=v1alpha1,name=vattestation.kb.io,admissionReviewVersions=v1
+
+var _ webhook.Validator = &Attestation{}
+
+// ValidateCreate implements webhook.Validator so a webhook will be registered for the type
+func (r *Attestation) ValidateCreate() error {
+	attestationlog.Info("validate create", "name", r.Name)
+	return r.validateAttestation(true)
+}
+
+// ValidateUpdate implements webhook.Validator so a webhook will be registered for the type.
+// Attestation type is only required if the previous attestation had one, so that attestations created before it
+// was required can still be updated, e.g. to remove their finalizer when deleted
+func (r *Attestation) ValidateUpdate(old runtime.Object) error {
+	attestationlog.Info("validate update", "name", r.Name)
+	previous, ok := old.(*Attestation)
+	return r.validateAttestation(!ok || previous.Spec.hasAttestationType())
+}
+
+// ValidateDelete implements webhook.Validator so a webhook will be registered for the type.
+// Verified attestations can only be deleted if AllowDeleteAnnotation is set to "true"
+func (r *Attestation) ValidateDelete() error {
+	attestationlog.Info("validate delete", "name", r.Name)
+	if !meta.IsStatusConditionTrue(r.Status.Conditions, ConditionVerified) || r.Annotations[AllowDeleteAnnotation] == "true" {
+		return nil
+	}
+	return apierrors.NewForbidden(schema.GroupResource{Group: GroupVersion.Group, Resource: "attestations"}, r.Name,
+		fmt.Errorf("attestation is verified, set annotation %s to \"true\" to allow its deletion, e.g. "+
+			"kubectl annotate attestation %s %s=true", AllowDeleteAnnotation, r.Name, AllowDeleteAnnotation))
+}
+
+// validateAttestation returns an Invalid error listing every invalid field of the spec, or nil if spec is valid.
+// Attestation type is checked if required
+func (r *Attestation) validateAttestation(requireType bool) error {
+	path := field.NewPath("spec")
+	allErrs := r.Spec.validate(path)
+	if requireType && !r.Spec.hasAttestationType() && r.Spec.PodSelector == nil {
+		allErrs = append(allErrs, field.Required(path, "attestation type must be specified: podattestation "+
+			"to attest pods, or podretrieval enabled to list them"))
+	}
+	if len(allErrs) == 0 {
+		return nil
+	}
+	return apierrors.NewInvalid(schema.GroupKind{Group: GroupVersion.Group, Kind: "Attestation"}, r.Name, allErrs)
+}
+
+// hasAttestationType returns whether the spec specifies a known attestation type, either attesting pods or
+// listing them. Unknown ones are pruned by the API server, as they are not part of the schema, leaving none
+func (s *AttestationSpec) hasAttestationType() bool {
+	return s.PodAttestationInfo != nil || (s.PodRetrievalInfo != nil && s.PodRetrievalInfo.Enabled)
+}
+
+// validate checks the attestation spec fields
+func (s *AttestationSpec) validate(path *field.Path) field.ErrorList {
+	var allErrs field.ErrorList
+	if s.GetIntervalSeconds() < 0 {
+		allErrs = append(allErrs, field.Invalid(path.Child("intervalseconds"), s.GetIntervalSeconds(),
+			"must not be negative"))
+	}
+	if s.TimeoutSeconds < 0 {
+		allErrs = append(allErrs, field.Invalid(path.Child("timeoutseconds"), s.TimeoutSeconds, "must be positive"))
+	}
+	if s.PodAttestationInfo != nil && s.PodAttestationInfo.PodName == "" && s.PodSelector == nil {
+		allErrs = append(allErrs, field.Required(path.Child("podattestation", "podname"),
+			"name of the pod to attest must be specified, unless podselector is"))
+	}
+	if s.PodAttestationInfo != nil && s.PodAttestationInfo.InitContainer && s.PodAttestationInfo.ContainerName == "" {
+		allErrs = append(allErrs, field.Required(path.Child("podattestation", "containername"),
+			"name of the init container must be specified"))
+	}
+	if s.PodAttestationInfo != nil {
+		switch s.PodAttestationInfo.VerificationPolicy {
+		case "", VerificationPolicyNonce, VerificationPolicyVerifier:
+		default:
+			allErrs = append(allErrs, field.NotSupported(path.Child("podattestation", "verificationpolicy"),
+				s.PodAttestationInfo.VerificationPolicy, []string{VerificationPolicyNonce, VerificationPolicyVerifier}))
+		}
+	}
+	if s.Schedule != "" {
+		if _, err := cron.ParseStandard(s.Schedule); err != nil {
+			allErrs = append(allErrs, field.Invalid(path.Child("schedule"), s.Schedule, err.Error()))
+		}
+	}
+	if s.CommandSecretRef != nil {
+		if s.CommandSecretRef.Name == "" {
+			allErrs = append(allErrs, field.Required(path.Child("commandsecretref", "name"),
+				"name of the Secret holding the attestation command must be specified"))
+		}
+		if s.CommandSecretRef.Key == "" {
+			allErrs = append(allErrs, field.Required(path.Child("commandsecretref", "key"),
+				"key of the Secret holding the attestation command must be specified"))
+		}
+		if s.PodAttestationInfo != nil && len(s.PodAttestationInfo.Command) > 0 {
+			allErrs = append(allErrs, field.Forbidden(path.Child("commandsecretref"),
+				"commandsecretref and podattestation.command are mutually exclusive"))
+		}
+	}
+	if s.PodSelector != nil {
+		if s.PodAttestationInfo == nil {
+			allErrs = append(allErrs, field.Required(path.Child("podattestation"),
+				"pod attestation is required to attest the pods matching podselector"))
+		} else if s.PodAttestationInfo.PodName != "" {
+			allErrs = append(allErrs, field.Forbidden(path.Child("podselector"),
+				"podselector and podattestation.podname are mutually exclusive"))
+		}
+		if _, err := metav1.LabelSelectorAsSelector(s.PodSelector); err != nil {
+			allErrs = append(allErrs, field.Invalid(path.Child("podselector"), s.PodSelector, err.Error()))
+		}
+	}
+	return allErrs
+}
@@ -0,0 +1,284 @@
+/*
+Copyright 2023.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha1
+
+import (
+	"context"
+	"testing"
+
+	. "github.com/onsi/gomega"
+	core_v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/utils/pointer"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+func TestValidateAttestation(t *testing.T) {
+	tests := []struct {
+		name    string
+		spec    AttestationSpec
+		allowed bool
+		message string
+	}{
+		{
+			name:    "empty spec",
+			spec:    AttestationSpec{},
+			message: "spec: Required value: attestation type must be specified",
+		},
+		{
+			name:    "disabled pod retrieval",
+			spec:    AttestationSpec{PodRetrievalInfo: &PodRetrieval{Namespace: "keylime"}},
+			message: "spec: Required value: attestation type must be specified",
+		},
+		{
+			name:    "pod retrieval",
+			spec:    AttestationSpec{PodRetrievalInfo: &PodRetrieval{Enabled: true, Namespace: "keylime"}},
+			allowed: true,
+		},
+		{
+			name: "valid pod attestation",
+			spec: AttestationSpec{
+				PodAttestationInfo: &PodAttestation{PodName: "pod", Command: []string{"true"}},
+				IntervalSeconds:    pointer.Int(60),
+			},
+			allowed: true,
+		},
+		{
+			name:    "negative interval",
+			spec:    AttestationSpec{IntervalSeconds: pointer.Int(-1)},
+			message: "spec.intervalseconds",
+		},
+		{
+			name:    "negative timeout",
+			spec:    AttestationSpec{TimeoutSeconds: -1},
+			message: "spec.timeoutseconds",
+		},
+		{
+			name:    "empty pod name",
+			spec:    AttestationSpec{PodAttestationInfo: &PodAttestation{Command: []string{"true"}}},
+			message: "spec.podattestation.podname",
+		},
+		{
+			name:    "init container without name",
+			spec:    AttestationSpec{PodAttestationInfo: &PodAttestation{PodName: "pod", InitContainer: true}},
+			message: "spec.podattestation.containername",
+		},
+		{
+			name: "command secret without key",
+			spec: AttestationSpec{
+				PodAttestationInfo: &PodAttestation{PodName: "pod"},
+				CommandSecretRef:   &core_v1.SecretKeySelector{LocalObjectReference: core_v1.LocalObjectReference{Name: "command"}},
+			},
+			message: "spec.commandsecretref.key",
+		},
+		{
+			name: "command secret and command",
+			spec: AttestationSpec{
+				PodAttestationInfo: &PodAttestation{PodName: "pod", Command: []string{"true"}},
+				CommandSecretRef: &core_v1.SecretKeySelector{
+					LocalObjectReference: core_v1.LocalObjectReference{Name: "command"}, Key: "command"},
+			},
+			message: "spec.commandsecretref",
+		},
+		{
+			name: "unknown verification policy",
+			spec: AttestationSpec{
+				PodAttestationInfo: &PodAttestation{PodName: "pod", Command: []string{"true"}, VerificationPolicy: "none"},
+			},
+			message: "spec.podattestation.verificationpolicy",
+		},
+		{
+			name:    "invalid schedule",
+			spec:    AttestationSpec{Schedule: "* * *"},
+			message: "spec.schedule",
+		},
+		{
+			name: "schedule",
+			spec: AttestationSpec{
+				PodAttestationInfo: &PodAttestation{PodName: "pod", Command: []string{"true"}},
+				Schedule:           "* 2-3 * * 6",
+			},
+			allowed: true,
+		},
+		{
+			name: "pod selector",
+			spec: AttestationSpec{
+				PodAttestationInfo: &PodAttestation{Command: []string{"true"}},
+				PodSelector:        &metav1.LabelSelector{MatchLabels: map[string]string{"app": "agent"}},
+			},
+			allowed: true,
+		},
+		{
+			name: "pod selector and pod name",
+			spec: AttestationSpec{
+				PodAttestationInfo: &PodAttestation{PodName: "pod", Command: []string{"true"}},
+				PodSelector:        &metav1.LabelSelector{MatchLabels: map[string]string{"app": "agent"}},
+			},
+			message: "spec.podselector",
+		},
+		{
+			name: "invalid pod selector",
+			spec: AttestationSpec{
+				PodAttestationInfo: &PodAttestation{Command: []string{"true"}},
+				PodSelector:        &metav1.LabelSelector{MatchLabels: map[string]string{"app": "agent/"}},
+			},
+			message: "spec.podselector",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := NewWithT(t)
+			a := &Attestation{ObjectMeta: metav1.ObjectMeta{Name: "attestation"}, Spec: tt.spec}
+			previous := &Attestation{Spec: AttestationSpec{PodAttestationInfo: &PodAttestation{PodName: "pod"}}}
+			for _, err := range []error{a.ValidateCreate(), a.ValidateUpdate(previous)} {
+				if tt.allowed {
+					g.Expect(err).NotTo(HaveOccurred())
+					continue
+				}
+				g.Expect(apierrors.IsInvalid(err)).To(BeTrue())
+				g.Expect(err.Error()).To(ContainSubstring(tt.message))
+			}
+		})
+	}
+}
+
+func TestValidateUpdateWithoutAttestationType(t *testing.T) {
+	g := NewWithT(t)
+	previous := &Attestation{ObjectMeta: metav1.ObjectMeta{Name: "attestation"}}
+
+	// Attestation created before the attestation type was required can still be updated
+	a := previous.DeepCopy()
+	g.Expect(a.ValidateUpdate(previous)).To(Succeed())
+
+	// Attestation type cannot be removed once specified
+	previous.Spec.PodAttestationInfo = &PodAttestation{PodName: "pod"}
+	err := a.ValidateUpdate(previous)
+	g.Expect(apierrors.IsInvalid(err)).To(BeTrue())
+	g.Expect(err.Error()).To(ContainSubstring("attestation type must be specified"))
+
+	// Other fields are still validated
+	a.Spec.IntervalSeconds = pointer.Int(-1)
+	g.Expect(apierrors.IsInvalid(a.ValidateUpdate(&Attestation{}))).To(BeTrue())
+}
+
+func TestValidateDelete(t *testing.T) {
+	g := NewWithT(t)
+	verified := []metav1.Condition{{Type: ConditionVerified, Status: metav1.ConditionTrue}}
+
+	a := &Attestation{Spec: AttestationSpec{IntervalSeconds: pointer.Int(-1)}}
+	g.Expect(a.ValidateDelete()).To(Succeed())
+
+	a = &Attestation{ObjectMeta: metav1.ObjectMeta{Name: "attestation"}, Status: AttestationStatus{Conditions: verified}}
+	err := a.ValidateDelete()
+	g.Expect(apierrors.IsForbidden(err)).To(BeTrue())
+	g.Expect(err.Error()).To(ContainSubstring("kubectl annotate attestation attestation attestation.io/allow-delete=true"))
+
+	a.Annotations = map[string]string{AllowDeleteAnnotation: "false"}
+	g.Expect(apierrors.IsForbidden(a.ValidateDelete())).To(BeTrue())
+
+	a.Annotations = map[string]string{AllowDeleteAnnotation: "true"}
+	g.Expect(a.ValidateDelete()).To(Succeed())
+}
+
+func TestDefault(t *testing.T) {
+	tests := []struct {
+		name     string
+		interval *int
+		expected int
+	}{
+		{name: "unset interval", interval: nil, expected: DefaultIntervalSeconds},
+		{name: "explicit interval", interval: pointer.Int(60), expected: 60},
+		{name: "explicit zero interval", interval: pointer.Int(0), expected: 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := NewWithT(t)
+			a := &Attestation{Spec: AttestationSpec{IntervalSeconds: tt.interval}}
+			a.Default()
+			g.Expect(a.Spec.IntervalSeconds).NotTo(BeNil())
+			g.Expect(*a.Spec.IntervalSeconds).To(Equal(tt.expected))
+		})
+	}
+}
+
+func TestDefaultVerificationPolicy(t *testing.T) {
+	tests := []struct {
+		name     string
+		policy   string
+		expected string
+	}{
+		{name: "unset policy", policy: "", expected: VerificationPolicyVerifier},
+		{name: "explicit verifier policy", policy: VerificationPolicyVerifier, expected: VerificationPolicyVerifier},
+		{name: "explicit nonce policy", policy: VerificationPolicyNonce, expected: VerificationPolicyNonce},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := NewWithT(t)
+			a := &Attestation{Spec: AttestationSpec{PodAttestationInfo: &PodAttestation{VerificationPolicy: tt.policy}}}
+			a.Default()
+			g.Expect(a.Spec.PodAttestationInfo.VerificationPolicy).To(Equal(tt.expected))
+		})
+	}
+
+	// No policy is set for attestations not attesting pods
+	a := &Attestation{Spec: AttestationSpec{PodRetrievalInfo: &PodRetrieval{Enabled: true}}}
+	a.Default()
+	NewWithT(t).Expect(a.Spec.PodAttestationInfo).To(BeNil())
+}
+
+func TestDefaultContainerName(t *testing.T) {
+	scheme := runtime.NewScheme()
+	utilruntime.Must(clientgoscheme.AddToScheme(scheme))
+	pod := func(name string, annotations map[string]string) *core_v1.Pod {
+		return &core_v1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "keylime", Name: name, Annotations: annotations},
+			Spec:       core_v1.PodSpec{Containers: []core_v1.Container{{Name: "agent"}, {Name: "sidecar"}}},
+		}
+	}
+	defaulter := &attestationDefaulter{reader: fake.NewClientBuilder().WithScheme(scheme).WithObjects(
+		pod("agent", nil), pod("annotated", map[string]string{ContainerAnnotation: "sidecar"})).Build()}
+	tests := []struct {
+		name     string
+		info     PodAttestation
+		expected string
+	}{
+		{name: "first container", info: PodAttestation{PodName: "agent"}, expected: "agent"},
+		{name: "annotated container", info: PodAttestation{PodName: "annotated"}, expected: "sidecar"},
+		{name: "explicit container", info: PodAttestation{PodName: "agent", ContainerName: "sidecar"},
+			expected: "sidecar"},
+		{name: "pod in other namespace", info: PodAttestation{Namespace: "other", PodName: "agent"}, expected: ""},
+		{name: "pod not found", info: PodAttestation{PodName: "missing"}, expected: ""},
+		{name: "pod selector", info: PodAttestation{}, expected: ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := NewWithT(t)
+			info := tt.info
+			a := &Attestation{ObjectMeta: metav1.ObjectMeta{Namespace: "keylime", Name: "attestation"},
+				Spec: AttestationSpec{PodAttestationInfo: &info}}
+			g.Expect(defaulter.Default(context.Background(), a)).To(Succeed())
+			g.Expect(a.Spec.PodAttestationInfo.ContainerName).To(Equal(tt.expected))
+			// Defaults of the attestation not requiring a pod are set as well
+			g.Expect(a.Spec.IntervalSeconds).To(Equal(pointer.Int(DefaultIntervalSeconds)))
+			g.Expect(a.Spec.PodAttestationInfo.VerificationPolicy).To(Equal(VerificationPolicyVerifier))
+		})
+	}
+}
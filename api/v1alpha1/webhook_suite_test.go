@@ -0,0 +1,214 @@
+/*
+Copyright 2023.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha1
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	admissionv1 "k8s.io/api/admission/v1"
+	core_v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/rest"
+	"k8s.io/utils/pointer"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/envtest"
+	logf "sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/log/zap"
+)
+
+// These tests use Ginkgo (BDD-style Go testing framework). Refer to
+// http://onsi.github.io/ginkgo/ to learn more about Ginkgo.
+
+var cfg *rest.Config
+var k8sClient client.Client
+var testEnv *envtest.Environment
+var ctx context.Context
+var cancel context.CancelFunc
+
+func TestWebhooks(t *testing.T) {
+	// Binaries of the test environment are set up by "make test"
+	if os.Getenv("KUBEBUILDER_ASSETS") == "" {
+		t.Skip("KUBEBUILDER_ASSETS not set, skipping tests requiring a test environment")
+	}
+	RegisterFailHandler(Fail)
+
+	RunSpecs(t, "Webhook Suite")
+}
+
+var _ = BeforeSuite(func() {
+	logf.SetLogger(zap.New(zap.WriteTo(GinkgoWriter), zap.UseDevMode(true)))
+
+	ctx, cancel = context.WithCancel(context.TODO())
+
+	By("bootstrapping test environment")
+	testEnv = &envtest.Environment{
+		CRDDirectoryPaths:     []string{filepath.Join("..", "..", "config", "crd", "bases")},
+		ErrorIfCRDPathMissing: true,
+		WebhookInstallOptions: envtest.WebhookInstallOptions{
+			Paths: []string{filepath.Join("..", "..", "config", "webhook")},
+		},
+	}
+
+	var err error
+	// cfg is defined in this file globally.
+	cfg, err = testEnv.Start()
+	Expect(err).NotTo(HaveOccurred())
+	Expect(cfg).NotTo(BeNil())
+
+	scheme := runtime.NewScheme()
+	Expect(AddToScheme(scheme)).To(Succeed())
+	Expect(admissionv1.AddToScheme(scheme)).To(Succeed())
+	Expect(clientgoscheme.AddToScheme(scheme)).To(Succeed())
+
+	k8sClient, err = client.New(cfg, client.Options{Scheme: scheme})
+	Expect(err).NotTo(HaveOccurred())
+	Expect(k8sClient).NotTo(BeNil())
+
+	// start webhook server using Manager
+	webhookInstallOptions := &testEnv.WebhookInstallOptions
+	mgr, err := ctrl.NewManager(cfg, ctrl.Options{
+		Scheme:             scheme,
+		Host:               webhookInstallOptions.LocalServingHost,
+		Port:               webhookInstallOptions.LocalServingPort,
+		CertDir:            webhookInstallOptions.LocalServingCertDir,
+		LeaderElection:     false,
+		MetricsBindAddress: "0",
+	})
+	Expect(err).NotTo(HaveOccurred())
+	Expect((&Attestation{}).SetupWebhookWithManager(mgr)).To(Succeed())
+
+	go func() {
+		defer GinkgoRecover()
+		Expect(mgr.Start(ctx)).To(Succeed())
+	}()
+
+	// wait for the webhook server to get ready
+	dialer := &net.Dialer{Timeout: time.Second}
+	addrPort := fmt.Sprintf("%s:%d", webhookInstallOptions.LocalServingHost, webhookInstallOptions.LocalServingPort)
+	Eventually(func() error {
+		conn, err := tls.DialWithDialer(dialer, "tcp", addrPort, &tls.Config{InsecureSkipVerify: true})
+		if err != nil {
+			return err
+		}
+		return conn.Close()
+	}).Should(Succeed())
+})
+
+var _ = AfterSuite(func() {
+	cancel()
+	By("tearing down the test environment")
+	Expect(testEnv.Stop()).To(Succeed())
+})
+
+var _ = Describe("Attestation webhooks", func() {
+	// attestation returns an attestation with the spec provided in the default namespace
+	attestation := func(name string, spec AttestationSpec) *Attestation {
+		return &Attestation{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: name}, Spec: spec}
+	}
+
+	It("denies an attestation without attestation type", func() {
+		err := k8sClient.Create(ctx, attestation("no-type", AttestationSpec{}))
+		Expect(apierrors.IsInvalid(err)).To(BeTrue())
+		Expect(err.Error()).To(ContainSubstring("attestation type must be specified"))
+	})
+
+	It("denies an attestation with an unknown attestation type", func() {
+		// Fields unknown to the schema are pruned by the API server, leaving no attestation type
+		unknown := &unstructured.Unstructured{Object: map[string]interface{}{
+			"metadata": map[string]interface{}{"namespace": "default", "name": "unknown-type"},
+			"spec":     map[string]interface{}{"tpmattestation": map[string]interface{}{"podname": "agent"}},
+		}}
+		unknown.SetGroupVersionKind(GroupVersion.WithKind("Attestation"))
+		err := k8sClient.Create(ctx, unknown)
+		Expect(err).To(HaveOccurred())
+		Expect(err.Error()).To(ContainSubstring("attestation type must be specified"))
+	})
+
+	It("denies an attestation without target pod", func() {
+		err := k8sClient.Create(ctx, attestation("no-pod", AttestationSpec{
+			PodAttestationInfo: &PodAttestation{Command: []string{"true"}},
+		}))
+		Expect(apierrors.IsInvalid(err)).To(BeTrue())
+		Expect(err.Error()).To(ContainSubstring("spec.podattestation.podname"))
+	})
+
+	It("denies an attestation with a negative timeout", func() {
+		err := k8sClient.Create(ctx, attestation("negative-timeout", AttestationSpec{
+			PodAttestationInfo: &PodAttestation{PodName: "agent", Command: []string{"true"}},
+			TimeoutSeconds:     -1,
+		}))
+		Expect(err).To(HaveOccurred())
+		Expect(err.Error()).To(ContainSubstring("spec.timeoutseconds"))
+	})
+
+	It("defaults and admits a valid attestation", func() {
+		valid := attestation("valid", AttestationSpec{
+			PodAttestationInfo: &PodAttestation{PodName: "agent", Command: []string{"true"}},
+		})
+		Expect(k8sClient.Create(ctx, valid)).To(Succeed())
+		Expect(valid.Spec.IntervalSeconds).To(Equal(pointer.Int(DefaultIntervalSeconds)))
+		Expect(valid.Spec.PodAttestationInfo.VerificationPolicy).To(Equal(VerificationPolicyVerifier))
+		// Pod does not exist, so its container is resolved when attesting it
+		Expect(valid.Spec.PodAttestationInfo.ContainerName).To(BeEmpty())
+
+		// Negative intervals are denied on update as well
+		valid.Spec.IntervalSeconds = pointer.Int(-1)
+		err := k8sClient.Update(ctx, valid)
+		Expect(err).To(HaveOccurred())
+		Expect(err.Error()).To(ContainSubstring("spec.intervalseconds"))
+	})
+
+	It("defaults the container to the first container of the pod", func() {
+		pod := &core_v1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "multi-container-agent"},
+			Spec: core_v1.PodSpec{Containers: []core_v1.Container{
+				{Name: "agent", Image: "agent"}, {Name: "sidecar", Image: "sidecar"}}},
+		}
+		Expect(k8sClient.Create(ctx, pod)).To(Succeed())
+
+		defaulted := attestation("default-container", AttestationSpec{
+			PodAttestationInfo: &PodAttestation{PodName: pod.Name, Command: []string{"true"}},
+		})
+		Expect(k8sClient.Create(ctx, defaulted)).To(Succeed())
+		Expect(defaulted.Spec.PodAttestationInfo.ContainerName).To(Equal("agent"))
+
+		explicit := attestation("explicit-container", AttestationSpec{
+			PodAttestationInfo: &PodAttestation{PodName: pod.Name, ContainerName: "sidecar", Command: []string{"true"},
+				VerificationPolicy: VerificationPolicyNonce},
+			IntervalSeconds: pointer.Int(0),
+		})
+		Expect(k8sClient.Create(ctx, explicit)).To(Succeed())
+		Expect(explicit.Spec.PodAttestationInfo.ContainerName).To(Equal("sidecar"))
+		Expect(explicit.Spec.PodAttestationInfo.VerificationPolicy).To(Equal(VerificationPolicyNonce))
+		Expect(explicit.Spec.IntervalSeconds).To(Equal(pointer.Int(0)))
+	})
+})
@@ -22,7 +22,9 @@ limitations under the License.
 package v1alpha1
 
 import (
-	runtime "k8s.io/apimachinery/pkg/runtime"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
 )
 
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
@@ -92,6 +94,36 @@ func (in *AttestationSpec) DeepCopyInto(out *AttestationSpec) {
 		*out = new(PodRetrieval)
 		**out = **in
 	}
+	if in.PodAttestationInfo != nil {
+		in, out := &in.PodAttestationInfo, &out.PodAttestationInfo
+		*out = new(PodAttestation)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.IntervalSeconds != nil {
+		in, out := &in.IntervalSeconds, &out.IntervalSeconds
+		*out = new(int)
+		**out = **in
+	}
+	if in.PodSelector != nil {
+		in, out := &in.PodSelector, &out.PodSelector
+		*out = new(v1.LabelSelector)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.PreExecCommand != nil {
+		in, out := &in.PreExecCommand, &out.PreExecCommand
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+	if in.PostExecCommand != nil {
+		in, out := &in.PostExecCommand, &out.PostExecCommand
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+	if in.CommandSecretRef != nil {
+		in, out := &in.CommandSecretRef, &out.CommandSecretRef
+		*out = new(corev1.SecretKeySelector)
+		(*in).DeepCopyInto(*out)
+	}
 }
 
 // DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new AttestationSpec.
@@ -112,6 +144,29 @@ func (in *AttestationStatus) DeepCopyInto(out *AttestationStatus) {
 		*out = make([]PodInformation, len(*in))
 		copy(*out, *in)
 	}
+	if in.Conditions != nil {
+		in, out := &in.Conditions, &out.Conditions
+		*out = make([]v1.Condition, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+	if in.LastAttestationTime != nil {
+		in, out := &in.LastAttestationTime, &out.LastAttestationTime
+		*out = (*in).DeepCopy()
+	}
+	if in.HookOutputs != nil {
+		in, out := &in.HookOutputs, &out.HookOutputs
+		*out = make([]HookOutput, len(*in))
+		copy(*out, *in)
+	}
+	if in.PodResults != nil {
+		in, out := &in.PodResults, &out.PodResults
+		*out = make([]PodAttestationResult, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
 }
 
 // DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new AttestationStatus.
@@ -124,6 +179,62 @@ func (in *AttestationStatus) DeepCopy() *AttestationStatus {
 	return out
 }
 
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *HookOutput) DeepCopyInto(out *HookOutput) {
+	*out = *in
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new HookOutput.
+func (in *HookOutput) DeepCopy() *HookOutput {
+	if in == nil {
+		return nil
+	}
+	out := new(HookOutput)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *PodAttestation) DeepCopyInto(out *PodAttestation) {
+	*out = *in
+	if in.Command != nil {
+		in, out := &in.Command, &out.Command
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+	if in.CleanupCommand != nil {
+		in, out := &in.CleanupCommand, &out.CleanupCommand
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new PodAttestation.
+func (in *PodAttestation) DeepCopy() *PodAttestation {
+	if in == nil {
+		return nil
+	}
+	out := new(PodAttestation)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *PodAttestationResult) DeepCopyInto(out *PodAttestationResult) {
+	*out = *in
+	in.Timestamp.DeepCopyInto(&out.Timestamp)
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new PodAttestationResult.
+func (in *PodAttestationResult) DeepCopy() *PodAttestationResult {
+	if in == nil {
+		return nil
+	}
+	out := new(PodAttestationResult)
+	in.DeepCopyInto(out)
+	return out
+}
+
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *PodInformation) DeepCopyInto(out *PodInformation) {
 	*out = *in
@@ -0,0 +1,117 @@
+/*
+Copyright 2023.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"time"
+
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/log/zap"
+
+	"github.com/sarroutbi/osdk-attestation-operator/controllers"
+)
+
+// attestSubcommand executes a single command in a pod and prints its result, bypassing the controller,
+// so that attestation commands can be checked manually without creating an Attestation
+const attestSubcommand = "attest"
+
+// attestOptions are the options of the attest subcommand
+type attestOptions struct {
+	namespace   string
+	pod         string
+	container   string
+	kubeContext string
+	timeout     time.Duration
+	// command is executed as it is, each argument remaining after the flags being an argument of the command
+	command []string
+}
+
+// bindAttestFlags binds the flags of the attest subcommand to the options provided
+func bindAttestFlags(flags *flag.FlagSet, o *attestOptions) {
+	flags.StringVar(&o.namespace, "namespace", "default", "Namespace of the pod where the command is executed.")
+	flags.StringVar(&o.pod, "pod", "", "Name of the pod where the command is executed.")
+	flags.StringVar(&o.container, "container", "",
+		"Container where the command is executed. The container declared by the pod, or its single one, "+
+			"is used if not specified.")
+	flags.DurationVar(&o.timeout, "timeout", controllers.DefaultExecTimeout, "Maximum duration of the command.")
+	flags.StringVar(&o.kubeContext, "kube-context", "",
+		"Kubeconfig context used when not running in cluster, taking precedence over OPERATOR_KUBE_CONTEXT.")
+}
+
+// parseAttestFlags parses the arguments of the attest subcommand with the flags provided, bound by bindAttestFlags.
+// Command executed is made of the arguments remaining after the flags, e.g. after "--", so that its arguments
+// are passed as they are, without being split on spaces
+func parseAttestFlags(flags *flag.FlagSet, o *attestOptions, args []string) error {
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	o.command = flags.Args()
+	return nil
+}
+
+// runAttest runs the attest subcommand with the arguments provided, returning the exit code of the operator:
+// the exit code of the command executed, or 1 if it could not be executed
+func runAttest(args []string) int {
+	o := &attestOptions{}
+	bindAttestFlags(flag.CommandLine, o)
+	opts := zap.Options{Development: true}
+	logConfigErr := controllers.ConfigureLogOptions(&opts)
+	opts.BindFlags(flag.CommandLine)
+	if err := parseAttestFlags(flag.CommandLine, o, args); err != nil {
+		return 1
+	}
+	ctrl.SetLogger(zap.New(zap.UseFlagOptions(&opts)))
+	if logConfigErr != nil {
+		setupLog.Error(logConfigErr, "invalid log configuration")
+	}
+	if o.pod == "" || len(o.command) == 0 {
+		fmt.Fprintf(os.Stderr, "usage: %s %s --pod POD [--namespace NAMESPACE] [--container CONTAINER] -- COMMAND [ARGS...]\n",
+			os.Args[0], attestSubcommand)
+		return 1
+	}
+	namespace, pod, container, command := o.namespace, o.pod, o.container, o.command
+
+	if kubeconfig := flag.Lookup("kubeconfig"); kubeconfig != nil && kubeconfig.Value.String() != "" {
+		controllers.SetKubeconfigPath(kubeconfig.Value.String())
+	}
+	if o.kubeContext != "" {
+		controllers.SetKubeContext(o.kubeContext)
+	}
+	if _, err := controllers.GetClusterClientset(); err != nil {
+		setupLog.Error(err, "unable to get cluster clientset")
+		return 1
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), o.timeout)
+	defer cancel()
+	stdout, stderr, exitCode, err := controllers.PodExec(ctx, namespace, pod, container, command, nil)
+	fmt.Fprint(os.Stdout, stdout)
+	fmt.Fprint(os.Stderr, stderr)
+	if err != nil {
+		setupLog.Error(err, "unable to execute command", "Namespace", namespace, "Pod", pod, "Command", command)
+		return 1
+	}
+	if exitCode != 0 {
+		setupLog.Info("Command failed", "Namespace", namespace, "Pod", pod, "Command", command, "Exit Code", exitCode)
+		return exitCode
+	}
+	return 0
+}
@@ -0,0 +1,51 @@
+/*
+Copyright 2023.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"flag"
+	"testing"
+
+	. "github.com/onsi/gomega"
+)
+
+func TestParseAttestFlags(t *testing.T) {
+	tests := []struct {
+		name     string
+		args     []string
+		expected []string
+	}{
+		{name: "command after separator", args: []string{"--pod", "agent", "--", "tpm2_quote", "--pcr-list", "sha256:0"},
+			expected: []string{"tpm2_quote", "--pcr-list", "sha256:0"}},
+		{name: "arguments with spaces", args: []string{"--pod", "agent", "--", "sh", "-c", "tpm2_quote --pcr-list 'sha256:0'"},
+			expected: []string{"sh", "-c", "tpm2_quote --pcr-list 'sha256:0'"}},
+		{name: "command without separator", args: []string{"--pod", "agent", "tpm2_quote"},
+			expected: []string{"tpm2_quote"}},
+		{name: "no command", args: []string{"--pod", "agent"}, expected: []string{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := NewWithT(t)
+			flags := flag.NewFlagSet(attestSubcommand, flag.ContinueOnError)
+			o := &attestOptions{}
+			bindAttestFlags(flags, o)
+			g.Expect(parseAttestFlags(flags, o, tt.args)).To(Succeed())
+			g.Expect(o.pod).To(Equal("agent"))
+			g.Expect(o.command).To(Equal(tt.expected))
+		})
+	}
+}
@@ -18,11 +18,25 @@ package controllers
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"time"
 
-	"k8s.io/apimachinery/pkg/api/errors"
+	core_v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
 	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/client-go/util/workqueue"
+	"k8s.io/utils/clock"
+	"sigs.k8s.io/controller-runtime/pkg/builder"
 	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
 	"sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
+	"sigs.k8s.io/controller-runtime/pkg/source"
 
 	keylimev1alpha1 "github.com/sarroutbi/osdk-attestation-operator/api/v1alpha1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
@@ -33,6 +47,52 @@ import (
 type AttestationReconciler struct {
 	client.Client
 	Scheme *runtime.Scheme
+	// APIReader reads from the API server, bypassing the cache of the manager. Secrets are only read through it,
+	// so that the manager does not cache every Secret of the cluster. It is the API reader of the manager if not
+	// provided, or Client if not set up with a manager
+	APIReader client.Reader
+	// Recorder emits events on the attestation lifecycle. It is created from the manager if not provided
+	Recorder record.EventRecorder
+	// BackoffBase is the requeue delay after the first failed attestation. DefaultBackoffBase is used if not set
+	BackoffBase time.Duration
+	// BackoffCap is the maximum requeue delay after consecutive failed attestations. DefaultBackoffCap is used if not set
+	BackoffCap time.Duration
+	// PodNotReadyRequeue is the requeue delay when the pod to attest is not ready yet. DefaultPodNotReadyRequeue is used if not set
+	PodNotReadyRequeue time.Duration
+	// RateLimiter limits the retries of failed reconciles. NewRateLimiter with default delays is used if not set
+	RateLimiter workqueue.RateLimiter
+	// PodUnhealthyRequeue is the requeue delay when the pod to attest is unhealthy, e.g. crash looping.
+	// DefaultPodUnhealthyRequeue is used if not set
+	PodUnhealthyRequeue time.Duration
+	// ReconcileTimeout bounds the duration of each reconcile. DefaultReconcileTimeout is used if not set
+	ReconcileTimeout time.Duration
+	// ExecTimeout bounds the duration of each command executed in the pod to attest, so that the status can
+	// still be updated when the command times out. DefaultExecTimeout is used if not set
+	ExecTimeout time.Duration
+	// MaxExecTimeout bounds the exec timeout attestations can specify. DefaultMaxExecTimeout is used if not set
+	MaxExecTimeout time.Duration
+	// MaxStatusOutputBytes bounds the command output stored in the attestation status, so that verbose agents do not
+	// exceed the size limits of the objects. DefaultMaxStatusOutputBytes is used if not set
+	MaxStatusOutputBytes int
+	// ExecRetries is the number of times the attestation command is executed again when its stream fails
+	ExecRetries int
+	// Clock provides the current time, e.g. to check the schedule of the attestations. Real clock is used if not set
+	Clock clock.PassiveClock
+	// Verifier verifies the quotes collected from the pods to attest. NoopVerifier is used if not set
+	Verifier Verifier
+	// commandCache caches the attestation commands read from Secrets referenced by CommandSecretRef
+	commandCache commandSecretCache
+	// RequeueJitterFactor scatters periodic re-attestations by this fraction of their interval, e.g. 0.1 for ±10%,
+	// so that attestations sharing the same interval do not requeue at once. Jitter is disabled if not set
+	RequeueJitterFactor float64
+	// DisableEvidencePersistence disables storing the evidence of successful attestations in a Secret
+	DisableEvidencePersistence bool
+	// DryRun performs read operations only, logging the exec commands and writes that would be performed instead
+	DryRun bool
+	// MaxConcurrentReconciles is the number of attestations reconciled in parallel. DefaultMaxConcurrentReconciles
+	// is used if not set. All reconciles share the client rate limits (OPERATOR_CLIENT_QPS and OPERATOR_CLIENT_BURST),
+	// which should be raised accordingly, as otherwise parallel reconciles throttle each other
+	MaxConcurrentReconciles int
 }
 
 //+kubebuilder:rbac:groups=keylime.redhat.com,resources=attestations,verbs=get;list;watch;create;update;patch;delete
@@ -40,6 +100,13 @@ type AttestationReconciler struct {
 //+kubebuilder:rbac:groups=keylime.redhat.com,resources=attestations/finalizers,verbs=update
 //+kubebuilder:rbac:groups=core,resources=pods,verbs=get;list;watch;create;update
 //+kubebuilder:rbac:groups=core,resources=pods/status,verbs=get;list;watch;create;update
+//+kubebuilder:rbac:groups=core,resources=pods/exec,verbs=create;get
+//+kubebuilder:rbac:groups=core,resources=pods/log,verbs=get
+//+kubebuilder:rbac:groups=core,resources=pods/portforward,verbs=create;get
+//+kubebuilder:rbac:groups=core,resources=events,verbs=create;patch
+//+kubebuilder:rbac:groups=core,resources=secrets,verbs=get;list;create;update;delete
+//+kubebuilder:rbac:groups=core,resources=configmaps,verbs=get;list;watch
+//+kubebuilder:rbac:groups=core,resources=services,verbs=get
 
 // Reconcile is part of the main kubernetes reconciliation loop which aims to
 // move the current state of the cluster closer to the desired state.
@@ -52,28 +119,174 @@ type AttestationReconciler struct {
 // - https://pkg.go.dev/sigs.k8s.io/controller-runtime@v0.14.1/pkg/reconcile
 func (r *AttestationReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
 	SetLogInstance(log.FromContext(ctx))
-	a := &keylimev1alpha1.Attestation{
-		ObjectMeta: metav1.ObjectMeta{
-			Namespace: req.NamespacedName.Namespace,
-			Name:      req.NamespacedName.Name,
-		},
+	reconcileTotal.Inc()
+	recordReconcileStart()
+	timeout := r.reconcileTimeout()
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	result, err := r.reconcile(ctx, req)
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		GetLogInstance().Error(ctx.Err(), "Reconcile timed out", "Attestation", req.NamespacedName, "Timeout", timeout)
+		return ctrl.Result{}, fmt.Errorf("reconcile of %s timed out after %v: %w", req.NamespacedName, timeout, ctx.Err())
+	}
+	if err == nil {
+		recordReconcileSuccess()
 	}
-	err := r.Get(ctx, req.NamespacedName, a)
+	return result, err
+}
+
+// reconcile performs the reconciliation of the attestation, bounded by the context provided
+func (r *AttestationReconciler) reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
+	a, err := GetAttestation(ctx, r.Client, req.NamespacedName)
 	if err != nil {
-		if errors.IsNotFound(err) {
+		if apierrors.IsNotFound(err) {
 			GetLogInstance().Info("Attestation resource not found")
+			return ctrl.Result{}, nil
 		}
+		GetLogInstance().Error(err, "Unable to get Attestation")
+		return ctrl.Result{}, err
+	}
+	if !a.DeletionTimestamp.IsZero() {
+		return ctrl.Result{}, r.Finalize(ctx, a)
+	}
+	if err = r.EnsureFinalizer(ctx, a); err != nil {
+		GetLogInstance().Error(err, "Unable to add finalizer to Attestation")
+		return ctrl.Result{}, err
+	}
+	if Paused(a) {
+		return r.pause(ctx, a)
+	}
+	if upToDate, requeueAfter := r.UpToDate(a); upToDate {
+		GetLogInstance().Info("Attestation up to date, skipping reconcile", "Generation", a.Generation,
+			"Requeue After", requeueAfter)
+		return ctrl.Result{RequeueAfter: requeueAfter}, nil
+	}
+	if outside, untilNext := r.outsideSchedule(a); outside {
+		GetLogInstance().Info("Attestation outside of its schedule, requeuing", "Schedule", a.Spec.Schedule,
+			"Requeue After", untilNext)
+		return ctrl.Result{RequeueAfter: untilNext}, nil
 	}
 	r.CheckSpec(a, ctx)
+	result := ctrl.Result{}
+	attestErr := r.Attest(ctx, a)
+	if errors.Is(attestErr, ErrInvalidSpec) {
+		// Spec must be fixed, which triggers a new reconcile, so no requeue is required
+		r.SetCondition(a, keylimev1alpha1.ConditionReady, metav1.ConditionFalse, ReasonInvalidSpec, attestErr.Error())
+	} else if errors.Is(attestErr, ErrPodNotReady) {
+		r.SetCondition(a, keylimev1alpha1.ConditionReady, metav1.ConditionFalse, ReasonPodNotReady, attestErr.Error())
+		result.RequeueAfter = r.podNotReadyRequeue()
+		GetLogInstance().Info("Pod not ready, requeuing", "Requeue After", result.RequeueAfter)
+	} else if errors.Is(attestErr, ErrPodUnhealthy) {
+		// Pod is fundamentally broken, so retries are spaced to reduce API load
+		r.SetCondition(a, keylimev1alpha1.ConditionReady, metav1.ConditionFalse, ReasonPodUnhealthy, attestErr.Error())
+		result.RequeueAfter = r.podUnhealthyRequeue()
+		GetLogInstance().Info("Pod unhealthy, requeuing", "Requeue After", result.RequeueAfter)
+	} else if errors.Is(attestErr, ErrPodNotFound) {
+		// Pod may not have been created yet, so it is not considered an attestation failure
+		r.SetCondition(a, keylimev1alpha1.ConditionReady, metav1.ConditionFalse, ReasonPodNotFound, attestErr.Error())
+		result.RequeueAfter = r.podNotReadyRequeue()
+		GetLogInstance().Info("Pod not found, requeuing", "Requeue After", result.RequeueAfter)
+	} else if errors.Is(attestErr, ErrConfigUnavailable) || errors.Is(attestErr, ErrClientsetCreation) {
+		// API server can not be accessed by the operator, which is not a failure of the attestation itself
+		r.SetCondition(a, keylimev1alpha1.ConditionReady, metav1.ConditionFalse, ReasonClientUnavailable, attestErr.Error())
+		result.RequeueAfter = r.Backoff(1)
+		GetLogInstance().Info("Client unavailable, requeuing", "Requeue After", result.RequeueAfter)
+	} else if retryAfter, throttled := ThrottledRetryAfter(attestErr); throttled {
+		// API server suggests when to retry, so its delay is honored instead of backing off
+		r.SetCondition(a, keylimev1alpha1.ConditionReady, metav1.ConditionFalse, ReasonThrottled, attestErr.Error())
+		result.RequeueAfter = retryAfter
+		if result.RequeueAfter <= 0 {
+			result.RequeueAfter = r.Backoff(1)
+		}
+		GetLogInstance().Info("Throttled by API server, requeuing", "Requeue After", result.RequeueAfter)
+	} else if errors.Is(attestErr, ErrVerifierUnavailable) {
+		// Verifier may be restarting, so quote is verified again without counting an attestation failure
+		r.SetCondition(a, keylimev1alpha1.ConditionReady, metav1.ConditionFalse, ReasonVerifierUnavailable,
+			attestErr.Error())
+		result.RequeueAfter = r.Backoff(1)
+		GetLogInstance().Info("Verifier unavailable, requeuing", "Requeue After", result.RequeueAfter)
+	} else if attestErr != nil {
+		r.SetCondition(a, keylimev1alpha1.ConditionReady, metav1.ConditionFalse, ReasonReconcileFailed, attestErr.Error())
+		a.Status.ConsecutiveFailures++
+		a.Status.LastFailureReason = r.FailureReason(a)
+		result.RequeueAfter = r.Backoff(a.Status.ConsecutiveFailures)
+		GetLogInstance().Info("Attestation failed, requeuing", "Consecutive Failures", a.Status.ConsecutiveFailures,
+			"Requeue After", result.RequeueAfter)
+	} else {
+		r.SetCondition(a, keylimev1alpha1.ConditionReady, metav1.ConditionTrue, ReasonReconciled, "Attestation reconciled")
+		a.Status.ConsecutiveFailures = 0
+		a.Status.ObservedGeneration = a.Generation
+		if a.Spec.PodAttestationInfo != nil && a.Spec.GetIntervalSeconds() > 0 {
+			result.RequeueAfter = r.PeriodicRequeue(time.Duration(a.Spec.GetIntervalSeconds()) * time.Second)
+			GetLogInstance().Info("Attestation succeeded, requeuing for periodic attestation", "Requeue After", result.RequeueAfter)
+		}
+	}
 	r.VersionUpdate(a)
-	err = r.Client.Status().Update(context.Background(), a)
+	if r.DryRun {
+		GetLogInstance().Info("Dry run: would update Attestation status", "Status", a.Status)
+		return result, nil
+	}
+	err = UpdateAttestationStatus(context.Background(), r.Client, a)
 	if err != nil {
 		GetLogInstance().Error(err, "Unable to update Attestation status")
 		return ctrl.Result{}, err
 	}
+	return result, nil
+}
+
+// PausedAnnotation pauses the attestation when set to "true", until it is removed
+const PausedAnnotation = "attestation.io/paused"
+
+// Paused checks if the attestation is paused through PausedAnnotation
+func Paused(attestation *keylimev1alpha1.Attestation) bool {
+	return attestation.Annotations[PausedAnnotation] == "true"
+}
+
+// pause records the attestation is paused, without attesting nor requeuing it, as removing the
+// annotation triggers a new reconcile
+func (r *AttestationReconciler) pause(ctx context.Context, a *keylimev1alpha1.Attestation) (ctrl.Result, error) {
+	GetLogInstance().Info("Attestation paused, skipping reconcile", "Annotation", PausedAnnotation)
+	r.SetCondition(a, keylimev1alpha1.ConditionReady, metav1.ConditionUnknown, ReasonPaused,
+		fmt.Sprintf("Attestation paused through %s annotation", PausedAnnotation))
+	if r.DryRun {
+		GetLogInstance().Info("Dry run: would update Attestation status", "Status", a.Status)
+		return ctrl.Result{}, nil
+	}
+	if err := UpdateAttestationStatus(ctx, r.Client, a); err != nil {
+		GetLogInstance().Error(err, "Unable to update Attestation status")
+		return ctrl.Result{}, err
+	}
 	return ctrl.Result{}, nil
 }
 
+// UpToDate checks if the spec generation of the attestation has already been reconciled successfully, so
+// that updates not modifying the spec (e.g. labels or annotations) don't trigger a new attestation.
+// If periodic attestation is requested, attestation is up to date until next attestation is due
+//
+// :return:
+//
+//	bool: true if attestation is up to date, otherwise false
+//	time.Duration: time until next attestation is due, if attestation is up to date and periodic
+func (r *AttestationReconciler) UpToDate(attestation *keylimev1alpha1.Attestation) (bool, time.Duration) {
+	if attestation.Status.ObservedGeneration != attestation.Generation ||
+		!meta.IsStatusConditionTrue(attestation.Status.Conditions, keylimev1alpha1.ConditionReady) {
+		return false, 0
+	}
+	interval := time.Duration(attestation.Spec.GetIntervalSeconds()) * time.Second
+	if attestation.Spec.PodAttestationInfo == nil || interval <= 0 {
+		return true, 0
+	}
+	if attestation.Status.LastAttestationTime == nil {
+		return false, 0
+	}
+	remaining := time.Until(attestation.Status.LastAttestationTime.Add(interval))
+	// Requeues scattered before the interval elapses are due, otherwise they would requeue again on the interval
+	if remaining <= time.Duration(r.requeueJitterFactor()*float64(interval)) {
+		return false, 0
+	}
+	return true, remaining
+}
+
 func (r *AttestationReconciler) VersionUpdate(attestation *keylimev1alpha1.Attestation) {
 	v := new(VersionUpdater)
 	v.NewVersionUpdater(attestation)
@@ -84,7 +297,12 @@ func (r *AttestationReconciler) CheckSpec(attestation *keylimev1alpha1.Attestati
 	GetLogInstance().Info("Checking Pod List", "Spec", attestation.Spec)
 	if attestation.Spec.PodRetrievalInfo != nil && attestation.Spec.PodRetrievalInfo.Enabled {
 		// TODO: Set namespace in CRD
-		lpods, e := PodList(attestation.Spec.PodRetrievalInfo.Namespace, ctx)
+		pods, e := PodListStructured(ctx, attestation.Spec.PodRetrievalInfo.Namespace,
+			PodListOptions{
+				LabelSelector: attestation.Spec.PodRetrievalInfo.LabelSelector,
+				FieldSelector: attestation.Spec.PodRetrievalInfo.FieldSelector,
+			})
+		lpods := PodInformationFromPods(pods)
 		GetLogInstance().Info("Logging Pod List", "Pod List", lpods, "Error", e)
 		attestation.Status.PodList = lpods
 	} else {
@@ -94,9 +312,39 @@ func (r *AttestationReconciler) CheckSpec(attestation *keylimev1alpha1.Attestati
 	return nil
 }
 
+// controllerOptions returns the options of the controller reconciling the attestations
+func (r *AttestationReconciler) controllerOptions() controller.Options {
+	return controller.Options{
+		MaxConcurrentReconciles: r.maxConcurrentReconciles(),
+		RateLimiter:             r.rateLimiter(),
+	}
+}
+
+// attestationPredicate filters the attestation events triggering reconciles: updates not modifying the spec,
+// such as the status updates of the reconciler itself, are ignored unless they pause or resume the attestation,
+// while create and delete events pass through
+func attestationPredicate() predicate.Predicate {
+	return predicate.Or(predicate.GenerationChangedPredicate{}, predicate.Funcs{
+		UpdateFunc: func(e event.UpdateEvent) bool {
+			old, okOld := e.ObjectOld.(*keylimev1alpha1.Attestation)
+			updated, okNew := e.ObjectNew.(*keylimev1alpha1.Attestation)
+			return okOld && okNew && Paused(old) != Paused(updated)
+		},
+	})
+}
+
 // SetupWithManager sets up the controller with the Manager.
 func (r *AttestationReconciler) SetupWithManager(mgr ctrl.Manager) error {
+	if r.Recorder == nil {
+		r.Recorder = mgr.GetEventRecorderFor("attestation-controller")
+	}
+	if r.APIReader == nil {
+		r.APIReader = mgr.GetAPIReader()
+	}
 	return ctrl.NewControllerManagedBy(mgr).
-		For(&keylimev1alpha1.Attestation{}).
+		For(&keylimev1alpha1.Attestation{}, builder.WithPredicates(attestationPredicate())).
+		Watches(&source.Kind{Type: &core_v1.Pod{}}, handler.EnqueueRequestsFromMapFunc(r.attestationsForPod),
+			builder.WithPredicates(podPredicate())).
+		WithOptions(r.controllerOptions()).
 		Complete(r)
 }
@@ -0,0 +1,569 @@
+/*
+Copyright 2023.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/robfig/cron/v3"
+	keylimev1alpha1 "github.com/sarroutbi/osdk-attestation-operator/api/v1alpha1"
+	core_v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	// EventAttestationStarted is emitted when the attestation command is about to be executed
+	EventAttestationStarted = "AttestationStarted"
+	// EventAttestationVerified is emitted when the pod attestation completed successfully
+	EventAttestationVerified = "AttestationVerified"
+	// EventAttestationFailed is emitted when the pod attestation failed
+	EventAttestationFailed = "AttestationFailed"
+	// EventHookFailed is emitted when a command executed before or after the attestation command failed
+	EventHookFailed = "HookFailed"
+	// EventEvidenceFailed is emitted when the evidence of the attestation could not be stored
+	EventEvidenceFailed = "EvidenceFailed"
+)
+
+const (
+	// ReasonReconciled is used when the attestation has been reconciled
+	ReasonReconciled = "Reconciled"
+	// ReasonReconcileFailed is used when the attestation could not be reconciled
+	ReasonReconcileFailed = "ReconcileFailed"
+	// ReasonQuoteRetrieved is used when the attestation command was executed successfully
+	ReasonQuoteRetrieved = "QuoteRetrieved"
+	// ReasonExecFailed is used when the attestation command could not be executed successfully
+	ReasonExecFailed = "ExecFailed"
+	// ReasonHookFailed is used when the command executed before the attestation command failed
+	ReasonHookFailed = "HookFailed"
+	// ReasonNonceMismatch is used when the quote was not generated for the nonce of the attestation challenge
+	ReasonNonceMismatch = "NonceMismatch"
+	// ReasonInvalidSpec is used when the attestation spec is not valid
+	ReasonInvalidSpec = "InvalidSpec"
+	// ReasonPodNotFound is used when the pod to attest does not exist
+	ReasonPodNotFound = "PodNotFound"
+	// ReasonPodUnhealthy is used when the pod to attest is not expected to become ready soon, e.g. it is crash looping
+	ReasonPodUnhealthy = "PodUnhealthy"
+	// ReasonPodUnavailable is used when the pod to attest could not be checked
+	ReasonPodUnavailable = "PodUnavailable"
+	// ReasonClientUnavailable is used when the operator can not access the API server to attest the pod
+	ReasonClientUnavailable = "ClientUnavailable"
+	// ReasonPodNotReady is used when the pod to attest is not ready yet
+	ReasonPodNotReady = "PodNotReady"
+	// ReasonAttestationSucceeded is used when the pod attestation completed successfully
+	ReasonAttestationSucceeded = "AttestationSucceeded"
+	// ReasonAttestationFailed is used when the pod attestation failed
+	ReasonAttestationFailed = "AttestationFailed"
+	// ReasonPaused is used when the attestation is paused through the paused annotation
+	ReasonPaused = "Paused"
+	// ReasonVerificationFailed is set when the verifier rejects the quote retrieved
+	ReasonVerificationFailed = "VerificationFailed"
+	// ReasonVerifierUnavailable is set when the verifier of the quote can not be reached
+	ReasonVerifierUnavailable = "VerifierUnavailable"
+	// ReasonThrottled is set when the API server throttles the requests of the operator
+	ReasonThrottled = "Throttled"
+)
+
+// SetCondition sets the condition in the attestation status, updating transition time only if its status changes.
+// Verified status field mirrors the Verified condition
+func (r *AttestationReconciler) SetCondition(attestation *keylimev1alpha1.Attestation, conditionType string,
+	status metav1.ConditionStatus, reason, message string) {
+	meta.SetStatusCondition(&attestation.Status.Conditions, metav1.Condition{
+		Type:               conditionType,
+		Status:             status,
+		ObservedGeneration: attestation.Generation,
+		Reason:             reason,
+		Message:            message,
+	})
+	if conditionType == keylimev1alpha1.ConditionVerified {
+		attestation.Status.Verified = status == metav1.ConditionTrue
+	}
+}
+
+// GetCondition returns the condition of the attestation status with the type provided, or nil if not found
+func (r *AttestationReconciler) GetCondition(attestation *keylimev1alpha1.Attestation, conditionType string) *metav1.Condition {
+	return meta.FindStatusCondition(attestation.Status.Conditions, conditionType)
+}
+
+// ErrInvalidSpec is returned when the attestation spec is not valid
+var ErrInvalidSpec = errors.New("invalid attestation spec")
+
+// ValidateSpec checks the attestation spec is valid
+func ValidateSpec(spec *keylimev1alpha1.AttestationSpec) error {
+	if spec.GetIntervalSeconds() < 0 {
+		return fmt.Errorf("%w: intervalseconds must not be negative, got %d", ErrInvalidSpec, spec.GetIntervalSeconds())
+	}
+	if spec.TimeoutSeconds < 0 {
+		return fmt.Errorf("%w: timeoutseconds must be positive, got %d", ErrInvalidSpec, spec.TimeoutSeconds)
+	}
+	if spec.PodAttestationInfo != nil {
+		if spec.PodAttestationInfo.InitContainer && spec.PodAttestationInfo.ContainerName == "" {
+			return fmt.Errorf("%w: podattestation.containername is required for init containers", ErrInvalidSpec)
+		}
+		switch spec.PodAttestationInfo.NonceDelivery {
+		case "", keylimev1alpha1.NonceDeliveryStdin, keylimev1alpha1.NonceDeliveryFile:
+		default:
+			return fmt.Errorf("%w: unknown podattestation.noncedelivery %q", ErrInvalidSpec,
+				spec.PodAttestationInfo.NonceDelivery)
+		}
+		switch spec.PodAttestationInfo.VerificationPolicy {
+		case "", keylimev1alpha1.VerificationPolicyNonce, keylimev1alpha1.VerificationPolicyVerifier:
+		default:
+			return fmt.Errorf("%w: unknown podattestation.verificationpolicy %q", ErrInvalidSpec,
+				spec.PodAttestationInfo.VerificationPolicy)
+		}
+	}
+	if spec.Schedule != "" {
+		if _, err := cron.ParseStandard(spec.Schedule); err != nil {
+			return fmt.Errorf("%w: invalid schedule %q: %v", ErrInvalidSpec, spec.Schedule, err)
+		}
+	}
+	if spec.CommandSecretRef != nil {
+		if spec.CommandSecretRef.Name == "" || spec.CommandSecretRef.Key == "" {
+			return fmt.Errorf("%w: commandsecretref.name and commandsecretref.key are required", ErrInvalidSpec)
+		}
+		if spec.PodAttestationInfo != nil && len(spec.PodAttestationInfo.Command) > 0 {
+			return fmt.Errorf("%w: commandsecretref and podattestation.command are mutually exclusive", ErrInvalidSpec)
+		}
+	}
+	if spec.PodSelector != nil {
+		if spec.PodAttestationInfo != nil && spec.PodAttestationInfo.PodName != "" {
+			return fmt.Errorf("%w: podselector and podattestation.podname are mutually exclusive", ErrInvalidSpec)
+		}
+		if _, err := metav1.LabelSelectorAsSelector(spec.PodSelector); err != nil {
+			return fmt.Errorf("%w: invalid podselector: %v", ErrInvalidSpec, err)
+		}
+	}
+	return nil
+}
+
+// FailureReason returns the reason of a failed attestation, this is, the reason of the Quoted condition
+// if the attestation command failed, or ReasonReconcileFailed otherwise
+func (r *AttestationReconciler) FailureReason(attestation *keylimev1alpha1.Attestation) string {
+	quoted := r.GetCondition(attestation, keylimev1alpha1.ConditionQuoted)
+	if quoted != nil && quoted.Status == metav1.ConditionFalse {
+		return quoted.Reason
+	}
+	return ReasonReconcileFailed
+}
+
+// RecordEvent emits an event on the attestation, if an event recorder is available
+func (r *AttestationReconciler) RecordEvent(attestation *keylimev1alpha1.Attestation, eventType, reason, message string) {
+	if r.Recorder == nil {
+		return
+	}
+	r.Recorder.Event(attestation, eventType, reason, message)
+}
+
+// Attest executes the attestation command in the pod to attest, if pod attestation is specified,
+// and sets Quoted and Verified conditions according to the result. If a pod selector is specified,
+// all the pods matching it are attested instead
+func (r *AttestationReconciler) Attest(ctx context.Context, attestation *keylimev1alpha1.Attestation) error {
+	if err := ValidateSpec(&attestation.Spec); err != nil {
+		GetLogInstance().Info("Invalid attestation spec", "Error", err)
+		return err
+	}
+	timeout, err := r.attestationExecTimeout(attestation)
+	if err != nil {
+		GetLogInstance().Info("Invalid attestation spec", "Error", err)
+		return err
+	}
+	GetLogInstance().Info("Exec timeout of attestation", "Timeout", timeout.String())
+	info := attestation.Spec.PodAttestationInfo
+	if info == nil {
+		GetLogInstance().Info("Pod attestation not requested")
+		return nil
+	}
+	namespace := info.Namespace
+	if namespace == "" {
+		namespace = attestation.Namespace
+	}
+	attestation.Status.TargetPod = TargetPod(&attestation.Spec, namespace)
+	if attestation.Spec.PodSelector != nil {
+		return r.attestSelectedPods(ctx, attestation, namespace)
+	}
+	if r.DryRun {
+		GetLogInstance().Info("Dry run: would execute attestation command", "Namespace", namespace, "Pod", info.PodName,
+			"Container", info.ContainerName, "Command", info.Command)
+		return nil
+	}
+	attestation.Status.PodResults = nil
+	outcome := r.attestPod(ctx, attestation, namespace, info.PodName)
+	attestation.Status.Nonce = outcome.nonce
+	if attestationDeferred(outcome.err) {
+		return outcome.err
+	}
+	if outcome.err != nil {
+		// Error may include the output of the command, so it is bounded as well
+		message := truncateOutput(fmt.Sprintf("Attestation of pod %s/%s failed: %v", namespace, info.PodName,
+			outcome.err), r.maxStatusOutputBytes())
+		if outcome.quoteFailed {
+			r.SetCondition(attestation, keylimev1alpha1.ConditionQuoted, metav1.ConditionFalse, outcome.reason, message)
+		}
+		r.SetCondition(attestation, keylimev1alpha1.ConditionVerified, metav1.ConditionFalse, ReasonAttestationFailed, message)
+		r.RecordEvent(attestation, core_v1.EventTypeWarning, EventAttestationFailed, message)
+		attestationFailureTotal.WithLabelValues(outcome.reason).Inc()
+		return outcome.err
+	}
+	r.SetCondition(attestation, keylimev1alpha1.ConditionQuoted, metav1.ConditionTrue, ReasonQuoteRetrieved,
+		fmt.Sprintf("Attestation command executed in pod %s/%s", namespace, info.PodName))
+	message := fmt.Sprintf("Pod %s/%s attested successfully", namespace, info.PodName)
+	r.SetCondition(attestation, keylimev1alpha1.ConditionVerified, metav1.ConditionTrue, ReasonAttestationSucceeded, message)
+	r.RecordEvent(attestation, core_v1.EventTypeNormal, EventAttestationVerified, message)
+	now := metav1.Now()
+	attestation.Status.LastAttestationTime = &now
+	attestationSuccessTotal.Inc()
+	return r.recordOutput(ctx, attestation, Evidence{Quote: outcome.quote, Nonce: outcome.nonce, Timestamp: now.Time,
+		Verified: true})
+}
+
+// attestationDeferred returns whether the attestation of a pod failed with the error provided only because it can
+// not be attested yet, this is, the pod is not ready or not created yet, or the API server throttles requests.
+// Attestation is retried, without failing, once the pod can be attested
+func attestationDeferred(err error) bool {
+	return errors.Is(err, ErrPodNotReady) || errors.Is(err, ErrPodNotFound) || errors.Is(err, ErrThrottled)
+}
+
+// firstThrottled returns the first of the errors provided reporting a request throttled by the API server (see
+// ThrottledError), or nil if none does
+func firstThrottled(errs []error) error {
+	for _, err := range errs {
+		var throttled *ThrottledError
+		if errors.As(err, &throttled) {
+			return err
+		}
+	}
+	return nil
+}
+
+// TargetPod returns the pod attested, as namespace/name, or the namespace and pod selector of the pods
+// attested if a pod selector is specified
+func TargetPod(spec *keylimev1alpha1.AttestationSpec, namespace string) string {
+	if spec.PodSelector != nil {
+		return namespace + "/" + metav1.FormatLabelSelector(spec.PodSelector)
+	}
+	if spec.PodAttestationInfo == nil {
+		return ""
+	}
+	return namespace + "/" + spec.PodAttestationInfo.PodName
+}
+
+// recordOutput stores the output of the attestation command in the attestation status, truncated to
+// MaxStatusOutputBytes, and the full output in the evidence Secret
+func (r *AttestationReconciler) recordOutput(ctx context.Context, attestation *keylimev1alpha1.Attestation,
+	evidence Evidence) error {
+	attestation.Status.Output = truncateOutput(evidence.Quote, r.maxStatusOutputBytes())
+	if len(attestation.Status.Output) != len(evidence.Quote) {
+		GetLogInstance().Info("Output of attestation command truncated in status", "Output Bytes", len(evidence.Quote),
+			"Max Status Output Bytes", r.maxStatusOutputBytes())
+	}
+	if err := r.PersistEvidence(ctx, attestation, evidence); err != nil {
+		r.RecordEvent(attestation, core_v1.EventTypeWarning, EventEvidenceFailed, err.Error())
+		return err
+	}
+	return nil
+}
+
+// truncateOutput keeps the first maxBytes bytes of the output, without splitting UTF-8 characters, followed by
+// a marker with the number of bytes truncated
+func truncateOutput(output string, maxBytes int) string {
+	if len(output) <= maxBytes {
+		return output
+	}
+	keep := maxBytes
+	for keep > 0 && !utf8.RuneStart(output[keep]) {
+		keep--
+	}
+	return fmt.Sprintf("%s...[truncated %d bytes]", output[:keep], len(output)-keep)
+}
+
+// podAttestationOutcome contains the result of the attestation of a pod
+type podAttestationOutcome struct {
+	// quote returned by the attestation command
+	quote string
+	// nonce sent to the attestation command
+	nonce string
+	// reason of the failure, if any
+	reason string
+	// quoteFailed is true if the failure occurred retrieving the quote, rather than checking the pod
+	quoteFailed bool
+	// err reports the failure, if any
+	err error
+}
+
+// readinessFailure returns the outcome of an attestation whose pod readiness could not be checked
+func readinessFailure(err error) podAttestationOutcome {
+	reason := ReasonPodUnavailable
+	if errors.Is(err, ErrPodUnhealthy) {
+		reason = ReasonPodUnhealthy
+	}
+	return podAttestationOutcome{reason: reason, err: fmt.Errorf("unable to check readiness: %w", err)}
+}
+
+// attestTerminatedInitContainer uses the logs of the terminated init container to attest as quote, as commands
+// can not be executed in it anymore. Logs can not include the nonce, so it is not verified
+func (r *AttestationReconciler) attestTerminatedInitContainer(ctx context.Context, attestation *keylimev1alpha1.Attestation,
+	namespace, podName string, terminated *core_v1.ContainerStateTerminated) podAttestationOutcome {
+	container := attestation.Spec.PodAttestationInfo.ContainerName
+	outcome := podAttestationOutcome{quoteFailed: true}
+	if terminated.ExitCode != 0 {
+		outcome.reason = ReasonExecFailed
+		outcome.err = fmt.Errorf("init container %s exited with code %d: %s", container, terminated.ExitCode,
+			terminated.Reason)
+		return outcome
+	}
+	GetLogInstance().Info("Init container terminated, attesting its logs without nonce", "Namespace", namespace,
+		"Pod", podName, "Container", container)
+	r.RecordEvent(attestation, core_v1.EventTypeNormal, EventAttestationStarted,
+		fmt.Sprintf("Attesting pod %s/%s from the logs of init container %s", namespace, podName, container))
+	logsCtx, cancel := context.WithTimeout(ctx, r.effectiveExecTimeout(attestation))
+	defer cancel()
+	logs, err := GetPodLogs(logsCtx, namespace, podName, container, 0)
+	if err != nil {
+		outcome.reason = ReasonExecFailed
+		outcome.err = fmt.Errorf("unable to read logs of init container %s: %w", container, err)
+		return outcome
+	}
+	outcome.quote, outcome.quoteFailed = logs, false
+	return outcome
+}
+
+// attestPod executes the attestation command of the attestation spec in the pod provided, checking the
+// pod is ready (or its init container running) first, and verifying the nonce of the quote returned
+func (r *AttestationReconciler) attestPod(ctx context.Context, attestation *keylimev1alpha1.Attestation,
+	namespace, podName string) podAttestationOutcome {
+	info := attestation.Spec.PodAttestationInfo
+	if info.InitContainer {
+		// Pod is not ready while its init containers run, so the state of the init container is checked instead
+		state, err := r.initContainerState(ctx, namespace, podName, info.ContainerName)
+		if err != nil {
+			return readinessFailure(err)
+		}
+		if state.Terminated != nil {
+			return r.attestTerminatedInitContainer(ctx, attestation, namespace, podName, state.Terminated)
+		}
+		if state.Running == nil {
+			GetLogInstance().Info("Init container to attest is not running yet", "Namespace", namespace, "Pod", podName,
+				"Container", info.ContainerName)
+			return podAttestationOutcome{reason: ReasonPodNotReady, err: fmt.Errorf("%w: %s/%s: init container %s not started",
+				ErrPodNotReady, namespace, podName, info.ContainerName)}
+		}
+	} else {
+		ready, err := r.podIsReady(ctx, namespace, podName)
+		if err != nil {
+			return readinessFailure(err)
+		}
+		if !ready {
+			GetLogInstance().Info("Pod to attest is not ready yet", "Namespace", namespace, "Pod", podName)
+			return podAttestationOutcome{reason: ReasonPodNotReady, err: fmt.Errorf("%w: %s/%s", ErrPodNotReady, namespace, podName)}
+		}
+	}
+	GetLogInstance().Info("Attesting pod", "Namespace", namespace, "Pod", podName, "Container", info.ContainerName)
+	r.RecordEvent(attestation, core_v1.EventTypeNormal, EventAttestationStarted,
+		fmt.Sprintf("Attesting pod %s/%s", namespace, podName))
+	nonce, err := GenerateNonce(DefaultNonceSize)
+	if err != nil {
+		return podAttestationOutcome{reason: ReasonReconcileFailed, err: err}
+	}
+	attestationCommand, err := r.attestationCommand(ctx, attestation)
+	if err != nil {
+		if errors.Is(err, ErrInvalidSpec) {
+			return podAttestationOutcome{reason: ReasonInvalidSpec, err: err}
+		}
+		return podAttestationOutcome{reason: ReasonReconcileFailed, err: err}
+	}
+	outcome := podAttestationOutcome{nonce: nonce, quoteFailed: true}
+	err = r.WithExecHooks(ctx, attestation, namespace, podName, info.ContainerName, func() error {
+		execCtx, cancel := context.WithTimeout(ctx, r.effectiveExecTimeout(attestation))
+		defer cancel()
+		command, input := attestationCommand, nonce+"\n"
+		if info.NonceDelivery == keylimev1alpha1.NonceDeliveryFile {
+			path := NonceFilePath(attestation)
+			if err := writeNonceFile(execCtx, namespace, podName, info.ContainerName, path, nonce); err != nil {
+				return err
+			}
+			defer r.removeNonceFile(ctx, attestation, namespace, podName, info.ContainerName, path)
+			command, input = append(append([]string{}, attestationCommand...), path), ""
+		}
+		result, execErr := podExecWithInputResult(execCtx, namespace, podName, info.ContainerName, command, input,
+			ExecOptions{ExecRetries: r.ExecRetries})
+		execDurationSeconds.Observe(result.Duration.Seconds())
+		outcome.quote = result.Stdout
+		GetLogInstance().Info("Attestation command executed", "Container", result.Container, "Stdout", result.Stdout,
+			"Stderr", result.Stderr, "Exit Code", result.ExitCode, "Duration", result.Duration.String(), "Error", execErr)
+		if execErr == nil && result.ExitCode != 0 {
+			execErr = fmt.Errorf("attestation command exited with code %d: %s", result.ExitCode, result.Stderr)
+		}
+		return execErr
+	})
+	if errors.Is(err, ErrHookFailed) {
+		outcome.reason, outcome.err = ReasonHookFailed, err
+		return outcome
+	}
+	if err != nil {
+		outcome.reason, outcome.err = ReasonExecFailed, err
+		return outcome
+	}
+	if err = VerifyQuoteNonce(outcome.quote, nonce); err != nil {
+		outcome.reason, outcome.err = ReasonNonceMismatch, err
+		return outcome
+	}
+	outcome.quoteFailed = false
+	if info.VerificationPolicy == keylimev1alpha1.VerificationPolicyNonce {
+		return outcome
+	}
+	return r.verifyQuote(ctx, outcome)
+}
+
+// verifyQuote verifies the quote of the outcome provided with the verifier of the reconciler, returning
+// the outcome with the result of the verification
+func (r *AttestationReconciler) verifyQuote(ctx context.Context, outcome podAttestationOutcome) podAttestationOutcome {
+	verified, message, err := r.verifier().Verify(ctx, []byte(outcome.quote), []byte(outcome.nonce))
+	GetLogInstance().Info("Quote verified", "Verified", verified, "Message", message, "Error", err)
+	if errors.Is(err, ErrVerifierUnavailable) {
+		outcome.reason, outcome.err = ReasonVerifierUnavailable, err
+		return outcome
+	}
+	if err != nil {
+		outcome.reason, outcome.err = ReasonVerificationFailed, err
+		return outcome
+	}
+	if !verified {
+		outcome.reason, outcome.err = ReasonVerificationFailed, fmt.Errorf("quote rejected by verifier: %s", message)
+	}
+	return outcome
+}
+
+// attestSelectedPods attests all the pods matching the pod selector of the attestation spec, storing the
+// result of each of them in the status, and their quotes in the evidence Secret (see PersistPodEvidence), as
+// Output status field only holds the output of single pod attestations. Attestation is verified only if all
+// the pods are verified. Pods that can not be attested yet (see attestationDeferred) are not counted as failed:
+// unless the attestation of other pods failed, attestation is deferred until all the pods can be attested
+func (r *AttestationReconciler) attestSelectedPods(ctx context.Context, attestation *keylimev1alpha1.Attestation,
+	namespace string) error {
+	selector, err := metav1.LabelSelectorAsSelector(attestation.Spec.PodSelector)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidSpec, err)
+	}
+	pods, err := r.listPods(ctx, namespace, selector)
+	if err != nil {
+		GetLogInstance().Info("Unable to list pods to attest", "Namespace", namespace, "Selector", selector.String())
+		return err
+	}
+	if r.DryRun {
+		GetLogInstance().Info("Dry run: would execute attestation command", "Namespace", namespace,
+			"Selector", selector.String(), "Pods", len(pods), "Command", attestation.Spec.PodAttestationInfo.Command)
+		return nil
+	}
+	if len(pods) == 0 {
+		message := fmt.Sprintf("No pods match selector %q in namespace %s", selector.String(), namespace)
+		r.SetCondition(attestation, keylimev1alpha1.ConditionVerified, metav1.ConditionFalse, ReasonPodNotFound, message)
+		attestation.Status.PodResults = nil
+		return fmt.Errorf("%w: no pods match selector %q in namespace %s", ErrPodNotFound, selector.String(), namespace)
+	}
+	attestation.Status.Nonce = ""
+	attestation.Status.Output = ""
+	results := make([]keylimev1alpha1.PodAttestationResult, 0, len(pods))
+	evidence := make(map[string]Evidence, len(pods))
+	var deferred []error
+	failed := false
+	for _, pod := range pods {
+		outcome := r.attestPod(ctx, attestation, namespace, pod.Name)
+		if attestationDeferred(outcome.err) {
+			GetLogInstance().Info("Attestation of pod deferred", "Namespace", namespace, "Pod", pod.Name,
+				"Error", outcome.err)
+			deferred = append(deferred, outcome.err)
+			continue
+		}
+		failed = failed || outcome.err != nil
+		result := keylimev1alpha1.PodAttestationResult{
+			PodName:   pod.Name,
+			Verified:  outcome.err == nil,
+			Timestamp: metav1.Now(),
+			Reason:    outcome.reason,
+			Nonce:     outcome.nonce,
+		}
+		evidence[pod.Name] = Evidence{Quote: outcome.quote, Nonce: outcome.nonce, Timestamp: result.Timestamp.Time,
+			Verified: result.Verified}
+		if outcome.err != nil {
+			GetLogInstance().Info("Attestation of pod failed", "Namespace", namespace, "Pod", pod.Name, "Error", outcome.err)
+			attestationFailureTotal.WithLabelValues(outcome.reason).Inc()
+		} else {
+			attestationSuccessTotal.Inc()
+		}
+		results = append(results, result)
+	}
+	if !failed && len(deferred) > 0 {
+		// Attestation is retried, without failing, once all the pods can be attested. Throttling is reported
+		// first, so that the delay suggested by the API server is honored
+		deferredErr := deferred[0]
+		if throttled := firstThrottled(deferred); throttled != nil {
+			deferredErr = throttled
+		}
+		return fmt.Errorf("attestation of %d of %d pods deferred: %w", len(deferred), len(pods), deferredErr)
+	}
+	aggregateErr := r.AggregatePodResults(attestation, namespace, results, deferred...)
+	// Evidence of every pod is kept for audit, including the pods whose attestation failed
+	if err := r.PersistPodEvidence(ctx, attestation, evidence); err != nil {
+		r.RecordEvent(attestation, core_v1.EventTypeWarning, EventEvidenceFailed, err.Error())
+		return err
+	}
+	return aggregateErr
+}
+
+// AggregatePodResults stores the results of the attestation of the pods matching the pod selector in
+// the status, and sets Quoted and Verified conditions: attestation is verified only if all the pods are
+// :param []error deferred: errors of the pods whose attestation was deferred, if any (see attestationDeferred)
+//
+// :return:
+//
+//	error: If any of the pods was not verified, wrapping the first ThrottledError of the deferred pods, if any,
+//	so that the delay suggested by the API server is honored, otherwise `nil`
+func (r *AttestationReconciler) AggregatePodResults(attestation *keylimev1alpha1.Attestation, namespace string,
+	results []keylimev1alpha1.PodAttestationResult, deferred ...error) error {
+	attestation.Status.PodResults = results
+	var failed []string
+	for _, result := range results {
+		if !result.Verified {
+			failed = append(failed, result.PodName)
+		}
+	}
+	if len(failed) > 0 {
+		message := fmt.Sprintf("Attestation of %d of %d pods in namespace %s failed: %s", len(failed), len(results),
+			namespace, strings.Join(failed, ", "))
+		r.SetCondition(attestation, keylimev1alpha1.ConditionQuoted, metav1.ConditionFalse, ReasonAttestationFailed, message)
+		r.SetCondition(attestation, keylimev1alpha1.ConditionVerified, metav1.ConditionFalse, ReasonAttestationFailed, message)
+		r.RecordEvent(attestation, core_v1.EventTypeWarning, EventAttestationFailed, message)
+		err := fmt.Errorf("attestation of %d of %d pods failed: %s", len(failed), len(results), strings.Join(failed, ", "))
+		if throttled := firstThrottled(deferred); throttled != nil {
+			return fmt.Errorf("%v, %w", err, throttled)
+		}
+		return err
+	}
+	r.SetCondition(attestation, keylimev1alpha1.ConditionQuoted, metav1.ConditionTrue, ReasonQuoteRetrieved,
+		fmt.Sprintf("Attestation command executed in %d pods in namespace %s", len(results), namespace))
+	message := fmt.Sprintf("%d pods in namespace %s attested successfully", len(results), namespace)
+	r.SetCondition(attestation, keylimev1alpha1.ConditionVerified, metav1.ConditionTrue, ReasonAttestationSucceeded, message)
+	r.RecordEvent(attestation, core_v1.EventTypeNormal, EventAttestationVerified, message)
+	now := metav1.Now()
+	attestation.Status.LastAttestationTime = &now
+	return nil
+}
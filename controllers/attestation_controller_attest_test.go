@@ -0,0 +1,285 @@
+/*
+Copyright 2023.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+	"unicode/utf8"
+
+	. "github.com/onsi/gomega"
+	keylimev1alpha1 "github.com/sarroutbi/osdk-attestation-operator/api/v1alpha1"
+	core_v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/record"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+func TestAggregatePodResultsPartialFailure(t *testing.T) {
+	g := NewWithT(t)
+	r := &AttestationReconciler{}
+	attestation := &keylimev1alpha1.Attestation{}
+	results := []keylimev1alpha1.PodAttestationResult{
+		{PodName: "agent-0", Verified: true},
+		{PodName: "agent-1", Verified: false, Reason: ReasonNonceMismatch},
+		{PodName: "agent-2", Verified: true},
+	}
+
+	err := r.AggregatePodResults(attestation, "keylime", results)
+	g.Expect(err).To(MatchError("attestation of 1 of 3 pods failed: agent-1"))
+	g.Expect(attestation.Status.PodResults).To(Equal(results))
+	verified := meta.FindStatusCondition(attestation.Status.Conditions, keylimev1alpha1.ConditionVerified)
+	g.Expect(verified.Status).To(Equal(metav1.ConditionFalse))
+	g.Expect(verified.Message).To(ContainSubstring("agent-1"))
+	g.Expect(attestation.Status.Verified).To(BeFalse())
+	g.Expect(attestation.Status.LastAttestationTime).To(BeNil())
+}
+
+func TestAggregatePodResultsAllVerified(t *testing.T) {
+	g := NewWithT(t)
+	r := &AttestationReconciler{}
+	attestation := &keylimev1alpha1.Attestation{}
+	results := []keylimev1alpha1.PodAttestationResult{
+		{PodName: "agent-0", Verified: true},
+		{PodName: "agent-1", Verified: true},
+	}
+
+	g.Expect(r.AggregatePodResults(attestation, "keylime", results)).To(Succeed())
+	g.Expect(meta.IsStatusConditionTrue(attestation.Status.Conditions, keylimev1alpha1.ConditionVerified)).To(BeTrue())
+	g.Expect(meta.IsStatusConditionTrue(attestation.Status.Conditions, keylimev1alpha1.ConditionQuoted)).To(BeTrue())
+	g.Expect(attestation.Status.Verified).To(BeTrue())
+	g.Expect(attestation.Status.LastAttestationTime).NotTo(BeNil())
+}
+
+func TestTargetPod(t *testing.T) {
+	g := NewWithT(t)
+	spec := &keylimev1alpha1.AttestationSpec{PodAttestationInfo: &keylimev1alpha1.PodAttestation{PodName: "agent"}}
+	g.Expect(TargetPod(spec, "keylime")).To(Equal("keylime/agent"))
+
+	spec.PodSelector = &metav1.LabelSelector{MatchLabels: map[string]string{"app": "agent"}}
+	g.Expect(TargetPod(spec, "keylime")).To(Equal("keylime/app=agent"))
+
+	g.Expect(TargetPod(&keylimev1alpha1.AttestationSpec{}, "keylime")).To(BeEmpty())
+}
+
+func TestValidateSpecPodSelector(t *testing.T) {
+	g := NewWithT(t)
+	selector := &metav1.LabelSelector{MatchLabels: map[string]string{"app": "agent"}}
+	g.Expect(ValidateSpec(&keylimev1alpha1.AttestationSpec{
+		PodAttestationInfo: &keylimev1alpha1.PodAttestation{Command: []string{"attest"}},
+		PodSelector:        selector,
+	})).To(Succeed())
+
+	err := ValidateSpec(&keylimev1alpha1.AttestationSpec{
+		PodAttestationInfo: &keylimev1alpha1.PodAttestation{PodName: "agent", Command: []string{"attest"}},
+		PodSelector:        selector,
+	})
+	g.Expect(errors.Is(err, ErrInvalidSpec)).To(BeTrue())
+
+	err = ValidateSpec(&keylimev1alpha1.AttestationSpec{
+		PodSelector: &metav1.LabelSelector{MatchExpressions: []metav1.LabelSelectorRequirement{{Key: "app", Operator: "Unknown"}}},
+	})
+	g.Expect(errors.Is(err, ErrInvalidSpec)).To(BeTrue())
+}
+
+func TestTruncateOutput(t *testing.T) {
+	g := NewWithT(t)
+	g.Expect(truncateOutput("quote", 5)).To(Equal("quote"))
+	g.Expect(truncateOutput("quote: 0xdeadbeef", 5)).To(Equal("quote...[truncated 12 bytes]"))
+
+	// Multi-byte characters are not split
+	truncated := truncateOutput("PCR€€", 5)
+	g.Expect(utf8.ValidString(truncated)).To(BeTrue())
+	g.Expect(truncated).To(Equal("PCR...[truncated 6 bytes]"))
+}
+
+func TestRecordOversizedOutput(t *testing.T) {
+	useFakeConfig(t)
+	g := NewWithT(t)
+	attestation := &keylimev1alpha1.Attestation{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "keylime", Name: "attestation", UID: "1234"},
+	}
+	r := testReconciler(t, attestation)
+	r.MaxStatusOutputBytes = 64
+	quote := strings.Repeat("PCR€", 100)
+
+	g.Expect(r.recordOutput(context.Background(), attestation, Evidence{Quote: quote, Timestamp: time.Now(),
+		Verified: true})).To(Succeed())
+	g.Expect(len(attestation.Status.Output)).To(BeNumerically("<=", 64+len("...[truncated 400 bytes]")))
+	g.Expect(attestation.Status.Output).To(HaveSuffix("bytes]"))
+	g.Expect(utf8.ValidString(attestation.Status.Output)).To(BeTrue())
+
+	secret := &core_v1.Secret{}
+	g.Expect(r.Get(context.Background(), types.NamespacedName{Namespace: "keylime", Name: "attestation-evidence"}, secret)).To(Succeed())
+	g.Expect(string(secret.Data[EvidenceQuoteKey])).To(Equal(quote))
+}
+
+func TestAttestFailedInitContainer(t *testing.T) {
+	useFakeConfig(t)
+	g := NewWithT(t)
+	r := &AttestationReconciler{}
+	attestation := &keylimev1alpha1.Attestation{Spec: keylimev1alpha1.AttestationSpec{
+		PodAttestationInfo: &keylimev1alpha1.PodAttestation{PodName: "agent", ContainerName: "measure", InitContainer: true},
+	}}
+
+	outcome := r.attestTerminatedInitContainer(context.Background(), attestation, "keylime", "agent",
+		&core_v1.ContainerStateTerminated{ExitCode: 2, Reason: "Error"})
+	g.Expect(outcome.quoteFailed).To(BeTrue())
+	g.Expect(outcome.reason).To(Equal(ReasonExecFailed))
+	g.Expect(outcome.err).To(MatchError("init container measure exited with code 2: Error"))
+}
+
+func TestAttestPodNotFound(t *testing.T) {
+	useFakeConfig(t)
+	g := NewWithT(t)
+	attestation := &keylimev1alpha1.Attestation{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "keylime", Name: "attestation", UID: "1234"},
+		Spec: keylimev1alpha1.AttestationSpec{
+			PodAttestationInfo: &keylimev1alpha1.PodAttestation{PodName: "agent", Command: []string{"attest"}},
+		},
+	}
+	r := testReconciler(t, attestation)
+	recorder := record.NewFakeRecorder(10)
+	r.Recorder = recorder
+
+	// Pod may not have been created yet, so attestation is deferred, without failing
+	err := r.Attest(context.Background(), attestation)
+	g.Expect(errors.Is(err, ErrPodNotFound)).To(BeTrue())
+	g.Expect(meta.FindStatusCondition(attestation.Status.Conditions, keylimev1alpha1.ConditionVerified)).To(BeNil())
+	g.Expect(recorder.Events).To(BeEmpty())
+}
+
+// selectorAttestation returns an attestation of the pods labeled with app=agent in the keylime namespace
+func selectorAttestation() *keylimev1alpha1.Attestation {
+	return &keylimev1alpha1.Attestation{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "keylime", Name: "attestation", UID: "1234"},
+		Spec: keylimev1alpha1.AttestationSpec{
+			PodAttestationInfo: &keylimev1alpha1.PodAttestation{ContainerName: "agent", Command: []string{"attest"}},
+			PodSelector:        &metav1.LabelSelector{MatchLabels: map[string]string{"app": "agent"}},
+		},
+	}
+}
+
+func TestAttestSelectedPodsNotReady(t *testing.T) {
+	useFakeConfig(t)
+	g := NewWithT(t)
+	attestation := selectorAttestation()
+	starting := labeledPod("agent-1", map[string]string{"app": "agent"})
+	starting.Status.Conditions[0].Status = core_v1.ConditionFalse
+	r := testReconciler(t, attestation, starting)
+	recorder := record.NewFakeRecorder(10)
+	r.Recorder = recorder
+
+	// Pods not ready yet are not failed, attestation is deferred until they are
+	err := r.Attest(context.Background(), attestation)
+	g.Expect(errors.Is(err, ErrPodNotReady)).To(BeTrue())
+	g.Expect(err).To(MatchError(ContainSubstring("attestation of 1 of 1 pods deferred")))
+	g.Expect(meta.FindStatusCondition(attestation.Status.Conditions, keylimev1alpha1.ConditionVerified)).To(BeNil())
+	g.Expect(attestation.Status.PodResults).To(BeEmpty())
+	g.Expect(recorder.Events).To(BeEmpty())
+}
+
+func TestAttestSelectedPodsFailedAndNotReady(t *testing.T) {
+	useFakeConfig(t)
+	g := NewWithT(t)
+	useCommandExecutors(t, map[string]*fakeExecutor{"attest": {stdout: "PCR quote"}})
+	attestation := selectorAttestation()
+	starting := labeledPod("agent-1", map[string]string{"app": "agent"})
+	starting.Status.Conditions[0].Status = core_v1.ConditionFalse
+	r := testReconciler(t, attestation, labeledPod("agent-0", map[string]string{"app": "agent"}), starting)
+
+	// Quote does not include the nonce, so attestation of the ready pod fails, pod not ready is not failed
+	err := r.Attest(context.Background(), attestation)
+	g.Expect(err).To(MatchError("attestation of 1 of 1 pods failed: agent-0"))
+	g.Expect(errors.Is(err, ErrPodNotReady)).To(BeFalse())
+	g.Expect(podResultNames(attestation.Status.PodResults)).To(Equal([]string{"agent-0"}))
+	g.Expect(meta.IsStatusConditionFalse(attestation.Status.Conditions, keylimev1alpha1.ConditionVerified)).To(BeTrue())
+}
+
+// throttlingClient throttles the requests to get the pod provided, suggesting to retry after the delay provided
+type throttlingClient struct {
+	client.Client
+	pod        string
+	retryAfter int
+}
+
+func (c *throttlingClient) Get(ctx context.Context, key client.ObjectKey, obj client.Object,
+	opts ...client.GetOption) error {
+	if _, isPod := obj.(*core_v1.Pod); isPod && key.Name == c.pod {
+		return apierrors.NewTooManyRequests("too many requests", c.retryAfter)
+	}
+	return c.Client.Get(ctx, key, obj, opts...)
+}
+
+func TestReconcileSelectedPodsThrottled(t *testing.T) {
+	useFakeConfig(t)
+	g := NewWithT(t)
+	ctx := context.Background()
+	useCommandExecutors(t, map[string]*fakeExecutor{"attest": {stdout: "PCR quote"}})
+	attestation := selectorAttestation()
+	r := testReconciler(t, attestation, labeledPod("agent-0", map[string]string{"app": "agent"}),
+		labeledPod("agent-1", map[string]string{"app": "agent"}))
+	r.Client = &throttlingClient{Client: r.Client, pod: "agent-1", retryAfter: 7}
+	key := client.ObjectKeyFromObject(attestation)
+
+	// Attestation of agent-0 fails, but the delay suggested by the API server for agent-1 is honored
+	result, err := r.Reconcile(ctx, ctrl.Request{NamespacedName: key})
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(result.RequeueAfter).To(Equal(7 * time.Second))
+	current, err := GetAttestation(ctx, r.Client, key)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(current.Status.ConsecutiveFailures).To(BeZero())
+	ready := meta.FindStatusCondition(current.Status.Conditions, keylimev1alpha1.ConditionReady)
+	g.Expect(ready).NotTo(BeNil())
+	g.Expect(ready.Reason).To(Equal(ReasonThrottled))
+	g.Expect(podResultNames(current.Status.PodResults)).To(Equal([]string{"agent-0"}))
+
+	// Attestation is deferred if no other pod fails
+	g.Expect(r.Delete(ctx, labeledPod("agent-0", nil))).To(Succeed())
+	err = r.Attest(ctx, selectorAttestation())
+	g.Expect(err).To(MatchError(ContainSubstring("attestation of 1 of 1 pods deferred")))
+	retryAfter, throttled := ThrottledRetryAfter(err)
+	g.Expect(throttled).To(BeTrue())
+	g.Expect(retryAfter).To(Equal(7 * time.Second))
+}
+
+// podResultNames returns the names of the pods of the results provided
+func podResultNames(results []keylimev1alpha1.PodAttestationResult) []string {
+	var names []string
+	for _, result := range results {
+		names = append(names, result.PodName)
+	}
+	return names
+}
+
+func TestValidateSpecInitContainer(t *testing.T) {
+	g := NewWithT(t)
+	err := ValidateSpec(&keylimev1alpha1.AttestationSpec{
+		PodAttestationInfo: &keylimev1alpha1.PodAttestation{PodName: "agent", InitContainer: true},
+	})
+	g.Expect(errors.Is(err, ErrInvalidSpec)).To(BeTrue())
+	g.Expect(ValidateSpec(&keylimev1alpha1.AttestationSpec{
+		PodAttestationInfo: &keylimev1alpha1.PodAttestation{PodName: "agent", ContainerName: "measure", InitContainer: true},
+	})).To(Succeed())
+}
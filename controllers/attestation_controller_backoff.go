@@ -0,0 +1,224 @@
+/*
+Copyright 2023.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"fmt"
+	"time"
+
+	keylimev1alpha1 "github.com/sarroutbi/osdk-attestation-operator/api/v1alpha1"
+
+	"golang.org/x/time/rate"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/util/workqueue"
+)
+
+// DefaultBackoffBase is the requeue delay after the first failed attestation
+const DefaultBackoffBase = 5 * time.Second
+
+// DefaultBackoffCap is the maximum requeue delay after consecutive failed attestations
+const DefaultBackoffCap = 5 * time.Minute
+
+// DefaultPodNotReadyRequeue is the requeue delay when the pod to attest is not ready yet
+const DefaultPodNotReadyRequeue = 10 * time.Second
+
+// podNotReadyRequeue returns the requeue delay when the pod to attest is not ready yet
+func (r *AttestationReconciler) podNotReadyRequeue() time.Duration {
+	if r.PodNotReadyRequeue <= 0 {
+		return DefaultPodNotReadyRequeue
+	}
+	return r.PodNotReadyRequeue
+}
+
+// DefaultPodUnhealthyRequeue is the requeue delay when the pod to attest is unhealthy, e.g. crash looping
+const DefaultPodUnhealthyRequeue = 5 * time.Minute
+
+// podUnhealthyRequeue returns the requeue delay when the pod to attest is unhealthy
+func (r *AttestationReconciler) podUnhealthyRequeue() time.Duration {
+	if r.PodUnhealthyRequeue <= 0 {
+		return DefaultPodUnhealthyRequeue
+	}
+	return r.PodUnhealthyRequeue
+}
+
+// DefaultReconcileTimeout bounds the duration of each reconcile
+const DefaultReconcileTimeout = 2 * time.Minute
+
+// reconcileTimeout returns the maximum duration of each reconcile
+func (r *AttestationReconciler) reconcileTimeout() time.Duration {
+	if r.ReconcileTimeout <= 0 {
+		return DefaultReconcileTimeout
+	}
+	return r.ReconcileTimeout
+}
+
+// DefaultExecTimeout bounds the duration of each command executed in the pod to attest
+const DefaultExecTimeout = 30 * time.Second
+
+// execTimeout returns the maximum duration of each command executed in the pod to attest
+func (r *AttestationReconciler) execTimeout() time.Duration {
+	if r.ExecTimeout <= 0 {
+		return DefaultExecTimeout
+	}
+	return r.ExecTimeout
+}
+
+// DefaultMaxExecTimeout is the maximum exec timeout attestations can specify
+const DefaultMaxExecTimeout = 10 * time.Minute
+
+// maxExecTimeout returns the maximum exec timeout attestations can specify
+func (r *AttestationReconciler) maxExecTimeout() time.Duration {
+	if r.MaxExecTimeout <= 0 {
+		return DefaultMaxExecTimeout
+	}
+	return r.MaxExecTimeout
+}
+
+// effectiveExecTimeout returns the maximum duration of each command executed in the pod to attest,
+// this is, the timeout specified by the attestation, if any, or the default exec timeout otherwise
+func (r *AttestationReconciler) effectiveExecTimeout(attestation *keylimev1alpha1.Attestation) time.Duration {
+	if attestation.Spec.TimeoutSeconds > 0 {
+		return time.Duration(attestation.Spec.TimeoutSeconds) * time.Second
+	}
+	return r.execTimeout()
+}
+
+// attestationExecTimeout returns the effective exec timeout of the attestation, checking it does not
+// exceed the maximum exec timeout
+func (r *AttestationReconciler) attestationExecTimeout(attestation *keylimev1alpha1.Attestation) (time.Duration, error) {
+	timeout := r.effectiveExecTimeout(attestation)
+	if attestation.Spec.TimeoutSeconds > 0 && timeout > r.maxExecTimeout() {
+		return 0, fmt.Errorf("%w: timeoutseconds must not exceed %d, got %d", ErrInvalidSpec,
+			int(r.maxExecTimeout().Seconds()), attestation.Spec.TimeoutSeconds)
+	}
+	return timeout, nil
+}
+
+// DefaultMaxStatusOutputBytes is the maximum size of the command output stored in the attestation status
+const DefaultMaxStatusOutputBytes = 4096
+
+// maxStatusOutputBytes returns the maximum size of the command output stored in the attestation status
+func (r *AttestationReconciler) maxStatusOutputBytes() int {
+	if r.MaxStatusOutputBytes <= 0 {
+		return DefaultMaxStatusOutputBytes
+	}
+	return r.MaxStatusOutputBytes
+}
+
+// DefaultRequeueJitterFactor is the fraction of the interval by which periodic re-attestations are scattered
+// around it, so that attestations sharing the same interval do not requeue at once
+const DefaultRequeueJitterFactor = 0.1
+
+// requeueJitterFactor returns the fraction of the interval by which periodic re-attestations are scattered,
+// zero if disabled
+func (r *AttestationReconciler) requeueJitterFactor() float64 {
+	if r.RequeueJitterFactor <= 0 {
+		return 0
+	}
+	return r.RequeueJitterFactor
+}
+
+// ValidateRequeueJitterFactor checks the jitter factor is a fraction of the interval, from 0 (disabled) up to,
+// but not including, 1
+func ValidateRequeueJitterFactor(factor float64) error {
+	if factor < 0 || factor >= 1 {
+		return fmt.Errorf("requeue jitter factor must be in [0, 1), got %v", factor)
+	}
+	return nil
+}
+
+// PeriodicRequeue returns the requeue delay of the periodic re-attestation on the interval provided,
+// scattered uniformly by ±RequeueJitterFactor of the interval
+func (r *AttestationReconciler) PeriodicRequeue(interval time.Duration) time.Duration {
+	factor := r.requeueJitterFactor()
+	if factor == 0 || interval <= 0 {
+		return interval
+	}
+	// wait.Jitter only delays, so the band [interval, interval*(1+2*factor)) is shifted down by interval*factor
+	return wait.Jitter(interval, 2*factor) - time.Duration(factor*float64(interval))
+}
+
+// Backoff returns the requeue delay after the number of consecutive failures provided.
+// Delay doubles on each failure, starting from BackoffBase, and never exceeds BackoffCap
+func (r *AttestationReconciler) Backoff(failures int) time.Duration {
+	base, limit := r.BackoffBase, r.BackoffCap
+	if base <= 0 {
+		base = DefaultBackoffBase
+	}
+	if limit <= 0 {
+		limit = DefaultBackoffCap
+	}
+	delay := base
+	for i := 1; i < failures; i++ {
+		delay *= 2
+		if delay >= limit {
+			return limit
+		}
+	}
+	if delay > limit {
+		return limit
+	}
+	return delay
+}
+
+// DefaultReconcileBaseDelay is the delay of the first retry of a failed reconcile
+const DefaultReconcileBaseDelay = time.Second
+
+// DefaultReconcileMaxDelay is the maximum delay of the retries of a failed reconcile
+const DefaultReconcileMaxDelay = 1000 * time.Second
+
+// reconcileQPS and reconcileBurst bound the overall rate of reconciles, so that cluster-wide events
+// (e.g. a node restart) do not trigger a thundering herd of attestations
+const (
+	reconcileQPS   = 10
+	reconcileBurst = 100
+)
+
+// NewRateLimiter returns a rate limiter combining a per-item exponential backoff, from the base delay
+// provided up to the maximum delay provided, and an overall token bucket.
+// Default delays are used if not provided
+func NewRateLimiter(baseDelay, maxDelay time.Duration) workqueue.RateLimiter {
+	if baseDelay <= 0 {
+		baseDelay = DefaultReconcileBaseDelay
+	}
+	if maxDelay <= 0 {
+		maxDelay = DefaultReconcileMaxDelay
+	}
+	return workqueue.NewMaxOfRateLimiter(
+		workqueue.NewItemExponentialFailureRateLimiter(baseDelay, maxDelay),
+		&workqueue.BucketRateLimiter{Limiter: rate.NewLimiter(rate.Limit(reconcileQPS), reconcileBurst)},
+	)
+}
+
+// rateLimiter returns the rate limiter of the reconciles
+func (r *AttestationReconciler) rateLimiter() workqueue.RateLimiter {
+	if r.RateLimiter == nil {
+		return NewRateLimiter(DefaultReconcileBaseDelay, DefaultReconcileMaxDelay)
+	}
+	return r.RateLimiter
+}
+
+// DefaultMaxConcurrentReconciles is the number of attestations reconciled in parallel
+const DefaultMaxConcurrentReconciles = 1
+
+// maxConcurrentReconciles returns the number of attestations reconciled in parallel
+func (r *AttestationReconciler) maxConcurrentReconciles() int {
+	if r.MaxConcurrentReconciles <= 0 {
+		return DefaultMaxConcurrentReconciles
+	}
+	return r.MaxConcurrentReconciles
+}
@@ -0,0 +1,135 @@
+/*
+Copyright 2023.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	. "github.com/onsi/gomega"
+	keylimev1alpha1 "github.com/sarroutbi/osdk-attestation-operator/api/v1alpha1"
+)
+
+func TestBackoff(t *testing.T) {
+	g := NewWithT(t)
+	r := &AttestationReconciler{BackoffBase: time.Millisecond, BackoffCap: 10 * time.Millisecond}
+	g.Expect(r.Backoff(1)).To(Equal(time.Millisecond))
+	g.Expect(r.Backoff(2)).To(Equal(2 * time.Millisecond))
+	g.Expect(r.Backoff(4)).To(Equal(8 * time.Millisecond))
+	g.Expect(r.Backoff(5)).To(Equal(10 * time.Millisecond))
+	g.Expect(r.Backoff(1000)).To(Equal(10 * time.Millisecond))
+}
+
+func TestBackoffDefaults(t *testing.T) {
+	g := NewWithT(t)
+	r := &AttestationReconciler{}
+	g.Expect(r.Backoff(1)).To(Equal(DefaultBackoffBase))
+	g.Expect(r.Backoff(100)).To(Equal(DefaultBackoffCap))
+	g.Expect(r.podUnhealthyRequeue()).To(Equal(DefaultPodUnhealthyRequeue))
+}
+
+func TestPeriodicRequeue(t *testing.T) {
+	g := NewWithT(t)
+	interval := 100 * time.Second
+	r := &AttestationReconciler{RequeueJitterFactor: DefaultRequeueJitterFactor}
+	var below, above bool
+	for i := 0; i < 1000; i++ {
+		requeue := r.PeriodicRequeue(interval)
+		g.Expect(requeue).To(BeNumerically(">=", 90*time.Second))
+		g.Expect(requeue).To(BeNumerically("<", 110*time.Second))
+		below, above = below || requeue < interval, above || requeue > interval
+	}
+	// Requeues are scattered on both sides of the interval
+	g.Expect(below).To(BeTrue())
+	g.Expect(above).To(BeTrue())
+}
+
+func TestPeriodicRequeueWithoutJitter(t *testing.T) {
+	g := NewWithT(t)
+	for _, factor := range []float64{0, -0.5} {
+		r := &AttestationReconciler{RequeueJitterFactor: factor}
+		g.Expect(r.PeriodicRequeue(time.Minute)).To(Equal(time.Minute))
+	}
+	r := &AttestationReconciler{RequeueJitterFactor: DefaultRequeueJitterFactor}
+	g.Expect(r.PeriodicRequeue(0)).To(BeZero())
+}
+
+func TestValidateRequeueJitterFactor(t *testing.T) {
+	g := NewWithT(t)
+	g.Expect(ValidateRequeueJitterFactor(0)).To(Succeed())
+	g.Expect(ValidateRequeueJitterFactor(DefaultRequeueJitterFactor)).To(Succeed())
+	g.Expect(ValidateRequeueJitterFactor(-0.1)).NotTo(Succeed())
+	g.Expect(ValidateRequeueJitterFactor(1)).NotTo(Succeed())
+}
+
+func TestNewRateLimiter(t *testing.T) {
+	g := NewWithT(t)
+	limiter := NewRateLimiter(10*time.Millisecond, 50*time.Millisecond)
+	g.Expect(limiter.When("attestation")).To(Equal(10 * time.Millisecond))
+	g.Expect(limiter.When("attestation")).To(Equal(20 * time.Millisecond))
+	g.Expect(limiter.When("attestation")).To(Equal(40 * time.Millisecond))
+	g.Expect(limiter.When("attestation")).To(Equal(50 * time.Millisecond))
+	g.Expect(limiter.NumRequeues("attestation")).To(Equal(4))
+	limiter.Forget("attestation")
+	g.Expect(limiter.When("attestation")).To(Equal(10 * time.Millisecond))
+}
+
+func TestRateLimiterDefaults(t *testing.T) {
+	g := NewWithT(t)
+	r := &AttestationReconciler{}
+	g.Expect(r.rateLimiter().When("attestation")).To(Equal(DefaultReconcileBaseDelay))
+}
+
+func TestControllerOptions(t *testing.T) {
+	g := NewWithT(t)
+	r := &AttestationReconciler{MaxConcurrentReconciles: 8}
+	g.Expect(r.controllerOptions().MaxConcurrentReconciles).To(Equal(8))
+	g.Expect(r.controllerOptions().RateLimiter).NotTo(BeNil())
+
+	r = &AttestationReconciler{}
+	g.Expect(r.controllerOptions().MaxConcurrentReconciles).To(Equal(DefaultMaxConcurrentReconciles))
+}
+
+func TestExecTimeout(t *testing.T) {
+	g := NewWithT(t)
+	g.Expect((&AttestationReconciler{}).execTimeout()).To(Equal(DefaultExecTimeout))
+	g.Expect((&AttestationReconciler{ExecTimeout: time.Second}).execTimeout()).To(Equal(time.Second))
+}
+
+func TestAttestationExecTimeout(t *testing.T) {
+	g := NewWithT(t)
+	r := &AttestationReconciler{ExecTimeout: time.Minute, MaxExecTimeout: 5 * time.Minute}
+	attestation := &keylimev1alpha1.Attestation{}
+
+	timeout, err := r.attestationExecTimeout(attestation)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(timeout).To(Equal(time.Minute))
+
+	// Timeout of the attestation is honored over the default exec timeout
+	attestation.Spec.TimeoutSeconds = 120
+	timeout, err = r.attestationExecTimeout(attestation)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(timeout).To(Equal(2 * time.Minute))
+
+	attestation.Spec.TimeoutSeconds = 600
+	_, err = r.attestationExecTimeout(attestation)
+	g.Expect(errors.Is(err, ErrInvalidSpec)).To(BeTrue())
+	g.Expect(err).To(MatchError(ContainSubstring("must not exceed 300")))
+
+	g.Expect((&AttestationReconciler{}).maxExecTimeout()).To(Equal(DefaultMaxExecTimeout))
+}
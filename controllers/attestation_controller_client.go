@@ -0,0 +1,86 @@
+/*
+Copyright 2023.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+
+	keylimev1alpha1 "github.com/sarroutbi/osdk-attestation-operator/api/v1alpha1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/utils/pointer"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// GetAttestation retrieves an attestation
+// :param context
+// :param client.Client c: client used to retrieve the attestation
+// :param types.NamespacedName key: namespace and name of the attestation
+//
+// :return:
+//
+//	*keylimev1alpha1.Attestation: attestation retrieved
+//	error: If any error has occurred otherwise `nil`
+func GetAttestation(ctx context.Context, c client.Client, key types.NamespacedName) (*keylimev1alpha1.Attestation, error) {
+	attestation := &keylimev1alpha1.Attestation{}
+	if err := c.Get(ctx, key, attestation); err != nil {
+		return nil, err
+	}
+	return attestation, nil
+}
+
+// FieldManager is the field manager of the changes applied by the operator, so that ownership of the fields
+// it manages is tracked apart from the ones edited by users
+const FieldManager = "attestation-operator"
+
+// statusApplyObject returns the object applied to update the status of the attestation, holding its status only
+func statusApplyObject(attestation *keylimev1alpha1.Attestation,
+	status *keylimev1alpha1.AttestationStatus) *keylimev1alpha1.Attestation {
+	return &keylimev1alpha1.Attestation{
+		TypeMeta:   metav1.TypeMeta{APIVersion: keylimev1alpha1.GroupVersion.String(), Kind: "Attestation"},
+		ObjectMeta: metav1.ObjectMeta{Namespace: attestation.Namespace, Name: attestation.Name},
+		Status:     *status.DeepCopy(),
+	}
+}
+
+// statusApplyOptions returns the options of the status apply patches, forcing ownership of the status fields
+// applied, as the operator is the only writer of the status
+func statusApplyOptions() *client.SubResourcePatchOptions {
+	return &client.SubResourcePatchOptions{
+		PatchOptions: client.PatchOptions{FieldManager: FieldManager, Force: pointer.Bool(true)},
+	}
+}
+
+// UpdateAttestationStatus updates the status subresource of an attestation through server-side apply, as
+// FieldManager. Apply is forced and carries no resourceVersion, so it does not conflict if the attestation has
+// been modified since it was retrieved: the status fields owned by the operator are overwritten and the rest of
+// the attestation is kept. Errors are returned, not retried, so that the attestation is reconciled again
+// :param context
+// :param client.Client c: client used to update the attestation
+// :param *keylimev1alpha1.Attestation attestation: attestation whose status is updated. Updated on success
+//
+// :return:
+//
+//	error: If any error has occurred otherwise `nil`
+func UpdateAttestationStatus(ctx context.Context, c client.Client, attestation *keylimev1alpha1.Attestation) error {
+	applied := statusApplyObject(attestation, &attestation.Status)
+	if err := c.Status().Patch(ctx, applied, client.Apply, statusApplyOptions()); err != nil {
+		return err
+	}
+	applied.DeepCopyInto(attestation)
+	return nil
+}
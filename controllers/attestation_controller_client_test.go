@@ -0,0 +1,162 @@
+/*
+Copyright 2023.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"testing"
+
+	. "github.com/onsi/gomega"
+	keylimev1alpha1 "github.com/sarroutbi/osdk-attestation-operator/api/v1alpha1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// statusApplyClient emulates server-side apply of the attestation status, as the fake client handles apply
+// patches as strategic merge patches, not removing the fields omitted. As the API server, a forced apply without
+// resourceVersion never conflicts. Options of the status applied are recorded, and the error configured, if any,
+// is returned instead of applying
+type statusApplyClient struct {
+	client.Client
+	applied []client.SubResourcePatchOptions
+	err     error
+}
+
+func (c *statusApplyClient) Status() client.SubResourceWriter {
+	return &statusApplyWriter{SubResourceWriter: c.Client.Status(), client: c}
+}
+
+type statusApplyWriter struct {
+	client.SubResourceWriter
+	client *statusApplyClient
+}
+
+func (w *statusApplyWriter) Patch(ctx context.Context, obj client.Object, patch client.Patch,
+	opts ...client.SubResourcePatchOption) error {
+	if patch.Type() != types.ApplyPatchType {
+		return w.SubResourceWriter.Patch(ctx, obj, patch, opts...)
+	}
+	w.client.applied = append(w.client.applied, *(&client.SubResourcePatchOptions{}).ApplyOptions(opts))
+	if w.client.err != nil {
+		return w.client.err
+	}
+	applied := obj.(*keylimev1alpha1.Attestation)
+	current, err := GetAttestation(ctx, w.client, client.ObjectKeyFromObject(obj))
+	if err != nil {
+		return err
+	}
+	current.Status = applied.Status
+	if err := w.SubResourceWriter.Update(ctx, current); err != nil {
+		return err
+	}
+	current.DeepCopyInto(applied)
+	return nil
+}
+
+func TestGetAttestation(t *testing.T) {
+	g := NewWithT(t)
+	r := testReconciler(t, &keylimev1alpha1.Attestation{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "attestation"},
+	})
+
+	attestation, err := GetAttestation(context.Background(), r.Client, types.NamespacedName{Namespace: "default", Name: "attestation"})
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(attestation.Name).To(Equal("attestation"))
+
+	_, err = GetAttestation(context.Background(), r.Client, types.NamespacedName{Namespace: "default", Name: "missing"})
+	g.Expect(apierrors.IsNotFound(err)).To(BeTrue())
+}
+
+func TestUpdateAttestationStatusStaleAttestation(t *testing.T) {
+	useFakeConfig(t)
+	g := NewWithT(t)
+	ctx := context.Background()
+	key := types.NamespacedName{Namespace: "default", Name: "attestation"}
+	r := testReconciler(t, &keylimev1alpha1.Attestation{ObjectMeta: metav1.ObjectMeta{Namespace: key.Namespace, Name: key.Name}})
+
+	stale, err := GetAttestation(ctx, r.Client, key)
+	g.Expect(err).NotTo(HaveOccurred())
+	// Attestation is modified after being retrieved, stale copy is applied once, without conflict
+	modified, err := GetAttestation(ctx, r.Client, key)
+	g.Expect(err).NotTo(HaveOccurred())
+	modified.Labels = map[string]string{"modified": "true"}
+	g.Expect(r.Update(ctx, modified)).To(Succeed())
+
+	stale.Status.Version = "1.0.0"
+	g.Expect(UpdateAttestationStatus(ctx, r.Client, stale)).To(Succeed())
+	g.Expect(r.Client.(*statusApplyClient).applied).To(HaveLen(1))
+	g.Expect(stale.Labels).To(HaveKeyWithValue("modified", "true"))
+
+	updated, err := GetAttestation(ctx, r.Client, key)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(updated.Status.Version).To(Equal("1.0.0"))
+	g.Expect(updated.Labels).To(HaveKeyWithValue("modified", "true"))
+}
+
+func TestUpdateAttestationStatusFieldManager(t *testing.T) {
+	useFakeConfig(t)
+	g := NewWithT(t)
+	ctx := context.Background()
+	key := types.NamespacedName{Namespace: "default", Name: "attestation"}
+	r := testReconciler(t, &keylimev1alpha1.Attestation{ObjectMeta: metav1.ObjectMeta{Namespace: key.Namespace, Name: key.Name}})
+
+	attestation, err := GetAttestation(ctx, r.Client, key)
+	g.Expect(err).NotTo(HaveOccurred())
+	attestation.Status.Version = "1.0.0"
+	g.Expect(UpdateAttestationStatus(ctx, r.Client, attestation)).To(Succeed())
+
+	applied := r.Client.(*statusApplyClient).applied
+	g.Expect(applied).To(HaveLen(1))
+	g.Expect(applied[0].FieldManager).To(Equal(FieldManager))
+	g.Expect(applied[0].Force).NotTo(BeNil())
+	g.Expect(*applied[0].Force).To(BeTrue())
+	g.Expect(FieldManager).To(Equal("attestation-operator"))
+}
+
+func TestStatusApplyObject(t *testing.T) {
+	g := NewWithT(t)
+	attestation := &keylimev1alpha1.Attestation{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "attestation", ResourceVersion: "10",
+			Labels: map[string]string{"app": "agent"}},
+		Spec: keylimev1alpha1.AttestationSpec{PodAttestationInfo: &keylimev1alpha1.PodAttestation{PodName: "agent"}},
+	}
+	applied := statusApplyObject(attestation, &keylimev1alpha1.AttestationStatus{Version: "1.0.0"})
+	// Only the status is applied, so that the operator does not own fields of the metadata or spec
+	g.Expect(applied.APIVersion).To(Equal(keylimev1alpha1.GroupVersion.String()))
+	g.Expect(applied.Kind).To(Equal("Attestation"))
+	g.Expect(applied.ObjectMeta).To(Equal(metav1.ObjectMeta{Namespace: "default", Name: "attestation"}))
+	g.Expect(applied.Spec).To(Equal(keylimev1alpha1.AttestationSpec{}))
+	g.Expect(applied.Status.Version).To(Equal("1.0.0"))
+}
+
+func TestUpdateAttestationStatusDoesNotRetryErrors(t *testing.T) {
+	useFakeConfig(t)
+	g := NewWithT(t)
+	ctx := context.Background()
+	key := types.NamespacedName{Namespace: "default", Name: "attestation"}
+	r := testReconciler(t, &keylimev1alpha1.Attestation{ObjectMeta: metav1.ObjectMeta{Namespace: key.Namespace, Name: key.Name}})
+	applyClient := r.Client.(*statusApplyClient)
+	applyClient.err = apierrors.NewServiceUnavailable("etcd unavailable")
+
+	attestation, err := GetAttestation(ctx, r.Client, key)
+	g.Expect(err).NotTo(HaveOccurred())
+	err = UpdateAttestationStatus(ctx, r.Client, attestation)
+	g.Expect(apierrors.IsServiceUnavailable(err)).To(BeTrue())
+	g.Expect(applyClient.applied).To(HaveLen(1))
+}
@@ -18,42 +18,190 @@ package controllers
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"os"
 	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
 
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/rest"
 	"k8s.io/client-go/tools/clientcmd"
 
 	keylimev1alpha1 "github.com/sarroutbi/osdk-attestation-operator/api/v1alpha1"
+	core_v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	apivalidation "k8s.io/apimachinery/pkg/api/validation"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/util/wait"
 )
 
+var configCacheLock = &sync.Mutex{}
+
+var cachedConfig *rest.Config
+
+var kubeconfigPath string
+
+var kubeContext string
+
+// kubeContextEnvVar allows selecting the kubeconfig context used when not running in cluster
+const kubeContextEnvVar = "OPERATOR_KUBE_CONTEXT"
+
 // GetClusterClientConfig first tries to get a config object which uses the service account kubernetes gives to pods,
 // if it is called from a process running in a kubernetes environment.
 // Otherwise, it tries to build config from a default kubeconfig filepath if it fails, it fallback to the default config.
 // Once it get the config, it returns the same.
 func GetClusterClientConfig() (*rest.Config, error) {
-	config, err := rest.InClusterConfig()
+	return GetClusterClientConfigWithContext(context.Background())
+}
+
+// GetClusterClientConfigWithContext behaves as GetClusterClientConfig, but stops acquiring the config
+// and returns the context error as soon as the provided context is cancelled or its deadline is exceeded.
+// The config is built once and cached, so that subsequent calls return a copy of the cached config.
+// If the config can not be built, nothing is cached, and next call will try to build it again.
+func GetClusterClientConfigWithContext(ctx context.Context) (*rest.Config, error) {
+	configCacheLock.Lock()
+	defer configCacheLock.Unlock()
+	if cachedConfig != nil {
+		return rest.CopyConfig(cachedConfig), nil
+	}
+	config, err := buildClusterClientConfig(ctx)
 	if err != nil {
+		return nil, wrapError(ErrConfigUnavailable, err)
+	}
+	cachedConfig = config
+	return rest.CopyConfig(cachedConfig), nil
+}
+
+// ResetConfigCache drops the cached config, so that next call to GetClusterClientConfig builds it again
+func ResetConfigCache() {
+	configCacheLock.Lock()
+	defer configCacheLock.Unlock()
+	cachedConfig = nil
+}
+
+// buildClusterClientConfig builds the config, either in cluster or from kubeconfig
+func buildClusterClientConfig(ctx context.Context) (*rest.Config, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	config, err := rest.InClusterConfig()
+	if err == nil {
+		if err = applyAPIServerHostEnvironment(config); err != nil {
+			return nil, wrapError(ErrInvalidConfig, err)
+		}
+	} else {
 		err1 := err
-		kubeconfig := filepath.Join(os.Getenv("HOME"), ".kube", "config")
-		config, err = clientcmd.BuildConfigFromFlags("", kubeconfig)
+		if err = ctx.Err(); err != nil {
+			return nil, err
+		}
+		var attempted string
+		config, attempted, err = buildKubeConfig()
 		if err != nil {
-			err = fmt.Errorf("InClusterConfig as well as BuildConfigFromFlags Failed. Error in InClusterConfig: %+v\nError in BuildConfigFromFlags: %+v", err1, err)
+			err = fmt.Errorf("InClusterConfig as well as kubeconfig loading Failed. Error in InClusterConfig: %+v\nError loading kubeconfig from %s: %+v", err1, attempted, err)
 			return nil, err
 		}
 	}
+	if err = applyConfigEnvironment(config); err != nil {
+		return nil, wrapError(ErrInvalidConfig, err)
+	}
+	config.UserAgent = UserAgent()
 	return config, nil
 }
 
+// SetKubeconfigPath sets the kubeconfig file used when not running in cluster, which takes precedence
+// over KUBECONFIG environment variable and $HOME/.kube/config. The cached config is dropped, if any
+func SetKubeconfigPath(path string) {
+	configCacheLock.Lock()
+	defer configCacheLock.Unlock()
+	kubeconfigPath = path
+	cachedConfig = nil
+}
+
+// SetKubeContext sets the kubeconfig context used when not running in cluster, which takes precedence
+// over OPERATOR_KUBE_CONTEXT environment variable. The cached config is dropped, if any
+func SetKubeContext(name string) {
+	configCacheLock.Lock()
+	defer configCacheLock.Unlock()
+	kubeContext = name
+	cachedConfig = nil
+}
+
+// GetKubeContext returns the kubeconfig context used when not running in cluster, either set through
+// SetKubeContext or OPERATOR_KUBE_CONTEXT environment variable. Empty means the current context is used
+func GetKubeContext() string {
+	if kubeContext != "" {
+		return kubeContext
+	}
+	return os.Getenv(kubeContextEnvVar)
+}
+
+// loadKubeConfig builds the config from the kubeconfig files of the loading rules provided, using the
+// context selected through GetKubeContext, if any. An error listing the available contexts is returned
+// if the context selected does not exist
+func loadKubeConfig(loadingRules *clientcmd.ClientConfigLoadingRules) (*rest.Config, error) {
+	contextName := GetKubeContext()
+	clientConfig := clientcmd.NewNonInteractiveDeferredLoadingClientConfig(loadingRules,
+		&clientcmd.ConfigOverrides{CurrentContext: contextName})
+	if contextName != "" {
+		rawConfig, err := clientConfig.RawConfig()
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := rawConfig.Contexts[contextName]; !ok {
+			contexts := make([]string, 0, len(rawConfig.Contexts))
+			for name := range rawConfig.Contexts {
+				contexts = append(contexts, name)
+			}
+			sort.Strings(contexts)
+			return nil, fmt.Errorf("context %q not found in kubeconfig, available contexts: %s", contextName,
+				strings.Join(contexts, ", "))
+		}
+	}
+	return clientConfig.ClientConfig()
+}
+
+// buildKubeConfig builds the config from the kubeconfig file set through SetKubeconfigPath, if any.
+// Otherwise, it builds the config from the kubeconfig files listed in KUBECONFIG environment variable, if set,
+// merging them with the default loading rules. If it is not set, or config can not be built from it,
+// it fallbacks to the kubeconfig file in $HOME/.kube/config.
+// Context selected through GetKubeContext is used, if any, otherwise the current context of the kubeconfig.
+// It returns the config together with a description of the loading paths attempted.
+func buildKubeConfig() (*rest.Config, string, error) {
+	if kubeconfigPath != "" {
+		config, err := loadKubeConfig(&clientcmd.ClientConfigLoadingRules{ExplicitPath: kubeconfigPath})
+		return config, kubeconfigPath, err
+	}
+	attempted := ""
+	if kubeconfigEnv := os.Getenv(clientcmd.RecommendedConfigPathEnvVar); kubeconfigEnv != "" {
+		loadingRules := clientcmd.NewDefaultClientConfigLoadingRules()
+		config, err := loadKubeConfig(loadingRules)
+		if err == nil {
+			return config, clientcmd.RecommendedConfigPathEnvVar + "=" + kubeconfigEnv, nil
+		}
+		GetLogInstance().Info("Unable to build config from KUBECONFIG, falling back to HOME", "KUBECONFIG", kubeconfigEnv, "Error", err)
+		attempted = clientcmd.RecommendedConfigPathEnvVar + "=" + kubeconfigEnv + " and "
+	}
+	home := os.Getenv("HOME")
+	if home == "" || home == "/" {
+		return nil, attempted + "$HOME/.kube/config",
+			fmt.Errorf("HOME is not set or is /, provide kubeconfig file through --kubeconfig flag or KUBECONFIG environment variable")
+	}
+	kubeconfig := filepath.Join(home, ".kube", "config")
+	config, err := loadKubeConfig(&clientcmd.ClientConfigLoadingRules{ExplicitPath: kubeconfig})
+	return config, attempted + kubeconfig, err
+}
+
 // GetClientsetFromClusterConfig takes REST config and Create a clientset based on that and return that clientset
 func GetClientsetFromClusterConfig(config *rest.Config) (*kubernetes.Clientset, error) {
 	clientset, err := kubernetes.NewForConfig(config)
 	if err != nil {
-		err = fmt.Errorf("failed creating clientset. Error: %+v", err)
-		return nil, err
+		return nil, wrapError(ErrClientsetCreation, err)
 	}
 
 	return clientset, nil
@@ -64,66 +212,363 @@ func GetClientsetFromClusterConfig(config *rest.Config) (*kubernetes.Clientset,
 // Otherwise, it tries to build config from a default kubeconfig filepath if it fails, it fallback to the default config.
 // Once it get the config, it creates a new Clientset for the given config and returns the clientset.
 func GetClusterClientset() (*kubernetes.Clientset, error) {
-	config, err := GetClusterClientConfig()
+	return GetClusterClientsetWithContext(context.Background())
+}
+
+// GetClusterClientsetWithContext behaves as GetClusterClientset, but aborts the clientset creation
+// when the provided context is cancelled or its deadline is exceeded.
+func GetClusterClientsetWithContext(ctx context.Context) (*kubernetes.Clientset, error) {
+	config, err := GetClusterClientConfigWithContext(ctx)
 	if err != nil {
 		return nil, err
 	}
+	if err = ctx.Err(); err != nil {
+		return nil, err
+	}
 
 	return GetClientsetFromClusterConfig(config)
 }
 
+// GetClusterClientsetWithRetry behaves as GetClusterClientsetWithContext, retrying config and clientset creation
+// up to the number of attempts provided. Delay between attempts grows exponentially from baseDelay, with jitter,
+// so that several operator instances do not retry simultaneously. Retries stop as soon as the context is done.
+// Invalid configurations (ErrInvalidConfig) are returned immediately, as retrying can not fix them.
+// If all the attempts fail, the error of the last attempt is returned
+func GetClusterClientsetWithRetry(ctx context.Context, attempts int, baseDelay time.Duration) (*kubernetes.Clientset, error) {
+	var lastErr error
+	delay := baseDelay
+	for attempt := 1; attempt <= attempts; attempt++ {
+		clientset, err := GetClusterClientsetWithContext(ctx)
+		if err == nil {
+			return clientset, nil
+		}
+		if errors.Is(err, ErrInvalidConfig) {
+			return nil, err
+		}
+		lastErr = err
+		if attempt == attempts {
+			break
+		}
+		jittered := wait.Jitter(delay, 0.5)
+		GetLogInstance().Info("Unable to get ClusterClientset, retrying", "Attempt", attempt, "Attempts", attempts,
+			"Retry After", jittered, "Error", err)
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(jittered):
+		}
+		delay *= 2
+	}
+	return nil, fmt.Errorf("unable to get ClusterClientset after %d attempts: %w", attempts, lastErr)
+}
+
 // GetRESTClient first tries to get a config object which uses the service account kubernetes gives to pods,
 // if it is called from a process running in a kubernetes environment.
 // Otherwise, it tries to build config from a default kubeconfig filepath if it fails, it fallback to the default config.
-// Once it get the config, it
+// Once it get the config, it creates a new REST client for the given config and returns it.
 func GetRESTClient() (*rest.RESTClient, error) {
-	config, err := GetClusterClientConfig()
+	return GetRESTClientWithContext(context.Background())
+}
+
+// GetRESTClientWithContext behaves as GetRESTClient, but aborts the REST client creation
+// when the provided context is cancelled or its deadline is exceeded.
+func GetRESTClientWithContext(ctx context.Context) (*rest.RESTClient, error) {
+	config, err := GetClusterClientConfigWithContext(ctx)
 	if err != nil {
 		return &rest.RESTClient{}, err
 	}
+	if err = ctx.Err(); err != nil {
+		return &rest.RESTClient{}, err
+	}
 
 	return rest.RESTClientFor(config)
 }
 
+// PodListOptions allows restricting the pods to list
+type PodListOptions struct {
+	// LabelSelector restricts the list to pods whose labels match the selector. Empty selector matches everything
+	LabelSelector string
+	// FieldSelector restricts the list to pods whose fields match the selector. Empty selector matches everything.
+	// Only fields in podSelectableFields can be used. Field status.phase can be selected with
+	// values Pending, Running, Succeeded, Failed and Unknown, e.g. "status.phase=Running"
+	FieldSelector string
+	// Config allows customizing the config used to list the pods, e.g. impersonating a different identity
+	Config ConfigOptions
+	// PageSize is the maximum number of pods retrieved on each list request. DefaultPodListPageSize is used if not set
+	PageSize int64
+}
+
+// DefaultPodListPageSize is the maximum number of pods retrieved on each list request
+const DefaultPodListPageSize = 500
+
+// pageSize returns the maximum number of pods retrieved on each list request
+func (o *PodListOptions) pageSize() int64 {
+	if o.PageSize <= 0 {
+		return DefaultPodListPageSize
+	}
+	return o.PageSize
+}
+
+// podSelectableFields contains the pod fields the API server accepts in a field selector
+var podSelectableFields = map[string]bool{
+	"metadata.name":            true,
+	"metadata.namespace":       true,
+	"spec.nodeName":            true,
+	"spec.restartPolicy":       true,
+	"spec.schedulerName":       true,
+	"spec.serviceAccountName":  true,
+	"spec.hostNetwork":         true,
+	"status.phase":             true,
+	"status.podIP":             true,
+	"status.podIPs":            true,
+	"status.nominatedNodeName": true,
+}
+
+// podSelectablePhases contains the pod phases that can be selected through status.phase field
+var podSelectablePhases = map[string]bool{
+	string(core_v1.PodPending):   true,
+	string(core_v1.PodRunning):   true,
+	string(core_v1.PodSucceeded): true,
+	string(core_v1.PodFailed):    true,
+	string(core_v1.PodUnknown):   true,
+}
+
+// validateFieldSelector checks the field selector only uses fields that can be selected for pods
+func validateFieldSelector(fieldSelector string) error {
+	selector, err := fields.ParseSelector(fieldSelector)
+	if err != nil {
+		return fmt.Errorf("invalid field selector %q: %v", fieldSelector, err)
+	}
+	for _, requirement := range selector.Requirements() {
+		if !podSelectableFields[requirement.Field] {
+			return fmt.Errorf("invalid field selector %q: field %q is not selectable for pods", fieldSelector, requirement.Field)
+		}
+		if requirement.Field == "status.phase" && !podSelectablePhases[requirement.Value] {
+			return fmt.Errorf("invalid field selector %q: unknown pod phase %q", fieldSelector, requirement.Value)
+		}
+	}
+	return nil
+}
+
+// listOptions validates the options and converts them to the options used by the API request
+func (o *PodListOptions) listOptions() (metav1.ListOptions, error) {
+	if _, err := labels.Parse(o.LabelSelector); err != nil {
+		return metav1.ListOptions{}, fmt.Errorf("invalid label selector %q: %v", o.LabelSelector, err)
+	}
+	if err := validateFieldSelector(o.FieldSelector); err != nil {
+		return metav1.ListOptions{}, err
+	}
+	return metav1.ListOptions{LabelSelector: o.LabelSelector, FieldSelector: o.FieldSelector}, nil
+}
+
+// validateNamespace checks the namespace is a valid DNS-1123 label, before using it in any request
+func validateNamespace(namespace string) error {
+	if errs := apivalidation.ValidateNamespaceName(namespace, false); len(errs) > 0 {
+		return fmt.Errorf("invalid namespace %q: %v", namespace, strings.Join(errs, ", "))
+	}
+	return nil
+}
+
+// mergePodListOptions merges the optional options provided into a single set of options
+func mergePodListOptions(options []PodListOptions) PodListOptions {
+	merged := PodListOptions{}
+	for _, o := range options {
+		if o.LabelSelector != "" {
+			merged.LabelSelector = o.LabelSelector
+		}
+		if o.FieldSelector != "" {
+			merged.FieldSelector = o.FieldSelector
+		}
+		if o.Config.Impersonate.UserName != "" || len(o.Config.Impersonate.Groups) > 0 {
+			merged.Config = o.Config
+		}
+		if o.PageSize > 0 {
+			merged.PageSize = o.PageSize
+		}
+	}
+	return merged
+}
+
 // PodList list the pods in a particular namespace
 // :param string namespace: namespace of the Pod
 // :param context
+// :param ...PodListOptions options: optional restrictions on the pods to list
 //
 // :return:
 //
-//	string: Output of the command. (STDOUT)
-//	string: Errors. (STDERR)
-//	 error: If any error has occurred otherwise `nil`
-func PodList(namespace string, ctx context.Context) ([]keylimev1alpha1.PodInformation, error) {
-	config, err := GetClusterClientConfig()
+//	[]PodInformation: Name and phase of each of the pods
+//	error: If any error has occurred otherwise `nil`. Errors accessing the API server are reported as
+//	       KindError of kind ErrConfigUnavailable or ErrClientsetCreation
+func PodList(namespace string, ctx context.Context, options ...PodListOptions) ([]keylimev1alpha1.PodInformation, error) {
+	pods, err := PodListStructured(ctx, namespace, options...)
 	if err != nil {
-		GetLogInstance().Info("Unable to get ClusterClientConfig")
 		return []keylimev1alpha1.PodInformation{}, err
 	}
+	return PodInformationFromPods(pods), nil
+}
+
+// PodListStructured list the pods in a particular namespace
+// :param context
+// :param string namespace: namespace of the Pod
+// :param ...PodListOptions options: optional restrictions on the pods to list
+//
+// :return:
+//
+//	[]core_v1.Pod: Pods retrieved, so that phase and conditions can be inspected
+//	error: If any error has occurred otherwise `nil`
+func PodListStructured(ctx context.Context, namespace string, options ...PodListOptions) ([]core_v1.Pod, error) {
+	if err := validateNamespace(namespace); err != nil {
+		return nil, err
+	}
+	return listPods(ctx, namespace, mergePodListOptions(options))
+}
+
+// PodListAllNamespaces list the pods in all the namespaces. Operator requires permission to list pods
+// cluster-wide, this is, a ClusterRole granting "list" verb on "pods" resource bound through a
+// ClusterRoleBinding to the operator service account, as config/rbac/role.yaml does
+// :param context
+// :param string labelSelector: restrict the pods to list to those matching the selector, all pods if empty
+//
+// :return:
+//
+//	[]core_v1.Pod: Pods retrieved, so that phase and conditions can be inspected
+//	error: If any error has occurred otherwise `nil`
+func PodListAllNamespaces(ctx context.Context, labelSelector string) ([]core_v1.Pod, error) {
+	pods, err := listPods(ctx, core_v1.NamespaceAll, PodListOptions{LabelSelector: labelSelector})
+	if apierrors.IsForbidden(err) {
+		return nil, fmt.Errorf("unable to list pods in all namespaces, operator requires a ClusterRole granting "+
+			"list on pods: %w", err)
+	}
+	return pods, err
+}
+
+// listPods list the pods in a particular namespace, or in all namespaces if namespace is empty
+func listPods(ctx context.Context, namespace string, podListOptions PodListOptions) ([]core_v1.Pod, error) {
+	list, listOptions, err := podLister(ctx, namespace, podListOptions)
+	if err != nil {
+		return nil, err
+	}
+	var pods []core_v1.Pod
+	err = listPodPages(ctx, list, listOptions, podListOptions.pageSize(), func(page []core_v1.Pod) error {
+		pods = append(pods, page...)
+		return nil
+	})
+	if err != nil {
+		GetLogInstance().Info("Unable to list pods", "Namespace", namespace)
+		return nil, err
+	}
+	return pods, nil
+}
+
+// PodListChan list the pods in a particular namespace, sending them as pages are received, so that large
+// lists can be processed incrementally. Pods channel is closed when all the pods have been sent, or an error
+// occurs, which is then sent through the errors channel. Cancelling the context stops the list
+// :param context
+// :param string namespace: namespace of the Pod
+// :param ...PodListOptions options: optional restrictions on the pods to list
+//
+// :return:
+//
+//	<-chan core_v1.Pod: Pods retrieved
+//	<-chan error: Error, if any has occurred. Closed after pods channel
+func PodListChan(ctx context.Context, namespace string, options ...PodListOptions) (<-chan core_v1.Pod, <-chan error) {
+	pods := make(chan core_v1.Pod)
+	errs := make(chan error, 1)
+	go func() {
+		defer close(errs)
+		defer close(pods)
+		if err := validateNamespace(namespace); err != nil {
+			errs <- err
+			return
+		}
+		podListOptions := mergePodListOptions(options)
+		list, listOptions, err := podLister(ctx, namespace, podListOptions)
+		if err != nil {
+			errs <- err
+			return
+		}
+		err = listPodPages(ctx, list, listOptions, podListOptions.pageSize(), func(page []core_v1.Pod) error {
+			for _, pod := range page {
+				select {
+				case pods <- pod:
+				case <-ctx.Done():
+					return ctx.Err()
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			errs <- err
+		}
+	}()
+	return pods, errs
+}
+
+// podListFunc retrieves a page of pods
+type podListFunc func(ctx context.Context, options metav1.ListOptions) (*core_v1.PodList, error)
+
+// podLister returns the function retrieving the pages of pods in a namespace, and the list options to use
+func podLister(ctx context.Context, namespace string, podListOptions PodListOptions) (podListFunc, metav1.ListOptions, error) {
+	listOptions, err := podListOptions.listOptions()
+	if err != nil {
+		return nil, listOptions, err
+	}
+
+	config, err := GetClusterClientConfigWithOptions(ctx, podListOptions.Config)
+	if err != nil {
+		GetLogInstance().Info("Unable to get ClusterClientConfig")
+		return nil, listOptions, err
+	}
 	if config == nil {
 		GetLogInstance().Info("Unable to get config")
-		err = fmt.Errorf("nil config")
-		return []keylimev1alpha1.PodInformation{}, err
+		err = wrapError(ErrConfigUnavailable, errors.New("nil config"))
+		return nil, listOptions, err
 	}
 
 	clientset, err := GetClientsetFromClusterConfig(config)
 	if err != nil {
 		GetLogInstance().Info("Unable to get ClientSetFromClusterConfig")
-		return []keylimev1alpha1.PodInformation{}, err
+		return nil, listOptions, err
 	}
 	if clientset == nil {
 		GetLogInstance().Info("Clientset is null")
-		err = fmt.Errorf("nil clientset")
-		return []keylimev1alpha1.PodInformation{}, err
+		err = wrapError(ErrClientsetCreation, errors.New("nil clientset"))
+		return nil, listOptions, err
 	}
+	return clientset.CoreV1().Pods(namespace).List, listOptions, nil
+}
+
+// listPodPages retrieves the pods in pages of the size provided, passing each of the pages to the function
+// provided. Context is checked between pages, so that cancelling it stops the list
+func listPodPages(ctx context.Context, list podListFunc, listOptions metav1.ListOptions, pageSize int64,
+	page func([]core_v1.Pod) error) error {
+	listOptions.Limit = pageSize
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		pods, err := list(ctx, listOptions)
+		if err != nil {
+			return checkThrottled(err)
+		}
+		if err = page(pods.Items); err != nil {
+			return err
+		}
+		if pods.Continue == "" {
+			return nil
+		}
+		listOptions.Continue = pods.Continue
+	}
+}
 
-	pods, _ := clientset.CoreV1().Pods(namespace).List(ctx, metav1.ListOptions{})
-	lpods := make([]keylimev1alpha1.PodInformation, len(pods.Items))
-	for i, pod := range pods.Items {
+// PodInformationFromPods returns the name and phase of each of the pods
+func PodInformationFromPods(pods []core_v1.Pod) []keylimev1alpha1.PodInformation {
+	lpods := make([]keylimev1alpha1.PodInformation, len(pods))
+	for i, pod := range pods {
 		GetLogInstance().Info("Execution information (Pod)", "i", i, "Pod", pod.GetName(),
 			"Pod Reason", pod.Status.Reason, "Pod Status", pod.Status)
 		lpods[i].PodName = pod.GetName()
 		lpods[i].PodStatus = string(pod.Status.Phase)
 	}
-	return lpods, nil
+	return lpods
 }
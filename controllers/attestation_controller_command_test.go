@@ -0,0 +1,161 @@
+/*
+Copyright 2023.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	. "github.com/onsi/gomega"
+	core_v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/clientcmd"
+	clientcmdapi "k8s.io/client-go/tools/clientcmd/api"
+)
+
+func TestValidateNamespace(t *testing.T) {
+	g := NewWithT(t)
+	g.Expect(validateNamespace("keylime")).To(Succeed())
+	for _, namespace := range []string{"", "Keylime", strings.Repeat("k", 64)} {
+		err := validateNamespace(namespace)
+		g.Expect(err).To(HaveOccurred(), "namespace %q", namespace)
+		g.Expect(err.Error()).To(HavePrefix("invalid namespace %q", namespace))
+	}
+}
+
+func TestPodListAndExecRejectInvalidNamespace(t *testing.T) {
+	g := NewWithT(t)
+	useFakeConfig(t)
+	_, err := PodListStructured(context.Background(), "Keylime")
+	g.Expect(err).To(MatchError(ContainSubstring("invalid namespace")))
+	_, _, _, err = PodExec(context.Background(), "", "agent", "agent", []string{"true"}, nil)
+	g.Expect(err).To(MatchError(ContainSubstring("invalid namespace")))
+	_, err = PodIsReady(context.Background(), strings.Repeat("k", 64), "agent")
+	g.Expect(err).To(MatchError(ContainSubstring("invalid namespace")))
+}
+
+func TestPodListAllNamespacesRejectsInvalidSelector(t *testing.T) {
+	g := NewWithT(t)
+	useFakeConfig(t)
+	_, err := PodListAllNamespaces(context.Background(), "app in (agent")
+	g.Expect(err).To(MatchError(ContainSubstring("invalid label selector")))
+}
+
+// pagedPodList returns a list function serving the pods provided in pages, recording the page sizes requested
+func pagedPodList(pods []core_v1.Pod, limits *[]int64) podListFunc {
+	return func(_ context.Context, options metav1.ListOptions) (*core_v1.PodList, error) {
+		*limits = append(*limits, options.Limit)
+		start := 0
+		if options.Continue != "" {
+			start, _ = strconv.Atoi(options.Continue)
+		}
+		end := start + int(options.Limit)
+		list := &core_v1.PodList{}
+		if end < len(pods) {
+			list.Continue = strconv.Itoa(end)
+		} else {
+			end = len(pods)
+		}
+		list.Items = pods[start:end]
+		return list, nil
+	}
+}
+
+func TestListPodPages(t *testing.T) {
+	g := NewWithT(t)
+	var pods []core_v1.Pod
+	for i := 0; i < 7; i++ {
+		pods = append(pods, *testPod("keylime", fmt.Sprintf("agent-%d", i), true))
+	}
+	var limits []int64
+	var pages [][]core_v1.Pod
+	err := listPodPages(context.Background(), pagedPodList(pods, &limits), metav1.ListOptions{}, 3,
+		func(page []core_v1.Pod) error {
+			pages = append(pages, page)
+			return nil
+		})
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(limits).To(Equal([]int64{3, 3, 3}))
+	g.Expect(pages).To(HaveLen(3))
+	g.Expect(pages[2]).To(HaveLen(1))
+	g.Expect(pages[2][0].Name).To(Equal("agent-6"))
+}
+
+func TestListPodPagesStopsOnCancel(t *testing.T) {
+	g := NewWithT(t)
+	var pods []core_v1.Pod
+	for i := 0; i < 7; i++ {
+		pods = append(pods, *testPod("keylime", fmt.Sprintf("agent-%d", i), true))
+	}
+	var limits []int64
+	ctx, cancel := context.WithCancel(context.Background())
+	err := listPodPages(ctx, pagedPodList(pods, &limits), metav1.ListOptions{}, 3, func([]core_v1.Pod) error {
+		cancel()
+		return nil
+	})
+	g.Expect(err).To(MatchError(context.Canceled))
+	g.Expect(limits).To(HaveLen(1))
+}
+
+func TestPodListChanReportsErrors(t *testing.T) {
+	g := NewWithT(t)
+	useFakeConfig(t)
+	pods, errs := PodListChan(context.Background(), "Keylime")
+	g.Eventually(pods).Should(BeClosed())
+	g.Expect(<-errs).To(MatchError(ContainSubstring("invalid namespace")))
+}
+
+// testKubeconfig writes a kubeconfig with a context per cluster server provided, returning its path
+func testKubeconfig(t *testing.T, servers map[string]string) string {
+	config := clientcmdapi.NewConfig()
+	for name, server := range servers {
+		config.Clusters[name] = &clientcmdapi.Cluster{Server: server}
+		config.AuthInfos[name] = &clientcmdapi.AuthInfo{Token: "token"}
+		config.Contexts[name] = &clientcmdapi.Context{Cluster: name, AuthInfo: name}
+		config.CurrentContext = name
+	}
+	path := filepath.Join(t.TempDir(), "kubeconfig")
+	if err := clientcmd.WriteToFile(*config, path); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestBuildKubeConfigSelectsContext(t *testing.T) {
+	g := NewWithT(t)
+	SetKubeconfigPath(testKubeconfig(t, map[string]string{"dev": "https://dev:6443", "prod": "https://prod:6443"}))
+	t.Cleanup(func() { SetKubeconfigPath("") })
+
+	t.Setenv(kubeContextEnvVar, "dev")
+	config, _, err := buildKubeConfig()
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(config.Host).To(Equal("https://dev:6443"))
+
+	SetKubeContext("prod")
+	t.Cleanup(func() { SetKubeContext("") })
+	config, _, err = buildKubeConfig()
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(config.Host).To(Equal("https://prod:6443"))
+
+	SetKubeContext("staging")
+	_, _, err = buildKubeConfig()
+	g.Expect(err).To(MatchError(`context "staging" not found in kubeconfig, available contexts: dev, prod`))
+}
@@ -0,0 +1,132 @@
+/*
+Copyright 2023.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	keylimev1alpha1 "github.com/sarroutbi/osdk-attestation-operator/api/v1alpha1"
+	core_v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+// commandSecretCacheTTL is the time a command read from a Secret is used before reading the Secret again,
+// so that periodic attestations do not read it on each attestation
+const commandSecretCacheTTL = 30 * time.Second
+
+// commandSecretEntry is a command read from a Secret, valid until its expiration
+type commandSecretEntry struct {
+	command []string
+	expires time.Time
+}
+
+// commandSecretCache caches the commands read from Secrets, keyed by Secret and key
+type commandSecretCache struct {
+	lock    sync.Mutex
+	entries map[string]commandSecretEntry
+}
+
+// get returns the command cached for the key provided, if not expired
+func (c *commandSecretCache) get(key string, now time.Time) ([]string, bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	entry, found := c.entries[key]
+	if !found || now.After(entry.expires) {
+		return nil, false
+	}
+	return entry.command, true
+}
+
+// set caches the command provided for the key provided, until the expiration provided
+func (c *commandSecretCache) set(key string, command []string, expires time.Time) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.entries == nil {
+		c.entries = map[string]commandSecretEntry{}
+	}
+	c.entries[key] = commandSecretEntry{command: command, expires: expires}
+}
+
+// ParseCommand parses a command (and its arguments) either as a JSON array of strings or, otherwise,
+// as one argument per line. Empty lines are ignored
+// :param string data: command to parse
+//
+// :return:
+//
+//	[]string: command parsed
+//	error: If command is empty or malformed, otherwise `nil`
+func ParseCommand(data string) ([]string, error) {
+	trimmed := strings.TrimSpace(data)
+	var command []string
+	if strings.HasPrefix(trimmed, "[") {
+		if err := json.Unmarshal([]byte(trimmed), &command); err != nil {
+			return nil, fmt.Errorf("malformed JSON command: %w", err)
+		}
+	} else {
+		for _, line := range strings.Split(trimmed, "\n") {
+			if line = strings.TrimSuffix(line, "\r"); strings.TrimSpace(line) != "" {
+				command = append(command, line)
+			}
+		}
+	}
+	if len(command) == 0 || command[0] == "" {
+		return nil, errors.New("command is empty")
+	}
+	return command, nil
+}
+
+// attestationCommand returns the attestation command of the attestation, read from the Secret referenced by
+// CommandSecretRef, if any, or from podattestation.command otherwise. Missing Secrets or keys, and malformed
+// commands, are reported as ErrInvalidSpec, as they are not fixed by retrying
+func (r *AttestationReconciler) attestationCommand(ctx context.Context,
+	attestation *keylimev1alpha1.Attestation) ([]string, error) {
+	ref := attestation.Spec.CommandSecretRef
+	if ref == nil {
+		return attestation.Spec.PodAttestationInfo.Command, nil
+	}
+	cacheKey := attestation.Namespace + "/" + ref.Name + "/" + ref.Key
+	if command, found := r.commandCache.get(cacheKey, time.Now()); found {
+		return command, nil
+	}
+	// Secret is read through the API reader, so that Secrets are not cached by the manager
+	secret := &core_v1.Secret{}
+	if err := r.apiReader().Get(ctx, types.NamespacedName{Namespace: attestation.Namespace, Name: ref.Name}, secret); err != nil {
+		if apierrors.IsNotFound(err) {
+			return nil, fmt.Errorf("%w: command secret %s/%s not found", ErrInvalidSpec, attestation.Namespace, ref.Name)
+		}
+		return nil, fmt.Errorf("unable to get command secret %s/%s: %w", attestation.Namespace, ref.Name, err)
+	}
+	data, found := secret.Data[ref.Key]
+	if !found {
+		return nil, fmt.Errorf("%w: key %s not found in command secret %s/%s", ErrInvalidSpec, ref.Key,
+			attestation.Namespace, ref.Name)
+	}
+	command, err := ParseCommand(string(data))
+	if err != nil {
+		return nil, fmt.Errorf("%w: key %s of command secret %s/%s: %v", ErrInvalidSpec, ref.Key,
+			attestation.Namespace, ref.Name, err)
+	}
+	r.commandCache.set(cacheKey, command, time.Now().Add(commandSecretCacheTTL))
+	return command, nil
+}
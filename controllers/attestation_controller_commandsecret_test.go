@@ -0,0 +1,117 @@
+/*
+Copyright 2023.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	. "github.com/onsi/gomega"
+	keylimev1alpha1 "github.com/sarroutbi/osdk-attestation-operator/api/v1alpha1"
+	core_v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestParseCommand(t *testing.T) {
+	tests := []struct {
+		name     string
+		data     string
+		expected []string
+	}{
+		{name: "json array", data: `["tpm2_quote", "--pcr-list", "sha256:0,1"]`,
+			expected: []string{"tpm2_quote", "--pcr-list", "sha256:0,1"}},
+		{name: "json array with spaces", data: "\n [\"/bin/sh\", \"-c\", \"echo a b\"]\n",
+			expected: []string{"/bin/sh", "-c", "echo a b"}},
+		{name: "newline separated", data: "tpm2_quote\n--pcr-list\r\nsha256:0,1\n\n",
+			expected: []string{"tpm2_quote", "--pcr-list", "sha256:0,1"}},
+		{name: "single line", data: "tpm2_quote", expected: []string{"tpm2_quote"}},
+		{name: "empty", data: " \n"},
+		{name: "empty json array", data: "[]"},
+		{name: "malformed json", data: `["tpm2_quote", 1]`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := NewWithT(t)
+			command, err := ParseCommand(tt.data)
+			if tt.expected == nil {
+				g.Expect(err).To(HaveOccurred())
+				return
+			}
+			g.Expect(err).NotTo(HaveOccurred())
+			g.Expect(command).To(Equal(tt.expected))
+		})
+	}
+}
+
+// commandSecretAttestation returns an attestation whose command is read from the key of the Secret provided
+func commandSecretAttestation(name, key string) *keylimev1alpha1.Attestation {
+	return &keylimev1alpha1.Attestation{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "attestation"},
+		Spec: keylimev1alpha1.AttestationSpec{
+			PodAttestationInfo: &keylimev1alpha1.PodAttestation{PodName: "agent"},
+			CommandSecretRef: &core_v1.SecretKeySelector{
+				LocalObjectReference: core_v1.LocalObjectReference{Name: name}, Key: key},
+		},
+	}
+}
+
+func TestAttestationCommandFromSecret(t *testing.T) {
+	useFakeConfig(t)
+	g := NewWithT(t)
+	secret := &core_v1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "command"},
+		Data: map[string][]byte{
+			"command":   []byte(`["tpm2_quote", "--pcr-list", "sha256:0"]`),
+			"malformed": []byte(`["tpm2_quote"`),
+		},
+	}
+	r := testReconciler(t, secret)
+
+	command, err := r.attestationCommand(context.Background(), commandSecretAttestation("command", "command"))
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(command).To(Equal([]string{"tpm2_quote", "--pcr-list", "sha256:0"}))
+
+	_, err = r.attestationCommand(context.Background(), commandSecretAttestation("command", "malformed"))
+	g.Expect(errors.Is(err, ErrInvalidSpec)).To(BeTrue())
+	g.Expect(err).To(MatchError(ContainSubstring("malformed JSON command")))
+
+	_, err = r.attestationCommand(context.Background(), commandSecretAttestation("command", "missing"))
+	g.Expect(errors.Is(err, ErrInvalidSpec)).To(BeTrue())
+	g.Expect(err).To(MatchError(ContainSubstring("key missing not found in command secret default/command")))
+
+	_, err = r.attestationCommand(context.Background(), commandSecretAttestation("missing", "command"))
+	g.Expect(errors.Is(err, ErrInvalidSpec)).To(BeTrue())
+	g.Expect(err).To(MatchError(ContainSubstring("command secret default/missing not found")))
+
+	// Command is cached, so that the Secret is not read on each attestation
+	g.Expect(r.Delete(context.Background(), secret)).To(Succeed())
+	command, err = r.attestationCommand(context.Background(), commandSecretAttestation("command", "command"))
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(command).To(Equal([]string{"tpm2_quote", "--pcr-list", "sha256:0"}))
+}
+
+func TestAttestationCommandFromSpec(t *testing.T) {
+	g := NewWithT(t)
+	r := &AttestationReconciler{}
+	attestation := &keylimev1alpha1.Attestation{Spec: keylimev1alpha1.AttestationSpec{
+		PodAttestationInfo: &keylimev1alpha1.PodAttestation{PodName: "agent", Command: []string{"tpm2_quote"}},
+	}}
+	command, err := r.attestationCommand(context.Background(), attestation)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(command).To(Equal([]string{"tpm2_quote"}))
+}
@@ -0,0 +1,275 @@
+/*
+Copyright 2023.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+
+	"golang.org/x/net/http/httpproxy"
+	"k8s.io/client-go/rest"
+)
+
+// clientQPSEnvVar allows tuning the maximum queries per second to the API server
+const clientQPSEnvVar = "OPERATOR_CLIENT_QPS"
+
+// clientBurstEnvVar allows tuning the maximum burst of queries to the API server
+const clientBurstEnvVar = "OPERATOR_CLIENT_BURST"
+
+// insecureSkipTLSVerifyEnvVar allows disabling TLS verification of the API server (development only)
+const insecureSkipTLSVerifyEnvVar = "OPERATOR_INSECURE_SKIP_TLS_VERIFY"
+
+// caBundleFileEnvVar allows specifying a PEM bundle file with the CAs used to verify the API server
+const caBundleFileEnvVar = "OPERATOR_CA_BUNDLE_FILE"
+
+// clientCertFileEnvVar allows specifying a PEM certificate file authenticating the operator to the API server
+const clientCertFileEnvVar = "OPERATOR_CLIENT_CERT_FILE"
+
+// clientKeyFileEnvVar allows specifying the PEM key file of the certificate authenticating the operator
+const clientKeyFileEnvVar = "OPERATOR_CLIENT_KEY_FILE"
+
+// apiServerHostEnvVar allows overriding the API server URL of the in-cluster config, e.g. when the
+// kubernetes.default.svc service is not reachable from the network of the operator
+const apiServerHostEnvVar = "OPERATOR_API_SERVER_HOST"
+
+// apiProxyEnvVar allows specifying the proxy used to reach the API server, taking precedence over HTTPS_PROXY
+const apiProxyEnvVar = "OPERATOR_API_PROXY"
+
+// watchNamespacesEnvVar allows restricting the namespaces where attestations are reconciled (comma separated)
+const watchNamespacesEnvVar = "OPERATOR_WATCH_NAMESPACES"
+
+// GetWatchNamespaces returns the namespaces where attestations are reconciled, as configured in the
+// OPERATOR_WATCH_NAMESPACES environment variable. Empty list means attestations are reconciled cluster-wide
+func GetWatchNamespaces() ([]string, error) {
+	var namespaces []string
+	seen := map[string]bool{}
+	for _, namespace := range strings.Split(os.Getenv(watchNamespacesEnvVar), ",") {
+		namespace = strings.TrimSpace(namespace)
+		if namespace == "" || seen[namespace] {
+			continue
+		}
+		if err := validateNamespace(namespace); err != nil {
+			return nil, fmt.Errorf("invalid %s: %w", watchNamespacesEnvVar, err)
+		}
+		seen[namespace] = true
+		namespaces = append(namespaces, namespace)
+	}
+	return namespaces, nil
+}
+
+// ConfigOptions allows customizing the config returned by GetClusterClientConfigWithOptions
+type ConfigOptions struct {
+	// Impersonate allows performing the requests as a different identity, e.g. a service account
+	// of a tenant namespace ("system:serviceaccount:<namespace>:<name>"). Operator service account
+	// requires the "impersonate" verb on the impersonated users, groups or serviceaccounts resources,
+	// and requests are then authorized with the RBAC permissions of the impersonated identity.
+	Impersonate rest.ImpersonationConfig
+}
+
+// Validate checks the options are consistent
+func (o *ConfigOptions) Validate() error {
+	if o.Impersonate.UserName == "" && (len(o.Impersonate.Groups) > 0 || len(o.Impersonate.Extra) > 0) {
+		return fmt.Errorf("invalid impersonation config: user name is required when groups or extra fields are specified")
+	}
+	return nil
+}
+
+// GetClusterClientConfigWithOptions behaves as GetClusterClientConfigWithContext, customizing the
+// returned config with the options provided. The cached config is never modified by the options
+func GetClusterClientConfigWithOptions(ctx context.Context, options ConfigOptions) (*rest.Config, error) {
+	if err := options.Validate(); err != nil {
+		return nil, err
+	}
+	config, err := GetClusterClientConfigWithContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if options.Impersonate.UserName != "" {
+		GetLogInstance().Info("Impersonating user", "User", options.Impersonate.UserName, "Groups", options.Impersonate.Groups)
+		config.Impersonate = options.Impersonate
+	}
+	return config, nil
+}
+
+// applyAPIServerHostEnvironment overrides the host of the in-cluster config provided with OPERATOR_API_SERVER_HOST,
+// if set, keeping the service account token and CA of the config
+func applyAPIServerHostEnvironment(config *rest.Config) error {
+	host := os.Getenv(apiServerHostEnvVar)
+	if host == "" {
+		return nil
+	}
+	hostURL, err := url.Parse(host)
+	if err != nil {
+		return fmt.Errorf("invalid %s value: %v", apiServerHostEnvVar, err)
+	}
+	if (hostURL.Scheme != "http" && hostURL.Scheme != "https") || hostURL.Host == "" || hostURL.User != nil {
+		return fmt.Errorf("invalid %s value %q: must be an http or https URL, e.g. https://api.example.com:6443",
+			apiServerHostEnvVar, hostURL.Redacted())
+	}
+	GetLogInstance().Info("Overriding in cluster API server host", "Original Host", config.Host, "Host", hostURL.String())
+	config.Host = hostURL.String()
+	return nil
+}
+
+// applyConfigEnvironment tunes the config according to the OPERATOR_* environment variables.
+// Values not set in the environment keep the config untouched
+func applyConfigEnvironment(config *rest.Config) error {
+	if qps := os.Getenv(clientQPSEnvVar); qps != "" {
+		value, err := strconv.ParseFloat(qps, 32)
+		if err != nil || value <= 0 {
+			return fmt.Errorf("invalid %s value %q: must be a positive number", clientQPSEnvVar, qps)
+		}
+		config.QPS = float32(value)
+	}
+	if burst := os.Getenv(clientBurstEnvVar); burst != "" {
+		value, err := strconv.Atoi(burst)
+		if err != nil || value <= 0 {
+			return fmt.Errorf("invalid %s value %q: must be a positive integer", clientBurstEnvVar, burst)
+		}
+		config.Burst = value
+	}
+	if caBundleFile := os.Getenv(caBundleFileEnvVar); caBundleFile != "" {
+		caData, err := loadCABundle(caBundleFile)
+		if err != nil {
+			return fmt.Errorf("invalid %s: %w", caBundleFileEnvVar, err)
+		}
+		GetLogInstance().Info("Using CA bundle to verify the API server", "File", caBundleFile)
+		// CA file takes precedence over CA data, so it is cleared
+		config.TLSClientConfig.CAData = caData
+		config.TLSClientConfig.CAFile = ""
+	}
+	if err := applyClientCertEnvironment(config); err != nil {
+		return err
+	}
+	if insecure := os.Getenv(insecureSkipTLSVerifyEnvVar); insecure != "" {
+		value, err := strconv.ParseBool(insecure)
+		if err != nil {
+			return fmt.Errorf("invalid %s value %q: must be a boolean", insecureSkipTLSVerifyEnvVar, insecure)
+		}
+		if value {
+			GetLogInstance().Info("TLS verification of the API server disabled, "+
+				"this is insecure and must never be used in production", "Environment variable", insecureSkipTLSVerifyEnvVar)
+			// CA can not be specified together with insecure mode
+			config.TLSClientConfig.Insecure = true
+			config.TLSClientConfig.CAData = nil
+			config.TLSClientConfig.CAFile = ""
+		}
+	}
+	if err := applyProxyEnvironment(config); err != nil {
+		return err
+	}
+	GetLogInstance().Info("Client config rate limits", "QPS", effectiveQPS(config), "Burst", effectiveBurst(config))
+	return nil
+}
+
+// loadCABundle reads a PEM bundle file, checking it contains valid certificates
+func loadCABundle(path string) ([]byte, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read CA bundle: %w", err)
+	}
+	if !x509.NewCertPool().AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("no valid PEM certificates found in CA bundle %s", path)
+	}
+	return data, nil
+}
+
+// applyClientCertEnvironment configures the client certificate authenticating the operator, if both
+// OPERATOR_CLIENT_CERT_FILE and OPERATOR_CLIENT_KEY_FILE are set, checking they contain a valid keypair
+func applyClientCertEnvironment(config *rest.Config) error {
+	certFile, keyFile := os.Getenv(clientCertFileEnvVar), os.Getenv(clientKeyFileEnvVar)
+	if certFile == "" && keyFile == "" {
+		return nil
+	}
+	if certFile == "" || keyFile == "" {
+		return fmt.Errorf("%s and %s must be set together", clientCertFileEnvVar, clientKeyFileEnvVar)
+	}
+	if _, err := tls.LoadX509KeyPair(certFile, keyFile); err != nil {
+		return fmt.Errorf("invalid %s and %s: %w", clientCertFileEnvVar, clientKeyFileEnvVar, err)
+	}
+	GetLogInstance().Info("Using client certificate to authenticate to the API server", "Certificate File", certFile)
+	// Certificate data takes precedence over certificate files, so it is cleared
+	config.TLSClientConfig.CertFile = certFile
+	config.TLSClientConfig.KeyFile = keyFile
+	config.TLSClientConfig.CertData = nil
+	config.TLSClientConfig.KeyData = nil
+	return nil
+}
+
+// effectiveQPS returns the QPS client-go uses for the config, which defaults to rest.DefaultQPS when not set
+func effectiveQPS(config *rest.Config) float32 {
+	if config.QPS == 0 {
+		return rest.DefaultQPS
+	}
+	return config.QPS
+}
+
+// effectiveBurst returns the Burst client-go uses for the config, which defaults to rest.DefaultBurst when not set
+func effectiveBurst(config *rest.Config) int {
+	if config.Burst == 0 {
+		return rest.DefaultBurst
+	}
+	return config.Burst
+}
+
+// applyProxyEnvironment configures the proxy used to reach the API server from OPERATOR_API_PROXY
+// or, if not set, from HTTPS_PROXY. Hosts listed in NO_PROXY are reached directly, so that in cluster
+// access to the API server can still skip the proxy
+func applyProxyEnvironment(config *rest.Config) error {
+	source := apiProxyEnvVar
+	proxy := os.Getenv(apiProxyEnvVar)
+	if proxy == "" {
+		source = "HTTPS_PROXY"
+		proxy = getEnvAnyCase("HTTPS_PROXY")
+	}
+	if proxy == "" {
+		return nil
+	}
+	proxyURL, err := url.Parse(proxy)
+	if err != nil {
+		return fmt.Errorf("invalid %s value: %v", source, err)
+	}
+	if (proxyURL.Scheme != "http" && proxyURL.Scheme != "https" && proxyURL.Scheme != "socks5") || proxyURL.Host == "" {
+		return fmt.Errorf("invalid %s value %q: must be an http, https or socks5 URL", source, proxyURL.Redacted())
+	}
+	noProxy := getEnvAnyCase("NO_PROXY")
+	GetLogInstance().Info("Using proxy to reach the API server", "Source", source, "Proxy", proxyURL.Redacted(), "No Proxy", noProxy)
+	proxyFunc := (&httpproxy.Config{
+		HTTPProxy:  proxyURL.String(),
+		HTTPSProxy: proxyURL.String(),
+		NoProxy:    noProxy,
+	}).ProxyFunc()
+	config.Proxy = func(request *http.Request) (*url.URL, error) {
+		return proxyFunc(request.URL)
+	}
+	return nil
+}
+
+// getEnvAnyCase returns the value of the environment variable, looking it up in lower case if not set in upper case
+func getEnvAnyCase(name string) string {
+	if value := os.Getenv(name); value != "" {
+		return value
+	}
+	return os.Getenv(strings.ToLower(name))
+}
@@ -0,0 +1,126 @@
+/*
+Copyright 2023.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// DefaultExecDrainTimeout is the time in-flight execs are allowed to complete on shutdown
+const DefaultExecDrainTimeout = 30 * time.Second
+
+// execsInFlight tracks the execs in flight, so that they can be drained on shutdown
+var (
+	execsInFlight = &sync.WaitGroup{}
+	execsRunning  atomic.Int32
+	execsDraining atomic.Bool
+	// drainStarted holds the time BeginExecDrain was called, as Unix nanoseconds, zero if not called yet
+	drainStarted atomic.Int64
+)
+
+// forceStopCtx is cancelled when the drain timeout expires, stopping the execs still in flight
+var forceStopCtx, forceStop = context.WithCancel(context.Background())
+
+// trackExec registers an exec in flight, returning the context the exec must use and the function to call
+// when the exec completes. Exec context keeps the deadline of the context provided, and it is cancelled
+// with it, except while draining: then, execs are only stopped when the drain timeout expires, so that
+// shutdown does not leave partial results
+func trackExec(ctx context.Context) (context.Context, func()) {
+	inFlight := execsInFlight
+	inFlight.Add(1)
+	execsRunning.Add(1)
+	execCtx, cancel := context.WithCancel(forceStopCtx)
+	if deadline, ok := ctx.Deadline(); ok {
+		var cancelDeadline context.CancelFunc
+		execCtx, cancelDeadline = context.WithDeadline(execCtx, deadline)
+		cancelCtx := cancel
+		cancel = func() {
+			cancelDeadline()
+			cancelCtx()
+		}
+	}
+	go func() {
+		select {
+		case <-ctx.Done():
+			if !execsDraining.Load() {
+				cancel()
+			}
+		case <-execCtx.Done():
+		}
+	}()
+	return execCtx, func() {
+		cancel()
+		execsRunning.Add(-1)
+		inFlight.Done()
+	}
+}
+
+// BeginExecDrain makes in-flight execs ignore the cancellation of their context, so that they can complete
+// on shutdown. It must be called before cancelling the context of the manager
+func BeginExecDrain() {
+	drainStarted.CompareAndSwap(0, time.Now().UnixNano())
+	execsDraining.Store(true)
+}
+
+// RemainingDrainTimeout returns the part of the drain timeout provided not elapsed since BeginExecDrain was
+// called, so that the graceful shutdown of the manager and DrainExecs share a single deadline. The full timeout
+// is returned if the drain has not begun, and zero once the timeout has elapsed
+func RemainingDrainTimeout(timeout time.Duration) time.Duration {
+	started := drainStarted.Load()
+	if started == 0 {
+		return timeout
+	}
+	remaining := timeout - time.Since(time.Unix(0, started))
+	if remaining < 0 {
+		return 0
+	}
+	return remaining
+}
+
+// DrainExecs waits for the execs in flight to complete, up to the timeout provided. Execs still running
+// after the timeout are stopped
+// :param time.Duration timeout: maximum time to wait for the execs in flight
+//
+// :return:
+//
+//	int: number of execs still running when the timeout expired
+func DrainExecs(timeout time.Duration) int {
+	running := int(execsRunning.Load())
+	if running == 0 {
+		return 0
+	}
+	GetLogInstance().Info("Draining execs in flight", "Running", running, "Timeout", timeout)
+	done := make(chan struct{})
+	inFlight := execsInFlight
+	go func() {
+		inFlight.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		GetLogInstance().Info("All execs in flight completed")
+		return 0
+	case <-time.After(timeout):
+	}
+	running = int(execsRunning.Load())
+	GetLogInstance().Info("Exec drain timed out, stopping execs still running", "Running", running)
+	forceStop()
+	return running
+}
@@ -0,0 +1,113 @@
+/*
+Copyright 2023.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-logr/logr"
+	. "github.com/onsi/gomega"
+)
+
+// useExecDrain restores the exec drain state when the test finishes
+func useExecDrain(t *testing.T) {
+	SetLogInstance(logr.Discard())
+	t.Cleanup(func() {
+		execsDraining.Store(false)
+		drainStarted.Store(0)
+		execsInFlight = &sync.WaitGroup{}
+		forceStopCtx, forceStop = context.WithCancel(context.Background())
+	})
+}
+
+func TestTrackExecCancelledWithContext(t *testing.T) {
+	useExecDrain(t)
+	g := NewWithT(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	execCtx, done := trackExec(ctx)
+	defer done()
+
+	cancel()
+	g.Eventually(execCtx.Done()).Should(BeClosed())
+}
+
+func TestTrackExecKeepsDeadline(t *testing.T) {
+	useExecDrain(t)
+	g := NewWithT(t)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	execCtx, done := trackExec(ctx)
+	defer done()
+
+	deadline, ok := ctx.Deadline()
+	g.Expect(ok).To(BeTrue())
+	execDeadline, ok := execCtx.Deadline()
+	g.Expect(ok).To(BeTrue())
+	g.Expect(execDeadline).To(Equal(deadline))
+}
+
+func TestDrainExecsWaitsForExecsInFlight(t *testing.T) {
+	useExecDrain(t)
+	g := NewWithT(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	execCtx, done := trackExec(ctx)
+
+	BeginExecDrain()
+	cancel()
+	g.Consistently(execCtx.Done(), 50*time.Millisecond).ShouldNot(BeClosed())
+
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		done()
+	}()
+	g.Expect(DrainExecs(time.Minute)).To(BeZero())
+}
+
+func TestDrainExecsStopsExecsOnTimeout(t *testing.T) {
+	useExecDrain(t)
+	g := NewWithT(t)
+	execCtx, done := trackExec(context.Background())
+	defer done()
+
+	BeginExecDrain()
+	g.Expect(DrainExecs(50 * time.Millisecond)).To(Equal(1))
+	g.Eventually(execCtx.Done()).Should(BeClosed())
+}
+
+func TestRemainingDrainTimeout(t *testing.T) {
+	useExecDrain(t)
+	g := NewWithT(t)
+	g.Expect(RemainingDrainTimeout(time.Minute)).To(Equal(time.Minute))
+
+	BeginExecDrain()
+	g.Expect(RemainingDrainTimeout(time.Minute)).To(BeNumerically("<", time.Minute))
+	g.Expect(RemainingDrainTimeout(time.Minute)).To(BeNumerically(">", 50*time.Second))
+	// Deadline is counted from the first call
+	drainStarted.Store(time.Now().Add(-2 * time.Minute).UnixNano())
+	BeginExecDrain()
+	g.Expect(RemainingDrainTimeout(time.Minute)).To(BeZero())
+}
+
+func TestDrainExecsNoExecsInFlight(t *testing.T) {
+	useExecDrain(t)
+	g := NewWithT(t)
+	BeginExecDrain()
+	g.Expect(DrainExecs(0)).To(BeZero())
+}
@@ -0,0 +1,111 @@
+/*
+Copyright 2023.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// DefaultExecShell is the shell, with the flag making it execute a script, used by the features wrapping the
+// commands executed in pods, such as environment injection
+const DefaultExecShell = "/bin/sh -c"
+
+// NoExecShell disables the features requiring a shell, for containers without shell (e.g. distroless images).
+// Commands are then always passed verbatim to exec
+const NoExecShell = "none"
+
+// ErrShellRequired is returned when a feature requiring a shell is used with NoExecShell
+var ErrShellRequired = errors.New("shell required")
+
+// envNameRegexp matches the environment variable names that can be exported by a POSIX shell
+var envNameRegexp = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// CommandWithEnv wraps a command so that it is executed with the environment variables provided, as
+// exec subresource does not allow setting the environment of the command. The command is executed
+// through /bin/sh, which must be available in the container. Values are single quoted, and command
+// and its arguments are passed as positional parameters of the shell, so they are never interpreted
+// :param map[string]string env: environment variables to set
+// :param []string command: command (and its arguments) to execute
+//
+// :return:
+//
+//	[]string: Command to execute, the original one if no environment variables are provided
+//	   error: If any environment variable name is invalid, otherwise `nil`
+func CommandWithEnv(env map[string]string, command []string) ([]string, error) {
+	return CommandWithEnvShell(env, command, DefaultExecShell)
+}
+
+// CommandWithEnvShell behaves as CommandWithEnv, executing the command through the shell provided
+// (e.g. "busybox sh -c"), which must execute the script following it, as "/bin/sh -c" does.
+// Empty shell means DefaultExecShell, and ErrShellRequired (wrapped) is returned for NoExecShell
+func CommandWithEnvShell(env map[string]string, command []string, shell string) ([]string, error) {
+	if len(env) == 0 {
+		return command, nil
+	}
+	if len(command) == 0 {
+		return nil, fmt.Errorf("empty command")
+	}
+	shellCommand, err := parseExecShell(shell)
+	if err != nil {
+		return nil, err
+	}
+	if shellCommand == nil {
+		return nil, fmt.Errorf("%w: environment variables can not be injected without shell", ErrShellRequired)
+	}
+	names := make([]string, 0, len(env))
+	for name := range env {
+		if !envNameRegexp.MatchString(name) {
+			return nil, fmt.Errorf("invalid environment variable name %q", name)
+		}
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var script strings.Builder
+	for _, name := range names {
+		fmt.Fprintf(&script, "export %s=%s; ", name, shellQuote(env[name]))
+	}
+	script.WriteString(`exec "$@"`)
+	// First argument after the script is $0, the name of the shell
+	wrapped := append(shellCommand, script.String(), shellCommand[0])
+	return append(wrapped, command...), nil
+}
+
+// parseExecShell splits the shell provided into the shell command and its arguments, returning nil
+// for NoExecShell. Empty shell means DefaultExecShell
+func parseExecShell(shell string) ([]string, error) {
+	if shell == "" {
+		shell = DefaultExecShell
+	}
+	if shell == NoExecShell {
+		return nil, nil
+	}
+	shellCommand := strings.Fields(shell)
+	if len(shellCommand) < 2 {
+		return nil, fmt.Errorf("invalid exec shell %q: shell and its script flag are required, e.g. %q", shell,
+			DefaultExecShell)
+	}
+	return shellCommand, nil
+}
+
+// shellQuote quotes a value so that it is interpreted literally by a POSIX shell
+func shellQuote(value string) string {
+	return "'" + strings.ReplaceAll(value, "'", `'\''`) + "'"
+}
@@ -0,0 +1,87 @@
+/*
+Copyright 2023.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"testing"
+
+	. "github.com/onsi/gomega"
+)
+
+func TestCommandWithEnv(t *testing.T) {
+	g := NewWithT(t)
+	command := []string{"tpm2_quote", "--pcr-list", "sha256:0,1"}
+
+	wrapped, err := CommandWithEnv(nil, command)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(wrapped).To(Equal(command))
+
+	wrapped, err = CommandWithEnv(map[string]string{
+		"TPM_DEVICE": "/dev/tpm0",
+		"NONCE":      "a'b; rm -rf / $(reboot) `id`",
+	}, command)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(wrapped).To(Equal([]string{
+		"/bin/sh", "-c",
+		`export NONCE='a'\''b; rm -rf / $(reboot) ` + "`id`" + `'; export TPM_DEVICE='/dev/tpm0'; exec "$@"`,
+		"/bin/sh", "tpm2_quote", "--pcr-list", "sha256:0,1",
+	}))
+}
+
+func TestCommandWithEnvRejectsInvalidInput(t *testing.T) {
+	g := NewWithT(t)
+	for _, name := range []string{"", "1TPM", "TPM DEVICE", "TPM;id"} {
+		_, err := CommandWithEnv(map[string]string{name: "value"}, []string{"true"})
+		g.Expect(err).To(MatchError(ContainSubstring("invalid environment variable name")), "name %q", name)
+	}
+	_, err := CommandWithEnv(map[string]string{"TPM_DEVICE": "/dev/tpm0"}, nil)
+	g.Expect(err).To(MatchError("empty command"))
+}
+
+func TestShellQuote(t *testing.T) {
+	g := NewWithT(t)
+	g.Expect(shellQuote("")).To(Equal("''"))
+	g.Expect(shellQuote("value")).To(Equal("'value'"))
+	g.Expect(shellQuote("it's")).To(Equal(`'it'\''s'`))
+}
+
+func TestCommandWithEnvShell(t *testing.T) {
+	g := NewWithT(t)
+	command := []string{"tpm2_quote"}
+	env := map[string]string{"TPM_DEVICE": "/dev/tpm0"}
+
+	wrapped, err := CommandWithEnvShell(env, command, "busybox sh -c")
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(wrapped).To(Equal([]string{"busybox", "sh", "-c", `export TPM_DEVICE='/dev/tpm0'; exec "$@"`, "busybox",
+		"tpm2_quote"}))
+
+	_, err = CommandWithEnvShell(env, command, "/bin/sh")
+	g.Expect(err).To(MatchError(ContainSubstring("invalid exec shell")))
+}
+
+func TestCommandWithEnvNoShell(t *testing.T) {
+	g := NewWithT(t)
+	command := []string{"tpm2_quote", "--pcr-list", "sha256:0,1"}
+
+	// Commands are passed verbatim
+	wrapped, err := CommandWithEnvShell(nil, command, NoExecShell)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(wrapped).To(Equal(command))
+
+	_, err = CommandWithEnvShell(map[string]string{"TPM_DEVICE": "/dev/tpm0"}, command, NoExecShell)
+	g.Expect(err).To(MatchError(ErrShellRequired))
+}
@@ -0,0 +1,129 @@
+/*
+Copyright 2023.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+)
+
+var (
+	// ErrConfigUnavailable is returned when the config to access the API server can not be built
+	ErrConfigUnavailable = errors.New("cluster config unavailable")
+	// ErrInvalidConfig is returned when the OPERATOR_* environment variables customizing the config are not valid,
+	// e.g. a missing CA bundle, which retrying can not fix
+	ErrInvalidConfig = errors.New("invalid cluster config")
+	// ErrClientsetCreation is returned when the clientset can not be created from the config
+	ErrClientsetCreation = errors.New("clientset creation failed")
+	// ErrExecSetup is returned when the execution of a command in a pod can not be set up
+	ErrExecSetup = errors.New("exec setup failed")
+	// ErrExecStream is returned when the streams of a command executed in a pod fail
+	ErrExecStream = errors.New("exec stream failed")
+	// ErrExecTimeout is returned when a command executed in a pod does not complete before the deadline
+	ErrExecTimeout = errors.New("exec timed out")
+	// ErrVerifierUnavailable is returned when the verifier of the quotes can not be reached
+	ErrVerifierUnavailable = errors.New("verifier unavailable")
+	// ErrThrottled is returned when the API server rejects a request with 429 Too Many Requests
+	ErrThrottled = errors.New("throttled by API server")
+)
+
+// KindError reports an error of a particular kind, one of the sentinel errors above, wrapping its cause,
+// so that both the kind and the cause can be checked with errors.Is and errors.As
+type KindError struct {
+	// Kind is the sentinel error matched by errors.Is
+	Kind error
+	// Err is the cause of the error
+	Err error
+}
+
+// Error returns the kind of the error followed by its cause
+func (e *KindError) Error() string {
+	return fmt.Sprintf("%v: %v", e.Kind, e.Err)
+}
+
+// Unwrap returns the cause of the error
+func (e *KindError) Unwrap() error {
+	return e.Err
+}
+
+// Is reports whether the target is the kind of the error
+func (e *KindError) Is(target error) bool {
+	return target == e.Kind
+}
+
+// wrapError wraps the cause provided into an error of the kind provided
+func wrapError(kind, err error) error {
+	return &KindError{Kind: kind, Err: err}
+}
+
+// ThrottledError reports a request throttled by the API server, matched by errors.Is as ErrThrottled, with
+// the delay suggested by the server before retrying (Retry-After header), zero if not suggested
+type ThrottledError struct {
+	// RetryAfter is the delay suggested by the API server before retrying
+	RetryAfter time.Duration
+	// Err is the error returned by the API server
+	Err error
+}
+
+// Error returns ErrThrottled followed by the error of the API server
+func (e *ThrottledError) Error() string {
+	return fmt.Sprintf("%v: %v", ErrThrottled, e.Err)
+}
+
+// Unwrap returns the error of the API server
+func (e *ThrottledError) Unwrap() error {
+	return e.Err
+}
+
+// Is reports whether the target is ErrThrottled
+func (e *ThrottledError) Is(target error) bool {
+	return target == ErrThrottled
+}
+
+// checkThrottled returns a ThrottledError if the error provided is a 429 Too Many Requests response of the
+// API server, and the error provided as it is otherwise
+func checkThrottled(err error) error {
+	if err == nil || !apierrors.IsTooManyRequests(err) {
+		return err
+	}
+	var throttled *ThrottledError
+	if errors.As(err, &throttled) {
+		return err
+	}
+	throttled = &ThrottledError{Err: err}
+	if seconds, ok := apierrors.SuggestsClientDelay(err); ok {
+		throttled.RetryAfter = time.Duration(seconds) * time.Second
+	}
+	return throttled
+}
+
+// ThrottledRetryAfter returns the delay suggested by the API server before retrying a throttled request
+//
+// :return:
+//
+//	time.Duration: Delay suggested, zero if the server did not suggest any
+//	bool: true if the error provided is, or wraps, a ThrottledError
+func ThrottledRetryAfter(err error) (time.Duration, bool) {
+	var throttled *ThrottledError
+	if !errors.As(err, &throttled) {
+		return 0, false
+	}
+	return throttled.RetryAfter, true
+}
@@ -0,0 +1,168 @@
+/*
+Copyright 2023.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/go-logr/logr"
+	. "github.com/onsi/gomega"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/remotecommand"
+)
+
+func TestKindError(t *testing.T) {
+	g := NewWithT(t)
+	cause := fmt.Errorf("connection reset")
+	err := fmt.Errorf("attestation failed: %w", wrapError(ErrExecStream, cause))
+	g.Expect(errors.Is(err, ErrExecStream)).To(BeTrue())
+	g.Expect(errors.Is(err, ErrExecTimeout)).To(BeFalse())
+	g.Expect(errors.Is(err, cause)).To(BeTrue())
+	var kindErr *KindError
+	g.Expect(errors.As(err, &kindErr)).To(BeTrue())
+	g.Expect(kindErr.Kind).To(Equal(ErrExecStream))
+	g.Expect(err.Error()).To(Equal("attestation failed: exec stream failed: connection reset"))
+}
+
+func TestPodListReportsConfigUnavailable(t *testing.T) {
+	g := NewWithT(t)
+	SetLogInstance(logr.Discard())
+	t.Setenv("KUBERNETES_SERVICE_HOST", "")
+	SetKubeconfigPath(filepath.Join(t.TempDir(), "missing"))
+	t.Cleanup(func() { SetKubeconfigPath("") })
+
+	_, err := PodList("keylime", context.Background())
+	g.Expect(errors.Is(err, ErrConfigUnavailable)).To(BeTrue())
+}
+
+func TestClientsetCreationError(t *testing.T) {
+	g := NewWithT(t)
+	// Burst is required when QPS is set
+	_, err := GetClientsetFromClusterConfig(&rest.Config{Host: "http://127.0.0.1:1", QPS: 10, Burst: 0})
+	g.Expect(errors.Is(err, ErrClientsetCreation)).To(BeTrue())
+}
+
+func TestPodExecErrorKinds(t *testing.T) {
+	expired, cancel := context.WithDeadline(context.Background(), time.Now().Add(-time.Second))
+	defer cancel()
+	tests := []struct {
+		name     string
+		ctx      context.Context
+		executor func(*rest.Config, string, *url.URL) (remotecommand.Executor, error)
+		kind     error
+	}{
+		{
+			name: "setup",
+			ctx:  context.Background(),
+			executor: func(*rest.Config, string, *url.URL) (remotecommand.Executor, error) {
+				return nil, fmt.Errorf("unable to upgrade connection")
+			},
+			kind: ErrExecSetup,
+		},
+		{
+			name: "stream",
+			ctx:  context.Background(),
+			executor: func(*rest.Config, string, *url.URL) (remotecommand.Executor, error) {
+				return &fakeExecutor{err: fmt.Errorf("connection reset")}, nil
+			},
+			kind: ErrExecStream,
+		},
+		{
+			name: "timeout",
+			ctx:  expired,
+			executor: func(*rest.Config, string, *url.URL) (remotecommand.Executor, error) {
+				return &fakeExecutor{err: context.DeadlineExceeded}, nil
+			},
+			kind: ErrExecTimeout,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := NewWithT(t)
+			useFakeConfig(t)
+			useExecutor(t, tt.executor)
+			_, _, _, err := PodExec(tt.ctx, "keylime", "agent", "tpm", []string{"tpm2_quote"}, nil)
+			g.Expect(errors.Is(err, tt.kind)).To(BeTrue(), "unexpected error %v", err)
+		})
+	}
+}
+
+func TestThrottledRetryAfterHeader(t *testing.T) {
+	tests := []struct {
+		name        string
+		contentType string
+		body        string
+	}{
+		// Delay is taken from the Retry-After header when the response is not a Status
+		{name: "header", contentType: "text/plain", body: "Too many requests, please try again later."},
+		// API server reports the delay in the details of the Status as well
+		{name: "status details", contentType: "application/json",
+			body: `{"kind":"Status","apiVersion":"v1","status":"Failure","message":"too many requests",` +
+				`"reason":"TooManyRequests","details":{"retryAfterSeconds":7},"code":429}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := NewWithT(t)
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", tt.contentType)
+				w.Header().Set("Retry-After", "7")
+				w.WriteHeader(http.StatusTooManyRequests)
+				_, _ = w.Write([]byte(tt.body))
+			}))
+			defer server.Close()
+			clientset, err := kubernetes.NewForConfig(&rest.Config{Host: server.URL})
+			g.Expect(err).NotTo(HaveOccurred())
+
+			// Retries of the client are disabled, as they would wait for the delay suggested
+			err = clientset.CoreV1().RESTClient().Get().Namespace("keylime").Resource("pods").MaxRetries(0).
+				Do(context.Background()).Error()
+			err = checkThrottled(fmt.Errorf("unable to list pods: %w", err))
+			g.Expect(errors.Is(err, ErrThrottled)).To(BeTrue())
+			retryAfter, throttled := ThrottledRetryAfter(fmt.Errorf("attestation failed: %w", err))
+			g.Expect(throttled).To(BeTrue())
+			g.Expect(retryAfter).To(Equal(7 * time.Second))
+		})
+	}
+}
+
+func TestCheckThrottled(t *testing.T) {
+	g := NewWithT(t)
+	g.Expect(checkThrottled(nil)).To(BeNil())
+	notFound := apierrors.NewNotFound(schema.GroupResource{Resource: "pods"}, "agent")
+	g.Expect(checkThrottled(notFound)).To(Equal(notFound))
+	_, throttled := ThrottledRetryAfter(notFound)
+	g.Expect(throttled).To(BeFalse())
+
+	// Throttling without suggested delay
+	err := checkThrottled(apierrors.NewTooManyRequests("too many requests", 0))
+	retryAfter, throttled := ThrottledRetryAfter(err)
+	g.Expect(throttled).To(BeTrue())
+	g.Expect(retryAfter).To(BeZero())
+	// Already checked errors are not wrapped again
+	g.Expect(checkThrottled(err)).To(BeIdenticalTo(err))
+}
@@ -0,0 +1,493 @@
+/*
+Copyright 2023.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	core_v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/remotecommand"
+	utilexec "k8s.io/client-go/util/exec"
+)
+
+// newExecutor creates the executor used to stream commands into pods. It can be replaced in tests
+var newExecutor = remotecommand.NewSPDYExecutor
+
+// defaultTerminalSize is the terminal size used when a TTY is requested without a terminal size queue
+var defaultTerminalSize = remotecommand.TerminalSize{Width: 80, Height: 24}
+
+// ExecOptions allows customizing the execution of commands in pods
+type ExecOptions struct {
+	// Tty allocates a terminal for the command. As terminals provide a single output stream, errors of
+	// the command are merged into its output: everything is written to stdout, and stderr is never written
+	Tty bool
+	// TerminalSizeQueue provides the terminal size when Tty is set. If not provided, defaultTerminalSize is used
+	TerminalSizeQueue remotecommand.TerminalSizeQueue
+	// Ephemeral targets an ephemeral container of the pod (e.g. a debug container injected to run measurement
+	// tools), which must be specified by name and be running
+	Ephemeral bool
+	// Env sets environment variables of the command, which is then wrapped to be executed through ExecShell
+	Env map[string]string
+	// ExecShell is the shell, with its script flag, used to wrap the command when required (e.g. "busybox sh -c").
+	// DefaultExecShell is used if not set. NoExecShell passes the command verbatim, rejecting options requiring a shell
+	ExecShell string
+	// Stdin controls whether the input of the command is attached, regardless of the reader provided: when false,
+	// no input is attached even if a reader is provided, and when true, input is attached and closed right away
+	// if no reader is provided. If not set, input is attached only if a reader is provided
+	Stdin *bool
+	// ExecRetries is the number of times the command is executed again, after ExecRetryDelay, when its stream
+	// fails or it exits with one of the RetryExitCodes, e.g. when the agent is briefly busy. Other non zero
+	// exit codes are deterministic failures of the command, and so they are not retried
+	ExecRetries int
+	// ExecRetryDelay is the delay between the attempts to execute the command. DefaultExecRetryDelay is used if not set
+	ExecRetryDelay time.Duration
+	// RetryExitCodes are the exit codes of the command retried when ExecRetries is set
+	RetryExitCodes []int
+}
+
+// DefaultExecRetryDelay is the delay between the attempts to execute a command, when retries are requested
+const DefaultExecRetryDelay = 500 * time.Millisecond
+
+// execRetryDelay returns the delay between the attempts to execute a command
+func (o ExecOptions) execRetryDelay() time.Duration {
+	if o.ExecRetryDelay <= 0 {
+		return DefaultExecRetryDelay
+	}
+	return o.ExecRetryDelay
+}
+
+// retryable reports whether the attempt to execute a command with the result provided must be retried, this is,
+// if its stream failed, or it exited with one of the RetryExitCodes
+func (o ExecOptions) retryable(result *ExecResult, err error) bool {
+	if err != nil {
+		return errors.Is(err, ErrExecStream)
+	}
+	for _, code := range o.RetryExitCodes {
+		if result.ExitCode != 0 && result.ExitCode == code {
+			return true
+		}
+	}
+	return false
+}
+
+// execStdin returns the input of the command actually streamed, according to the Stdin option, or nil if
+// input is not attached
+func (o ExecOptions) execStdin(stdin io.Reader) io.Reader {
+	if o.Stdin == nil {
+		return stdin
+	}
+	if !*o.Stdin {
+		return nil
+	}
+	if stdin == nil {
+		// Empty input is closed as soon as streamed, so that commands waiting for the end of input do not hang
+		return strings.NewReader("")
+	}
+	return stdin
+}
+
+// mergeExecOptions merges the optional options provided into a single set of options
+func mergeExecOptions(options []ExecOptions) ExecOptions {
+	merged := ExecOptions{}
+	for _, o := range options {
+		if o.Tty {
+			merged.Tty = true
+		}
+		if o.TerminalSizeQueue != nil {
+			merged.TerminalSizeQueue = o.TerminalSizeQueue
+		}
+		if o.Ephemeral {
+			merged.Ephemeral = true
+		}
+		if len(o.Env) > 0 {
+			merged.Env = o.Env
+		}
+		if o.ExecShell != "" {
+			merged.ExecShell = o.ExecShell
+		}
+		if o.Stdin != nil {
+			merged.Stdin = o.Stdin
+		}
+		if o.ExecRetries > 0 {
+			merged.ExecRetries = o.ExecRetries
+		}
+		if o.ExecRetryDelay > 0 {
+			merged.ExecRetryDelay = o.ExecRetryDelay
+		}
+		if len(o.RetryExitCodes) > 0 {
+			merged.RetryExitCodes = o.RetryExitCodes
+		}
+	}
+	return merged
+}
+
+// fixedTerminalSizeQueue reports a single terminal size, and stops monitoring afterwards
+type fixedTerminalSizeQueue struct {
+	size *remotecommand.TerminalSize
+}
+
+// Next returns the terminal size the first time it is called, and nil afterwards
+func (q *fixedTerminalSizeQueue) Next() *remotecommand.TerminalSize {
+	size := q.size
+	q.size = nil
+	return size
+}
+
+// PodExecRequest builds the request against the exec subresource of a pod.
+// Exec subresource requires POST verb, which must be used as well when creating the executor
+func PodExecRequest(clientset kubernetes.Interface, namespace, podName string, options *core_v1.PodExecOptions) *rest.Request {
+	return clientset.CoreV1().RESTClient().
+		Post().
+		Namespace(namespace).
+		Resource("pods").
+		Name(podName).
+		SubResource("exec").
+		VersionedParams(options, scheme.ParameterCodec)
+}
+
+// BuildExecURL builds the URL of the exec subresource of the pod executing the command in the container, without
+// executing it, so that the request performed by PodExec can be checked. Command is wrapped according to the
+// options, as when executed. Output of the command is attached, and its errors unless TTY is allocated, and
+// input is attached only if requested by the Stdin option
+// :param *rest.Config config: config of the cluster where the pod runs
+// :param string namespace: namespace of the Pod
+// :param string pod: name of the Pod
+// :param string container: name of the container where command is executed
+// :param []string command: command (and its arguments) to execute
+// :param ...ExecOptions options: optional customization of the execution, e.g. TTY allocation
+//
+// :return:
+//
+//	*url.URL: URL of the exec request
+//	   error: If any error has occurred otherwise `nil`
+func BuildExecURL(config *rest.Config, namespace, pod, container string, command []string,
+	options ...ExecOptions) (*url.URL, error) {
+	if config == nil {
+		return nil, wrapError(ErrConfigUnavailable, errors.New("nil config"))
+	}
+	execOptions := mergeExecOptions(options)
+	command, err := CommandWithEnvShell(execOptions.Env, command, execOptions.ExecShell)
+	if err != nil {
+		return nil, err
+	}
+	clientset, err := GetClientsetFromClusterConfig(config)
+	if err != nil {
+		return nil, err
+	}
+	return buildExecURL(clientset, namespace, pod, container, command, execOptions.execStdin(nil) != nil, execOptions), nil
+}
+
+// buildExecURL builds the URL of the exec subresource of the pod executing the command, already wrapped,
+// in the container, attaching the input of the command if requested
+func buildExecURL(clientset kubernetes.Interface, namespace, pod, container string, command []string, stdin bool,
+	execOptions ExecOptions) *url.URL {
+	return PodExecRequest(clientset, namespace, pod, &core_v1.PodExecOptions{
+		Container: container,
+		Command:   command,
+		Stdin:     stdin,
+		Stdout:    true,
+		Stderr:    !execOptions.Tty,
+		TTY:       execOptions.Tty,
+	}).URL()
+}
+
+// ExecResult is the result of a command executed in a container of a pod
+type ExecResult struct {
+	// Stdout contains the output of the command (merged with its errors when TTY is allocated)
+	Stdout string
+	// Stderr contains the errors of the command (always empty when TTY is allocated)
+	Stderr string
+	// ExitCode contains the exit code of the command
+	ExitCode int
+	// Duration contains the time taken by the exec, from its request to the end of its streams
+	Duration time.Duration
+	// PodName contains the name of the pod where the command was executed
+	PodName string
+	// Container contains the name of the container where the command was executed, once resolved
+	Container string
+	// Attempts contains the number of times the command was executed, more than one if retried
+	Attempts int
+}
+
+// PodExecWithResult executes a command in a particular container of a pod, returning its result
+// :param context: bounds the execution, so that a deadline in the context makes the exec time out
+// :param string namespace: namespace of the Pod
+// :param string podName: name of the Pod
+// :param string containerName: name of the container where command is executed. If empty, it is resolved
+// as described in PodExecStream
+// :param []string command: command (and its arguments) to execute
+// :param io.Reader stdin: input of the command, or nil if no input is required
+// :param ...ExecOptions options: optional customization of the execution, e.g. TTY allocation or retries
+//
+// :return:
+//
+//	*ExecResult: Result of the command (of its last attempt, if retried), returned even on error with the
+//	             partial output collected, if any. Non zero exit codes are reported in its ExitCode, not as error
+//	      error: If command could not be executed, otherwise `nil`. On timeout, it includes the partial output, if any
+func PodExecWithResult(ctx context.Context, namespace, podName, containerName string, command []string,
+	stdin io.Reader, options ...ExecOptions) (*ExecResult, error) {
+	execOptions := mergeExecOptions(options)
+	if execOptions.ExecRetries <= 0 {
+		return podExecAttempt(ctx, namespace, podName, containerName, command, stdin, options...)
+	}
+	// Input is replayed on each attempt
+	var input []byte
+	if stdin != nil {
+		var err error
+		if input, err = io.ReadAll(stdin); err != nil {
+			return &ExecResult{PodName: podName, Container: containerName}, fmt.Errorf("unable to read input: %w", err)
+		}
+	}
+	start := time.Now()
+	for attempt := 1; ; attempt++ {
+		var attemptStdin io.Reader
+		if stdin != nil {
+			attemptStdin = bytes.NewReader(input)
+		}
+		result, err := podExecAttempt(ctx, namespace, podName, containerName, command, attemptStdin, options...)
+		result.Attempts, result.Duration = attempt, time.Since(start)
+		if attempt > execOptions.ExecRetries || !execOptions.retryable(result, err) {
+			return result, err
+		}
+		GetLogInstance().Info("Pod exec failed, retrying", "Namespace", namespace, "Pod", podName, "Command", command,
+			"Attempt", attempt, "Retries", execOptions.ExecRetries, "Exit Code", result.ExitCode, "Error", err)
+		select {
+		case <-ctx.Done():
+			return result, err
+		case <-time.After(execOptions.execRetryDelay()):
+		}
+	}
+}
+
+// podExecAttempt executes a command in a particular container of a pod once, returning its result
+func podExecAttempt(ctx context.Context, namespace, podName, containerName string, command []string,
+	stdin io.Reader, options ...ExecOptions) (*ExecResult, error) {
+	var stdout, stderr bytes.Buffer
+	result := &ExecResult{PodName: podName, Container: containerName, Attempts: 1}
+	start := time.Now()
+	container, err := podExecStream(ctx, namespace, podName, containerName, command, stdin, &stdout, &stderr,
+		options...)
+	result.Duration = time.Since(start)
+	if container != "" {
+		result.Container = container
+	}
+	if errors.Is(err, ErrExecTimeout) && stdout.Len()+stderr.Len() > 0 {
+		// Output collected before the timeout helps diagnosing slow commands
+		err = fmt.Errorf("%w, partial stdout: %q, partial stderr: %q", err, stdout.String(), stderr.String())
+	}
+	result.ExitCode, err = exitCodeFromError(err)
+	result.Stdout, result.Stderr = stdout.String(), stderr.String()
+	return result, err
+}
+
+// PodExec executes a command in a particular container of a pod
+// :param context: bounds the execution, so that a deadline in the context makes the exec time out
+// :param string namespace: namespace of the Pod
+// :param string podName: name of the Pod
+// :param string containerName: name of the container where command is executed
+// :param []string command: command (and its arguments) to execute
+// :param io.Reader stdin: input of the command, or nil if no input is required
+// :param ...ExecOptions options: optional customization of the execution, e.g. TTY allocation
+//
+// :return:
+//
+//	string: Output of the command. (STDOUT, merged with STDERR when TTY is allocated)
+//	string: Errors. (STDERR, always empty when TTY is allocated)
+//	   int: Exit code of the command. Non zero exit codes are not reported as error
+//	 error: If command could not be executed, otherwise `nil`. On timeout, it includes the partial output, if any
+func PodExec(ctx context.Context, namespace, podName, containerName string, command []string, stdin io.Reader,
+	options ...ExecOptions) (string, string, int, error) {
+	result, err := PodExecWithResult(ctx, namespace, podName, containerName, command, stdin, options...)
+	return result.Stdout, result.Stderr, result.ExitCode, err
+}
+
+// PodExecWithInput executes a command in a particular container of a pod, sending the input provided
+// to the command (e.g. a nonce). Empty input means the command has no input, and no stdin is attached
+// :param context: bounds the execution, so that a deadline in the context makes the exec time out
+// :param string namespace: namespace of the Pod
+// :param string podName: name of the Pod
+// :param string containerName: name of the container where command is executed
+// :param []string command: command (and its arguments) to execute
+// :param string input: input of the command
+// :param ...ExecOptions options: optional customization of the execution, e.g. TTY allocation
+//
+// :return:
+//
+//	string: Output of the command. (STDOUT, merged with STDERR when TTY is allocated)
+//	string: Errors. (STDERR, always empty when TTY is allocated)
+//	   int: Exit code of the command. Non zero exit codes are not reported as error
+//	 error: If command could not be executed, otherwise `nil`
+func PodExecWithInput(ctx context.Context, namespace, podName, containerName string, command []string, input string,
+	options ...ExecOptions) (string, string, int, error) {
+	result, err := podExecWithInputResult(ctx, namespace, podName, containerName, command, input, options...)
+	return result.Stdout, result.Stderr, result.ExitCode, err
+}
+
+// podExecWithInputResult executes a command sending the input provided, as PodExecWithInput does,
+// returning the result of the command
+func podExecWithInputResult(ctx context.Context, namespace, podName, containerName string, command []string,
+	input string, options ...ExecOptions) (*ExecResult, error) {
+	if input == "" {
+		return PodExecWithResult(ctx, namespace, podName, containerName, command, nil, options...)
+	}
+	stdin := strings.NewReader(input)
+	result, err := PodExecWithResult(ctx, namespace, podName, containerName, command, stdin, options...)
+	if err == nil && stdin.Len() > 0 {
+		GetLogInstance().Info("Input not fully consumed by command", "Namespace", namespace, "Pod", podName,
+			"Command", command, "Unread Bytes", stdin.Len())
+	}
+	return result, err
+}
+
+// exitCodeFromError extracts the exit code of the command from the exec error. Errors not caused
+// by the command exit status are returned as they are
+func exitCodeFromError(err error) (int, error) {
+	if err == nil {
+		return 0, nil
+	}
+	var exitErr utilexec.ExitError
+	if errors.As(err, &exitErr) && exitErr.Exited() {
+		return exitErr.ExitStatus(), nil
+	}
+	return 0, err
+}
+
+// PodExecStream executes a command in a particular container of a pod, writing the output of the command
+// to the writers provided as it is received, so that large outputs are not buffered in memory
+// :param context: bounds the execution, so that a deadline in the context makes the exec time out
+// :param string namespace: namespace of the Pod
+// :param string podName: name of the Pod
+// :param string containerName: name of the container where command is executed. If empty, the container
+// declared in the ContainerAnnotation of the pod, or its single container, is selected, and an error is
+// returned if the pod has several containers
+// :param []string command: command (and its arguments) to execute
+// :param io.Reader stdin: input of the command, or nil if no input is required. Stdin option overrides
+// whether it is attached
+// :param io.Writer stdout: writer for the output of the command (STDOUT)
+// :param io.Writer stderr: writer for the errors of the command (STDERR, never written when TTY is allocated)
+// :param ...ExecOptions options: optional customization of the execution, e.g. TTY allocation
+//
+// :return:
+//
+//	error: If any error has occurred otherwise `nil`. Non zero exit codes are reported as utilexec.ExitError,
+//	       and ErrPodNotFound (wrapped) is returned if the pod does not exist. Other errors are reported as
+//	       KindError of kind ErrConfigUnavailable, ErrClientsetCreation, ErrExecSetup, ErrExecStream or ErrExecTimeout
+func PodExecStream(ctx context.Context, namespace, podName, containerName string, command []string,
+	stdin io.Reader, stdout, stderr io.Writer, options ...ExecOptions) error {
+	_, err := podExecStream(ctx, namespace, podName, containerName, command, stdin, stdout, stderr, options...)
+	return err
+}
+
+// podExecStream executes a command as PodExecStream does, returning the name of the container where it was
+// executed once resolved, or empty if it could not be resolved
+func podExecStream(ctx context.Context, namespace, podName, containerName string, command []string,
+	stdin io.Reader, stdout, stderr io.Writer, options ...ExecOptions) (string, error) {
+	if err := validateNamespace(namespace); err != nil {
+		return "", err
+	}
+	execOptions := mergeExecOptions(options)
+	command, err := CommandWithEnvShell(execOptions.Env, command, execOptions.ExecShell)
+	if err != nil {
+		return "", err
+	}
+	config, err := GetClusterClientConfigWithContext(ctx)
+	if err != nil {
+		GetLogInstance().Info("Unable to get ClusterClientConfig")
+		return "", err
+	}
+	if config == nil {
+		GetLogInstance().Info("Unable to get config")
+		err = wrapError(ErrConfigUnavailable, errors.New("nil config"))
+		return "", err
+	}
+
+	clientset, err := GetClientsetFromClusterConfig(config)
+	if err != nil {
+		GetLogInstance().Info("Unable to get ClientSetFromClusterConfig")
+		return "", err
+	}
+	if clientset == nil {
+		GetLogInstance().Info("Clientset is null")
+		err = wrapError(ErrClientsetCreation, errors.New("nil clientset"))
+		return "", err
+	}
+
+	containerName, err = resolveContainerName(ctx, clientset, namespace, podName, containerName, execOptions.Ephemeral)
+	if err != nil {
+		return "", err
+	}
+	stdin = execOptions.execStdin(stdin)
+	execURL := buildExecURL(clientset, namespace, podName, containerName, command, stdin != nil, execOptions)
+	GetLogInstance().V(1).Info("Pod exec request", "URL", execURL, "Command", command)
+
+	streamOptions := remotecommand.StreamOptions{
+		Stdin:  stdin,
+		Stdout: stdout,
+		Stderr: stderr,
+	}
+	if execOptions.Tty {
+		GetLogInstance().Info("TTY allocated, errors of the command are merged into its output")
+		streamOptions.Stderr = nil
+		streamOptions.Tty = true
+		streamOptions.TerminalSizeQueue = execOptions.TerminalSizeQueue
+		if streamOptions.TerminalSizeQueue == nil {
+			size := defaultTerminalSize
+			streamOptions.TerminalSizeQueue = &fixedTerminalSizeQueue{size: &size}
+		}
+	}
+
+	exec, spdyerr := newExecutor(config, http.MethodPost, execURL)
+	if spdyerr != nil {
+		return containerName, wrapError(ErrExecSetup, fmt.Errorf("error while creating Executor: %w", spdyerr))
+	}
+
+	// Exec is tracked, so that it can complete on shutdown
+	execCtx, done := trackExec(ctx)
+	defer done()
+	start := time.Now()
+	err = exec.StreamWithContext(execCtx, streamOptions)
+	GetLogInstance().V(1).Info("Pod exec streamed", "Namespace", namespace, "Pod", podName,
+		"Duration", time.Since(start).String(), "Error", err)
+	if err != nil {
+		// Context provided is checked as well, as its expiration may cancel the exec context before its own deadline
+		if errors.Is(ctx.Err(), context.DeadlineExceeded) || errors.Is(execCtx.Err(), context.DeadlineExceeded) {
+			return containerName, wrapError(ErrExecTimeout, fmt.Errorf("exec timed out in pod %s/%s: %w", namespace, podName,
+				context.DeadlineExceeded))
+		}
+		if apierrors.IsNotFound(err) {
+			return containerName, fmt.Errorf("%w: %s/%s: %v", ErrPodNotFound, namespace, podName, err)
+		}
+		if apierrors.IsTooManyRequests(err) {
+			return containerName, checkThrottled(err)
+		}
+		return containerName, wrapError(ErrExecStream, fmt.Errorf("error in Stream: %w", err))
+	}
+
+	return containerName, nil
+}
@@ -0,0 +1,85 @@
+/*
+Copyright 2023.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"sync"
+)
+
+// DefaultExecConcurrency is the number of parallel execs used when no valid concurrency is provided
+const DefaultExecConcurrency = 4
+
+// PodExecResult contains the result of executing a command in a pod
+type PodExecResult struct {
+	// Stdout contains the output of the command
+	Stdout string
+	// Stderr contains the errors of the command
+	Stderr string
+	// ExitCode contains the exit code of the command
+	ExitCode int
+	// Err contains the error of the execution, if any. Non zero exit codes are not reported as error
+	Err error
+}
+
+// PodExecAll executes a command in a particular container of each of the pods provided, running
+// at most concurrency execs in parallel. Cancelling the context stops the execs in flight, and
+// the pods whose exec has not started yet get the context error as result
+// :param context: bounds the execution of all the execs
+// :param string namespace: namespace of the Pods
+// :param []string podNames: names of the Pods
+// :param string containerName: name of the container where command is executed
+// :param []string command: command (and its arguments) to execute
+// :param int concurrency: maximum number of parallel execs, DefaultExecConcurrency if not positive
+// :param ...ExecOptions options: optional customization of the execution, e.g. TTY allocation
+//
+// :return:
+//
+//	map[string]PodExecResult: Result of the exec, keyed by pod name
+func PodExecAll(ctx context.Context, namespace string, podNames []string, containerName string, command []string,
+	concurrency int, options ...ExecOptions) map[string]PodExecResult {
+	if concurrency <= 0 {
+		concurrency = DefaultExecConcurrency
+	}
+	results := make(map[string]PodExecResult, len(podNames))
+	var lock sync.Mutex
+	var wg sync.WaitGroup
+	pending := make(chan string)
+	for i := 0; i < concurrency && i < len(podNames); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for podName := range pending {
+				result := PodExecResult{Err: ctx.Err()}
+				if result.Err == nil {
+					result.Stdout, result.Stderr, result.ExitCode, result.Err = PodExec(ctx, namespace, podName, containerName, command,
+						nil, options...)
+				}
+				lock.Lock()
+				results[podName] = result
+				lock.Unlock()
+			}
+		}()
+	}
+	for _, podName := range podNames {
+		pending <- podName
+	}
+	close(pending)
+	wg.Wait()
+	GetLogInstance().Info("Pod execs completed", "Namespace", namespace, "Pods", len(podNames), "Concurrency", concurrency)
+	return results
+}
@@ -0,0 +1,106 @@
+/*
+Copyright 2023.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"path"
+	"sync"
+	"testing"
+	"time"
+
+	. "github.com/onsi/gomega"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/remotecommand"
+)
+
+// concurrencyExecutor writes the name of the pod as output, recording the maximum number of parallel streams
+type concurrencyExecutor struct {
+	lock    *sync.Mutex
+	running *int
+	max     *int
+	pod     string
+}
+
+func (c *concurrencyExecutor) Stream(options remotecommand.StreamOptions) error {
+	return c.StreamWithContext(context.Background(), options)
+}
+
+func (c *concurrencyExecutor) StreamWithContext(ctx context.Context, options remotecommand.StreamOptions) error {
+	c.lock.Lock()
+	*c.running++
+	if *c.running > *c.max {
+		*c.max = *c.running
+	}
+	c.lock.Unlock()
+	defer func() {
+		c.lock.Lock()
+		*c.running--
+		c.lock.Unlock()
+	}()
+	select {
+	case <-time.After(10 * time.Millisecond):
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	_, _ = options.Stdout.Write([]byte(c.pod))
+	return nil
+}
+
+func TestPodExecAllHonorsConcurrency(t *testing.T) {
+	g := NewWithT(t)
+	useFakeConfig(t)
+	var lock sync.Mutex
+	running, max := 0, 0
+	useExecutor(t, func(_ *rest.Config, _ string, u *url.URL) (remotecommand.Executor, error) {
+		// exec URL path is /api/v1/namespaces/<namespace>/pods/<pod>/exec
+		return &concurrencyExecutor{lock: &lock, running: &running, max: &max, pod: path.Base(path.Dir(u.Path))}, nil
+	})
+
+	var pods []string
+	for i := 0; i < 10; i++ {
+		pods = append(pods, fmt.Sprintf("agent-%d", i))
+	}
+	results := PodExecAll(context.Background(), "keylime", pods, "agent", []string{"tpm2_quote"}, 3)
+	g.Expect(results).To(HaveLen(len(pods)))
+	for _, pod := range pods {
+		g.Expect(results[pod].Err).NotTo(HaveOccurred())
+		g.Expect(results[pod].Stdout).To(Equal(pod))
+	}
+	g.Expect(max).To(BeNumerically("<=", 3))
+	g.Expect(max).To(BeNumerically(">", 1))
+}
+
+func TestPodExecAllStopsOnCancel(t *testing.T) {
+	g := NewWithT(t)
+	useFakeConfig(t)
+	var lock sync.Mutex
+	running, max := 0, 0
+	useExecutor(t, func(_ *rest.Config, _ string, u *url.URL) (remotecommand.Executor, error) {
+		return &concurrencyExecutor{lock: &lock, running: &running, max: &max, pod: path.Base(path.Dir(u.Path))}, nil
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	results := PodExecAll(ctx, "keylime", []string{"agent-0", "agent-1"}, "agent", []string{"tpm2_quote"}, 1)
+	g.Expect(results).To(HaveLen(2))
+	for _, result := range results {
+		g.Expect(result.Err).To(MatchError(context.Canceled))
+	}
+}
@@ -0,0 +1,490 @@
+/*
+Copyright 2023.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-logr/logr"
+	. "github.com/onsi/gomega"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/remotecommand"
+	utilexec "k8s.io/client-go/util/exec"
+	"k8s.io/utils/pointer"
+)
+
+// useFakeConfig caches a config pointing to an unreachable API server, so that no cluster is required
+func useFakeConfig(t *testing.T) {
+	SetLogInstance(logr.Discard())
+	ResetConfigCache()
+	configCacheLock.Lock()
+	cachedConfig = &rest.Config{Host: "http://127.0.0.1:1"}
+	configCacheLock.Unlock()
+	t.Cleanup(ResetConfigCache)
+}
+
+// fakeExecutor records the stream options it is invoked with and the input received, writing the configured output
+type fakeExecutor struct {
+	options remotecommand.StreamOptions
+	stdin   string
+	stdout  string
+	stderr  string
+	err     error
+}
+
+func (f *fakeExecutor) Stream(options remotecommand.StreamOptions) error {
+	return f.StreamWithContext(context.Background(), options)
+}
+
+func (f *fakeExecutor) StreamWithContext(_ context.Context, options remotecommand.StreamOptions) error {
+	f.options = options
+	if options.Stdin != nil {
+		input, err := io.ReadAll(options.Stdin)
+		if err != nil {
+			return err
+		}
+		f.stdin = string(input)
+	}
+	if options.Stdout != nil {
+		_, _ = options.Stdout.Write([]byte(f.stdout))
+	}
+	if options.Stderr != nil {
+		_, _ = options.Stderr.Write([]byte(f.stderr))
+	}
+	return f.err
+}
+
+// useFakeExecutor makes exec functions use the fake executor, recording the exec URL requested
+func useFakeExecutor(t *testing.T, executor *fakeExecutor) *url.URL {
+	execURL := &url.URL{}
+	useExecutor(t, func(_ *rest.Config, _ string, u *url.URL) (remotecommand.Executor, error) {
+		*execURL = *u
+		return executor, nil
+	})
+	return execURL
+}
+
+// useExecutor replaces the executor factory for the duration of the test
+func useExecutor(t *testing.T, factory func(*rest.Config, string, *url.URL) (remotecommand.Executor, error)) {
+	original := newExecutor
+	newExecutor = factory
+	t.Cleanup(func() { newExecutor = original })
+}
+
+func TestPodExecReportsExecutorCreationError(t *testing.T) {
+	g := NewWithT(t)
+	useFakeConfig(t)
+	useExecutor(t, func(*rest.Config, string, *url.URL) (remotecommand.Executor, error) {
+		return nil, fmt.Errorf("unable to upgrade connection")
+	})
+
+	_, _, _, err := PodExec(context.Background(), "default", "agent", "agent", []string{"true"}, nil)
+	g.Expect(err).To(HaveOccurred())
+	g.Expect(err.Error()).To(ContainSubstring("error while creating Executor"))
+	g.Expect(err.Error()).To(ContainSubstring("unable to upgrade connection"))
+}
+
+func TestPodExecUsesPostAgainstExecSubresource(t *testing.T) {
+	g := NewWithT(t)
+	useFakeConfig(t)
+	var method string
+	var execURL *url.URL
+	useExecutor(t, func(_ *rest.Config, m string, u *url.URL) (remotecommand.Executor, error) {
+		method, execURL = m, u
+		return nil, fmt.Errorf("stop")
+	})
+
+	_, _, _, _ = PodExec(context.Background(), "keylime", "agent", "tpm", []string{"tpm2_quote"}, nil)
+	g.Expect(method).To(Equal(http.MethodPost))
+	g.Expect(execURL.Path).To(Equal("/api/v1/namespaces/keylime/pods/agent/exec"))
+	g.Expect(execURL.Query().Get("container")).To(Equal("tpm"))
+	g.Expect(execURL.Query()["command"]).To(Equal([]string{"tpm2_quote"}))
+}
+
+func TestPodExecForwardsTty(t *testing.T) {
+	g := NewWithT(t)
+	useFakeConfig(t)
+	executor := &fakeExecutor{stdout: "quote"}
+	execURL := useFakeExecutor(t, executor)
+
+	stdout, stderr, exitCode, err := PodExec(context.Background(), "keylime", "agent", "tpm", []string{"tpm2_quote"}, nil,
+		ExecOptions{Tty: true})
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(exitCode).To(BeZero())
+	g.Expect(stdout).To(Equal("quote"))
+	g.Expect(stderr).To(BeEmpty())
+	g.Expect(executor.options.Tty).To(BeTrue())
+	g.Expect(executor.options.Stderr).To(BeNil())
+	g.Expect(executor.options.TerminalSizeQueue).NotTo(BeNil())
+	g.Expect(*executor.options.TerminalSizeQueue.Next()).To(Equal(defaultTerminalSize))
+	g.Expect(execURL.Query().Get("tty")).To(Equal("true"))
+	g.Expect(execURL.Query().Get("stderr")).To(BeEmpty())
+}
+
+func TestPodExecWithoutTty(t *testing.T) {
+	g := NewWithT(t)
+	useFakeConfig(t)
+	executor := &fakeExecutor{stdout: "quote", stderr: "warning"}
+	execURL := useFakeExecutor(t, executor)
+
+	stdout, stderr, exitCode, err := PodExec(context.Background(), "keylime", "agent", "tpm", []string{"tpm2_quote"}, nil)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(exitCode).To(BeZero())
+	g.Expect(stdout).To(Equal("quote"))
+	g.Expect(stderr).To(Equal("warning"))
+	g.Expect(executor.options.Tty).To(BeFalse())
+	g.Expect(execURL.Query().Get("tty")).To(BeEmpty())
+	g.Expect(execURL.Query().Get("stderr")).To(Equal("true"))
+}
+
+func TestPodExecReportsExitCode(t *testing.T) {
+	for _, code := range []int{0, 1, 137} {
+		t.Run(fmt.Sprintf("exit code %d", code), func(t *testing.T) {
+			g := NewWithT(t)
+			useFakeConfig(t)
+			executor := &fakeExecutor{stderr: "failure"}
+			if code != 0 {
+				executor.err = utilexec.CodeExitError{Err: fmt.Errorf("command terminated with exit code %d", code), Code: code}
+			}
+			useFakeExecutor(t, executor)
+
+			_, stderr, exitCode, err := PodExec(context.Background(), "keylime", "agent", "tpm", []string{"tpm2_quote"}, nil)
+			g.Expect(err).NotTo(HaveOccurred())
+			g.Expect(exitCode).To(Equal(code))
+			g.Expect(stderr).To(Equal("failure"))
+		})
+	}
+}
+
+func TestPodExecReportsStreamError(t *testing.T) {
+	g := NewWithT(t)
+	useFakeConfig(t)
+	useFakeExecutor(t, &fakeExecutor{err: fmt.Errorf("connection reset")})
+
+	_, _, exitCode, err := PodExec(context.Background(), "keylime", "agent", "tpm", []string{"tpm2_quote"}, nil)
+	g.Expect(err).To(MatchError(ContainSubstring("connection reset")))
+	g.Expect(exitCode).To(BeZero())
+}
+
+func TestPodExecWithInput(t *testing.T) {
+	g := NewWithT(t)
+	useFakeConfig(t)
+	executor := &fakeExecutor{stdout: "quote"}
+	execURL := useFakeExecutor(t, executor)
+	nonce := "35d2f1a8\n9c0e4b7d\n"
+
+	stdout, _, _, err := PodExecWithInput(context.Background(), "keylime", "agent", "tpm", []string{"tpm2_quote"}, nonce)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(stdout).To(Equal("quote"))
+	g.Expect(executor.stdin).To(Equal(nonce))
+	g.Expect(execURL.Query().Get("stdin")).To(Equal("true"))
+}
+
+func TestPodExecWithEmptyInput(t *testing.T) {
+	g := NewWithT(t)
+	useFakeConfig(t)
+	executor := &fakeExecutor{}
+	execURL := useFakeExecutor(t, executor)
+
+	_, _, _, err := PodExecWithInput(context.Background(), "keylime", "agent", "tpm", []string{"tpm2_quote"}, "")
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(executor.options.Stdin).To(BeNil())
+	g.Expect(execURL.Query().Get("stdin")).To(BeEmpty())
+}
+
+func TestPodExecReportsPodNotFound(t *testing.T) {
+	g := NewWithT(t)
+	useFakeConfig(t)
+	useFakeExecutor(t, &fakeExecutor{err: apierrors.NewNotFound(schema.GroupResource{Resource: "pods"}, "agent")})
+
+	_, _, _, err := PodExec(context.Background(), "keylime", "agent", "tpm", []string{"tpm2_quote"}, nil)
+	g.Expect(errors.Is(err, ErrPodNotFound)).To(BeTrue())
+	g.Expect(err.Error()).To(ContainSubstring("keylime/agent"))
+}
+
+// blockingExecutor writes partial output and blocks until the context is done
+type blockingExecutor struct {
+	fakeExecutor
+}
+
+func (b *blockingExecutor) StreamWithContext(ctx context.Context, options remotecommand.StreamOptions) error {
+	_, _ = options.Stdout.Write([]byte(b.stdout))
+	<-ctx.Done()
+	return ctx.Err()
+}
+
+func TestPodExecTimeoutReportsPartialOutput(t *testing.T) {
+	g := NewWithT(t)
+	useFakeConfig(t)
+	useExecutor(t, func(*rest.Config, string, *url.URL) (remotecommand.Executor, error) {
+		return &blockingExecutor{fakeExecutor{stdout: "reading PCRs"}}, nil
+	})
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	stdout, _, _, err := PodExec(ctx, "keylime", "agent", "tpm", []string{"tpm2_quote"}, nil)
+	g.Expect(errors.Is(err, ErrExecTimeout)).To(BeTrue())
+	g.Expect(err).To(MatchError(ContainSubstring(`partial stdout: "reading PCRs"`)))
+	g.Expect(stdout).To(Equal("reading PCRs"))
+}
+
+func TestPodExecShell(t *testing.T) {
+	g := NewWithT(t)
+	useFakeConfig(t)
+	execURL := useFakeExecutor(t, &fakeExecutor{})
+	env := map[string]string{"TPM_DEVICE": "/dev/tpm0"}
+
+	_, _, _, err := PodExec(context.Background(), "keylime", "agent", "tpm", []string{"tpm2_quote"}, nil,
+		ExecOptions{Env: env, ExecShell: "busybox sh -c"})
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(execURL.Query()["command"]).To(Equal([]string{"busybox", "sh", "-c",
+		`export TPM_DEVICE='/dev/tpm0'; exec "$@"`, "busybox", "tpm2_quote"}))
+
+	_, _, _, err = PodExec(context.Background(), "keylime", "agent", "tpm", []string{"tpm2_quote"}, nil,
+		ExecOptions{ExecShell: NoExecShell})
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(execURL.Query()["command"]).To(Equal([]string{"tpm2_quote"}))
+
+	_, _, _, err = PodExec(context.Background(), "keylime", "agent", "tpm", []string{"tpm2_quote"}, nil,
+		ExecOptions{Env: env, ExecShell: NoExecShell})
+	g.Expect(err).To(MatchError(ErrShellRequired))
+}
+
+func TestBuildExecURL(t *testing.T) {
+	g := NewWithT(t)
+	SetLogInstance(logr.Discard())
+	config := &rest.Config{Host: "https://cluster.example.com:6443"}
+
+	execURL, err := BuildExecURL(config, "keylime", "agent", "tpm", []string{"tpm2_quote", "-c", "0x81000003"})
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(execURL.Host).To(Equal("cluster.example.com:6443"))
+	g.Expect(execURL.Path).To(Equal("/api/v1/namespaces/keylime/pods/agent/exec"))
+	query := execURL.Query()
+	g.Expect(query["command"]).To(Equal([]string{"tpm2_quote", "-c", "0x81000003"}))
+	g.Expect(query.Get("container")).To(Equal("tpm"))
+	g.Expect(query.Get("stdout")).To(Equal("true"))
+	g.Expect(query.Get("stderr")).To(Equal("true"))
+	g.Expect(query.Get("stdin")).To(BeEmpty())
+	g.Expect(query.Get("tty")).To(BeEmpty())
+
+	// Command is wrapped, and errors merged into the output, as when executed
+	execURL, err = BuildExecURL(config, "keylime", "agent", "tpm", []string{"tpm2_quote"},
+		ExecOptions{Tty: true, Env: map[string]string{"TPM_DEVICE": "/dev/tpm0"}})
+	g.Expect(err).NotTo(HaveOccurred())
+	query = execURL.Query()
+	g.Expect(query["command"]).To(Equal([]string{"/bin/sh", "-c", `export TPM_DEVICE='/dev/tpm0'; exec "$@"`, "/bin/sh",
+		"tpm2_quote"}))
+	g.Expect(query.Get("tty")).To(Equal("true"))
+	g.Expect(query.Get("stderr")).To(BeEmpty())
+
+	_, err = BuildExecURL(nil, "keylime", "agent", "tpm", []string{"tpm2_quote"})
+	g.Expect(errors.Is(err, ErrConfigUnavailable)).To(BeTrue())
+}
+
+func TestPodExecUsesBuiltExecURL(t *testing.T) {
+	g := NewWithT(t)
+	useFakeConfig(t)
+	execURL := useFakeExecutor(t, &fakeExecutor{})
+
+	_, _, _, err := PodExecWithInput(context.Background(), "keylime", "agent", "tpm", []string{"tpm2_quote"}, "nonce\n")
+	g.Expect(err).NotTo(HaveOccurred())
+	expected, err := BuildExecURL(&rest.Config{Host: "http://127.0.0.1:1"}, "keylime", "agent", "tpm", []string{"tpm2_quote"})
+	g.Expect(err).NotTo(HaveOccurred())
+	// Input is attached when provided
+	query := expected.Query()
+	query.Set("stdin", "true")
+	expected.RawQuery = query.Encode()
+	g.Expect(execURL.Query()).To(Equal(expected.Query()))
+	g.Expect(execURL.Path).To(Equal(expected.Path))
+}
+
+func TestPodExecStdinAttachment(t *testing.T) {
+	tests := []struct {
+		name     string
+		stdin    io.Reader
+		option   *bool
+		attached bool
+		input    string
+	}{
+		{name: "reader, default", stdin: strings.NewReader("nonce"), attached: true, input: "nonce"},
+		{name: "no reader, default"},
+		{name: "reader, attached", stdin: strings.NewReader("nonce"), option: pointer.Bool(true), attached: true,
+			input: "nonce"},
+		{name: "no reader, attached", option: pointer.Bool(true), attached: true},
+		{name: "reader, detached", stdin: strings.NewReader("nonce"), option: pointer.Bool(false)},
+		{name: "no reader, detached", option: pointer.Bool(false)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := NewWithT(t)
+			useFakeConfig(t)
+			executor := &fakeExecutor{}
+			execURL := useFakeExecutor(t, executor)
+
+			_, _, _, err := PodExec(context.Background(), "keylime", "agent", "tpm", []string{"tpm2_quote"}, tt.stdin,
+				ExecOptions{Stdin: tt.option})
+			g.Expect(err).NotTo(HaveOccurred())
+			if tt.attached {
+				g.Expect(execURL.Query().Get("stdin")).To(Equal("true"))
+				g.Expect(executor.options.Stdin).NotTo(BeNil())
+				g.Expect(executor.stdin).To(Equal(tt.input))
+			} else {
+				g.Expect(execURL.Query().Get("stdin")).To(BeEmpty())
+				g.Expect(executor.options.Stdin).To(BeNil())
+			}
+
+			builtURL, err := BuildExecURL(&rest.Config{Host: "http://127.0.0.1:1"}, "keylime", "agent", "tpm",
+				[]string{"tpm2_quote"}, ExecOptions{Stdin: tt.option})
+			g.Expect(err).NotTo(HaveOccurred())
+			g.Expect(builtURL.Query().Get("stdin") == "true").To(Equal(tt.option != nil && *tt.option))
+		})
+	}
+}
+
+// slowExecutor writes the output configured after the delay provided
+type slowExecutor struct {
+	fakeExecutor
+	delay time.Duration
+}
+
+func (s *slowExecutor) StreamWithContext(ctx context.Context, options remotecommand.StreamOptions) error {
+	time.Sleep(s.delay)
+	return s.fakeExecutor.StreamWithContext(ctx, options)
+}
+
+func TestPodExecWithResult(t *testing.T) {
+	g := NewWithT(t)
+	useFakeConfig(t)
+	executor := &slowExecutor{delay: 50 * time.Millisecond, fakeExecutor: fakeExecutor{stdout: "quote", stderr: "failure",
+		err: utilexec.CodeExitError{Err: errors.New("command terminated with exit code 3"), Code: 3}}}
+	useExecutor(t, func(_ *rest.Config, _ string, _ *url.URL) (remotecommand.Executor, error) {
+		return executor, nil
+	})
+
+	result, err := PodExecWithResult(context.Background(), "keylime", "agent", "tpm", []string{"tpm2_quote"}, nil)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(result.Stdout).To(Equal("quote"))
+	g.Expect(result.Stderr).To(Equal("failure"))
+	g.Expect(result.ExitCode).To(Equal(3))
+	g.Expect(result.Duration).To(BeNumerically(">=", executor.delay))
+	g.Expect(result.PodName).To(Equal("agent"))
+	g.Expect(result.Container).To(Equal("tpm"))
+}
+
+func TestPodExecWithResultReportsError(t *testing.T) {
+	g := NewWithT(t)
+	useFakeConfig(t)
+	useFakeExecutor(t, &fakeExecutor{err: fmt.Errorf("connection reset")})
+
+	result, err := PodExecWithResult(context.Background(), "keylime", "agent", "tpm", []string{"tpm2_quote"}, nil)
+	g.Expect(err).To(MatchError(ContainSubstring("connection reset")))
+	g.Expect(result).NotTo(BeNil())
+	g.Expect(result.ExitCode).To(BeZero())
+	g.Expect(result.PodName).To(Equal("agent"))
+}
+
+// useExecutorSequence makes exec functions use the executors provided, one per exec, returning the number of execs
+func useExecutorSequence(t *testing.T, executors ...*fakeExecutor) *int {
+	execs := 0
+	useExecutor(t, func(_ *rest.Config, _ string, _ *url.URL) (remotecommand.Executor, error) {
+		executor := executors[execs]
+		execs++
+		return executor, nil
+	})
+	return &execs
+}
+
+func TestPodExecRetriesStreamError(t *testing.T) {
+	g := NewWithT(t)
+	useFakeConfig(t)
+	second := &fakeExecutor{stdout: "quote"}
+	execs := useExecutorSequence(t, &fakeExecutor{err: errors.New("connection reset")}, second)
+
+	result, err := PodExecWithResult(context.Background(), "keylime", "agent", "tpm", []string{"tpm2_quote"},
+		strings.NewReader("nonce"), ExecOptions{ExecRetries: 2, ExecRetryDelay: time.Millisecond})
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(*execs).To(Equal(2))
+	g.Expect(result.Attempts).To(Equal(2))
+	g.Expect(result.Stdout).To(Equal("quote"))
+	// Input is sent again on retries
+	g.Expect(second.stdin).To(Equal("nonce"))
+}
+
+func TestPodExecRetriesExhausted(t *testing.T) {
+	g := NewWithT(t)
+	useFakeConfig(t)
+	execs := useExecutorSequence(t, &fakeExecutor{err: errors.New("connection reset")},
+		&fakeExecutor{err: errors.New("broken pipe")})
+
+	result, err := PodExecWithResult(context.Background(), "keylime", "agent", "tpm", []string{"tpm2_quote"}, nil,
+		ExecOptions{ExecRetries: 1, ExecRetryDelay: time.Millisecond})
+	g.Expect(err).To(MatchError(ContainSubstring("broken pipe")))
+	g.Expect(errors.Is(err, ErrExecStream)).To(BeTrue())
+	g.Expect(*execs).To(Equal(2))
+	g.Expect(result.Attempts).To(Equal(2))
+}
+
+func TestPodExecRetriesExitCodes(t *testing.T) {
+	g := NewWithT(t)
+	useFakeConfig(t)
+	busy := utilexec.CodeExitError{Err: errors.New("command terminated with exit code 75"), Code: 75}
+	failed := utilexec.CodeExitError{Err: errors.New("command terminated with exit code 1"), Code: 1}
+
+	// Exit codes listed are retried
+	execs := useExecutorSequence(t, &fakeExecutor{err: busy}, &fakeExecutor{stdout: "quote"})
+	result, err := PodExecWithResult(context.Background(), "keylime", "agent", "tpm", []string{"tpm2_quote"}, nil,
+		ExecOptions{ExecRetries: 3, ExecRetryDelay: time.Millisecond, RetryExitCodes: []int{75}})
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(result.ExitCode).To(BeZero())
+	g.Expect(*execs).To(Equal(2))
+
+	// Other exit codes are deterministic failures
+	execs = useExecutorSequence(t, &fakeExecutor{err: failed}, &fakeExecutor{stdout: "quote"})
+	result, err = PodExecWithResult(context.Background(), "keylime", "agent", "tpm", []string{"tpm2_quote"}, nil,
+		ExecOptions{ExecRetries: 3, ExecRetryDelay: time.Millisecond, RetryExitCodes: []int{75}})
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(result.ExitCode).To(Equal(1))
+	g.Expect(result.Attempts).To(Equal(1))
+	g.Expect(*execs).To(Equal(1))
+}
+
+func TestPodExecRetriesStopOnCancel(t *testing.T) {
+	g := NewWithT(t)
+	useFakeConfig(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	execs := 0
+	useExecutor(t, func(_ *rest.Config, _ string, _ *url.URL) (remotecommand.Executor, error) {
+		execs++
+		cancel()
+		return &fakeExecutor{err: errors.New("connection reset")}, nil
+	})
+
+	_, err := PodExecWithResult(ctx, "keylime", "agent", "tpm", []string{"tpm2_quote"}, nil,
+		ExecOptions{ExecRetries: 5, ExecRetryDelay: time.Hour})
+	g.Expect(err).To(MatchError(ContainSubstring("connection reset")))
+	g.Expect(execs).To(Equal(1))
+}
@@ -0,0 +1,107 @@
+/*
+Copyright 2023.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	keylimev1alpha1 "github.com/sarroutbi/osdk-attestation-operator/api/v1alpha1"
+	core_v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+)
+
+// AttestationFinalizer allows cleaning up attestation artifacts before the attestation resource is deleted
+const AttestationFinalizer = "attestation.io/cleanup"
+
+// EventCleanupFailed is emitted when attestation artifacts could not be cleaned up on deletion
+const EventCleanupFailed = "CleanupFailed"
+
+// EnsureFinalizer adds the cleanup finalizer to the attestation, if not already present
+func (r *AttestationReconciler) EnsureFinalizer(ctx context.Context, attestation *keylimev1alpha1.Attestation) error {
+	if controllerutil.ContainsFinalizer(attestation, AttestationFinalizer) {
+		return nil
+	}
+	if r.DryRun {
+		GetLogInstance().Info("Dry run: would add finalizer", "Finalizer", AttestationFinalizer)
+		return nil
+	}
+	GetLogInstance().Info("Adding finalizer", "Finalizer", AttestationFinalizer)
+	controllerutil.AddFinalizer(attestation, AttestationFinalizer)
+	return r.Update(ctx, attestation)
+}
+
+// Finalize cleans up the attestation artifacts and removes the cleanup finalizer, so that the
+// attestation resource can be deleted. Cleanup failures are logged and reported as events, but
+// never prevent the finalizer removal, so that resources don't get stuck in Terminating state
+func (r *AttestationReconciler) Finalize(ctx context.Context, attestation *keylimev1alpha1.Attestation) error {
+	if !controllerutil.ContainsFinalizer(attestation, AttestationFinalizer) {
+		return nil
+	}
+	if r.DryRun {
+		GetLogInstance().Info("Dry run: would clean up attestation artifacts and remove finalizer", "Finalizer", AttestationFinalizer)
+		return nil
+	}
+	if err := r.Cleanup(ctx, attestation); err != nil {
+		GetLogInstance().Error(err, "Unable to clean up attestation artifacts, removing finalizer anyway")
+		r.RecordEvent(attestation, core_v1.EventTypeWarning, EventCleanupFailed, err.Error())
+	}
+	GetLogInstance().Info("Removing finalizer", "Finalizer", AttestationFinalizer)
+	controllerutil.RemoveFinalizer(attestation, AttestationFinalizer)
+	return r.Update(ctx, attestation)
+}
+
+// Cleanup executes the cleanup command in the attested pod, if specified.
+// Pods that do not exist anymore are considered already cleaned up
+func (r *AttestationReconciler) Cleanup(ctx context.Context, attestation *keylimev1alpha1.Attestation) error {
+	info := attestation.Spec.PodAttestationInfo
+	if info == nil || len(info.CleanupCommand) == 0 {
+		return nil
+	}
+	namespace := info.Namespace
+	if namespace == "" {
+		namespace = attestation.Namespace
+	}
+	clientset, err := GetClusterClientsetWithContext(ctx)
+	if err != nil {
+		return err
+	}
+	if _, err = clientset.CoreV1().Pods(namespace).Get(ctx, info.PodName, metav1.GetOptions{}); err != nil {
+		if apierrors.IsNotFound(err) {
+			GetLogInstance().Info("Attested pod does not exist, nothing to clean up", "Namespace", namespace, "Pod", info.PodName)
+			return nil
+		}
+		return err
+	}
+	stdout, stderr, exitCode, err := PodExec(ctx, namespace, info.PodName, info.ContainerName, info.CleanupCommand, nil)
+	GetLogInstance().Info("Cleanup command executed", "Stdout", stdout, "Stderr", stderr, "Exit Code", exitCode,
+		"Error", err)
+	if errors.Is(err, ErrPodNotFound) {
+		GetLogInstance().Info("Attested pod deleted during cleanup, nothing to clean up", "Namespace", namespace, "Pod", info.PodName)
+		return nil
+	}
+	if err == nil && exitCode != 0 {
+		err = fmt.Errorf("command exited with code %d: %s", exitCode, stderr)
+	}
+	if err != nil {
+		return fmt.Errorf("cleanup of pod %s/%s failed: %v", namespace, info.PodName, err)
+	}
+	return nil
+}
@@ -0,0 +1,105 @@
+/*
+Copyright 2023.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"fmt"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"k8s.io/client-go/discovery"
+	"sigs.k8s.io/controller-runtime/pkg/healthz"
+)
+
+// DefaultAPIServerCheckTimeout is the timeout of the API server connectivity check
+const DefaultAPIServerCheckTimeout = 5 * time.Second
+
+// APIServerChecker returns a health checker that fails if the API server can not be reached in the timeout
+// provided, so that the operator is not considered ready while it can not talk to the API server
+func APIServerChecker(timeout time.Duration) healthz.Checker {
+	return func(req *http.Request) error {
+		config, err := GetClusterClientConfigWithContext(req.Context())
+		if err != nil {
+			return fmt.Errorf("unable to get cluster config: %w", err)
+		}
+		// Config is a copy of the cached one, so timeout can be modified safely
+		config.Timeout = timeout
+		clientset, err := GetClientsetFromClusterConfig(config)
+		if err != nil {
+			return fmt.Errorf("unable to get clientset: %w", err)
+		}
+		return checkServerVersion(clientset.Discovery())
+	}
+}
+
+// checkServerVersion performs a lightweight request to the API server, retrieving its version
+func checkServerVersion(client discovery.ServerVersionInterface) error {
+	if _, err := client.ServerVersion(); err != nil {
+		GetLogInstance().Info("API server not reachable", "Error", err)
+		return fmt.Errorf("API server not reachable: %w", err)
+	}
+	return nil
+}
+
+// lastReconcileStart and lastReconcileSuccess contain the time (Unix nanoseconds) of the last reconcile
+// started and completed successfully. Last success is initialized on startup, so that stale reconcile
+// checks don't fail before the first reconcile completes
+var (
+	lastReconcileStart   atomic.Int64
+	lastReconcileSuccess atomic.Int64
+)
+
+func init() {
+	lastReconcileSuccess.Store(time.Now().UnixNano())
+}
+
+// recordReconcileStart records a reconcile has been started
+func recordReconcileStart() {
+	lastReconcileStart.Store(time.Now().UnixNano())
+}
+
+// recordReconcileSuccess records a reconcile has been completed successfully
+func recordReconcileSuccess() {
+	lastReconcileSuccess.Store(time.Now().UnixNano())
+}
+
+// StaleReconcileChecker returns a health checker that fails if reconciles have been started, but none has
+// completed successfully in the threshold provided, so that a wedged operator is restarted. Operators with
+// no pending reconciles are considered healthy. Zero or negative threshold disables the check
+func StaleReconcileChecker(threshold time.Duration) healthz.Checker {
+	return func(_ *http.Request) error {
+		return checkStaleReconcile(threshold, time.Now())
+	}
+}
+
+// checkStaleReconcile checks, at the time provided, if last successful reconcile is older than the threshold
+func checkStaleReconcile(threshold time.Duration, now time.Time) error {
+	if threshold <= 0 {
+		return nil
+	}
+	lastSuccess := time.Unix(0, lastReconcileSuccess.Load())
+	lastStart := time.Unix(0, lastReconcileStart.Load())
+	if !lastStart.After(lastSuccess) {
+		return nil
+	}
+	if elapsed := now.Sub(lastSuccess); elapsed > threshold {
+		return fmt.Errorf("no reconcile completed in %v, last successful reconcile at %v", elapsed.Round(time.Second),
+			lastSuccess.Format(time.RFC3339))
+	}
+	return nil
+}
@@ -0,0 +1,91 @@
+/*
+Copyright 2023.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"errors"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	. "github.com/onsi/gomega"
+	"k8s.io/apimachinery/pkg/version"
+)
+
+// fakeServerVersion returns the error provided when the server version is requested
+type fakeServerVersion struct {
+	err error
+}
+
+func (f *fakeServerVersion) ServerVersion() (*version.Info, error) {
+	if f.err != nil {
+		return nil, f.err
+	}
+	return &version.Info{Major: "1", Minor: "26"}, nil
+}
+
+func TestCheckServerVersion(t *testing.T) {
+	useFakeConfig(t)
+	g := NewWithT(t)
+	g.Expect(checkServerVersion(&fakeServerVersion{})).To(Succeed())
+	g.Expect(checkServerVersion(&fakeServerVersion{err: errors.New("connection refused")})).To(
+		MatchError(ContainSubstring("connection refused")))
+}
+
+func TestAPIServerCheckerUnreachable(t *testing.T) {
+	useFakeConfig(t)
+	g := NewWithT(t)
+	checker := APIServerChecker(time.Second)
+	g.Expect(checker(httptest.NewRequest("GET", "/readyz", nil))).To(MatchError(ContainSubstring("API server not reachable")))
+}
+
+func TestCheckStaleReconcile(t *testing.T) {
+	g := NewWithT(t)
+	start, success := lastReconcileStart.Load(), lastReconcileSuccess.Load()
+	t.Cleanup(func() {
+		lastReconcileStart.Store(start)
+		lastReconcileSuccess.Store(success)
+	})
+	now := time.Now()
+	lastReconcileSuccess.Store(now.Add(-time.Hour).UnixNano())
+
+	// No reconcile pending since last success
+	lastReconcileStart.Store(now.Add(-2 * time.Hour).UnixNano())
+	g.Expect(checkStaleReconcile(time.Minute, now)).To(Succeed())
+
+	// Reconcile pending, but last success in threshold
+	lastReconcileStart.Store(now.UnixNano())
+	g.Expect(checkStaleReconcile(2*time.Hour, now)).To(Succeed())
+
+	// Reconcile pending, and last success older than threshold
+	g.Expect(checkStaleReconcile(time.Minute, now)).To(MatchError(ContainSubstring("no reconcile completed in 1h0m0s")))
+
+	// Check disabled
+	g.Expect(checkStaleReconcile(0, now)).To(Succeed())
+}
+
+func TestCheckStaleReconcileOnStartup(t *testing.T) {
+	g := NewWithT(t)
+	start, success := lastReconcileStart.Load(), lastReconcileSuccess.Load()
+	t.Cleanup(func() {
+		lastReconcileStart.Store(start)
+		lastReconcileSuccess.Store(success)
+	})
+	lastReconcileSuccess.Store(time.Now().UnixNano())
+	recordReconcileStart()
+	g.Expect(checkStaleReconcile(time.Minute, time.Now())).To(Succeed())
+}
@@ -0,0 +1,96 @@
+/*
+Copyright 2023.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	keylimev1alpha1 "github.com/sarroutbi/osdk-attestation-operator/api/v1alpha1"
+	core_v1 "k8s.io/api/core/v1"
+)
+
+const (
+	// HookPre identifies the command executed before the attestation command
+	HookPre = "pre"
+	// HookPost identifies the command executed after the attestation command
+	HookPost = "post"
+)
+
+// maxHookOutputLength bounds the output of each hook stored in the attestation status
+const maxHookOutputLength = 1024
+
+// ErrHookFailed is returned when a command executed before or after the attestation command fails
+var ErrHookFailed = errors.New("exec hook failed")
+
+// WithExecHooks executes the attestation function provided between the PreExecCommand and PostExecCommand
+// of the attestation spec, if any, storing their results in the attestation status. Attestation function
+// is not executed if PreExecCommand fails. PostExecCommand is executed even if previous commands fail,
+// and its failure is reported through an event, so that it does not hide the result of the attestation
+//
+// :return:
+//
+//	error: ErrHookFailed (wrapped) if PreExecCommand failed, otherwise the error of the attestation function
+func (r *AttestationReconciler) WithExecHooks(ctx context.Context, attestation *keylimev1alpha1.Attestation,
+	namespace, podName, containerName string, attest func() error) error {
+	attestation.Status.HookOutputs = nil
+	err := r.runExecHook(ctx, attestation, HookPre, namespace, podName, containerName, attestation.Spec.PreExecCommand)
+	if err == nil {
+		err = attest()
+	}
+	if postErr := r.runExecHook(ctx, attestation, HookPost, namespace, podName, containerName,
+		attestation.Spec.PostExecCommand); postErr != nil {
+		GetLogInstance().Error(postErr, "Post exec hook failed", "Namespace", namespace, "Pod", podName)
+		r.RecordEvent(attestation, core_v1.EventTypeWarning, EventHookFailed, postErr.Error())
+	}
+	return err
+}
+
+// runExecHook executes the hook command in the pod, if any, appending its result to the attestation status
+func (r *AttestationReconciler) runExecHook(ctx context.Context, attestation *keylimev1alpha1.Attestation,
+	hook, namespace, podName, containerName string, command []string) error {
+	if len(command) == 0 {
+		return nil
+	}
+	execCtx, cancel := context.WithTimeout(ctx, r.effectiveExecTimeout(attestation))
+	defer cancel()
+	stdout, stderr, exitCode, err := PodExec(execCtx, namespace, podName, containerName, command, nil)
+	GetLogInstance().Info("Exec hook executed", "Hook", hook, "Stdout", stdout, "Stderr", stderr, "Exit Code", exitCode,
+		"Error", err)
+	output := keylimev1alpha1.HookOutput{Hook: hook, Output: truncateHookOutput(stdout + stderr), ExitCode: exitCode}
+	if err != nil {
+		output.Error = err.Error()
+	}
+	attestation.Status.HookOutputs = append(attestation.Status.HookOutputs, output)
+	if err != nil {
+		return fmt.Errorf("%w: %s hook in pod %s/%s: %v", ErrHookFailed, hook, namespace, podName, err)
+	}
+	if exitCode != 0 {
+		return fmt.Errorf("%w: %s hook in pod %s/%s exited with code %d: %s", ErrHookFailed, hook, namespace, podName,
+			exitCode, stderr)
+	}
+	return nil
+}
+
+// truncateHookOutput bounds the output of a hook, keeping its end, which usually explains failures
+func truncateHookOutput(output string) string {
+	if len(output) <= maxHookOutputLength {
+		return output
+	}
+	return "..." + output[len(output)-maxHookOutputLength+3:]
+}
@@ -0,0 +1,153 @@
+/*
+Copyright 2023.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	. "github.com/onsi/gomega"
+	keylimev1alpha1 "github.com/sarroutbi/osdk-attestation-operator/api/v1alpha1"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/remotecommand"
+	utilexec "k8s.io/client-go/util/exec"
+)
+
+// useCommandExecutors makes exec functions use the executor configured for each command, recording
+// the commands executed in order
+func useCommandExecutors(t *testing.T, executors map[string]*fakeExecutor) *[]string {
+	executed := &[]string{}
+	useExecutor(t, func(_ *rest.Config, _ string, u *url.URL) (remotecommand.Executor, error) {
+		command := strings.Join(u.Query()["command"], " ")
+		*executed = append(*executed, command)
+		if executor, ok := executors[command]; ok {
+			return executor, nil
+		}
+		return &fakeExecutor{}, nil
+	})
+	return executed
+}
+
+func hooksAttestation() *keylimev1alpha1.Attestation {
+	return &keylimev1alpha1.Attestation{Spec: keylimev1alpha1.AttestationSpec{
+		PreExecCommand:  []string{"mount-tpm"},
+		PostExecCommand: []string{"umount-tpm"},
+	}}
+}
+
+func runAttestCommand(ctx context.Context) error {
+	_, _, exitCode, err := PodExec(ctx, "keylime", "agent", "agent", []string{"attest"}, nil)
+	if err == nil && exitCode != 0 {
+		err = fmt.Errorf("attestation command exited with code %d", exitCode)
+	}
+	return err
+}
+
+func TestWithExecHooksOrdering(t *testing.T) {
+	g := NewWithT(t)
+	useFakeConfig(t)
+	executed := useCommandExecutors(t, map[string]*fakeExecutor{
+		"mount-tpm":  {stdout: "mounted"},
+		"umount-tpm": {stdout: "unmounted"},
+	})
+	r := &AttestationReconciler{}
+	attestation := hooksAttestation()
+
+	err := r.WithExecHooks(context.Background(), attestation, "keylime", "agent", "agent", func() error {
+		return runAttestCommand(context.Background())
+	})
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(*executed).To(Equal([]string{"mount-tpm", "attest", "umount-tpm"}))
+	g.Expect(attestation.Status.HookOutputs).To(Equal([]keylimev1alpha1.HookOutput{
+		{Hook: HookPre, Output: "mounted"},
+		{Hook: HookPost, Output: "unmounted"},
+	}))
+}
+
+func TestWithExecHooksPostRunsOnFailure(t *testing.T) {
+	g := NewWithT(t)
+	useFakeConfig(t)
+	executed := useCommandExecutors(t, map[string]*fakeExecutor{
+		"attest": {err: utilexec.CodeExitError{Err: fmt.Errorf("command terminated with exit code 1"), Code: 1}},
+		"umount-tpm": {stderr: "busy",
+			err: utilexec.CodeExitError{Err: fmt.Errorf("command terminated with exit code 2"), Code: 2}},
+	})
+	r := &AttestationReconciler{}
+	attestation := hooksAttestation()
+
+	err := r.WithExecHooks(context.Background(), attestation, "keylime", "agent", "agent", func() error {
+		return runAttestCommand(context.Background())
+	})
+	// Post hook failure does not hide the failure of the attestation command
+	g.Expect(err).To(MatchError(ContainSubstring("attestation command exited with code 1")))
+	g.Expect(errors.Is(err, ErrHookFailed)).To(BeFalse())
+	g.Expect(*executed).To(Equal([]string{"mount-tpm", "attest", "umount-tpm"}))
+	g.Expect(attestation.Status.HookOutputs[1]).To(Equal(keylimev1alpha1.HookOutput{Hook: HookPost, Output: "busy", ExitCode: 2}))
+}
+
+func TestWithExecHooksPreFailure(t *testing.T) {
+	g := NewWithT(t)
+	useFakeConfig(t)
+	executed := useCommandExecutors(t, map[string]*fakeExecutor{
+		"mount-tpm": {err: fmt.Errorf("connection reset")},
+	})
+	r := &AttestationReconciler{}
+	attestation := hooksAttestation()
+
+	err := r.WithExecHooks(context.Background(), attestation, "keylime", "agent", "agent", func() error {
+		return runAttestCommand(context.Background())
+	})
+	g.Expect(errors.Is(err, ErrHookFailed)).To(BeTrue())
+	g.Expect(err).To(MatchError(ContainSubstring("pre hook")))
+	// Attestation command is skipped, but post hook is still executed to clean up
+	g.Expect(*executed).To(Equal([]string{"mount-tpm", "umount-tpm"}))
+	g.Expect(attestation.Status.HookOutputs[0].Error).To(ContainSubstring("connection reset"))
+}
+
+// deadlineExecutor records the deadline of the context of the exec
+type deadlineExecutor struct {
+	fakeExecutor
+	deadline time.Time
+}
+
+func (d *deadlineExecutor) StreamWithContext(ctx context.Context, options remotecommand.StreamOptions) error {
+	d.deadline, _ = ctx.Deadline()
+	return d.fakeExecutor.StreamWithContext(ctx, options)
+}
+
+func TestExecHookHonorsAttestationTimeout(t *testing.T) {
+	g := NewWithT(t)
+	useFakeConfig(t)
+	executor := &deadlineExecutor{}
+	useExecutor(t, func(*rest.Config, string, *url.URL) (remotecommand.Executor, error) {
+		return executor, nil
+	})
+	r := &AttestationReconciler{ExecTimeout: time.Hour}
+	attestation := hooksAttestation()
+	attestation.Spec.TimeoutSeconds = 5
+
+	err := r.runExecHook(context.Background(), attestation, HookPre, "keylime", "agent", "agent",
+		attestation.Spec.PreExecCommand)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(time.Until(executor.deadline)).To(BeNumerically("<=", 5*time.Second))
+	g.Expect(time.Until(executor.deadline)).To(BeNumerically(">", 0))
+}
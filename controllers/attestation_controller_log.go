@@ -17,13 +17,27 @@ limitations under the License.
 package controllers
 
 import (
-	"github.com/go-logr/logr"
+	"fmt"
+	"os"
+	"strings"
 	"sync"
+
+	"github.com/go-logr/logr"
+	"go.uber.org/zap/zapcore"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/log/zap"
 )
 
+// logFormatEnvVar allows selecting the format of the logs, either text or json
+const logFormatEnvVar = "OPERATOR_LOG_FORMAT"
+
+// logLevelEnvVar allows selecting the minimum level of the logs, either debug, info, warn or error
+const logLevelEnvVar = "OPERATOR_LOG_LEVEL"
+
 var lock = &sync.Mutex{}
 
-var logInstance logr.Logger
+// logInstance delegates to the logger set in controller-runtime until a reconcile sets its own logger
+var logInstance logr.Logger = log.Log
 
 func GetLogInstance() logr.Logger {
 	lock.Lock()
@@ -36,3 +50,42 @@ func SetLogInstance(l logr.Logger) {
 	defer lock.Unlock()
 	logInstance = l
 }
+
+// ConfigureLogOptions configures the logger options according to the environment, and must be called once,
+// before the logger is created:
+// - OPERATOR_LOG_FORMAT selects whether logs are written as json ("json") or as human-readable text ("text").
+// Logger options are left untouched on an unset or invalid value.
+// - OPERATOR_LOG_LEVEL selects the minimum level logged ("debug", "info", "warn" or "error").
+// Debug level enables V(1) logs. Level defaults to info on an unset or invalid value.
+// Invalid values are reported through the returned error, so that a single warning can be logged
+func ConfigureLogOptions(opts *zap.Options) error {
+	invalid := []string{}
+	format := os.Getenv(logFormatEnvVar)
+	switch strings.ToLower(format) {
+	case "":
+	case "json":
+		zap.JSONEncoder()(opts)
+	case "text":
+		zap.ConsoleEncoder()(opts)
+	default:
+		invalid = append(invalid, fmt.Sprintf("invalid %s value %q: must be text or json", logFormatEnvVar, format))
+	}
+	level := os.Getenv(logLevelEnvVar)
+	switch strings.ToLower(level) {
+	case "debug":
+		opts.Level = zapcore.DebugLevel
+	case "", "info":
+		opts.Level = zapcore.InfoLevel
+	case "warn":
+		opts.Level = zapcore.WarnLevel
+	case "error":
+		opts.Level = zapcore.ErrorLevel
+	default:
+		opts.Level = zapcore.InfoLevel
+		invalid = append(invalid, fmt.Sprintf("invalid %s value %q: must be debug, info, warn or error, using info", logLevelEnvVar, level))
+	}
+	if len(invalid) > 0 {
+		return fmt.Errorf("%s", strings.Join(invalid, "; "))
+	}
+	return nil
+}
@@ -0,0 +1,51 @@
+/*
+Copyright 2023.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"sigs.k8s.io/controller-runtime/pkg/metrics"
+)
+
+var (
+	// reconcileTotal counts the reconciliations of attestation resources
+	reconcileTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "attestation_operator_reconcile_total",
+		Help: "Total number of attestation reconciliations",
+	})
+	// attestationSuccessTotal counts the successful pod attestations
+	attestationSuccessTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "attestation_operator_attestation_success_total",
+		Help: "Total number of successful pod attestations",
+	})
+	// attestationFailureTotal counts the failed pod attestations, by failure reason
+	attestationFailureTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "attestation_operator_attestation_failure_total",
+		Help: "Total number of failed pod attestations",
+	}, []string{"reason"})
+	// execDurationSeconds measures the duration of the attestation commands executed in pods
+	execDurationSeconds = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "attestation_operator_exec_duration_seconds",
+		Help:    "Duration in seconds of the attestation commands executed in pods",
+		Buckets: prometheus.DefBuckets,
+	})
+)
+
+func init() {
+	// Register custom metrics with the global registry served on the manager metrics endpoint
+	metrics.Registry.MustRegister(reconcileTotal, attestationSuccessTotal, attestationFailureTotal, execDurationSeconds)
+}
@@ -0,0 +1,128 @@
+/*
+Copyright 2023.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+
+	keylimev1alpha1 "github.com/sarroutbi/osdk-attestation-operator/api/v1alpha1"
+)
+
+// DefaultNonceSize is the number of random bytes of the nonce sent on each attestation challenge
+const DefaultNonceSize = 32
+
+// quoteNoncePrefix is the prefix of the line of the quote containing the nonce it was generated for
+const quoteNoncePrefix = "nonce:"
+
+// nonceFileDir is the directory of the pod where the nonce file is written, when nonce is delivered in a file
+const nonceFileDir = "/tmp"
+
+// ErrNonceMismatch is returned when the quote was not generated for the nonce of the attestation challenge
+var ErrNonceMismatch = errors.New("quote nonce mismatch")
+
+// GenerateNonce generates a random nonce, so that each attestation challenge gets a fresh one
+// :param int size: number of random bytes of the nonce
+//
+// :return:
+//
+//	string: Nonce, encoded in base64
+//	 error: If nonce could not be generated, otherwise `nil`
+func GenerateNonce(size int) (string, error) {
+	if size <= 0 {
+		return "", fmt.Errorf("invalid nonce size %d", size)
+	}
+	nonce := make([]byte, size)
+	if _, err := rand.Read(nonce); err != nil {
+		return "", fmt.Errorf("unable to generate nonce: %w", err)
+	}
+	return base64.StdEncoding.EncodeToString(nonce), nil
+}
+
+// QuoteNonce extracts the nonce from the quote returned by the attestation command, which must include
+// a line with the nonce the quote was generated for, prefixed by "nonce:"
+func QuoteNonce(quote string) (string, error) {
+	scanner := bufio.NewScanner(strings.NewReader(quote))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if strings.HasPrefix(line, quoteNoncePrefix) {
+			return strings.TrimSpace(strings.TrimPrefix(line, quoteNoncePrefix)), nil
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return "", fmt.Errorf("unable to read quote: %w", err)
+	}
+	return "", fmt.Errorf("%w: quote does not include a nonce", ErrNonceMismatch)
+}
+
+// VerifyQuoteNonce checks the quote was generated for the nonce provided, so that replayed quotes are rejected
+//
+// :return:
+//
+//	error: ErrNonceMismatch (wrapped) if quote does not include the nonce provided, otherwise `nil`
+func VerifyQuoteNonce(quote, nonce string) error {
+	quoteNonce, err := QuoteNonce(quote)
+	if err != nil {
+		return err
+	}
+	if subtle.ConstantTimeCompare([]byte(quoteNonce), []byte(nonce)) != 1 {
+		return fmt.Errorf("%w: quote was not generated for the nonce of the challenge", ErrNonceMismatch)
+	}
+	return nil
+}
+
+// NonceFilePath returns the path of the file in the pod where the nonce of the attestation is written, when nonce
+// is delivered in a file. Path is unique per attestation, so that attestations of the same pod do not collide
+func NonceFilePath(attestation *keylimev1alpha1.Attestation) string {
+	return fmt.Sprintf("%s/attestation-%s-%s.nonce", nonceFileDir, attestation.Namespace, attestation.Name)
+}
+
+// writeNonceFile writes the nonce into the file provided in the pod, through the input of a shell command
+func writeNonceFile(ctx context.Context, namespace, podName, containerName, path, nonce string) error {
+	command := append(strings.Fields(DefaultExecShell), "cat > "+shellQuote(path))
+	_, stderr, exitCode, err := PodExecWithInput(ctx, namespace, podName, containerName, command, nonce+"\n")
+	if err != nil {
+		return fmt.Errorf("unable to write nonce file %s in pod %s/%s: %w", path, namespace, podName, err)
+	}
+	if exitCode != 0 {
+		return fmt.Errorf("unable to write nonce file %s in pod %s/%s, exit code %d: %s", path, namespace, podName,
+			exitCode, stderr)
+	}
+	return nil
+}
+
+// removeNonceFile removes the nonce file provided from the pod. Failures are logged only, as the nonce is not
+// valid for further attestations anyway
+func (r *AttestationReconciler) removeNonceFile(ctx context.Context, attestation *keylimev1alpha1.Attestation,
+	namespace, podName, containerName, path string) {
+	// Attestation command may have consumed the exec timeout, so cleanup gets its own one
+	execCtx, cancel := context.WithTimeout(ctx, r.effectiveExecTimeout(attestation))
+	defer cancel()
+	_, stderr, exitCode, err := PodExec(execCtx, namespace, podName, containerName, []string{"rm", "-f", path}, nil)
+	if err != nil {
+		GetLogInstance().Error(err, "Unable to remove nonce file", "Namespace", namespace, "Pod", podName, "Path", path)
+	} else if exitCode != 0 {
+		GetLogInstance().Info("Unable to remove nonce file", "Namespace", namespace, "Pod", podName, "Path", path,
+			"Stderr", stderr, "Exit Code", exitCode)
+	}
+}
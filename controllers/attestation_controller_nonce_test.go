@@ -0,0 +1,115 @@
+/*
+Copyright 2023.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"testing"
+
+	. "github.com/onsi/gomega"
+	keylimev1alpha1 "github.com/sarroutbi/osdk-attestation-operator/api/v1alpha1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	utilexec "k8s.io/client-go/util/exec"
+)
+
+func TestGenerateNonceUnique(t *testing.T) {
+	g := NewWithT(t)
+	nonces := map[string]bool{}
+	for i := 0; i < 100; i++ {
+		nonce, err := GenerateNonce(DefaultNonceSize)
+		g.Expect(err).NotTo(HaveOccurred())
+		decoded, err := base64.StdEncoding.DecodeString(nonce)
+		g.Expect(err).NotTo(HaveOccurred())
+		g.Expect(decoded).To(HaveLen(DefaultNonceSize))
+		g.Expect(nonces).NotTo(HaveKey(nonce))
+		nonces[nonce] = true
+	}
+}
+
+func TestGenerateNonceInvalidSize(t *testing.T) {
+	g := NewWithT(t)
+	_, err := GenerateNonce(0)
+	g.Expect(err).To(HaveOccurred())
+}
+
+func TestVerifyQuoteNonce(t *testing.T) {
+	tests := []struct {
+		name    string
+		quote   string
+		nonce   string
+		wantErr bool
+	}{
+		{name: "matching nonce", quote: "quote: AAAA\nnonce: abc=\n", nonce: "abc="},
+		{name: "mismatching nonce", quote: "quote: AAAA\nnonce: xyz=\n", nonce: "abc=", wantErr: true},
+		{name: "missing nonce", quote: "quote: AAAA\n", nonce: "abc=", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := NewWithT(t)
+			err := VerifyQuoteNonce(tt.quote, tt.nonce)
+			if tt.wantErr {
+				g.Expect(err).To(MatchError(ErrNonceMismatch))
+			} else {
+				g.Expect(err).NotTo(HaveOccurred())
+			}
+		})
+	}
+}
+
+func TestNonceFilePath(t *testing.T) {
+	g := NewWithT(t)
+	attestation := &keylimev1alpha1.Attestation{ObjectMeta: metav1.ObjectMeta{Namespace: "keylime", Name: "agent"}}
+	g.Expect(NonceFilePath(attestation)).To(Equal("/tmp/attestation-keylime-agent.nonce"))
+
+	// Attestations of the same pod from other namespaces get a different file
+	other := &keylimev1alpha1.Attestation{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "agent"}}
+	g.Expect(NonceFilePath(other)).NotTo(Equal(NonceFilePath(attestation)))
+}
+
+func TestNonceFileWriteAndCleanup(t *testing.T) {
+	g := NewWithT(t)
+	useFakeConfig(t)
+	write := &fakeExecutor{}
+	executed := useCommandExecutors(t, map[string]*fakeExecutor{
+		"/bin/sh -c cat > '/tmp/attestation-keylime-agent.nonce'": write,
+	})
+	r := &AttestationReconciler{}
+	attestation := &keylimev1alpha1.Attestation{ObjectMeta: metav1.ObjectMeta{Namespace: "keylime", Name: "agent"}}
+	path := NonceFilePath(attestation)
+
+	g.Expect(writeNonceFile(context.Background(), "keylime", "agent", "agent", path, "bm9uY2U=")).To(Succeed())
+	g.Expect(write.stdin).To(Equal("bm9uY2U=\n"))
+	r.removeNonceFile(context.Background(), attestation, "keylime", "agent", "agent", path)
+	g.Expect(*executed).To(Equal([]string{
+		"/bin/sh -c cat > '/tmp/attestation-keylime-agent.nonce'",
+		"rm -f /tmp/attestation-keylime-agent.nonce",
+	}))
+}
+
+func TestNonceFileWriteFailure(t *testing.T) {
+	g := NewWithT(t)
+	useFakeConfig(t)
+	useCommandExecutors(t, map[string]*fakeExecutor{
+		"/bin/sh -c cat > '/tmp/nonce'": {stderr: "read-only file system",
+			err: utilexec.CodeExitError{Err: fmt.Errorf("command terminated with exit code 1"), Code: 1}},
+	})
+
+	err := writeNonceFile(context.Background(), "keylime", "agent", "agent", "/tmp/nonce", "bm9uY2U=")
+	g.Expect(err).To(MatchError(ContainSubstring("read-only file system")))
+}
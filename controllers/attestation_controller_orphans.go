@@ -0,0 +1,181 @@
+/*
+Copyright 2023.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	keylimev1alpha1 "github.com/sarroutbi/osdk-attestation-operator/api/v1alpha1"
+	core_v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/manager"
+)
+
+// OwnedByLabel is the label of the Secrets created by the operator, containing the UID of the owning attestation,
+// so that Secrets surviving their attestation (e.g. when finalizers are removed on force deletion) can be found.
+// UID is used as, unlike the name of the attestation, it is always a valid label value
+const OwnedByLabel = "attestation.io/owned-by"
+
+// OwnedByNameAnnotation is the annotation of the Secrets created by the operator, containing the name of the
+// owning attestation
+const OwnedByNameAnnotation = "attestation.io/owned-by-name"
+
+// DefaultOrphanSweepInterval is the period of the sweeps of Secrets whose owning attestation no longer exists
+const DefaultOrphanSweepInterval = time.Hour
+
+// setOwnedByLabel labels the secret with the UID of the attestation owning it, and annotates it with its name
+func setOwnedByLabel(attestation *keylimev1alpha1.Attestation, secret *core_v1.Secret) {
+	if secret.Labels == nil {
+		secret.Labels = map[string]string{}
+	}
+	secret.Labels[OwnedByLabel] = string(attestation.UID)
+	if secret.Annotations == nil {
+		secret.Annotations = map[string]string{}
+	}
+	secret.Annotations[OwnedByNameAnnotation] = attestation.Name
+}
+
+// secretOwner returns the attestation owning the secret, either from its controller owner reference or,
+// if it has none, from its OwnedByLabel and OwnedByNameAnnotation, and the UID of the owner, if known.
+// Secrets labeled by previous versions hold the name of the owner in OwnedByLabel and are not annotated
+func secretOwner(secret metav1.Object) (types.NamespacedName, types.UID) {
+	owner := types.NamespacedName{Namespace: secret.GetNamespace()}
+	if ref := metav1.GetControllerOf(secret); ref != nil && ref.Kind == "Attestation" &&
+		ref.APIVersion == keylimev1alpha1.GroupVersion.String() {
+		owner.Name = ref.Name
+		return owner, ref.UID
+	}
+	name, annotated := secret.GetAnnotations()[OwnedByNameAnnotation]
+	if !annotated {
+		owner.Name = secret.GetLabels()[OwnedByLabel]
+		return owner, ""
+	}
+	owner.Name = name
+	return owner, types.UID(secret.GetLabels()[OwnedByLabel])
+}
+
+// SweepOrphanSecrets deletes the Secrets labeled as owned by an attestation that no longer exists, or that has
+// been created again, and so has a different UID than the one of the owner reference of the secret.
+// Secrets are listed through the API reader, filtered by the API server and retrieving their metadata only
+// :param context: context of the request
+//
+// :return:
+//
+//	  int: Number of orphaned Secrets deleted (or that would be deleted in dry run)
+//	error: If any error has occurred otherwise `nil`
+func (r *AttestationReconciler) SweepOrphanSecrets(ctx context.Context) (int, error) {
+	secrets, err := r.listOwnedSecrets(ctx)
+	if err != nil {
+		return 0, err
+	}
+	orphans := 0
+	for i := range secrets {
+		secret := &secrets[i]
+		owner, uid := secretOwner(secret)
+		attestation := &keylimev1alpha1.Attestation{}
+		err := r.Get(ctx, owner, attestation)
+		if err != nil && !apierrors.IsNotFound(err) {
+			return orphans, fmt.Errorf("unable to get owner of secret %s/%s: %w", secret.Namespace, secret.Name, err)
+		}
+		if err == nil && (uid == "" || uid == attestation.UID) {
+			continue
+		}
+		orphans++
+		if r.DryRun {
+			GetLogInstance().Info("Dry run: would delete orphaned secret", "Namespace", secret.Namespace,
+				"Secret", secret.Name, "Attestation", owner.Name)
+			continue
+		}
+		GetLogInstance().Info("Deleting orphaned secret", "Namespace", secret.Namespace, "Secret", secret.Name,
+			"Attestation", owner.Name)
+		orphan := &core_v1.Secret{ObjectMeta: metav1.ObjectMeta{Namespace: secret.Namespace, Name: secret.Name}}
+		// Secret is only deleted if it has not been replaced since it was listed
+		if err := r.Delete(ctx, orphan, client.Preconditions{UID: &secret.UID}); err != nil && !apierrors.IsNotFound(err) {
+			return orphans, fmt.Errorf("unable to delete orphaned secret %s/%s: %w", secret.Namespace, secret.Name, err)
+		}
+	}
+	return orphans, nil
+}
+
+// listOwnedSecrets lists the metadata of the Secrets labeled with OwnedByLabel through the API reader, in the
+// namespaces watched by the manager, if restricted (see GetWatchNamespaces), or in all namespaces otherwise
+func (r *AttestationReconciler) listOwnedSecrets(ctx context.Context) ([]metav1.PartialObjectMetadata, error) {
+	namespaces, err := GetWatchNamespaces()
+	if err != nil {
+		return nil, err
+	}
+	if len(namespaces) == 0 {
+		namespaces = []string{core_v1.NamespaceAll}
+	}
+	var secrets []metav1.PartialObjectMetadata
+	for _, namespace := range namespaces {
+		list := &metav1.PartialObjectMetadataList{}
+		list.SetGroupVersionKind(core_v1.SchemeGroupVersion.WithKind("SecretList"))
+		if err := r.apiReader().List(ctx, list, client.InNamespace(namespace), client.HasLabels{OwnedByLabel}); err != nil {
+			return nil, fmt.Errorf("unable to list attestation secrets: %w", err)
+		}
+		secrets = append(secrets, list.Items...)
+	}
+	return secrets, nil
+}
+
+// apiReader returns the reader querying the API server directly, the client of the reconciler if not set
+func (r *AttestationReconciler) apiReader() client.Reader {
+	if r.APIReader == nil {
+		return r.Client
+	}
+	return r.APIReader
+}
+
+// runOrphanSweep sweeps orphaned Secrets on start and then periodically, on the interval provided, until the
+// context is done. Zero or negative interval means Secrets are only swept on start
+func (r *AttestationReconciler) runOrphanSweep(ctx context.Context, interval time.Duration) error {
+	for {
+		orphans, err := r.SweepOrphanSecrets(ctx)
+		if err != nil {
+			GetLogInstance().Error(err, "Unable to sweep orphaned secrets")
+		} else {
+			GetLogInstance().Info("Orphaned secrets swept", "Deleted", orphans)
+		}
+		if interval <= 0 {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(interval):
+		}
+	}
+}
+
+// SetupOrphanSweepWithManager sets up the sweep of orphaned Secrets, executed by the leader once
+// the manager is started, and then on the interval provided. Secrets are listed through the API reader of
+// the manager, unless an API reader is already set
+func (r *AttestationReconciler) SetupOrphanSweepWithManager(mgr ctrl.Manager, interval time.Duration) error {
+	if r.APIReader == nil {
+		r.APIReader = mgr.GetAPIReader()
+	}
+	return mgr.Add(manager.RunnableFunc(func(ctx context.Context) error {
+		return r.runOrphanSweep(ctx, interval)
+	}))
+}
@@ -0,0 +1,526 @@
+/*
+Copyright 2023.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	core_v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/metadata"
+
+	keylimev1alpha1 "github.com/sarroutbi/osdk-attestation-operator/api/v1alpha1"
+)
+
+// ErrPodNotFound is returned when the pod requested does not exist
+var ErrPodNotFound = errors.New("pod not found")
+
+// ErrPodNotReady is returned when the pod requested exists, but it is not ready yet
+var ErrPodNotReady = errors.New("pod not ready")
+
+// ErrPodUnhealthy is returned when the pod requested exists, but it is not expected to become ready soon,
+// e.g. because its containers are crash looping
+var ErrPodUnhealthy = errors.New("pod unhealthy")
+
+// ContainerAnnotation allows pods to declare the container to attest, when no container name is specified
+const ContainerAnnotation = keylimev1alpha1.ContainerAnnotation
+
+// crashLoopBackOffReason is the waiting reason of containers restarted repeatedly after crashing
+const crashLoopBackOffReason = "CrashLoopBackOff"
+
+// PodIsReady checks if a pod is ready, this is, if its Ready condition is true and all its containers are ready
+// :param context
+// :param string namespace: namespace of the Pod
+// :param string podName: name of the Pod
+//
+// :return:
+//
+//	bool: true if the pod is ready, false otherwise
+//	error: ErrPodNotFound (wrapped) if the pod does not exist, ErrPodUnhealthy (wrapped) if any of its containers
+//	       is crash looping, any other error if it occurred, otherwise `nil`
+func PodIsReady(ctx context.Context, namespace, podName string) (bool, error) {
+	if err := validateNamespace(namespace); err != nil {
+		return false, err
+	}
+	clientset, err := GetClusterClientsetWithContext(ctx)
+	if err != nil {
+		GetLogInstance().Info("Unable to get ClusterClientset")
+		return false, err
+	}
+	return podIsReady(ctx, clientset, namespace, podName)
+}
+
+// podIsReady checks if a pod is ready using the clientset provided
+func podIsReady(ctx context.Context, clientset kubernetes.Interface, namespace, podName string) (bool, error) {
+	pod, err := clientset.CoreV1().Pods(namespace).Get(ctx, podName, metav1.GetOptions{})
+	if err != nil {
+		if apierrors.IsNotFound(err) {
+			return false, fmt.Errorf("%w: %s/%s", ErrPodNotFound, namespace, podName)
+		}
+		return false, checkThrottled(err)
+	}
+	return podReadiness(pod)
+}
+
+// podReadiness checks if the pod provided is ready, reporting ErrPodUnhealthy (wrapped) if any of its
+// containers is crash looping
+func podReadiness(pod *core_v1.Pod) (bool, error) {
+	if container := crashLoopingContainer(pod); container != "" {
+		return false, fmt.Errorf("%w: %s/%s: container %s in %s", ErrPodUnhealthy, pod.Namespace, pod.Name, container,
+			crashLoopBackOffReason)
+	}
+	return isPodReady(pod), nil
+}
+
+// PodForNode finds the pod matching the label selector scheduled on a node, e.g. the pod of the DaemonSet of
+// the agent running on the node to attest. Pods being deleted or terminated are ignored, and ready pods are
+// preferred if several match, e.g. during a rolling update
+// :param context
+// :param string namespace: namespace of the Pod
+// :param string labelSelector: label selector of the pods, e.g. the selector of the DaemonSet. Must not be empty,
+// so that a pod of any workload scheduled on the node is not picked
+// :param string nodeName: name of the node where the pod is scheduled
+//
+// :return:
+//
+//	*core_v1.Pod: pod found
+//	error: ErrPodNotFound (wrapped) if no pod matches, any other error if it occurred, otherwise `nil`
+func PodForNode(ctx context.Context, namespace, labelSelector, nodeName string) (*core_v1.Pod, error) {
+	if err := validateNamespace(namespace); err != nil {
+		return nil, err
+	}
+	clientset, err := GetClusterClientsetWithContext(ctx)
+	if err != nil {
+		GetLogInstance().Info("Unable to get ClusterClientset")
+		return nil, err
+	}
+	return podForNode(ctx, clientset, namespace, labelSelector, nodeName)
+}
+
+// podForNode finds the pod matching the label selector scheduled on a node using the clientset provided
+func podForNode(ctx context.Context, clientset kubernetes.Interface, namespace, labelSelector,
+	nodeName string) (*core_v1.Pod, error) {
+	if nodeName == "" {
+		return nil, errors.New("node name must be specified")
+	}
+	selector, err := labels.Parse(labelSelector)
+	if err != nil {
+		return nil, fmt.Errorf("invalid label selector %q: %w", labelSelector, err)
+	}
+	if selector.Empty() {
+		return nil, errors.New("label selector must be specified")
+	}
+	pods, err := clientset.CoreV1().Pods(namespace).List(ctx, metav1.ListOptions{
+		LabelSelector: selector.String(),
+		FieldSelector: fields.OneTermEqualSelector("spec.nodeName", nodeName).String(),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("unable to list pods on node %s: %w", nodeName, checkThrottled(err))
+	}
+	var found *core_v1.Pod
+	for i := range pods.Items {
+		pod := &pods.Items[i]
+		// Field selector is checked again, as it is not honored by every client (e.g. fake ones)
+		if pod.Spec.NodeName != nodeName || pod.DeletionTimestamp != nil ||
+			pod.Status.Phase == core_v1.PodSucceeded || pod.Status.Phase == core_v1.PodFailed {
+			continue
+		}
+		if isPodReady(pod) {
+			return pod, nil
+		}
+		if found == nil {
+			found = pod
+		}
+	}
+	if found == nil {
+		return nil, fmt.Errorf("%w: no pod matching %q on node %s in namespace %s", ErrPodNotFound, labelSelector,
+			nodeName, namespace)
+	}
+	return found, nil
+}
+
+// PodsForService lists the pods selected by a Service, e.g. the pods backing the agent Service to attest.
+// Headless Services select their pods as any other Service does
+// :param context
+// :param string namespace: namespace of the Service and its Pods
+// :param string serviceName: name of the Service
+//
+// :return:
+//
+//	[]core_v1.Pod: pods selected by the Service, empty if none matches
+//	error: If the Service does not exist or does not select pods (e.g. ExternalName Services, or Services
+//	       whose endpoints are managed manually), any other error if it occurred, otherwise `nil`
+func PodsForService(ctx context.Context, namespace, serviceName string) ([]core_v1.Pod, error) {
+	if err := validateNamespace(namespace); err != nil {
+		return nil, err
+	}
+	clientset, err := GetClusterClientsetWithContext(ctx)
+	if err != nil {
+		GetLogInstance().Info("Unable to get ClusterClientset")
+		return nil, err
+	}
+	return podsForService(ctx, clientset, namespace, serviceName)
+}
+
+// podsForService lists the pods selected by a Service using the clientset provided
+func podsForService(ctx context.Context, clientset kubernetes.Interface, namespace,
+	serviceName string) ([]core_v1.Pod, error) {
+	service, err := clientset.CoreV1().Services(namespace).Get(ctx, serviceName, metav1.GetOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("unable to get service %s/%s: %w", namespace, serviceName, checkThrottled(err))
+	}
+	if service.Spec.Type == core_v1.ServiceTypeExternalName {
+		return nil, fmt.Errorf("service %s/%s is of type %s and does not select pods", namespace, serviceName,
+			core_v1.ServiceTypeExternalName)
+	}
+	if len(service.Spec.Selector) == 0 {
+		return nil, fmt.Errorf("service %s/%s has no selector, its pods can not be determined", namespace, serviceName)
+	}
+	selector := labels.SelectorFromSet(service.Spec.Selector).String()
+	pods, err := clientset.CoreV1().Pods(namespace).List(ctx, metav1.ListOptions{LabelSelector: selector})
+	if err != nil {
+		return nil, fmt.Errorf("unable to list pods of service %s/%s: %w", namespace, serviceName, checkThrottled(err))
+	}
+	GetLogInstance().V(1).Info("Pods of service listed", "Namespace", namespace, "Service", serviceName,
+		"Selector", selector, "Pods", len(pods.Items))
+	return pods.Items, nil
+}
+
+// podsResource is the resource of the pods, as requested to the metadata client
+var podsResource = schema.GroupVersionResource{Version: "v1", Resource: "pods"}
+
+// PodMetadataList lists the metadata of the pods matching the label selector, without their specs and statuses,
+// e.g. to check which pods exist with less payload than a full list. Phases and readiness are not included
+// :param context
+// :param string namespace: namespace of the Pods
+// :param string labelSelector: label selector of the pods, all the pods of the namespace if empty
+//
+// :return:
+//
+//	[]metav1.PartialObjectMetadata: metadata of the pods found
+//	error: If any error has occurred otherwise `nil`
+func PodMetadataList(ctx context.Context, namespace, labelSelector string) ([]metav1.PartialObjectMetadata, error) {
+	if err := validateNamespace(namespace); err != nil {
+		return nil, err
+	}
+	config, err := GetClusterClientConfigWithContext(ctx)
+	if err != nil {
+		GetLogInstance().Info("Unable to get ClusterClientConfig")
+		return nil, err
+	}
+	client, err := metadata.NewForConfig(config)
+	if err != nil {
+		return nil, wrapError(ErrClientsetCreation, err)
+	}
+	return podMetadataList(ctx, client, namespace, labelSelector)
+}
+
+// podMetadataList lists the metadata of the pods matching the label selector using the metadata client provided
+func podMetadataList(ctx context.Context, client metadata.Interface, namespace,
+	labelSelector string) ([]metav1.PartialObjectMetadata, error) {
+	pods, err := client.Resource(podsResource).Namespace(namespace).List(ctx, metav1.ListOptions{
+		LabelSelector: labelSelector,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("unable to list metadata of pods in namespace %s: %w", namespace, checkThrottled(err))
+	}
+	return pods.Items, nil
+}
+
+// InitContainerState returns the state of an init container of a pod. Empty state means the init container has
+// not started yet
+// :param context
+// :param string namespace: namespace of the Pod
+// :param string podName: name of the Pod
+// :param string containerName: name of the init container
+//
+// :return:
+//
+//	core_v1.ContainerState: state of the init container
+//	error: ErrPodNotFound (wrapped) if the pod does not exist, ErrPodUnhealthy (wrapped) if the init container is
+//	       crash looping, any other error if it occurred (e.g. the init container does not exist), otherwise `nil`
+func InitContainerState(ctx context.Context, namespace, podName, containerName string) (core_v1.ContainerState, error) {
+	if err := validateNamespace(namespace); err != nil {
+		return core_v1.ContainerState{}, err
+	}
+	clientset, err := GetClusterClientsetWithContext(ctx)
+	if err != nil {
+		GetLogInstance().Info("Unable to get ClusterClientset")
+		return core_v1.ContainerState{}, err
+	}
+	return initContainerState(ctx, clientset, namespace, podName, containerName)
+}
+
+// initContainerState returns the state of an init container of a pod using the clientset provided
+func initContainerState(ctx context.Context, clientset kubernetes.Interface, namespace, podName,
+	containerName string) (core_v1.ContainerState, error) {
+	pod, err := clientset.CoreV1().Pods(namespace).Get(ctx, podName, metav1.GetOptions{})
+	if err != nil {
+		if apierrors.IsNotFound(err) {
+			return core_v1.ContainerState{}, fmt.Errorf("%w: %s/%s", ErrPodNotFound, namespace, podName)
+		}
+		return core_v1.ContainerState{}, checkThrottled(err)
+	}
+	return podInitContainerState(pod, containerName)
+}
+
+// podInitContainerState returns the state of the init container of the pod provided
+func podInitContainerState(pod *core_v1.Pod, containerName string) (core_v1.ContainerState, error) {
+	found := false
+	names := make([]string, 0, len(pod.Spec.InitContainers))
+	for _, container := range pod.Spec.InitContainers {
+		names = append(names, container.Name)
+		found = found || container.Name == containerName
+	}
+	if !found {
+		return core_v1.ContainerState{}, fmt.Errorf("init container %s not found in pod %s/%s, one of: %s",
+			containerName, pod.Namespace, pod.Name, strings.Join(names, ", "))
+	}
+	for _, status := range pod.Status.InitContainerStatuses {
+		if status.Name != containerName {
+			continue
+		}
+		if status.State.Waiting != nil && status.State.Waiting.Reason == crashLoopBackOffReason {
+			return status.State, fmt.Errorf("%w: %s/%s: init container %s in %s", ErrPodUnhealthy, pod.Namespace,
+				pod.Name, containerName, crashLoopBackOffReason)
+		}
+		return status.State, nil
+	}
+	return core_v1.ContainerState{}, nil
+}
+
+// crashLoopingContainer returns the name of the first container of the pod in CrashLoopBackOff, if any
+func crashLoopingContainer(pod *core_v1.Pod) string {
+	for _, status := range pod.Status.ContainerStatuses {
+		if status.State.Waiting != nil && status.State.Waiting.Reason == crashLoopBackOffReason {
+			return status.Name
+		}
+	}
+	return ""
+}
+
+// isPodReady returns true if the Ready condition of the pod is true and all its containers are ready
+func isPodReady(pod *core_v1.Pod) bool {
+	ready := false
+	for _, condition := range pod.Status.Conditions {
+		if condition.Type == core_v1.PodReady {
+			ready = condition.Status == core_v1.ConditionTrue
+			break
+		}
+	}
+	if !ready {
+		return false
+	}
+	for _, status := range pod.Status.ContainerStatuses {
+		if !status.Ready {
+			return false
+		}
+	}
+	return true
+}
+
+// resolveContainerName returns the container where commands are executed in a pod. If no container name is
+// provided, the container declared in the ContainerAnnotation of the pod, or its single container, is selected,
+// as exec is ambiguous in multi-container pods.
+// Ephemeral containers must be specified by name, and exist in the pod status
+func resolveContainerName(ctx context.Context, clientset kubernetes.Interface, namespace, podName,
+	containerName string, ephemeral bool) (string, error) {
+	if containerName != "" && !ephemeral {
+		return containerName, nil
+	}
+	if containerName == "" && ephemeral {
+		return "", fmt.Errorf("ephemeral container name must be specified for pod %s/%s", namespace, podName)
+	}
+	pod, err := clientset.CoreV1().Pods(namespace).Get(ctx, podName, metav1.GetOptions{})
+	if err != nil {
+		if apierrors.IsNotFound(err) {
+			return "", fmt.Errorf("%w: %s/%s", ErrPodNotFound, namespace, podName)
+		}
+		return "", checkThrottled(err)
+	}
+	if ephemeral {
+		return containerName, validateEphemeralContainer(pod, containerName)
+	}
+	return selectContainer(pod)
+}
+
+// validateEphemeralContainer checks the ephemeral container is running in the pod
+func validateEphemeralContainer(pod *core_v1.Pod, containerName string) error {
+	for _, status := range pod.Status.EphemeralContainerStatuses {
+		if status.Name != containerName {
+			continue
+		}
+		if status.State.Running == nil {
+			return fmt.Errorf("ephemeral container %s is not running in pod %s/%s", containerName, pod.Namespace, pod.Name)
+		}
+		return nil
+	}
+	return fmt.Errorf("ephemeral container %s not found in pod %s/%s", containerName, pod.Namespace, pod.Name)
+}
+
+// selectContainer returns the name of the container declared by the pod in the ContainerAnnotation,
+// or the name of its single container otherwise. An error listing the available containers is
+// returned if there are several, or if the container declared does not exist
+func selectContainer(pod *core_v1.Pod) (string, error) {
+	if annotated, ok := pod.Annotations[ContainerAnnotation]; ok {
+		for _, container := range pod.Spec.Containers {
+			if container.Name == annotated {
+				return annotated, nil
+			}
+		}
+		return "", fmt.Errorf("container %s declared by annotation %s not found in pod %s/%s, one of: %s",
+			annotated, ContainerAnnotation, pod.Namespace, pod.Name, containerNames(pod))
+	}
+	switch len(pod.Spec.Containers) {
+	case 0:
+		return "", fmt.Errorf("pod %s/%s has no containers", pod.Namespace, pod.Name)
+	case 1:
+		return pod.Spec.Containers[0].Name, nil
+	}
+	return "", fmt.Errorf("pod %s/%s has several containers, container name must be specified, one of: %s",
+		pod.Namespace, pod.Name, containerNames(pod))
+}
+
+// containerNames returns the comma separated names of the containers of the pod
+func containerNames(pod *core_v1.Pod) string {
+	names := make([]string, 0, len(pod.Spec.Containers))
+	for _, container := range pod.Spec.Containers {
+		names = append(names, container.Name)
+	}
+	return strings.Join(names, ", ")
+}
+
+// WaitForPodReady waits for a pod to become ready, watching it instead of polling, e.g. to attest short-lived
+// pods as soon as they start. Pod may not exist yet when the wait starts
+// :param context
+// :param string namespace: namespace of the Pod
+// :param string podName: name of the Pod
+// :param time.Duration timeout: maximum time to wait for the pod
+//
+// :return:
+//
+//	error: `nil` when the pod is ready. ErrPodNotFound (wrapped) if the pod is deleted during the wait,
+//	       ErrPodUnhealthy (wrapped) if it is crash looping, ErrPodNotReady (wrapped) if the timeout expires,
+//	       the context error if it is done, any other error if it occurred
+func WaitForPodReady(ctx context.Context, namespace, podName string, timeout time.Duration) error {
+	if err := validateNamespace(namespace); err != nil {
+		return err
+	}
+	clientset, err := GetClusterClientsetWithContext(ctx)
+	if err != nil {
+		GetLogInstance().Info("Unable to get ClusterClientset")
+		return err
+	}
+	return waitForPodReady(ctx, clientset, namespace, podName, timeout)
+}
+
+// waitForPodReady waits for a pod to become ready using the clientset provided
+func waitForPodReady(ctx context.Context, clientset kubernetes.Interface, namespace, podName string,
+	timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	pods := clientset.CoreV1().Pods(namespace)
+	resourceVersion := ""
+	pod, err := pods.Get(ctx, podName, metav1.GetOptions{})
+	switch {
+	case err == nil:
+		// Wait is done once the pod is ready, or as soon as it is crash looping
+		if ready, err := podReadiness(pod); ready || err != nil {
+			return err
+		}
+		resourceVersion = pod.ResourceVersion
+	case !apierrors.IsNotFound(err):
+		return waitError(ctx, err, namespace, podName, timeout)
+	}
+	for {
+		watcher, err := pods.Watch(ctx, metav1.ListOptions{
+			FieldSelector:   fields.OneTermEqualSelector("metadata.name", podName).String(),
+			ResourceVersion: resourceVersion,
+		})
+		if err != nil {
+			return waitError(ctx, err, namespace, podName, timeout)
+		}
+		done, err := watchPodReady(ctx, watcher, &resourceVersion)
+		watcher.Stop()
+		if done {
+			if err != nil {
+				return waitError(ctx, err, namespace, podName, timeout)
+			}
+			return nil
+		}
+		// Watch closed by the API server, so it is started again from the last version seen
+		GetLogInstance().V(1).Info("Pod watch closed, watching again", "Namespace", namespace, "Pod", podName)
+	}
+}
+
+// watchPodReady processes the events of the pod watch, returning true when the wait is done, together with
+// its result, or false if the watch is closed before. Last resource version seen is stored in resourceVersion
+func watchPodReady(ctx context.Context, watcher watch.Interface, resourceVersion *string) (bool, error) {
+	for {
+		select {
+		case <-ctx.Done():
+			return true, ctx.Err()
+		case event, ok := <-watcher.ResultChan():
+			if !ok {
+				return false, nil
+			}
+			switch event.Type {
+			case watch.Error:
+				err := apierrors.FromObject(event.Object)
+				if apierrors.IsResourceExpired(err) || apierrors.IsGone(err) {
+					// Version seen is too old, so the pod is watched again from its current version
+					*resourceVersion = ""
+					return false, nil
+				}
+				return true, err
+			case watch.Deleted:
+				pod, _ := event.Object.(*core_v1.Pod)
+				if pod != nil {
+					return true, fmt.Errorf("%w: %s/%s deleted while waiting for it", ErrPodNotFound, pod.Namespace, pod.Name)
+				}
+				return true, fmt.Errorf("%w: deleted while waiting for it", ErrPodNotFound)
+			case watch.Added, watch.Modified:
+				pod, ok := event.Object.(*core_v1.Pod)
+				if !ok {
+					continue
+				}
+				*resourceVersion = pod.ResourceVersion
+				if ready, err := podReadiness(pod); ready || err != nil {
+					return true, err
+				}
+			}
+		}
+	}
+}
+
+// waitError reports the timeout of the wait as ErrPodNotReady (wrapped), returning any other error as it is
+func waitError(ctx context.Context, err error, namespace, podName string, timeout time.Duration) error {
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return fmt.Errorf("%w: %s/%s not ready after %v", ErrPodNotReady, namespace, podName, timeout)
+	}
+	return err
+}
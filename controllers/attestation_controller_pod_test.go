@@ -0,0 +1,439 @@
+/*
+Copyright 2023.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/go-logr/logr"
+	. "github.com/onsi/gomega"
+	core_v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/metadata"
+	"k8s.io/client-go/rest"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+// testPod returns a pod with a single container, ready or not
+func testPod(namespace, name string, ready bool) *core_v1.Pod {
+	status := core_v1.ConditionFalse
+	if ready {
+		status = core_v1.ConditionTrue
+	}
+	return &core_v1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Namespace: namespace, Name: name},
+		Spec: core_v1.PodSpec{
+			Containers: []core_v1.Container{{Name: "agent"}},
+		},
+		Status: core_v1.PodStatus{
+			Phase:             core_v1.PodRunning,
+			Conditions:        []core_v1.PodCondition{{Type: core_v1.PodReady, Status: status}},
+			ContainerStatuses: []core_v1.ContainerStatus{{Name: "agent", Ready: ready}},
+		},
+	}
+}
+
+func TestPodIsReady(t *testing.T) {
+	g := NewWithT(t)
+	clientset := fake.NewSimpleClientset(testPod("keylime", "ready", true), testPod("keylime", "starting", false))
+
+	ready, err := podIsReady(context.Background(), clientset, "keylime", "ready")
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(ready).To(BeTrue())
+
+	ready, err = podIsReady(context.Background(), clientset, "keylime", "starting")
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(ready).To(BeFalse())
+
+	_, err = podIsReady(context.Background(), clientset, "keylime", "missing")
+	g.Expect(errors.Is(err, ErrPodNotFound)).To(BeTrue())
+}
+
+func TestPodIsReadyCrashLoopBackOff(t *testing.T) {
+	g := NewWithT(t)
+	pod := testPod("keylime", "crashing", false)
+	pod.Status.ContainerStatuses[0].State.Waiting = &core_v1.ContainerStateWaiting{Reason: "CrashLoopBackOff"}
+	clientset := fake.NewSimpleClientset(pod)
+
+	ready, err := podIsReady(context.Background(), clientset, "keylime", "crashing")
+	g.Expect(ready).To(BeFalse())
+	g.Expect(errors.Is(err, ErrPodUnhealthy)).To(BeTrue())
+	g.Expect(err.Error()).To(ContainSubstring("container agent in CrashLoopBackOff"))
+}
+
+func TestResolveContainerName(t *testing.T) {
+	g := NewWithT(t)
+	multi := testPod("keylime", "multi", true)
+	multi.Spec.Containers = append(multi.Spec.Containers, core_v1.Container{Name: "sidecar"})
+	clientset := fake.NewSimpleClientset(testPod("keylime", "single", true), multi)
+
+	container, err := resolveContainerName(context.Background(), clientset, "keylime", "single", "", false)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(container).To(Equal("agent"))
+
+	container, err = resolveContainerName(context.Background(), clientset, "keylime", "multi", "sidecar", false)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(container).To(Equal("sidecar"))
+
+	_, err = resolveContainerName(context.Background(), clientset, "keylime", "multi", "", false)
+	g.Expect(err).To(MatchError(ContainSubstring("container name must be specified, one of: agent, sidecar")))
+
+	_, err = resolveContainerName(context.Background(), clientset, "keylime", "missing", "", false)
+	g.Expect(errors.Is(err, ErrPodNotFound)).To(BeTrue())
+}
+
+func TestResolveAnnotatedContainerName(t *testing.T) {
+	g := NewWithT(t)
+	annotated := testPod("keylime", "annotated", true)
+	annotated.Spec.Containers = append(annotated.Spec.Containers, core_v1.Container{Name: "sidecar"})
+	annotated.Annotations = map[string]string{ContainerAnnotation: "sidecar"}
+	invalid := testPod("keylime", "invalid", true)
+	invalid.Annotations = map[string]string{ContainerAnnotation: "missing"}
+	clientset := fake.NewSimpleClientset(annotated, invalid)
+
+	container, err := resolveContainerName(context.Background(), clientset, "keylime", "annotated", "", false)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(container).To(Equal("sidecar"))
+
+	container, err = resolveContainerName(context.Background(), clientset, "keylime", "annotated", "agent", false)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(container).To(Equal("agent"))
+
+	_, err = resolveContainerName(context.Background(), clientset, "keylime", "invalid", "", false)
+	g.Expect(err).To(MatchError(ContainSubstring("container missing declared by annotation")))
+}
+
+func TestResolveEphemeralContainerName(t *testing.T) {
+	g := NewWithT(t)
+	pod := testPod("keylime", "agent", true)
+	pod.Spec.EphemeralContainers = []core_v1.EphemeralContainer{
+		{EphemeralContainerCommon: core_v1.EphemeralContainerCommon{Name: "measure"}},
+		{EphemeralContainerCommon: core_v1.EphemeralContainerCommon{Name: "finished"}},
+	}
+	pod.Status.EphemeralContainerStatuses = []core_v1.ContainerStatus{
+		{Name: "measure", State: core_v1.ContainerState{Running: &core_v1.ContainerStateRunning{}}},
+		{Name: "finished", State: core_v1.ContainerState{Terminated: &core_v1.ContainerStateTerminated{}}},
+	}
+	clientset := fake.NewSimpleClientset(pod)
+
+	container, err := resolveContainerName(context.Background(), clientset, "keylime", "agent", "measure", true)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(container).To(Equal("measure"))
+
+	_, err = resolveContainerName(context.Background(), clientset, "keylime", "agent", "finished", true)
+	g.Expect(err).To(MatchError(ContainSubstring("ephemeral container finished is not running")))
+
+	_, err = resolveContainerName(context.Background(), clientset, "keylime", "agent", "agent", true)
+	g.Expect(err).To(MatchError(ContainSubstring("ephemeral container agent not found")))
+
+	_, err = resolveContainerName(context.Background(), clientset, "keylime", "agent", "", true)
+	g.Expect(err).To(MatchError(ContainSubstring("ephemeral container name must be specified")))
+}
+
+// watchedClientset returns a clientset with the pods provided, whose pod watches are served by the fake watcher
+func watchedClientset(watcher *watch.FakeWatcher, pods ...runtime.Object) *fake.Clientset {
+	clientset := fake.NewSimpleClientset(pods...)
+	clientset.PrependWatchReactor("pods", k8stesting.DefaultWatchReactor(watcher, nil))
+	return clientset
+}
+
+func TestWaitForPodReady(t *testing.T) {
+	g := NewWithT(t)
+	watcher := watch.NewFake()
+	clientset := watchedClientset(watcher, testPod("keylime", "agent", false))
+	go func() {
+		watcher.Modify(testPod("keylime", "agent", false))
+		watcher.Modify(testPod("keylime", "agent", true))
+	}()
+
+	err := waitForPodReady(context.Background(), clientset, "keylime", "agent", 10*time.Second)
+	g.Expect(err).NotTo(HaveOccurred())
+}
+
+func TestWaitForPodReadyAlreadyReady(t *testing.T) {
+	g := NewWithT(t)
+	clientset := watchedClientset(watch.NewFake(), testPod("keylime", "agent", true))
+
+	err := waitForPodReady(context.Background(), clientset, "keylime", "agent", 10*time.Second)
+	g.Expect(err).NotTo(HaveOccurred())
+}
+
+func TestWaitForPodReadyDeleted(t *testing.T) {
+	g := NewWithT(t)
+	watcher := watch.NewFake()
+	// Pod does not exist yet when the wait starts
+	clientset := watchedClientset(watcher)
+	go func() {
+		watcher.Add(testPod("keylime", "agent", false))
+		watcher.Delete(testPod("keylime", "agent", false))
+	}()
+
+	err := waitForPodReady(context.Background(), clientset, "keylime", "agent", 10*time.Second)
+	g.Expect(errors.Is(err, ErrPodNotFound)).To(BeTrue())
+}
+
+func TestWaitForPodReadyTimeout(t *testing.T) {
+	g := NewWithT(t)
+	clientset := watchedClientset(watch.NewFake(), testPod("keylime", "agent", false))
+
+	err := waitForPodReady(context.Background(), clientset, "keylime", "agent", 50*time.Millisecond)
+	g.Expect(errors.Is(err, ErrPodNotReady)).To(BeTrue())
+}
+
+// nodePod returns a pod of the agent DaemonSet scheduled on the node provided
+func nodePod(name, nodeName string, ready bool) *core_v1.Pod {
+	pod := testPod("keylime", name, ready)
+	pod.Labels = map[string]string{"app": "agent"}
+	pod.Spec.NodeName = nodeName
+	return pod
+}
+
+func TestPodForNode(t *testing.T) {
+	g := NewWithT(t)
+	terminating := nodePod("agent-old", "node-2", true)
+	terminating.DeletionTimestamp = &metav1.Time{Time: time.Now()}
+	other := testPod("keylime", "verifier", true)
+	other.Spec.NodeName = "node-1"
+	clientset := fake.NewSimpleClientset(
+		nodePod("agent-1", "node-1", true),
+		terminating,
+		nodePod("agent-2-starting", "node-2", false),
+		nodePod("agent-2", "node-2", true),
+		nodePod("agent-3", "node-3", false),
+		other,
+	)
+
+	pod, err := podForNode(context.Background(), clientset, "keylime", "app=agent", "node-1")
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(pod.Name).To(Equal("agent-1"))
+
+	// Ready pod is preferred, and pods being deleted are ignored
+	pod, err = podForNode(context.Background(), clientset, "keylime", "app=agent", "node-2")
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(pod.Name).To(Equal("agent-2"))
+
+	pod, err = podForNode(context.Background(), clientset, "keylime", "app=agent", "node-3")
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(pod.Name).To(Equal("agent-3"))
+
+	_, err = podForNode(context.Background(), clientset, "keylime", "app=agent", "node-4")
+	g.Expect(errors.Is(err, ErrPodNotFound)).To(BeTrue())
+	_, err = podForNode(context.Background(), clientset, "default", "app=agent", "node-1")
+	g.Expect(errors.Is(err, ErrPodNotFound)).To(BeTrue())
+}
+
+func TestPodForNodeFieldSelector(t *testing.T) {
+	g := NewWithT(t)
+	clientset := fake.NewSimpleClientset(nodePod("agent-1", "node-1", true))
+	var listed string
+	clientset.PrependReactor("list", "pods", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		listed = action.(k8stesting.ListAction).GetListRestrictions().Fields.String()
+		return false, nil, nil
+	})
+
+	_, err := podForNode(context.Background(), clientset, "keylime", "app=agent", "node-1")
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(listed).To(Equal("spec.nodeName=node-1"))
+}
+
+func TestPodForNodeInvalidSelector(t *testing.T) {
+	g := NewWithT(t)
+	clientset := fake.NewSimpleClientset(nodePod("agent-1", "node-1", true))
+	listed := false
+	clientset.PrependReactor("list", "pods", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		listed = true
+		return false, nil, nil
+	})
+
+	_, err := podForNode(context.Background(), clientset, "keylime", "app in (agent", "node-1")
+	g.Expect(err).To(MatchError(ContainSubstring(`invalid label selector "app in (agent"`)))
+	g.Expect(listed).To(BeFalse())
+}
+
+func TestPodForNodeEmptySelector(t *testing.T) {
+	g := NewWithT(t)
+	clientset := fake.NewSimpleClientset(nodePod("agent-1", "node-1", true))
+
+	// Empty selector would match any pod on the node, not only the pod of the agent
+	for _, selector := range []string{"", " "} {
+		_, err := podForNode(context.Background(), clientset, "keylime", selector, "node-1")
+		g.Expect(err).To(MatchError("label selector must be specified"))
+	}
+}
+
+// initContainerPod returns a pod with an init container in the state provided, if any
+func initContainerPod(name string, state *core_v1.ContainerState) *core_v1.Pod {
+	pod := testPod("keylime", name, false)
+	pod.Spec.InitContainers = []core_v1.Container{{Name: "measure"}}
+	if state != nil {
+		pod.Status.InitContainerStatuses = []core_v1.ContainerStatus{{Name: "measure", State: *state}}
+	}
+	return pod
+}
+
+func TestInitContainerState(t *testing.T) {
+	g := NewWithT(t)
+	clientset := fake.NewSimpleClientset(
+		initContainerPod("running", &core_v1.ContainerState{Running: &core_v1.ContainerStateRunning{}}),
+		initContainerPod("completed", &core_v1.ContainerState{Terminated: &core_v1.ContainerStateTerminated{ExitCode: 0}}),
+		initContainerPod("pending", nil),
+		initContainerPod("crashing", &core_v1.ContainerState{
+			Waiting: &core_v1.ContainerStateWaiting{Reason: crashLoopBackOffReason}}),
+	)
+
+	state, err := initContainerState(context.Background(), clientset, "keylime", "running", "measure")
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(state.Running).NotTo(BeNil())
+	g.Expect(state.Terminated).To(BeNil())
+
+	state, err = initContainerState(context.Background(), clientset, "keylime", "completed", "measure")
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(state.Running).To(BeNil())
+	g.Expect(state.Terminated).NotTo(BeNil())
+
+	// Init container not started yet has no state
+	state, err = initContainerState(context.Background(), clientset, "keylime", "pending", "measure")
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(state).To(Equal(core_v1.ContainerState{}))
+
+	_, err = initContainerState(context.Background(), clientset, "keylime", "crashing", "measure")
+	g.Expect(errors.Is(err, ErrPodUnhealthy)).To(BeTrue())
+
+	// Regular containers are not init containers
+	_, err = initContainerState(context.Background(), clientset, "keylime", "running", "agent")
+	g.Expect(err).To(MatchError(ContainSubstring("init container agent not found in pod keylime/running, one of: measure")))
+
+	_, err = initContainerState(context.Background(), clientset, "keylime", "missing", "measure")
+	g.Expect(errors.Is(err, ErrPodNotFound)).To(BeTrue())
+}
+
+func TestPodMetadataList(t *testing.T) {
+	g := NewWithT(t)
+	var accept, selector string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		accept, selector = r.Header.Get("Accept"), r.URL.Query().Get("labelSelector")
+		if r.URL.Path != "/api/v1/namespaces/keylime/pods" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json;as=PartialObjectMetadataList;g=meta.k8s.io;v=v1")
+		_, _ = w.Write([]byte(`{"kind":"PartialObjectMetadataList","apiVersion":"meta.k8s.io/v1","metadata":{},` +
+			`"items":[{"kind":"PartialObjectMetadata","apiVersion":"meta.k8s.io/v1",` +
+			`"metadata":{"name":"agent-1","namespace":"keylime","labels":{"app":"agent"}}},` +
+			`{"kind":"PartialObjectMetadata","apiVersion":"meta.k8s.io/v1",` +
+			`"metadata":{"name":"agent-2","namespace":"keylime","labels":{"app":"agent"}}}]}`))
+	}))
+	defer server.Close()
+	client, err := metadata.NewForConfig(&rest.Config{Host: server.URL})
+	g.Expect(err).NotTo(HaveOccurred())
+
+	pods, err := podMetadataList(context.Background(), client, "keylime", "app=agent")
+	g.Expect(err).NotTo(HaveOccurred())
+	// Metadata only payload is requested
+	g.Expect(accept).To(ContainSubstring("as=PartialObjectMetadataList"))
+	g.Expect(selector).To(Equal("app=agent"))
+	g.Expect(pods).To(HaveLen(2))
+	g.Expect(pods[0].Name).To(Equal("agent-1"))
+	g.Expect(pods[1].Name).To(Equal("agent-2"))
+	g.Expect(pods[1].Labels).To(HaveKeyWithValue("app", "agent"))
+
+	_, err = podMetadataList(context.Background(), client, "other", "")
+	g.Expect(err).To(MatchError(ContainSubstring("unable to list metadata of pods in namespace other")))
+}
+
+func TestPodIsReadyThrottled(t *testing.T) {
+	g := NewWithT(t)
+	clientset := fake.NewSimpleClientset(testPod("keylime", "agent", true))
+	clientset.PrependReactor("get", "pods", func(k8stesting.Action) (bool, runtime.Object, error) {
+		return true, nil, apierrors.NewTooManyRequests("too many requests", 7)
+	})
+
+	_, err := podIsReady(context.Background(), clientset, "keylime", "agent")
+	g.Expect(errors.Is(err, ErrThrottled)).To(BeTrue())
+	retryAfter, throttled := ThrottledRetryAfter(err)
+	g.Expect(throttled).To(BeTrue())
+	g.Expect(retryAfter).To(Equal(7 * time.Second))
+}
+
+// labeledPod returns a ready pod with the labels provided
+func labeledPod(name string, podLabels map[string]string) *core_v1.Pod {
+	pod := testPod("keylime", name, true)
+	pod.Labels = podLabels
+	return pod
+}
+
+// testService returns a service of the type provided selecting the pods with the labels provided
+func testService(name string, serviceType core_v1.ServiceType, clusterIP string,
+	selector map[string]string) *core_v1.Service {
+	return &core_v1.Service{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "keylime", Name: name},
+		Spec:       core_v1.ServiceSpec{Type: serviceType, ClusterIP: clusterIP, Selector: selector},
+	}
+}
+
+func TestPodsForService(t *testing.T) {
+	g := NewWithT(t)
+	SetLogInstance(logr.Discard())
+	clientset := fake.NewSimpleClientset(
+		labeledPod("agent-1", map[string]string{"app": "agent", "tier": "tpm"}),
+		labeledPod("agent-2", map[string]string{"app": "agent"}),
+		labeledPod("registrar", map[string]string{"app": "registrar"}),
+		testService("agent", core_v1.ServiceTypeClusterIP, "10.0.0.1", map[string]string{"app": "agent"}),
+		testService("headless", core_v1.ServiceTypeClusterIP, core_v1.ClusterIPNone, map[string]string{"tier": "tpm"}),
+		testService("verifier", core_v1.ServiceTypeClusterIP, "10.0.0.2", map[string]string{"app": "verifier"}),
+		testService("manual", core_v1.ServiceTypeClusterIP, "10.0.0.3", nil),
+		testService("external", core_v1.ServiceTypeExternalName, "", nil),
+	)
+
+	pods, err := podsForService(context.Background(), clientset, "keylime", "agent")
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(podNames(pods)).To(ConsistOf("agent-1", "agent-2"))
+
+	pods, err = podsForService(context.Background(), clientset, "keylime", "headless")
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(podNames(pods)).To(ConsistOf("agent-1"))
+
+	// Services selecting no pods are not an error
+	pods, err = podsForService(context.Background(), clientset, "keylime", "verifier")
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(pods).To(BeEmpty())
+
+	_, err = podsForService(context.Background(), clientset, "keylime", "manual")
+	g.Expect(err).To(MatchError("service keylime/manual has no selector, its pods can not be determined"))
+	_, err = podsForService(context.Background(), clientset, "keylime", "external")
+	g.Expect(err).To(MatchError(ContainSubstring("is of type ExternalName")))
+	_, err = podsForService(context.Background(), clientset, "keylime", "missing")
+	g.Expect(err).To(MatchError(ContainSubstring("unable to get service keylime/missing")))
+}
+
+// podNames returns the names of the pods provided
+func podNames(pods []core_v1.Pod) []string {
+	names := make([]string, 0, len(pods))
+	for _, pod := range pods {
+		names = append(names, pod.Name)
+	}
+	return names
+}
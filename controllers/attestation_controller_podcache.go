@@ -0,0 +1,149 @@
+/*
+Copyright 2023.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+
+	keylimev1alpha1 "github.com/sarroutbi/osdk-attestation-operator/api/v1alpha1"
+	core_v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+)
+
+// Pods are read through the client of the reconciler, which the manager backs with its shared informer
+// cache, so that reconciles do not query the API server. Cached pods may be slightly stale, which is fine
+// for readiness checks, as the Pod watch triggers a new reconcile once the cache catches up. Commands are
+// still executed through the clientset, directly against the API server. If the manager watches specific
+// namespaces (see GetWatchNamespaces), the pods to attest must belong to one of them
+
+// getPod retrieves a pod through the client of the reconciler
+//
+// :return:
+//
+//	*core_v1.Pod: pod retrieved
+//	error: ErrPodNotFound (wrapped) if the pod does not exist, any other error if it occurred, otherwise `nil`
+func (r *AttestationReconciler) getPod(ctx context.Context, namespace, podName string) (*core_v1.Pod, error) {
+	if err := validateNamespace(namespace); err != nil {
+		return nil, err
+	}
+	pod := &core_v1.Pod{}
+	if err := r.Get(ctx, types.NamespacedName{Namespace: namespace, Name: podName}, pod); err != nil {
+		if apierrors.IsNotFound(err) {
+			return nil, fmt.Errorf("%w: %s/%s", ErrPodNotFound, namespace, podName)
+		}
+		return nil, checkThrottled(err)
+	}
+	return pod, nil
+}
+
+// podIsReady checks if a pod is ready through the client of the reconciler, see PodIsReady
+func (r *AttestationReconciler) podIsReady(ctx context.Context, namespace, podName string) (bool, error) {
+	pod, err := r.getPod(ctx, namespace, podName)
+	if err != nil {
+		return false, err
+	}
+	return podReadiness(pod)
+}
+
+// initContainerState returns the state of an init container of a pod through the client of the reconciler,
+// see InitContainerState
+func (r *AttestationReconciler) initContainerState(ctx context.Context, namespace, podName,
+	containerName string) (core_v1.ContainerState, error) {
+	pod, err := r.getPod(ctx, namespace, podName)
+	if err != nil {
+		return core_v1.ContainerState{}, err
+	}
+	return podInitContainerState(pod, containerName)
+}
+
+// listPods lists the pods of a namespace matching the selector provided through the client of the reconciler
+func (r *AttestationReconciler) listPods(ctx context.Context, namespace string,
+	selector labels.Selector) ([]core_v1.Pod, error) {
+	if err := validateNamespace(namespace); err != nil {
+		return nil, err
+	}
+	list := &core_v1.PodList{}
+	if err := r.List(ctx, list, client.InNamespace(namespace), client.MatchingLabelsSelector{Selector: selector}); err != nil {
+		return nil, fmt.Errorf("unable to list pods in namespace %s: %w", namespace, checkThrottled(err))
+	}
+	return list.Items, nil
+}
+
+// podPredicate filters the pod events triggering reconciles: updates are ignored unless they change the
+// readiness of the pod, the state of its init containers or its labels, which may make it match a pod
+// selector, while create and delete events pass through
+func podPredicate() predicate.Predicate {
+	return predicate.Funcs{
+		UpdateFunc: func(e event.UpdateEvent) bool {
+			old, okOld := e.ObjectOld.(*core_v1.Pod)
+			updated, okNew := e.ObjectNew.(*core_v1.Pod)
+			if !okOld || !okNew {
+				return false
+			}
+			return isPodReady(old) != isPodReady(updated) ||
+				!reflect.DeepEqual(old.Status.InitContainerStatuses, updated.Status.InitContainerStatuses) ||
+				!reflect.DeepEqual(old.Labels, updated.Labels)
+		},
+	}
+}
+
+// attestationsForPod maps a pod to the requests of the attestations targeting it, either by name or through
+// their pod selector
+func (r *AttestationReconciler) attestationsForPod(object client.Object) []reconcile.Request {
+	attestations := &keylimev1alpha1.AttestationList{}
+	if err := r.List(context.Background(), attestations); err != nil {
+		GetLogInstance().Error(err, "Unable to list Attestations targeting pod", "Namespace", object.GetNamespace(),
+			"Pod", object.GetName())
+		return nil
+	}
+	var requests []reconcile.Request
+	for i := range attestations.Items {
+		if targetsPod(&attestations.Items[i], object) {
+			requests = append(requests, reconcile.Request{NamespacedName: client.ObjectKeyFromObject(&attestations.Items[i])})
+		}
+	}
+	return requests
+}
+
+// targetsPod checks if the attestation provided attests the pod provided
+func targetsPod(attestation *keylimev1alpha1.Attestation, pod client.Object) bool {
+	info := attestation.Spec.PodAttestationInfo
+	if info == nil {
+		return false
+	}
+	namespace := info.Namespace
+	if namespace == "" {
+		namespace = attestation.Namespace
+	}
+	if namespace != pod.GetNamespace() {
+		return false
+	}
+	if attestation.Spec.PodSelector == nil {
+		return info.PodName == pod.GetName()
+	}
+	selector, err := metav1.LabelSelectorAsSelector(attestation.Spec.PodSelector)
+	return err == nil && selector.Matches(labels.Set(pod.GetLabels()))
+}
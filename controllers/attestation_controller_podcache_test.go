@@ -0,0 +1,166 @@
+/*
+Copyright 2023.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	. "github.com/onsi/gomega"
+	keylimev1alpha1 "github.com/sarroutbi/osdk-attestation-operator/api/v1alpha1"
+	core_v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/util/workqueue"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+)
+
+// podAttestation returns an attestation of the pod provided
+func podAttestation(namespace, name, podName string) *keylimev1alpha1.Attestation {
+	return &keylimev1alpha1.Attestation{
+		ObjectMeta: metav1.ObjectMeta{Namespace: namespace, Name: name},
+		Spec: keylimev1alpha1.AttestationSpec{
+			PodAttestationInfo: &keylimev1alpha1.PodAttestation{PodName: podName, ContainerName: "agent",
+				Command: []string{"attest"}},
+		},
+	}
+}
+
+// enqueuedPodUpdate returns the requests enqueued by the Pod watch on the update of the pod provided
+func enqueuedPodUpdate(r *AttestationReconciler, old, updated *core_v1.Pod) []reconcile.Request {
+	e := event.UpdateEvent{ObjectOld: old, ObjectNew: updated}
+	if !podPredicate().Update(e) {
+		return nil
+	}
+	queue := workqueue.NewRateLimitingQueue(workqueue.DefaultControllerRateLimiter())
+	defer queue.ShutDown()
+	handler.EnqueueRequestsFromMapFunc(r.attestationsForPod).Update(e, queue)
+	var requests []reconcile.Request
+	for queue.Len() > 0 {
+		item, _ := queue.Get()
+		requests = append(requests, item.(reconcile.Request))
+		queue.Done(item)
+	}
+	return requests
+}
+
+func TestPodBecomingReadyTriggersReconcile(t *testing.T) {
+	g := NewWithT(t)
+	useFakeConfig(t)
+	executed := useCommandExecutors(t, map[string]*fakeExecutor{})
+	starting := testPod("keylime", "agent", false)
+	r := testReconciler(t, podAttestation("keylime", "attestation", "agent"),
+		podAttestation("keylime", "other", "other-agent"), starting)
+	key := types.NamespacedName{Namespace: "keylime", Name: "attestation"}
+
+	// Pod is read from the client, so not ready pod is reported without executing any command
+	result, err := r.Reconcile(context.Background(), ctrl.Request{NamespacedName: key})
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(result.RequeueAfter).To(Equal(r.podNotReadyRequeue()))
+	g.Expect(*executed).To(BeEmpty())
+	current, err := GetAttestation(context.Background(), r.Client, key)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(r.GetCondition(current, keylimev1alpha1.ConditionReady).Reason).To(Equal(ReasonPodNotReady))
+
+	// Status updates not changing readiness are ignored
+	restarted := starting.DeepCopy()
+	restarted.Status.ContainerStatuses[0].RestartCount = 1
+	g.Expect(enqueuedPodUpdate(r, starting, restarted)).To(BeEmpty())
+
+	// Pod becoming ready enqueues the attestation targeting it only
+	ready := testPod("keylime", "agent", true)
+	g.Expect(enqueuedPodUpdate(r, starting, ready)).To(ConsistOf(reconcile.Request{NamespacedName: key}))
+	g.Expect(r.Client.Update(context.Background(), ready)).To(Succeed())
+	_, err = r.Reconcile(context.Background(), ctrl.Request{NamespacedName: key})
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(*executed).To(ConsistOf("attest"))
+}
+
+func TestPodPredicate(t *testing.T) {
+	g := NewWithT(t)
+	p := podPredicate()
+	pod := testPod("keylime", "agent", true)
+
+	g.Expect(p.Create(event.CreateEvent{Object: pod})).To(BeTrue())
+	g.Expect(p.Delete(event.DeleteEvent{Object: pod})).To(BeTrue())
+
+	relabeled := pod.DeepCopy()
+	relabeled.Labels = map[string]string{"app": "agent"}
+	g.Expect(p.Update(event.UpdateEvent{ObjectOld: pod, ObjectNew: relabeled})).To(BeTrue())
+
+	initialized := pod.DeepCopy()
+	initialized.Status.InitContainerStatuses = []core_v1.ContainerStatus{{Name: "measure",
+		State: core_v1.ContainerState{Terminated: &core_v1.ContainerStateTerminated{}}}}
+	g.Expect(p.Update(event.UpdateEvent{ObjectOld: pod, ObjectNew: initialized})).To(BeTrue())
+
+	g.Expect(p.Update(event.UpdateEvent{ObjectOld: pod, ObjectNew: pod.DeepCopy()})).To(BeFalse())
+}
+
+func TestTargetsPod(t *testing.T) {
+	g := NewWithT(t)
+	pod := testPod("keylime", "agent", true)
+	pod.Labels = map[string]string{"app": "agent"}
+
+	g.Expect(targetsPod(podAttestation("keylime", "attestation", "agent"), pod)).To(BeTrue())
+	g.Expect(targetsPod(podAttestation("keylime", "attestation", "other"), pod)).To(BeFalse())
+	g.Expect(targetsPod(podAttestation("default", "attestation", "agent"), pod)).To(BeFalse())
+
+	// Namespace of the pod attestation takes precedence over the namespace of the attestation
+	attestation := podAttestation("default", "attestation", "agent")
+	attestation.Spec.PodAttestationInfo.Namespace = "keylime"
+	g.Expect(targetsPod(attestation, pod)).To(BeTrue())
+
+	selected := podAttestation("keylime", "attestation", "")
+	selected.Spec.PodSelector = &metav1.LabelSelector{MatchLabels: map[string]string{"app": "agent"}}
+	g.Expect(targetsPod(selected, pod)).To(BeTrue())
+	selected.Spec.PodSelector.MatchLabels["app"] = "verifier"
+	g.Expect(targetsPod(selected, pod)).To(BeFalse())
+
+	g.Expect(targetsPod(&keylimev1alpha1.Attestation{}, pod)).To(BeFalse())
+}
+
+func TestPodReadsThroughClient(t *testing.T) {
+	g := NewWithT(t)
+	crashing := testPod("keylime", "crashing", false)
+	crashing.Status.ContainerStatuses[0].State.Waiting = &core_v1.ContainerStateWaiting{Reason: crashLoopBackOffReason}
+	labeled := testPod("keylime", "labeled", true)
+	labeled.Labels = map[string]string{"app": "agent"}
+	measuring := initContainerPod("measuring", &core_v1.ContainerState{Running: &core_v1.ContainerStateRunning{}})
+	r := testReconciler(t, testPod("keylime", "ready", true), crashing, labeled, measuring)
+
+	ready, err := r.podIsReady(context.Background(), "keylime", "ready")
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(ready).To(BeTrue())
+	_, err = r.podIsReady(context.Background(), "keylime", "crashing")
+	g.Expect(errors.Is(err, ErrPodUnhealthy)).To(BeTrue())
+	_, err = r.podIsReady(context.Background(), "keylime", "missing")
+	g.Expect(errors.Is(err, ErrPodNotFound)).To(BeTrue())
+
+	state, err := r.initContainerState(context.Background(), "keylime", "measuring", "measure")
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(state.Running).NotTo(BeNil())
+
+	selector, err := metav1.LabelSelectorAsSelector(&metav1.LabelSelector{MatchLabels: map[string]string{"app": "agent"}})
+	g.Expect(err).NotTo(HaveOccurred())
+	pods, err := r.listPods(context.Background(), "keylime", selector)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(podNames(pods)).To(ConsistOf("labeled"))
+}
@@ -0,0 +1,137 @@
+/*
+Copyright 2023.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"io"
+
+	core_v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// DefaultMaxPodLogBytes bounds the logs retrieved from a pod, so that chatty agents can not exhaust memory
+const DefaultMaxPodLogBytes = 1 << 20
+
+// PodLogsOptions allows customizing the retrieval of the logs of a pod
+type PodLogsOptions struct {
+	// SinceTime retrieves the logs written after this time only
+	SinceTime *metav1.Time
+	// MaxBytes bounds the logs retrieved, keeping the most recent ones. DefaultMaxPodLogBytes is used if not set
+	MaxBytes int
+}
+
+// mergePodLogsOptions merges the optional options provided into a single set of options
+func mergePodLogsOptions(options []PodLogsOptions) PodLogsOptions {
+	merged := PodLogsOptions{}
+	for _, o := range options {
+		if o.SinceTime != nil {
+			merged.SinceTime = o.SinceTime
+		}
+		if o.MaxBytes > 0 {
+			merged.MaxBytes = o.MaxBytes
+		}
+	}
+	if merged.MaxBytes <= 0 {
+		merged.MaxBytes = DefaultMaxPodLogBytes
+	}
+	return merged
+}
+
+// GetPodLogs retrieves the logs of a particular container of a pod, e.g. the output of the agent
+// :param context
+// :param string namespace: namespace of the Pod
+// :param string podName: name of the Pod
+// :param string containerName: name of the container. If empty, the container is selected as for PodExecStream
+// :param int64 tailLines: number of most recent lines retrieved, or all the lines if not positive
+// :param ...PodLogsOptions options: optional restrictions on the logs to retrieve, e.g. since a particular time
+//
+// :return:
+//
+//	string: Logs of the container, truncated to the most recent MaxBytes bytes
+//	error: ErrPodNotFound (wrapped) if the pod does not exist, any other error if it occurred, otherwise `nil`
+func GetPodLogs(ctx context.Context, namespace, podName, containerName string, tailLines int64,
+	options ...PodLogsOptions) (string, error) {
+	if err := validateNamespace(namespace); err != nil {
+		return "", err
+	}
+	clientset, err := GetClusterClientsetWithContext(ctx)
+	if err != nil {
+		GetLogInstance().Info("Unable to get ClusterClientset")
+		return "", err
+	}
+	return getPodLogs(ctx, clientset, namespace, podName, containerName, tailLines, mergePodLogsOptions(options))
+}
+
+// getPodLogs retrieves the logs of a container of a pod using the clientset provided
+func getPodLogs(ctx context.Context, clientset kubernetes.Interface, namespace, podName, containerName string,
+	tailLines int64, options PodLogsOptions) (string, error) {
+	containerName, err := resolveContainerName(ctx, clientset, namespace, podName, containerName, false)
+	if err != nil {
+		return "", err
+	}
+	logOptions := &core_v1.PodLogOptions{
+		Container: containerName,
+		SinceTime: options.SinceTime,
+	}
+	if tailLines > 0 {
+		logOptions.TailLines = &tailLines
+	}
+	stream, err := clientset.CoreV1().Pods(namespace).GetLogs(podName, logOptions).Stream(ctx)
+	if err != nil {
+		if apierrors.IsNotFound(err) {
+			return "", fmt.Errorf("%w: %s/%s: %v", ErrPodNotFound, namespace, podName, err)
+		}
+		return "", fmt.Errorf("unable to get logs of pod %s/%s: %w", namespace, podName, err)
+	}
+	defer stream.Close()
+	logs := &tailBuffer{max: options.MaxBytes}
+	if _, err = io.Copy(logs, stream); err != nil {
+		return "", fmt.Errorf("unable to read logs of pod %s/%s: %w", namespace, podName, err)
+	}
+	if logs.truncated {
+		GetLogInstance().Info("Pod logs truncated", "Namespace", namespace, "Pod", podName,
+			"Container", containerName, "Max Bytes", options.MaxBytes)
+	}
+	return string(logs.data), nil
+}
+
+// tailBuffer keeps the last max bytes written to it, discarding older ones
+type tailBuffer struct {
+	data      []byte
+	max       int
+	truncated bool
+}
+
+// Write appends the bytes provided, discarding the oldest bytes beyond the maximum size
+func (b *tailBuffer) Write(p []byte) (int, error) {
+	written := len(p)
+	if len(p) >= b.max {
+		b.truncated = b.truncated || len(p) > b.max || len(b.data) > 0
+		b.data = append(b.data[:0], p[len(p)-b.max:]...)
+		return written, nil
+	}
+	if excess := len(b.data) + len(p) - b.max; excess > 0 {
+		b.truncated = true
+		b.data = append(b.data[:0], b.data[excess:]...)
+	}
+	b.data = append(b.data, p...)
+	return written, nil
+}
@@ -0,0 +1,82 @@
+/*
+Copyright 2023.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/go-logr/logr"
+	. "github.com/onsi/gomega"
+	core_v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+func TestGetPodLogs(t *testing.T) {
+	g := NewWithT(t)
+	SetLogInstance(logr.Discard())
+	clientset := fake.NewSimpleClientset(testPod("keylime", "agent", true))
+
+	// Fake clientset streams a fixed log body
+	logs, err := getPodLogs(context.Background(), clientset, "keylime", "agent", "", 10, mergePodLogsOptions(nil))
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(logs).To(Equal("fake logs"))
+
+	logs, err = getPodLogs(context.Background(), clientset, "keylime", "agent", "agent", 0,
+		mergePodLogsOptions([]PodLogsOptions{{MaxBytes: 4}}))
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(logs).To(Equal("logs"))
+
+	_, err = getPodLogs(context.Background(), clientset, "keylime", "missing", "", 10, mergePodLogsOptions(nil))
+	g.Expect(errors.Is(err, ErrPodNotFound)).To(BeTrue())
+}
+
+func TestGetInitContainerLogs(t *testing.T) {
+	g := NewWithT(t)
+	SetLogInstance(logr.Discard())
+	clientset := fake.NewSimpleClientset(initContainerPod("agent", &core_v1.ContainerState{
+		Terminated: &core_v1.ContainerStateTerminated{ExitCode: 0}}))
+	var container string
+	clientset.PrependReactor("get", "pods", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		if action.GetSubresource() == "log" {
+			container = action.(k8stesting.GenericAction).GetValue().(*core_v1.PodLogOptions).Container
+		}
+		return false, nil, nil
+	})
+
+	// Init containers are selected by name, as they are not candidates of the container selection
+	logs, err := getPodLogs(context.Background(), clientset, "keylime", "agent", "measure", 0, mergePodLogsOptions(nil))
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(logs).To(Equal("fake logs"))
+	g.Expect(container).To(Equal("measure"))
+}
+
+func TestTailBuffer(t *testing.T) {
+	g := NewWithT(t)
+	b := &tailBuffer{max: 5}
+	_, _ = b.Write([]byte("abc"))
+	g.Expect(string(b.data)).To(Equal("abc"))
+	g.Expect(b.truncated).To(BeFalse())
+	_, _ = b.Write([]byte("def"))
+	g.Expect(string(b.data)).To(Equal("bcdef"))
+	g.Expect(b.truncated).To(BeTrue())
+	_, _ = b.Write([]byte("0123456"))
+	g.Expect(string(b.data)).To(Equal("23456"))
+}
@@ -0,0 +1,174 @@
+/*
+Copyright 2023.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	"sort"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+	"k8s.io/client-go/kubernetes"
+	"sigs.k8s.io/yaml"
+)
+
+// PolicyConfigMapKey is the key of the ConfigMap data containing the attestation policy
+const PolicyConfigMapKey = "policy.yaml"
+
+// AttestationPolicy contains the expected state of the attested pods
+type AttestationPolicy struct {
+	// HashAlgorithm is the hash algorithm of the PCR bank to verify, e.g. sha256
+	HashAlgorithm string `json:"hashalgorithm,omitempty"`
+	// PCRs contains the expected digest of each PCR to verify, keyed by PCR index
+	PCRs map[int]string `json:"pcrs,omitempty"`
+}
+
+// MaxPCRIndex is the highest PCR index of a TPM 2.0 PCR bank
+const MaxPCRIndex = 23
+
+// policyDigestSizes contains the digest size in bytes of each hash algorithm allowed in attestation policies
+var policyDigestSizes = map[string]int{
+	"sha1":    20,
+	"sha256":  32,
+	"sha384":  48,
+	"sha512":  64,
+	"sm3_256": 32,
+}
+
+// ValidatePolicy parses the attestation policy provided, as stored in the PolicyConfigMapKey key of a
+// ConfigMap, and checks it is valid: hash algorithm and PCRs are required, hash algorithm must be one of
+// the allowed ones, and PCR digests must be hex encoded digests of the hash algorithm
+//
+// :return:
+//
+//	error: If the policy can not be parsed, or an aggregate of all the validation errors of the policy
+//	       (see k8s.io/apimachinery/pkg/util/errors.Aggregate), otherwise `nil`
+func ValidatePolicy(data []byte) error {
+	policy := &AttestationPolicy{}
+	if err := yaml.UnmarshalStrict(data, policy); err != nil {
+		return fmt.Errorf("unable to parse attestation policy: %w", err)
+	}
+	return policy.Validate().ToAggregate()
+}
+
+// Validate returns all the validation errors of the attestation policy, see ValidatePolicy
+func (p *AttestationPolicy) Validate() field.ErrorList {
+	var errs field.ErrorList
+	digestSize, known := policyDigestSizes[p.HashAlgorithm]
+	algorithmPath := field.NewPath("hashalgorithm")
+	switch {
+	case p.HashAlgorithm == "":
+		errs = append(errs, field.Required(algorithmPath, "hash algorithm must be specified"))
+	case !known:
+		allowed := make([]string, 0, len(policyDigestSizes))
+		for algorithm := range policyDigestSizes {
+			allowed = append(allowed, algorithm)
+		}
+		sort.Strings(allowed)
+		errs = append(errs, field.NotSupported(algorithmPath, p.HashAlgorithm, allowed))
+	}
+	pcrsPath := field.NewPath("pcrs")
+	if len(p.PCRs) == 0 {
+		errs = append(errs, field.Required(pcrsPath, "at least one PCR must be specified"))
+	}
+	indexes := make([]int, 0, len(p.PCRs))
+	for index := range p.PCRs {
+		indexes = append(indexes, index)
+	}
+	sort.Ints(indexes)
+	for _, index := range indexes {
+		path := pcrsPath.Key(fmt.Sprint(index))
+		if index < 0 || index > MaxPCRIndex {
+			errs = append(errs, field.Invalid(path, index, fmt.Sprintf("PCR index must be between 0 and %d", MaxPCRIndex)))
+		}
+		digest, err := hex.DecodeString(p.PCRs[index])
+		switch {
+		case err != nil:
+			errs = append(errs, field.Invalid(path, p.PCRs[index], "digest must be hex encoded"))
+		case known && len(digest) != digestSize:
+			// Digests are checked against the hash algorithm only if it is valid, not to report every digest
+			errs = append(errs, field.Invalid(path, p.PCRs[index], fmt.Sprintf("digest must be %d bytes long for %s",
+				digestSize, p.HashAlgorithm)))
+		}
+	}
+	return errs
+}
+
+// GetConfigMapData retrieves the data of a ConfigMap
+// :param context
+// :param string namespace: namespace of the ConfigMap
+// :param string name: name of the ConfigMap
+//
+// :return:
+//
+//	map[string]string: data of the ConfigMap
+//	error: If any error has occurred otherwise `nil`
+func GetConfigMapData(ctx context.Context, namespace, name string) (map[string]string, error) {
+	if err := validateNamespace(namespace); err != nil {
+		return nil, err
+	}
+	clientset, err := GetClusterClientsetWithContext(ctx)
+	if err != nil {
+		GetLogInstance().Info("Unable to get ClusterClientset")
+		return nil, err
+	}
+	return getConfigMapData(ctx, clientset, namespace, name)
+}
+
+// getConfigMapData retrieves the data of a ConfigMap using the clientset provided
+func getConfigMapData(ctx context.Context, clientset kubernetes.Interface, namespace, name string) (map[string]string, error) {
+	configMap, err := clientset.CoreV1().ConfigMaps(namespace).Get(ctx, name, metav1.GetOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("unable to get ConfigMap %s/%s: %w", namespace, name, checkThrottled(err))
+	}
+	return configMap.Data, nil
+}
+
+// LoadAttestationPolicy retrieves the attestation policy stored in the PolicyConfigMapKey key of a ConfigMap
+// :param context
+// :param types.NamespacedName ref: namespace and name of the ConfigMap
+//
+// :return:
+//
+//	*AttestationPolicy: attestation policy
+//	error: If the ConfigMap can not be retrieved, the key is missing or the policy is invalid, otherwise `nil`
+func LoadAttestationPolicy(ctx context.Context, ref types.NamespacedName) (*AttestationPolicy, error) {
+	data, err := GetConfigMapData(ctx, ref.Namespace, ref.Name)
+	if err != nil {
+		return nil, err
+	}
+	return attestationPolicyFromData(ref, data)
+}
+
+// attestationPolicyFromData parses and validates the attestation policy from the data of the ConfigMap provided
+func attestationPolicyFromData(ref types.NamespacedName, data map[string]string) (*AttestationPolicy, error) {
+	raw, found := data[PolicyConfigMapKey]
+	if !found {
+		return nil, fmt.Errorf("key %q not found in ConfigMap %s", PolicyConfigMapKey, ref)
+	}
+	policy := &AttestationPolicy{}
+	if err := yaml.UnmarshalStrict([]byte(raw), policy); err != nil {
+		return nil, fmt.Errorf("invalid attestation policy in ConfigMap %s: %w", ref, err)
+	}
+	if errs := policy.Validate(); len(errs) > 0 {
+		return nil, fmt.Errorf("invalid attestation policy in ConfigMap %s: %w", ref, errs.ToAggregate())
+	}
+	return policy, nil
+}
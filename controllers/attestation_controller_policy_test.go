@@ -0,0 +1,144 @@
+/*
+Copyright 2023.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	. "github.com/onsi/gomega"
+	core_v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	utilerrors "k8s.io/apimachinery/pkg/util/errors"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestGetConfigMapData(t *testing.T) {
+	g := NewWithT(t)
+	clientset := fake.NewSimpleClientset(&core_v1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "keylime", Name: "policy"},
+		Data:       map[string]string{PolicyConfigMapKey: "hashalgorithm: sha256"},
+	})
+
+	data, err := getConfigMapData(context.Background(), clientset, "keylime", "policy")
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(data).To(HaveKeyWithValue(PolicyConfigMapKey, "hashalgorithm: sha256"))
+
+	_, err = getConfigMapData(context.Background(), clientset, "keylime", "missing")
+	g.Expect(apierrors.IsNotFound(err)).To(BeTrue())
+}
+
+func TestAttestationPolicyFromData(t *testing.T) {
+	g := NewWithT(t)
+	ref := types.NamespacedName{Namespace: "keylime", Name: "policy"}
+
+	policy, err := attestationPolicyFromData(ref, map[string]string{
+		PolicyConfigMapKey: "hashalgorithm: sha256\npcrs:\n  0: 3d458cfe55cc03ea1f443f1562beec8df51c75e14a9fcf9a7234a13f198e7969\n",
+	})
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(policy.HashAlgorithm).To(Equal("sha256"))
+	g.Expect(policy.PCRs).To(HaveKeyWithValue(0, "3d458cfe55cc03ea1f443f1562beec8df51c75e14a9fcf9a7234a13f198e7969"))
+
+	_, err = attestationPolicyFromData(ref, map[string]string{"other.yaml": ""})
+	g.Expect(err).To(MatchError(ContainSubstring(`key "policy.yaml" not found in ConfigMap keylime/policy`)))
+
+	_, err = attestationPolicyFromData(ref, map[string]string{PolicyConfigMapKey: "pcrs: [unterminated"})
+	g.Expect(err).To(MatchError(ContainSubstring("invalid attestation policy in ConfigMap keylime/policy")))
+
+	_, err = attestationPolicyFromData(ref, map[string]string{PolicyConfigMapKey: "unknown: field"})
+	g.Expect(err).To(MatchError(ContainSubstring("invalid attestation policy")))
+}
+
+func TestValidatePolicy(t *testing.T) {
+	sha1Digest := strings.Repeat("ab", 20)
+	sha256Digest := strings.Repeat("ab", 32)
+	tests := []struct {
+		name   string
+		policy string
+		errors []string
+	}{
+		{
+			name:   "valid",
+			policy: "hashalgorithm: sha256\npcrs:\n  0: " + sha256Digest + "\n  7: " + sha256Digest + "\n",
+		},
+		{
+			name:   "empty",
+			policy: "",
+			errors: []string{"hashalgorithm: Required value", "pcrs: Required value"},
+		},
+		{
+			name:   "unsupported hash algorithm",
+			policy: "hashalgorithm: md5\npcrs:\n  0: " + sha256Digest + "\n",
+			errors: []string{`hashalgorithm: Unsupported value: "md5"`},
+		},
+		{
+			name:   "PCR index out of range",
+			policy: "hashalgorithm: sha256\npcrs:\n  24: " + sha256Digest + "\n  -1: " + sha256Digest + "\n",
+			errors: []string{"pcrs[-1]: Invalid value: -1", "pcrs[24]: Invalid value: 24"},
+		},
+		{
+			name:   "digest not hex encoded",
+			policy: "hashalgorithm: sha256\npcrs:\n  0: not-a-digest\n",
+			errors: []string{`pcrs[0]: Invalid value: "not-a-digest": digest must be hex encoded`},
+		},
+		{
+			name:   "digest of another hash algorithm",
+			policy: "hashalgorithm: sha256\npcrs:\n  0: " + sha1Digest + "\n  1: " + sha256Digest + "\n",
+			errors: []string{"pcrs[0]: Invalid value: \"" + sha1Digest + "\": digest must be 32 bytes long for sha256"},
+		},
+		{
+			name:   "several errors",
+			policy: "hashalgorithm: sha256\npcrs:\n  0: " + sha1Digest + "\n  25: " + sha256Digest + "\n  3: xyz\n",
+			errors: []string{"pcrs[0]: Invalid value", "pcrs[3]: Invalid value", "pcrs[25]: Invalid value"},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			g := NewWithT(t)
+			err := ValidatePolicy([]byte(test.policy))
+			if len(test.errors) == 0 {
+				g.Expect(err).NotTo(HaveOccurred())
+				return
+			}
+			var aggregate utilerrors.Aggregate
+			g.Expect(errors.As(err, &aggregate)).To(BeTrue())
+			g.Expect(aggregate.Errors()).To(HaveLen(len(test.errors)))
+			for i, message := range test.errors {
+				g.Expect(aggregate.Errors()[i].Error()).To(HavePrefix(message))
+			}
+		})
+	}
+}
+
+func TestValidatePolicyParseErrors(t *testing.T) {
+	g := NewWithT(t)
+	err := ValidatePolicy([]byte("pcrs: [unterminated"))
+	g.Expect(err).To(MatchError(ContainSubstring("unable to parse attestation policy")))
+	err = ValidatePolicy([]byte("hashalgorithm: sha256\nunknown: field\n"))
+	g.Expect(err).To(MatchError(ContainSubstring("unable to parse attestation policy")))
+}
+
+func TestAttestationPolicyFromDataValidates(t *testing.T) {
+	g := NewWithT(t)
+	ref := types.NamespacedName{Namespace: "keylime", Name: "policy"}
+	_, err := attestationPolicyFromData(ref, map[string]string{PolicyConfigMapKey: "hashalgorithm: sha256"})
+	g.Expect(err).To(MatchError(ContainSubstring("invalid attestation policy in ConfigMap keylime/policy: pcrs: Required value")))
+}
@@ -0,0 +1,116 @@
+/*
+Copyright 2023.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sync"
+
+	"k8s.io/apimachinery/pkg/util/httpstream"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/portforward"
+	"k8s.io/client-go/transport/spdy"
+)
+
+// newPortForwardDialer creates the dialer used to forward ports of pods. It can be replaced in tests
+var newPortForwardDialer = func(config *rest.Config, portForwardURL *url.URL) (httpstream.Dialer, error) {
+	transport, upgrader, err := spdy.RoundTripperFor(config)
+	if err != nil {
+		return nil, err
+	}
+	return spdy.NewDialer(upgrader, &http.Client{Transport: transport}, http.MethodPost, portForwardURL), nil
+}
+
+// PodPortForward forwards a local port to a port of a pod, e.g. to reach the HTTP attestation endpoint
+// of an agent from the operator. Forwarding stops when the stop function is called or the context is done
+// :param context: bounds both the setup and the duration of the forwarding
+// :param string namespace: namespace of the Pod
+// :param string podName: name of the Pod
+// :param int localPort: local port, on localhost, forwarded to the pod. It must be available
+// :param int remotePort: port of the pod
+//
+// :return:
+//
+//	func(): Function stopping the forwarding. It can be called several times
+//	error: KindError of kind ErrConfigUnavailable or ErrClientsetCreation if the API server can not be accessed,
+//	       any other error if forwarding could not be set up, otherwise `nil`
+func PodPortForward(ctx context.Context, namespace, podName string, localPort, remotePort int) (func(), error) {
+	if err := validateNamespace(namespace); err != nil {
+		return nil, err
+	}
+	if localPort <= 0 || localPort > 65535 || remotePort <= 0 || remotePort > 65535 {
+		return nil, fmt.Errorf("invalid ports %d:%d, ports must be between 1 and 65535", localPort, remotePort)
+	}
+	config, err := GetClusterClientConfigWithContext(ctx)
+	if err != nil {
+		GetLogInstance().Info("Unable to get ClusterClientConfig")
+		return nil, err
+	}
+	clientset, err := GetClientsetFromClusterConfig(config)
+	if err != nil {
+		GetLogInstance().Info("Unable to get ClientSetFromClusterConfig")
+		return nil, err
+	}
+	request := clientset.CoreV1().RESTClient().
+		Post().
+		Namespace(namespace).
+		Resource("pods").
+		Name(podName).
+		SubResource("portforward")
+	dialer, err := newPortForwardDialer(config, request.URL())
+	if err != nil {
+		return nil, fmt.Errorf("unable to create port forward dialer: %w", err)
+	}
+
+	stopChan := make(chan struct{})
+	var stopOnce sync.Once
+	stop := func() {
+		stopOnce.Do(func() { close(stopChan) })
+	}
+	readyChan := make(chan struct{})
+	forwarder, err := portforward.New(dialer, []string{fmt.Sprintf("%d:%d", localPort, remotePort)}, stopChan,
+		readyChan, io.Discard, io.Discard)
+	if err != nil {
+		return nil, fmt.Errorf("unable to create port forwarder: %w", err)
+	}
+	errChan := make(chan error, 1)
+	go func() {
+		errChan <- forwarder.ForwardPorts()
+	}()
+	select {
+	case <-readyChan:
+	case err = <-errChan:
+		return nil, fmt.Errorf("unable to forward port %d to %s/%s:%d: %w", localPort, namespace, podName, remotePort, err)
+	case <-ctx.Done():
+		stop()
+		return nil, ctx.Err()
+	}
+	GetLogInstance().Info("Forwarding port", "Namespace", namespace, "Pod", podName, "Local Port", localPort,
+		"Remote Port", remotePort)
+	go func() {
+		select {
+		case <-ctx.Done():
+			stop()
+		case <-stopChan:
+		}
+	}()
+	return stop, nil
+}
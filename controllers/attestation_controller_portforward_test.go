@@ -0,0 +1,187 @@
+/*
+Copyright 2023.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+
+	. "github.com/onsi/gomega"
+	core_v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/httpstream"
+	"k8s.io/client-go/rest"
+)
+
+// fakePortForwardStream is a port forward stream backed by a connection to the agent, for data streams,
+// or an empty error stream
+type fakePortForwardStream struct {
+	conn    net.Conn
+	headers http.Header
+}
+
+func (s *fakePortForwardStream) Read(p []byte) (int, error) {
+	if s.conn == nil {
+		return 0, io.EOF
+	}
+	return s.conn.Read(p)
+}
+
+func (s *fakePortForwardStream) Write(p []byte) (int, error) {
+	if s.conn == nil {
+		return len(p), nil
+	}
+	return s.conn.Write(p)
+}
+
+func (s *fakePortForwardStream) Close() error {
+	if conn, ok := s.conn.(*net.TCPConn); ok {
+		return conn.CloseWrite()
+	}
+	return nil
+}
+
+func (s *fakePortForwardStream) Reset() error {
+	if s.conn == nil {
+		return nil
+	}
+	return s.conn.Close()
+}
+
+func (s *fakePortForwardStream) Headers() http.Header { return s.headers }
+
+func (s *fakePortForwardStream) Identifier() uint32 { return 0 }
+
+// fakePortForwardConnection forwards data streams to the agent address provided, as the kubelet would
+type fakePortForwardConnection struct {
+	agent     string
+	closed    chan bool
+	closeOnce sync.Once
+}
+
+func (c *fakePortForwardConnection) CreateStream(headers http.Header) (httpstream.Stream, error) {
+	stream := &fakePortForwardStream{headers: headers}
+	if headers.Get(core_v1.StreamType) == core_v1.StreamTypeData {
+		conn, err := net.Dial("tcp", c.agent)
+		if err != nil {
+			return nil, err
+		}
+		stream.conn = conn
+	}
+	return stream, nil
+}
+
+func (c *fakePortForwardConnection) Close() error {
+	c.closeOnce.Do(func() { close(c.closed) })
+	return nil
+}
+
+func (c *fakePortForwardConnection) CloseChan() <-chan bool { return c.closed }
+
+func (c *fakePortForwardConnection) SetIdleTimeout(time.Duration) {}
+
+func (c *fakePortForwardConnection) RemoveStreams(streams ...httpstream.Stream) {
+	for _, stream := range streams {
+		_ = stream.Reset()
+	}
+}
+
+// fakePortForwardDialer dials fake port forward connections, or fails with the error provided
+type fakePortForwardDialer struct {
+	agent string
+	err   error
+}
+
+func (d *fakePortForwardDialer) Dial(...string) (httpstream.Connection, string, error) {
+	if d.err != nil {
+		return nil, "", d.err
+	}
+	return &fakePortForwardConnection{agent: d.agent, closed: make(chan bool)}, "portforward.k8s.io", nil
+}
+
+// usePortForwardDialer replaces the port forward dialer factory for the duration of the test
+func usePortForwardDialer(t *testing.T, dialer httpstream.Dialer) *url.URL {
+	requested := &url.URL{}
+	original := newPortForwardDialer
+	newPortForwardDialer = func(_ *rest.Config, u *url.URL) (httpstream.Dialer, error) {
+		*requested = *u
+		return dialer, nil
+	}
+	t.Cleanup(func() { newPortForwardDialer = original })
+	return requested
+}
+
+// freePort returns a local port available for listening
+func freePort(t *testing.T) int {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	return listener.Addr().(*net.TCPAddr).Port
+}
+
+func TestPodPortForward(t *testing.T) {
+	g := NewWithT(t)
+	useFakeConfig(t)
+	agent := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		_, _ = w.Write([]byte("quote"))
+	}))
+	defer agent.Close()
+	requested := usePortForwardDialer(t, &fakePortForwardDialer{agent: agent.Listener.Addr().String()})
+	localPort := freePort(t)
+
+	stop, err := PodPortForward(context.Background(), "keylime", "agent", localPort, 9002)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(requested.Path).To(Equal("/api/v1/namespaces/keylime/pods/agent/portforward"))
+
+	response, err := http.Get(fmt.Sprintf("http://127.0.0.1:%d/quote", localPort))
+	g.Expect(err).NotTo(HaveOccurred())
+	body, err := io.ReadAll(response.Body)
+	_ = response.Body.Close()
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(string(body)).To(Equal("quote"))
+
+	stop()
+	stop()
+	g.Eventually(func() error {
+		conn, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", localPort))
+		if err == nil {
+			_ = conn.Close()
+		}
+		return err
+	}).Should(HaveOccurred())
+}
+
+func TestPodPortForwardSetupError(t *testing.T) {
+	g := NewWithT(t)
+	useFakeConfig(t)
+	usePortForwardDialer(t, &fakePortForwardDialer{err: fmt.Errorf("pods \"agent\" is forbidden")})
+
+	_, err := PodPortForward(context.Background(), "keylime", "agent", freePort(t), 9002)
+	g.Expect(err).To(MatchError(ContainSubstring("forbidden")))
+
+	_, err = PodPortForward(context.Background(), "keylime", "agent", 0, 9002)
+	g.Expect(err).To(MatchError(ContainSubstring("invalid ports")))
+}
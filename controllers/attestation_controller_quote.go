@@ -0,0 +1,132 @@
+/*
+Copyright 2023.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"unicode"
+)
+
+// DefaultMaxDecompressedSize is the maximum size of decompressed data, e.g. measured boot event logs
+const DefaultMaxDecompressedSize = 64 * 1024 * 1024
+
+// ErrDecompressedTooLarge is returned when decompressed data exceeds the maximum size allowed
+var ErrDecompressedTooLarge = errors.New("decompressed data too large")
+
+// gzipMagic are the first bytes of gzip compressed data
+var gzipMagic = []byte{0x1f, 0x8b}
+
+// quoteEncodings are the base64 encodings accepted for attestation quotes, in order of preference
+var quoteEncodings = []*base64.Encoding{
+	base64.StdEncoding,
+	base64.RawStdEncoding,
+	base64.URLEncoding,
+	base64.RawURLEncoding,
+}
+
+// DecodeQuote decodes a base64 encoded attestation quote, as returned by the agent pods. Both standard
+// and URL safe encodings, padded or not, are accepted, and whitespace (e.g. line wrapping) is ignored
+// :param string raw: base64 encoded quote
+//
+// :return:
+//
+//	[]byte: decoded quote
+//	error: If quote is empty or not base64 encoded, otherwise `nil`
+func DecodeQuote(raw string) ([]byte, error) {
+	quote := strings.Map(func(r rune) rune {
+		if unicode.IsSpace(r) {
+			return -1
+		}
+		return r
+	}, raw)
+	if quote == "" {
+		return nil, fmt.Errorf("unable to decode quote: empty quote")
+	}
+	var err error
+	for _, encoding := range quoteEncodings {
+		var decoded []byte
+		if decoded, err = encoding.DecodeString(quote); err == nil {
+			return decoded, nil
+		}
+	}
+	return nil, fmt.Errorf("unable to decode quote: invalid base64 data: %w", err)
+}
+
+// ParsePEMCertificate parses a PEM encoded certificate, such as the agent certificate
+// :param string raw: PEM encoded certificate
+//
+// :return:
+//
+//	*x509.Certificate: parsed certificate
+//	error: If no PEM certificate is found or it can not be parsed, otherwise `nil`
+func ParsePEMCertificate(raw string) (*x509.Certificate, error) {
+	block, _ := pem.Decode([]byte(strings.TrimSpace(raw)))
+	if block == nil {
+		return nil, fmt.Errorf("unable to parse agent certificate: no PEM data found")
+	}
+	if block.Type != "CERTIFICATE" {
+		return nil, fmt.Errorf("unable to parse agent certificate: unexpected PEM block type %q", block.Type)
+	}
+	certificate, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse agent certificate: %w", err)
+	}
+	return certificate, nil
+}
+
+// DecompressIfGzip decompresses gzip compressed data, such as the measured boot event logs compressed by
+// the agents, up to DefaultMaxDecompressedSize. Data not compressed is returned as it is
+func DecompressIfGzip(data []byte) ([]byte, error) {
+	return DecompressIfGzipWithLimit(data, DefaultMaxDecompressedSize)
+}
+
+// DecompressIfGzipWithLimit decompresses gzip compressed data, returning data not compressed as it is
+// :param []byte data: data, compressed or not
+// :param int64 maxSize: maximum size of the decompressed data, to protect against decompression bombs
+//
+// :return:
+//
+//	[]byte: decompressed data
+//	error: ErrDecompressedTooLarge (wrapped) if decompressed data exceeds maxSize, any other error if data
+//	       can not be decompressed, otherwise `nil`
+func DecompressIfGzipWithLimit(data []byte, maxSize int64) ([]byte, error) {
+	if !bytes.HasPrefix(data, gzipMagic) {
+		return data, nil
+	}
+	reader, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("unable to decompress gzip data: %w", err)
+	}
+	defer reader.Close()
+	// One more byte than allowed is read, to detect data exceeding the maximum size
+	decompressed, err := io.ReadAll(io.LimitReader(reader, maxSize+1))
+	if err != nil {
+		return nil, fmt.Errorf("unable to decompress gzip data: %w", err)
+	}
+	if int64(len(decompressed)) > maxSize {
+		return nil, fmt.Errorf("%w: exceeds %d bytes", ErrDecompressedTooLarge, maxSize)
+	}
+	return decompressed, nil
+}
@@ -0,0 +1,126 @@
+/*
+Copyright 2023.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"math/big"
+	"testing"
+	"time"
+
+	. "github.com/onsi/gomega"
+)
+
+func TestDecodeQuote(t *testing.T) {
+	g := NewWithT(t)
+	// Bytes whose standard and URL safe encodings differ
+	quote := []byte{0xfb, 0xff, 0xfe, 0x01}
+	for _, encoding := range quoteEncodings {
+		decoded, err := DecodeQuote(" " + encoding.EncodeToString(quote) + "\n")
+		g.Expect(err).NotTo(HaveOccurred())
+		g.Expect(decoded).To(Equal(quote))
+	}
+
+	decoded, err := DecodeQuote("cXVv\ndGU=\n")
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(decoded).To(Equal([]byte("quote")))
+
+	_, err = DecodeQuote(" \n")
+	g.Expect(err).To(MatchError("unable to decode quote: empty quote"))
+	_, err = DecodeQuote("not base64!")
+	g.Expect(err).To(MatchError(ContainSubstring("unable to decode quote: invalid base64 data")))
+}
+
+// testCertificate returns a self-signed certificate, DER encoded
+func testCertificate(t *testing.T, commonName string) []byte {
+	g := NewWithT(t)
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	g.Expect(err).NotTo(HaveOccurred())
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    time.Now(),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	g.Expect(err).NotTo(HaveOccurred())
+	return der
+}
+
+func TestParsePEMCertificate(t *testing.T) {
+	g := NewWithT(t)
+	der := testCertificate(t, "agent")
+
+	certificate, err := ParsePEMCertificate(string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})))
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(certificate.Subject.CommonName).To(Equal("agent"))
+
+	_, err = ParsePEMCertificate(base64.StdEncoding.EncodeToString(der))
+	g.Expect(err).To(MatchError(ContainSubstring("no PEM data found")))
+	_, err = ParsePEMCertificate(string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})))
+	g.Expect(err).To(MatchError(ContainSubstring(`unexpected PEM block type "PRIVATE KEY"`)))
+	_, err = ParsePEMCertificate(string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: []byte("garbage")})))
+	g.Expect(err).To(MatchError(ContainSubstring("unable to parse agent certificate")))
+}
+
+// gzipData compresses the data provided
+func gzipData(t *testing.T, data []byte) []byte {
+	g := NewWithT(t)
+	var compressed bytes.Buffer
+	writer := gzip.NewWriter(&compressed)
+	_, err := writer.Write(data)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(writer.Close()).To(Succeed())
+	return compressed.Bytes()
+}
+
+func TestDecompressIfGzip(t *testing.T) {
+	g := NewWithT(t)
+	eventLog := []byte("measured boot event log")
+
+	decompressed, err := DecompressIfGzip(gzipData(t, eventLog))
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(decompressed).To(Equal(eventLog))
+
+	plain, err := DecompressIfGzip(eventLog)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(plain).To(Equal(eventLog))
+
+	_, err = DecompressIfGzip([]byte{0x1f, 0x8b, 0x00})
+	g.Expect(err).To(MatchError(ContainSubstring("unable to decompress gzip data")))
+}
+
+func TestDecompressIfGzipWithLimit(t *testing.T) {
+	g := NewWithT(t)
+	bomb := gzipData(t, bytes.Repeat([]byte{0}, 1024*1024))
+
+	_, err := DecompressIfGzipWithLimit(bomb, 1024)
+	g.Expect(errors.Is(err, ErrDecompressedTooLarge)).To(BeTrue())
+
+	decompressed, err := DecompressIfGzipWithLimit(bomb, 1024*1024)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(decompressed).To(HaveLen(1024 * 1024))
+}
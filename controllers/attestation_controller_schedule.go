@@ -0,0 +1,69 @@
+/*
+Copyright 2023.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"time"
+
+	"github.com/robfig/cron/v3"
+	keylimev1alpha1 "github.com/sarroutbi/osdk-attestation-operator/api/v1alpha1"
+	"k8s.io/utils/clock"
+)
+
+// now returns the current time of the clock of the reconciler, the real clock if not set
+func (r *AttestationReconciler) now() time.Time {
+	if r.Clock == nil {
+		return clock.RealClock{}.Now()
+	}
+	return r.Clock.Now()
+}
+
+// InSchedule checks whether the time provided is in a minute matched by the schedule, e.g. in a maintenance
+// window such as "* 2-3 * * 6" (every minute from 2:00 to 3:59 on Saturdays)
+// :param cron.Schedule schedule: schedule of the attestations
+// :param time.Time now: time to check
+//
+// :return:
+//
+//	bool: true if the schedule matches the minute of the time provided
+//	time.Time: next time matched by the schedule after the time provided
+func InSchedule(schedule cron.Schedule, now time.Time) (bool, time.Time) {
+	minute := now.Truncate(time.Minute)
+	if schedule.Next(minute.Add(-time.Second)).Equal(minute) {
+		return true, now
+	}
+	return false, schedule.Next(now)
+}
+
+// outsideSchedule checks whether the attestation specifies a schedule not matching the current time,
+// returning the delay until the next time matched if so. Invalid schedules are reported when the spec is
+// validated, so they are not considered here
+func (r *AttestationReconciler) outsideSchedule(attestation *keylimev1alpha1.Attestation) (bool, time.Duration) {
+	if attestation.Spec.Schedule == "" {
+		return false, 0
+	}
+	schedule, err := cron.ParseStandard(attestation.Spec.Schedule)
+	if err != nil {
+		return false, 0
+	}
+	now := r.now()
+	inSchedule, next := InSchedule(schedule, now)
+	if inSchedule {
+		return false, 0
+	}
+	return true, next.Sub(now)
+}
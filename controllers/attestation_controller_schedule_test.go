@@ -0,0 +1,102 @@
+/*
+Copyright 2023.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	. "github.com/onsi/gomega"
+	"github.com/robfig/cron/v3"
+	keylimev1alpha1 "github.com/sarroutbi/osdk-attestation-operator/api/v1alpha1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	clocktesting "k8s.io/utils/clock/testing"
+	ctrl "sigs.k8s.io/controller-runtime"
+)
+
+func TestInSchedule(t *testing.T) {
+	g := NewWithT(t)
+	// Maintenance window from 2:00 to 3:59 on Saturdays
+	schedule, err := cron.ParseStandard("CRON_TZ=UTC * 2-3 * * 6")
+	g.Expect(err).NotTo(HaveOccurred())
+	saturday := time.Date(2023, time.March, 4, 0, 0, 0, 0, time.UTC)
+
+	inSchedule, _ := InSchedule(schedule, saturday.Add(2*time.Hour))
+	g.Expect(inSchedule).To(BeTrue())
+	inSchedule, _ = InSchedule(schedule, saturday.Add(3*time.Hour+59*time.Minute+30*time.Second))
+	g.Expect(inSchedule).To(BeTrue())
+
+	inSchedule, next := InSchedule(schedule, saturday.Add(4*time.Hour))
+	g.Expect(inSchedule).To(BeFalse())
+	g.Expect(next).To(BeTemporally("==", saturday.Add(7*24*time.Hour+2*time.Hour)))
+	inSchedule, next = InSchedule(schedule, saturday.Add(time.Hour+30*time.Minute))
+	g.Expect(inSchedule).To(BeFalse())
+	g.Expect(next).To(BeTemporally("==", saturday.Add(2*time.Hour)))
+}
+
+// scheduledAttestation returns an attestation restricted to the schedule provided
+func scheduledAttestation(schedule string) *keylimev1alpha1.Attestation {
+	return &keylimev1alpha1.Attestation{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "keylime", Name: "attestation"},
+		Spec: keylimev1alpha1.AttestationSpec{
+			PodAttestationInfo: &keylimev1alpha1.PodAttestation{PodName: "agent", Command: []string{"attest"}},
+			Schedule:           schedule,
+		},
+	}
+}
+
+func TestReconcileOutsideSchedule(t *testing.T) {
+	g := NewWithT(t)
+	useFakeConfig(t)
+	r := testReconciler(t, scheduledAttestation("CRON_TZ=UTC * 2-3 * * *"))
+	r.Clock = clocktesting.NewFakePassiveClock(time.Date(2023, time.March, 4, 1, 30, 0, 0, time.UTC))
+	key := types.NamespacedName{Namespace: "keylime", Name: "attestation"}
+
+	result, err := r.Reconcile(context.Background(), ctrl.Request{NamespacedName: key})
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(result.RequeueAfter).To(Equal(30 * time.Minute))
+	current, err := GetAttestation(context.Background(), r.Client, key)
+	g.Expect(err).NotTo(HaveOccurred())
+	// Attestation is not attempted
+	g.Expect(current.Status.Conditions).To(BeEmpty())
+	g.Expect(current.Status.ConsecutiveFailures).To(BeZero())
+}
+
+func TestReconcileInsideSchedule(t *testing.T) {
+	g := NewWithT(t)
+	useFakeConfig(t)
+	r := testReconciler(t, scheduledAttestation("CRON_TZ=UTC * 2-3 * * *"), testPod("keylime", "agent", true))
+	r.Clock = clocktesting.NewFakePassiveClock(time.Date(2023, time.March, 4, 2, 30, 0, 0, time.UTC))
+	key := types.NamespacedName{Namespace: "keylime", Name: "attestation"}
+
+	// Attestation is attempted, and fails as fake config points to an unreachable API server to execute the command
+	_, err := r.Reconcile(context.Background(), ctrl.Request{NamespacedName: key})
+	g.Expect(err).NotTo(HaveOccurred())
+	current, err := GetAttestation(context.Background(), r.Client, key)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(current.Status.ConsecutiveFailures).To(Equal(1))
+}
+
+func TestValidateSpecSchedule(t *testing.T) {
+	g := NewWithT(t)
+	err := ValidateSpec(&scheduledAttestation("* 25 * * *").Spec)
+	g.Expect(errors.Is(err, ErrInvalidSpec)).To(BeTrue())
+	g.Expect(ValidateSpec(&scheduledAttestation("@daily").Spec)).To(Succeed())
+}
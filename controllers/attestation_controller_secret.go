@@ -0,0 +1,205 @@
+/*
+Copyright 2023.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	keylimev1alpha1 "github.com/sarroutbi/osdk-attestation-operator/api/v1alpha1"
+	core_v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+)
+
+// Keys of the evidence Secret
+const (
+	EvidenceQuoteKey     = "quote"
+	EvidenceNonceKey     = "nonce"
+	EvidenceTimestampKey = "timestamp"
+	EvidenceVerifiedKey  = "verified"
+)
+
+// EvidenceSecretSuffix is appended to the name of the attestation to name its evidence Secret, so that it does not
+// collide with the Secrets of the user, e.g. the one referenced by CommandSecretRef
+const EvidenceSecretSuffix = "-evidence"
+
+// ErrSecretNotOwned is returned when a Secret to store attestation artifacts already exists, but is not
+// controlled by the attestation, so it is not modified
+var ErrSecretNotOwned = errors.New("secret not controlled by attestation")
+
+// EvidenceSecretName returns the name of the Secret storing the evidence of the attestation
+func EvidenceSecretName(attestation *keylimev1alpha1.Attestation) string {
+	return attestation.Name + EvidenceSecretSuffix
+}
+
+// Evidence contains the result of an attestation, persisted for audit
+type Evidence struct {
+	// Quote is the output of the attestation command
+	Quote string
+	// Nonce is the challenge sent to the attestation command, if any
+	Nonce string
+	// Timestamp is the time of the attestation
+	Timestamp time.Time
+	// Verified is true if the attestation succeeded
+	Verified bool
+}
+
+// CreateOwnedSecret creates a secret holding attestation artifacts (e.g. quotes or nonces), owned by the
+// attestation, so that it is garbage collected by Kubernetes when the attestation is deleted, and labeled with
+// OwnedByLabel, so that it is swept if it survives the attestation.
+// Secret is created in the attestation namespace, as cross namespace owner references are not allowed
+// :param context: context of the request
+// :param *keylimev1alpha1.Attestation attestation: owner of the secret
+// :param *core_v1.Secret secret: secret to create
+//
+// :return:
+//
+//	error: If any error has occurred otherwise `nil`
+func (r *AttestationReconciler) CreateOwnedSecret(ctx context.Context, attestation *keylimev1alpha1.Attestation,
+	secret *core_v1.Secret) error {
+	if secret.Namespace == "" {
+		secret.Namespace = attestation.Namespace
+	}
+	if secret.Namespace != attestation.Namespace {
+		return fmt.Errorf("secret %s/%s must be in the namespace of attestation %s/%s", secret.Namespace, secret.Name,
+			attestation.Namespace, attestation.Name)
+	}
+	setOwnedByLabel(attestation, secret)
+	if err := controllerutil.SetControllerReference(attestation, secret, r.Scheme); err != nil {
+		return fmt.Errorf("unable to set owner reference on secret %s/%s: %w", secret.Namespace, secret.Name, err)
+	}
+	if r.DryRun {
+		GetLogInstance().Info("Dry run: would create secret", "Namespace", secret.Namespace, "Secret", secret.Name)
+		return nil
+	}
+	GetLogInstance().Info("Creating secret", "Namespace", secret.Namespace, "Secret", secret.Name)
+	return r.Create(ctx, secret)
+}
+
+// PersistEvidence stores the evidence of the attestation in a Secret owned by the attestation, named by
+// EvidenceSecretName. Secret is updated on re-attestation. Existing Secrets not controlled by the attestation are
+// never modified, ErrSecretNotOwned (wrapped) being returned instead. Nothing is stored if evidence persistence is
+// disabled
+// :param context: context of the request
+// :param *keylimev1alpha1.Attestation attestation: attestation the evidence belongs to
+// :param Evidence evidence: evidence to store
+//
+// :return:
+//
+//	error: If any error has occurred otherwise `nil`
+func (r *AttestationReconciler) PersistEvidence(ctx context.Context, attestation *keylimev1alpha1.Attestation,
+	evidence Evidence) error {
+	if r.DisableEvidencePersistence {
+		return nil
+	}
+	secret := &core_v1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Namespace: attestation.Namespace, Name: EvidenceSecretName(attestation)},
+	}
+	if r.DryRun {
+		GetLogInstance().Info("Dry run: would store evidence", "Namespace", secret.Namespace, "Secret", secret.Name)
+		return nil
+	}
+	return r.storeEvidence(ctx, attestation, secret, evidenceData("", evidence))
+}
+
+// PodEvidenceKey returns the key of the evidence Secret storing the evidence key provided for a pod attested
+// through the pod selector, e.g. agent-0.quote
+func PodEvidenceKey(podName, key string) string {
+	return podName + "." + key
+}
+
+// PersistPodEvidence stores the evidence of the pods attested through the pod selector in the evidence Secret of
+// the attestation, see PersistEvidence, under the keys returned by PodEvidenceKey for each pod
+// :param context: context of the request
+// :param *keylimev1alpha1.Attestation attestation: attestation the evidence belongs to
+// :param map[string]Evidence evidence: evidence to store, keyed by pod name
+//
+// :return:
+//
+//	error: If any error has occurred otherwise `nil`
+func (r *AttestationReconciler) PersistPodEvidence(ctx context.Context, attestation *keylimev1alpha1.Attestation,
+	evidence map[string]Evidence) error {
+	if r.DisableEvidencePersistence {
+		return nil
+	}
+	secret := &core_v1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Namespace: attestation.Namespace, Name: EvidenceSecretName(attestation)},
+	}
+	if r.DryRun {
+		GetLogInstance().Info("Dry run: would store evidence", "Namespace", secret.Namespace, "Secret", secret.Name,
+			"Pods", len(evidence))
+		return nil
+	}
+	data := map[string][]byte{}
+	for podName, podEvidence := range evidence {
+		for key, value := range evidenceData(PodEvidenceKey(podName, ""), podEvidence) {
+			data[key] = value
+		}
+	}
+	return r.storeEvidence(ctx, attestation, secret, data)
+}
+
+// evidenceData returns the data of the evidence Secret storing the evidence provided, prefixing its keys
+func evidenceData(prefix string, evidence Evidence) map[string][]byte {
+	return map[string][]byte{
+		prefix + EvidenceQuoteKey:     []byte(evidence.Quote),
+		prefix + EvidenceNonceKey:     []byte(evidence.Nonce),
+		prefix + EvidenceTimestampKey: []byte(evidence.Timestamp.UTC().Format(time.RFC3339)),
+		prefix + EvidenceVerifiedKey:  []byte(strconv.FormatBool(evidence.Verified)),
+	}
+}
+
+// storeEvidence creates or updates the evidence Secret provided with the data provided, replacing the previous
+// evidence. Existing Secrets not controlled by the attestation are never modified. Secret is read through the API
+// reader, so that Secrets are not cached by the manager
+func (r *AttestationReconciler) storeEvidence(ctx context.Context, attestation *keylimev1alpha1.Attestation,
+	secret *core_v1.Secret, data map[string][]byte) error {
+	err := r.apiReader().Get(ctx, client.ObjectKeyFromObject(secret), secret)
+	if err != nil && !apierrors.IsNotFound(err) {
+		return fmt.Errorf("unable to get evidence secret %s/%s: %w", secret.Namespace, secret.Name, err)
+	}
+	operation := controllerutil.OperationResultCreated
+	if err == nil {
+		if !metav1.IsControlledBy(secret, attestation) {
+			return fmt.Errorf("unable to store evidence in secret %s/%s: %w: already exists", secret.Namespace,
+				secret.Name, ErrSecretNotOwned)
+		}
+		operation = controllerutil.OperationResultUpdated
+	}
+	secret.Type = core_v1.SecretTypeOpaque
+	setOwnedByLabel(attestation, secret)
+	secret.Data = data
+	if err := controllerutil.SetControllerReference(attestation, secret, r.Scheme); err != nil {
+		return fmt.Errorf("unable to set owner reference on secret %s/%s: %w", secret.Namespace, secret.Name, err)
+	}
+	if operation == controllerutil.OperationResultCreated {
+		err = r.Create(ctx, secret)
+	} else {
+		err = r.Update(ctx, secret)
+	}
+	if err != nil {
+		return fmt.Errorf("unable to store evidence in secret %s/%s: %w", secret.Namespace, secret.Name, err)
+	}
+	GetLogInstance().Info("Evidence stored", "Namespace", secret.Namespace, "Secret", secret.Name, "Operation", operation)
+	return nil
+}
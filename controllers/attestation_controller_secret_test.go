@@ -0,0 +1,404 @@
+/*
+Copyright 2023.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	keylimev1alpha1 "github.com/sarroutbi/osdk-attestation-operator/api/v1alpha1"
+	core_v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/validation"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+// testReconciler returns a reconciler backed by a fake client holding the objects provided
+func testReconciler(t *testing.T, objects ...runtime.Object) *AttestationReconciler {
+	g := NewWithT(t)
+	s := runtime.NewScheme()
+	g.Expect(clientgoscheme.AddToScheme(s)).To(Succeed())
+	g.Expect(keylimev1alpha1.AddToScheme(s)).To(Succeed())
+	return &AttestationReconciler{
+		Client: &statusApplyClient{Client: fake.NewClientBuilder().WithScheme(s).WithRuntimeObjects(objects...).Build()},
+		Scheme: s,
+	}
+}
+
+func TestCreateOwnedSecret(t *testing.T) {
+	useFakeConfig(t)
+	g := NewWithT(t)
+	attestation := &keylimev1alpha1.Attestation{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "attestation", UID: "1234"},
+	}
+	r := testReconciler(t, attestation)
+
+	secret := &core_v1.Secret{ObjectMeta: metav1.ObjectMeta{Name: "quote"}}
+	g.Expect(r.CreateOwnedSecret(context.Background(), attestation, secret)).To(Succeed())
+
+	created := &core_v1.Secret{}
+	g.Expect(r.Get(context.Background(), types.NamespacedName{Namespace: "default", Name: "quote"}, created)).To(Succeed())
+	g.Expect(created.OwnerReferences).To(HaveLen(1))
+	owner := created.OwnerReferences[0]
+	g.Expect(owner.Kind).To(Equal("Attestation"))
+	g.Expect(owner.Name).To(Equal("attestation"))
+	g.Expect(owner.UID).To(Equal(attestation.UID))
+	g.Expect(owner.Controller).NotTo(BeNil())
+	g.Expect(*owner.Controller).To(BeTrue())
+	g.Expect(owner.BlockOwnerDeletion).NotTo(BeNil())
+	g.Expect(*owner.BlockOwnerDeletion).To(BeTrue())
+}
+
+func TestCreateOwnedSecretOtherNamespace(t *testing.T) {
+	useFakeConfig(t)
+	g := NewWithT(t)
+	attestation := &keylimev1alpha1.Attestation{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "attestation", UID: "1234"},
+	}
+	r := testReconciler(t, attestation)
+
+	secret := &core_v1.Secret{ObjectMeta: metav1.ObjectMeta{Namespace: "other", Name: "quote"}}
+	g.Expect(r.CreateOwnedSecret(context.Background(), attestation, secret)).NotTo(Succeed())
+}
+
+func TestPersistEvidence(t *testing.T) {
+	useFakeConfig(t)
+	g := NewWithT(t)
+	ctx := context.Background()
+	attestation := &keylimev1alpha1.Attestation{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "attestation", UID: "1234"},
+	}
+	r := testReconciler(t, attestation)
+	key := types.NamespacedName{Namespace: "default", Name: "attestation-evidence"}
+	timestamp := time.Date(2023, 3, 1, 10, 0, 0, 0, time.UTC)
+
+	g.Expect(r.PersistEvidence(ctx, attestation, Evidence{Quote: "quote", Nonce: "nonce", Timestamp: timestamp,
+		Verified: true})).To(Succeed())
+	secret := &core_v1.Secret{}
+	g.Expect(r.Get(ctx, key, secret)).To(Succeed())
+	g.Expect(secret.Data).To(Equal(map[string][]byte{
+		EvidenceQuoteKey:     []byte("quote"),
+		EvidenceNonceKey:     []byte("nonce"),
+		EvidenceTimestampKey: []byte("2023-03-01T10:00:00Z"),
+		EvidenceVerifiedKey:  []byte("true"),
+	}))
+	g.Expect(secret.OwnerReferences).To(HaveLen(1))
+	g.Expect(secret.OwnerReferences[0].UID).To(Equal(attestation.UID))
+
+	// Re-attestation updates the existing secret
+	g.Expect(r.PersistEvidence(ctx, attestation, Evidence{Quote: "new quote", Timestamp: timestamp.Add(time.Hour),
+		Verified: true})).To(Succeed())
+	secrets := &core_v1.SecretList{}
+	g.Expect(r.List(ctx, secrets)).To(Succeed())
+	g.Expect(secrets.Items).To(HaveLen(1))
+	g.Expect(secrets.Items[0].Data).To(HaveKeyWithValue(EvidenceQuoteKey, []byte("new quote")))
+	g.Expect(secrets.Items[0].Data).To(HaveKeyWithValue(EvidenceTimestampKey, []byte("2023-03-01T11:00:00Z")))
+	g.Expect(secrets.Items[0].OwnerReferences).To(HaveLen(1))
+}
+
+func TestPersistEvidenceExistingSecret(t *testing.T) {
+	useFakeConfig(t)
+	g := NewWithT(t)
+	ctx := context.Background()
+	attestation := &keylimev1alpha1.Attestation{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "attestation", UID: "1234"},
+	}
+	// Secrets of the user named after the attestation, e.g. the one holding its command, are not touched
+	command := &core_v1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "attestation"},
+		Data:       map[string][]byte{"command": []byte("attest")},
+	}
+	unowned := &core_v1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "attestation-evidence"},
+		Data:       map[string][]byte{"data": []byte("user data")},
+	}
+	r := testReconciler(t, attestation, command, unowned)
+
+	err := r.PersistEvidence(ctx, attestation, Evidence{Quote: "quote", Timestamp: time.Now(), Verified: true})
+	g.Expect(errors.Is(err, ErrSecretNotOwned)).To(BeTrue())
+	for _, expected := range []*core_v1.Secret{command, unowned} {
+		secret := &core_v1.Secret{}
+		g.Expect(r.Get(ctx, client.ObjectKeyFromObject(expected), secret)).To(Succeed())
+		g.Expect(secret.Data).To(Equal(expected.Data))
+		g.Expect(secret.OwnerReferences).To(BeEmpty())
+	}
+}
+
+func TestPersistEvidenceDisabled(t *testing.T) {
+	useFakeConfig(t)
+	g := NewWithT(t)
+	attestation := &keylimev1alpha1.Attestation{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "attestation", UID: "1234"},
+	}
+	r := testReconciler(t, attestation)
+	r.DisableEvidencePersistence = true
+
+	g.Expect(r.PersistEvidence(context.Background(), attestation, Evidence{Quote: "quote"})).To(Succeed())
+	secrets := &core_v1.SecretList{}
+	g.Expect(r.List(context.Background(), secrets)).To(Succeed())
+	g.Expect(secrets.Items).To(BeEmpty())
+}
+
+func TestPersistEvidenceLongAttestationName(t *testing.T) {
+	useFakeConfig(t)
+	g := NewWithT(t)
+	ctx := context.Background()
+	// Attestation names may be longer than the 63 characters allowed in label values
+	attestation := &keylimev1alpha1.Attestation{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: strings.Repeat("attestation.", 8) + "agent",
+			UID: "0b8f9a3c-5d2e-4f61-9a7b-3c2d1e0f9a8b"},
+	}
+	r := testReconciler(t, attestation)
+
+	g.Expect(r.PersistEvidence(ctx, attestation, Evidence{Quote: "quote"})).To(Succeed())
+	secret := &core_v1.Secret{}
+	g.Expect(r.Get(ctx, types.NamespacedName{Namespace: "default", Name: EvidenceSecretName(attestation)},
+		secret)).To(Succeed())
+	for _, value := range secret.Labels {
+		g.Expect(validation.IsValidLabelValue(value)).To(BeEmpty())
+	}
+	g.Expect(secret.Labels).To(HaveKeyWithValue(OwnedByLabel, string(attestation.UID)))
+	g.Expect(secret.Annotations).To(HaveKeyWithValue(OwnedByNameAnnotation, attestation.Name))
+
+	// Secret is found owned by the attestation without its owner reference as well
+	secret.OwnerReferences = nil
+	owner, uid := secretOwner(secret)
+	g.Expect(owner).To(Equal(client.ObjectKeyFromObject(attestation)))
+	g.Expect(uid).To(Equal(attestation.UID))
+}
+
+func TestSweepOrphanSecrets(t *testing.T) {
+	useFakeConfig(t)
+	g := NewWithT(t)
+	attestation := &keylimev1alpha1.Attestation{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "attestation", UID: "1234"},
+	}
+	owned := &core_v1.Secret{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "attestation",
+		Labels: map[string]string{OwnedByLabel: "attestation"}}}
+	orphan := &core_v1.Secret{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "deleted",
+		Labels: map[string]string{OwnedByLabel: "deleted"}}}
+	// Secret labeled with the UID of a previous attestation with the same name
+	recreated := &core_v1.Secret{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "recreated",
+		Labels:      map[string]string{OwnedByLabel: "5678"},
+		Annotations: map[string]string{OwnedByNameAnnotation: "attestation"}}}
+	unrelated := &core_v1.Secret{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "unrelated"}}
+	r := testReconciler(t, attestation, owned, orphan, recreated, unrelated)
+	// Secret owned by a previous attestation with the same name is orphaned as well
+	stale := &core_v1.Secret{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "stale"}}
+	g.Expect(r.CreateOwnedSecret(context.Background(), &keylimev1alpha1.Attestation{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "attestation", UID: "5678"},
+	}, stale)).To(Succeed())
+
+	orphans, err := r.SweepOrphanSecrets(context.Background())
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(orphans).To(Equal(3))
+
+	secrets := &core_v1.SecretList{}
+	g.Expect(r.List(context.Background(), secrets)).To(Succeed())
+	var names []string
+	for _, s := range secrets.Items {
+		names = append(names, s.Name)
+	}
+	g.Expect(names).To(ConsistOf("attestation", "unrelated"))
+}
+
+func TestSweepOrphanSecretsDryRun(t *testing.T) {
+	useFakeConfig(t)
+	g := NewWithT(t)
+	orphan := &core_v1.Secret{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "deleted",
+		Labels: map[string]string{OwnedByLabel: "deleted"}}}
+	r := testReconciler(t, orphan)
+	r.DryRun = true
+
+	orphans, err := r.SweepOrphanSecrets(context.Background())
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(orphans).To(Equal(1))
+	g.Expect(r.Get(context.Background(), types.NamespacedName{Namespace: "default", Name: "deleted"},
+		&core_v1.Secret{})).To(Succeed())
+}
+
+// listRecorder records the lists performed through the reader
+type listRecorder struct {
+	client.Reader
+	lists []string
+}
+
+func (l *listRecorder) List(ctx context.Context, list client.ObjectList, opts ...client.ListOption) error {
+	listOpts := &client.ListOptions{}
+	listOpts.ApplyOptions(opts)
+	l.lists = append(l.lists, fmt.Sprintf("%T/%s", list, listOpts.Namespace))
+	return l.Reader.List(ctx, list, opts...)
+}
+
+func TestSweepOrphanSecretsThroughAPIReader(t *testing.T) {
+	useFakeConfig(t)
+	t.Setenv(watchNamespacesEnvVar, "default,keylime")
+	g := NewWithT(t)
+	ctx := context.Background()
+	// Secret is only known by the API server, it is not in the cache of the client
+	orphan := &core_v1.Secret{ObjectMeta: metav1.ObjectMeta{Namespace: "keylime", Name: "deleted", UID: "1234",
+		Labels: map[string]string{OwnedByLabel: "deleted"}}}
+	apiReader := testReconciler(t, orphan)
+	reader := &listRecorder{Reader: apiReader.Client}
+	r := testReconciler(t)
+	r.APIReader = reader
+
+	orphans, err := r.SweepOrphanSecrets(ctx)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(orphans).To(Equal(1))
+	g.Expect(reader.lists).To(Equal([]string{
+		"*v1.PartialObjectMetadataList/default", "*v1.PartialObjectMetadataList/keylime",
+	}))
+}
+
+func TestSecretsReadThroughAPIReader(t *testing.T) {
+	useFakeConfig(t)
+	g := NewWithT(t)
+	ctx := context.Background()
+	// Secrets are only known by the API server, they are not in the cache of the client
+	existing := &core_v1.Secret{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "attestation-evidence"}}
+	command := &core_v1.Secret{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "command"},
+		Data: map[string][]byte{"command": []byte("tpm2_quote")}}
+	r := testReconciler(t)
+	r.APIReader = testReconciler(t, existing, command).Client
+
+	err := r.PersistEvidence(ctx, commandSecretAttestation("command", "command"), Evidence{Quote: "quote"})
+	g.Expect(errors.Is(err, ErrSecretNotOwned)).To(BeTrue())
+
+	commandRead, err := r.attestationCommand(ctx, commandSecretAttestation("command", "command"))
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(commandRead).To(Equal([]string{"tpm2_quote"}))
+}
+
+func TestPersistPodEvidence(t *testing.T) {
+	useFakeConfig(t)
+	g := NewWithT(t)
+	ctx := context.Background()
+	attestation := &keylimev1alpha1.Attestation{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "attestation", UID: "1234"},
+	}
+	r := testReconciler(t, attestation)
+	timestamp := time.Date(2023, 3, 1, 10, 0, 0, 0, time.UTC)
+
+	g.Expect(r.PersistPodEvidence(ctx, attestation, map[string]Evidence{
+		"agent-0": {Quote: "quote 0", Nonce: "nonce 0", Timestamp: timestamp, Verified: true},
+		"agent-1": {Quote: "quote 1", Nonce: "nonce 1", Timestamp: timestamp},
+	})).To(Succeed())
+	secret := &core_v1.Secret{}
+	g.Expect(r.Get(ctx, types.NamespacedName{Namespace: "default", Name: "attestation-evidence"}, secret)).To(Succeed())
+	g.Expect(secret.Data).To(Equal(map[string][]byte{
+		"agent-0.quote":     []byte("quote 0"),
+		"agent-0.nonce":     []byte("nonce 0"),
+		"agent-0.timestamp": []byte("2023-03-01T10:00:00Z"),
+		"agent-0.verified":  []byte("true"),
+		"agent-1.quote":     []byte("quote 1"),
+		"agent-1.nonce":     []byte("nonce 1"),
+		"agent-1.timestamp": []byte("2023-03-01T10:00:00Z"),
+		"agent-1.verified":  []byte("false"),
+	}))
+	g.Expect(metav1.IsControlledBy(secret, attestation)).To(BeTrue())
+}
+
+func TestAttestSelectedPodsPersistsEvidence(t *testing.T) {
+	useFakeConfig(t)
+	g := NewWithT(t)
+	ctx := context.Background()
+	useCommandExecutors(t, map[string]*fakeExecutor{"attest": {stdout: "PCR quote"}})
+	attestation := &keylimev1alpha1.Attestation{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "keylime", Name: "attestation", UID: "1234"},
+		Spec: keylimev1alpha1.AttestationSpec{
+			PodAttestationInfo: &keylimev1alpha1.PodAttestation{ContainerName: "agent", Command: []string{"attest"}},
+			PodSelector:        &metav1.LabelSelector{MatchLabels: map[string]string{"app": "agent"}},
+		},
+	}
+	r := testReconciler(t, attestation, labeledPod("agent-0", map[string]string{"app": "agent"}),
+		labeledPod("agent-1", map[string]string{"app": "agent"}))
+
+	// Quotes do not include the nonce, so attestation fails, but quotes are kept for audit
+	g.Expect(r.Attest(ctx, attestation)).NotTo(Succeed())
+	g.Expect(attestation.Status.PodResults).To(HaveLen(2))
+	g.Expect(attestation.Status.Output).To(BeEmpty())
+	secret := &core_v1.Secret{}
+	g.Expect(r.Get(ctx, types.NamespacedName{Namespace: "keylime", Name: "attestation-evidence"}, secret)).To(Succeed())
+	for _, pod := range []string{"agent-0", "agent-1"} {
+		g.Expect(secret.Data).To(HaveKeyWithValue(PodEvidenceKey(pod, EvidenceQuoteKey), []byte("PCR quote")))
+		g.Expect(secret.Data).To(HaveKeyWithValue(PodEvidenceKey(pod, EvidenceVerifiedKey), []byte("false")))
+		g.Expect(secret.Data).To(HaveKey(PodEvidenceKey(pod, EvidenceNonceKey)))
+	}
+}
+
+var _ = Describe("Evidence Secret", func() {
+	It("is removed once its attestation is deleted", func() {
+		ctx := context.Background()
+		attestation := &keylimev1alpha1.Attestation{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "evidence-owner"},
+			Spec: keylimev1alpha1.AttestationSpec{
+				PodAttestationInfo: &keylimev1alpha1.PodAttestation{PodName: "agent", Command: []string{"true"}},
+			},
+		}
+		Expect(k8sClient.Create(ctx, attestation)).To(Succeed())
+		r := &AttestationReconciler{Client: k8sClient, Scheme: clientgoscheme.Scheme}
+		Expect(r.PersistEvidence(ctx, attestation, Evidence{Quote: "quote"})).To(Succeed())
+
+		key := types.NamespacedName{Namespace: attestation.Namespace, Name: EvidenceSecretName(attestation)}
+		secret := &core_v1.Secret{}
+		Expect(k8sClient.Get(ctx, key, secret)).To(Succeed())
+		Expect(secret.Data).To(HaveKeyWithValue(EvidenceQuoteKey, []byte("quote")))
+		// envtest runs no garbage collector, so the owner reference it relies on is checked instead
+		owner := metav1.GetControllerOf(secret)
+		Expect(owner).NotTo(BeNil())
+		Expect(owner.UID).To(Equal(attestation.UID))
+		Expect(owner.BlockOwnerDeletion).NotTo(BeNil())
+		Expect(*owner.BlockOwnerDeletion).To(BeTrue())
+
+		Expect(k8sClient.Delete(ctx, attestation)).To(Succeed())
+		Eventually(func() bool {
+			return apierrors.IsNotFound(k8sClient.Get(ctx, client.ObjectKeyFromObject(attestation), attestation))
+		}).Should(BeTrue())
+		// Secret left behind without garbage collector is removed by the sweep of orphaned Secrets
+		orphans, err := r.SweepOrphanSecrets(ctx)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(orphans).To(Equal(1))
+		Expect(apierrors.IsNotFound(k8sClient.Get(ctx, key, &core_v1.Secret{}))).To(BeTrue())
+	})
+
+	It("is stored for attestations whose name is not a valid label value", func() {
+		ctx := context.Background()
+		attestation := &keylimev1alpha1.Attestation{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: strings.Repeat("long-name.", 8) + "attestation"},
+			Spec: keylimev1alpha1.AttestationSpec{
+				PodAttestationInfo: &keylimev1alpha1.PodAttestation{PodName: "agent", Command: []string{"true"}},
+			},
+		}
+		Expect(k8sClient.Create(ctx, attestation)).To(Succeed())
+		r := &AttestationReconciler{Client: k8sClient, Scheme: clientgoscheme.Scheme}
+		Expect(r.PersistEvidence(ctx, attestation, Evidence{Quote: "quote"})).To(Succeed())
+		Expect(r.PersistEvidence(ctx, attestation, Evidence{Quote: "new quote"})).To(Succeed())
+		Expect(k8sClient.Delete(ctx, attestation)).To(Succeed())
+	})
+})
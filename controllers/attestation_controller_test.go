@@ -0,0 +1,216 @@
+/*
+Copyright 2023.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	. "github.com/onsi/gomega"
+	keylimev1alpha1 "github.com/sarroutbi/osdk-attestation-operator/api/v1alpha1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/utils/pointer"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+)
+
+// reconciledAttestation returns an attestation whose generation has been reconciled successfully
+func reconciledAttestation(generation int64) *keylimev1alpha1.Attestation {
+	a := &keylimev1alpha1.Attestation{ObjectMeta: metav1.ObjectMeta{Name: "attestation", Generation: generation}}
+	a.Status.ObservedGeneration = generation
+	a.Status.Conditions = []metav1.Condition{{Type: keylimev1alpha1.ConditionReady, Status: metav1.ConditionTrue}}
+	return a
+}
+
+func TestUpToDate(t *testing.T) {
+	g := NewWithT(t)
+	r := &AttestationReconciler{}
+
+	upToDate, requeueAfter := r.UpToDate(reconciledAttestation(2))
+	g.Expect(upToDate).To(BeTrue())
+	g.Expect(requeueAfter).To(BeZero())
+
+	// Spec changes bump generation
+	a := reconciledAttestation(2)
+	a.Generation = 3
+	upToDate, _ = r.UpToDate(a)
+	g.Expect(upToDate).To(BeFalse())
+
+	a = reconciledAttestation(2)
+	a.Status.Conditions[0].Status = metav1.ConditionFalse
+	upToDate, _ = r.UpToDate(a)
+	g.Expect(upToDate).To(BeFalse())
+}
+
+func TestUpToDatePeriodicAttestation(t *testing.T) {
+	g := NewWithT(t)
+	r := &AttestationReconciler{}
+	a := reconciledAttestation(1)
+	a.Spec.PodAttestationInfo = &keylimev1alpha1.PodAttestation{PodName: "agent"}
+	a.Spec.IntervalSeconds = pointer.Int(60)
+
+	upToDate, _ := r.UpToDate(a)
+	g.Expect(upToDate).To(BeFalse())
+
+	last := metav1.NewTime(time.Now().Add(-20 * time.Second))
+	a.Status.LastAttestationTime = &last
+	upToDate, requeueAfter := r.UpToDate(a)
+	g.Expect(upToDate).To(BeTrue())
+	g.Expect(requeueAfter).To(BeNumerically("~", 40*time.Second, time.Second))
+
+	last = metav1.NewTime(time.Now().Add(-61 * time.Second))
+	upToDate, _ = r.UpToDate(a)
+	g.Expect(upToDate).To(BeFalse())
+}
+
+func TestUpToDateJitteredRequeue(t *testing.T) {
+	g := NewWithT(t)
+	r := &AttestationReconciler{RequeueJitterFactor: 0.1}
+	a := reconciledAttestation(1)
+	a.Spec.PodAttestationInfo = &keylimev1alpha1.PodAttestation{PodName: "agent"}
+	a.Spec.IntervalSeconds = pointer.Int(100)
+
+	// Requeue scattered before the interval is due
+	last := metav1.NewTime(time.Now().Add(-95 * time.Second))
+	a.Status.LastAttestationTime = &last
+	upToDate, _ := r.UpToDate(a)
+	g.Expect(upToDate).To(BeFalse())
+
+	last = metav1.NewTime(time.Now().Add(-80 * time.Second))
+	upToDate, _ = r.UpToDate(a)
+	g.Expect(upToDate).To(BeTrue())
+}
+
+func TestReconcileTracksConsecutiveFailures(t *testing.T) {
+	g := NewWithT(t)
+	useFakeConfig(t)
+	attestation := &keylimev1alpha1.Attestation{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "keylime", Name: "attestation"},
+		Spec: keylimev1alpha1.AttestationSpec{
+			PodAttestationInfo: &keylimev1alpha1.PodAttestation{PodName: "agent", Command: []string{"attest"}},
+		},
+	}
+	r := testReconciler(t, attestation, testPod("keylime", "agent", true))
+	key := types.NamespacedName{Namespace: "keylime", Name: "attestation"}
+
+	// Pod is ready, but command can not be executed, as fake config points to an unreachable API server
+	for failures := 1; failures <= 2; failures++ {
+		_, err := r.Reconcile(context.Background(), ctrl.Request{NamespacedName: key})
+		g.Expect(err).NotTo(HaveOccurred())
+		current, err := GetAttestation(context.Background(), r.Client, key)
+		g.Expect(err).NotTo(HaveOccurred())
+		g.Expect(current.Status.ConsecutiveFailures).To(Equal(failures))
+		g.Expect(current.Status.LastFailureReason).To(Equal(ReasonExecFailed))
+	}
+
+	current, err := GetAttestation(context.Background(), r.Client, key)
+	g.Expect(err).NotTo(HaveOccurred())
+	current.Spec.PodAttestationInfo = nil
+	g.Expect(r.Client.Update(context.Background(), current)).To(Succeed())
+	_, err = r.Reconcile(context.Background(), ctrl.Request{NamespacedName: key})
+	g.Expect(err).NotTo(HaveOccurred())
+	current, err = GetAttestation(context.Background(), r.Client, key)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(current.Status.ConsecutiveFailures).To(BeZero())
+	g.Expect(current.Status.LastFailureReason).To(Equal(ReasonExecFailed))
+}
+
+func TestFailureReason(t *testing.T) {
+	g := NewWithT(t)
+	r := &AttestationReconciler{}
+	a := &keylimev1alpha1.Attestation{}
+	g.Expect(r.FailureReason(a)).To(Equal(ReasonReconcileFailed))
+	r.SetCondition(a, keylimev1alpha1.ConditionQuoted, metav1.ConditionFalse, ReasonNonceMismatch, "mismatch")
+	g.Expect(r.FailureReason(a)).To(Equal(ReasonNonceMismatch))
+}
+
+func TestAttestationPredicate(t *testing.T) {
+	g := NewWithT(t)
+	p := attestationPredicate()
+	old := reconciledAttestation(1)
+
+	statusUpdate := old.DeepCopy()
+	statusUpdate.Status.ConsecutiveFailures = 3
+	g.Expect(p.Update(event.UpdateEvent{ObjectOld: old, ObjectNew: statusUpdate})).To(BeFalse())
+
+	specUpdate := old.DeepCopy()
+	specUpdate.Spec.IntervalSeconds = pointer.Int(60)
+	specUpdate.Generation = 2
+	g.Expect(p.Update(event.UpdateEvent{ObjectOld: old, ObjectNew: specUpdate})).To(BeTrue())
+
+	g.Expect(p.Create(event.CreateEvent{Object: old})).To(BeTrue())
+	g.Expect(p.Delete(event.DeleteEvent{Object: old})).To(BeTrue())
+}
+
+func TestReconcilePausedAttestation(t *testing.T) {
+	g := NewWithT(t)
+	useFakeConfig(t)
+	executed := useCommandExecutors(t, map[string]*fakeExecutor{})
+	attestation := &keylimev1alpha1.Attestation{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "keylime", Name: "attestation",
+			Annotations: map[string]string{PausedAnnotation: "true"}},
+		Spec: keylimev1alpha1.AttestationSpec{
+			PodAttestationInfo: &keylimev1alpha1.PodAttestation{PodName: "agent", Command: []string{"attest"}},
+			PreExecCommand:     []string{"mount-tpm"},
+			IntervalSeconds:    pointer.Int(60),
+		},
+	}
+	r := testReconciler(t, attestation, testPod("keylime", "agent", true))
+	key := types.NamespacedName{Namespace: "keylime", Name: "attestation"}
+
+	result, err := r.Reconcile(context.Background(), ctrl.Request{NamespacedName: key})
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(result).To(Equal(ctrl.Result{}))
+	g.Expect(*executed).To(BeEmpty())
+	paused, err := GetAttestation(context.Background(), r.Client, key)
+	g.Expect(err).NotTo(HaveOccurred())
+	ready := r.GetCondition(paused, keylimev1alpha1.ConditionReady)
+	g.Expect(ready).NotTo(BeNil())
+	g.Expect(ready.Status).To(Equal(metav1.ConditionUnknown))
+	g.Expect(ready.Reason).To(Equal(ReasonPaused))
+	g.Expect(paused.Status.ConsecutiveFailures).To(BeZero())
+
+	// Removing the annotation triggers a reconcile attesting the pod again
+	resumed := paused.DeepCopy()
+	delete(resumed.Annotations, PausedAnnotation)
+	g.Expect(attestationPredicate().Update(event.UpdateEvent{ObjectOld: paused, ObjectNew: resumed})).To(BeTrue())
+	g.Expect(r.Client.Update(context.Background(), resumed)).To(Succeed())
+	// Pre exec command can not be executed, as no executor is registered for it
+	result, err = r.Reconcile(context.Background(), ctrl.Request{NamespacedName: key})
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(result.RequeueAfter).NotTo(BeZero())
+	current, err := GetAttestation(context.Background(), r.Client, key)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(current.Status.ConsecutiveFailures).To(Equal(1))
+}
+
+func TestAttestationPredicatePause(t *testing.T) {
+	g := NewWithT(t)
+	p := attestationPredicate()
+	old := reconciledAttestation(1)
+
+	paused := old.DeepCopy()
+	paused.Annotations = map[string]string{PausedAnnotation: "true"}
+	g.Expect(p.Update(event.UpdateEvent{ObjectOld: old, ObjectNew: paused})).To(BeTrue())
+
+	// Other annotations changes are still ignored
+	annotated := paused.DeepCopy()
+	annotated.Annotations["owner"] = "security"
+	g.Expect(p.Update(event.UpdateEvent{ObjectOld: paused, ObjectNew: annotated})).To(BeFalse())
+}
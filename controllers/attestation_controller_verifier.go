@@ -0,0 +1,182 @@
+/*
+Copyright 2023.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/encoding"
+	"google.golang.org/grpc/status"
+)
+
+// Verifier verifies the quotes collected from the pods to attest, e.g. by an external verification service
+type Verifier interface {
+	// Verify verifies the quote provided, obtained with the nonce provided
+	//
+	// :return:
+	//
+	//	  bool: true if the quote is verified, false otherwise
+	//	string: Message explaining the result of the verification
+	//	 error: If quote could not be verified, otherwise `nil`. ErrVerifierUnavailable (wrapped) is returned if
+	//	        the verifier can not be reached, which is transient, so the quote must be verified again later
+	Verify(ctx context.Context, quote, nonce []byte) (bool, string, error)
+}
+
+// NoopVerifier accepts every quote, so that only the nonce of the quote is checked. It is used when no
+// verifier is configured
+type NoopVerifier struct{}
+
+// Verify accepts the quote provided
+func (NoopVerifier) Verify(_ context.Context, _, _ []byte) (bool, string, error) {
+	return true, "Quote verification not configured", nil
+}
+
+// verifier returns the verifier of the quotes, NoopVerifier if not set
+func (r *AttestationReconciler) verifier() Verifier {
+	if r.Verifier == nil {
+		return NoopVerifier{}
+	}
+	return r.Verifier
+}
+
+// VerifierMethod is the full name of the gRPC method called by GRPCVerifier. Requests and responses are
+// encoded as JSON (content subtype "json"), see VerifyRequest and VerifyResponse
+const VerifierMethod = "/attestation.verifier.v1.Verifier/Verify"
+
+// VerifyRequest is the request of the verification of a quote
+type VerifyRequest struct {
+	// Quote contains the quote to verify
+	Quote []byte `json:"quote"`
+	// Nonce contains the nonce the quote was obtained with
+	Nonce []byte `json:"nonce"`
+}
+
+// VerifyResponse is the result of the verification of a quote
+type VerifyResponse struct {
+	// Verified is true if the quote is verified
+	Verified bool `json:"verified"`
+	// Message explains the result of the verification
+	Message string `json:"message,omitempty"`
+}
+
+// jsonCodec encodes gRPC messages as JSON, so that the verification service does not require generated code
+type jsonCodec struct{}
+
+// Marshal encodes the message provided as JSON
+func (jsonCodec) Marshal(v interface{}) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+// Unmarshal decodes the JSON message provided
+func (jsonCodec) Unmarshal(data []byte, v interface{}) error {
+	return json.Unmarshal(data, v)
+}
+
+// Name returns the content subtype of the codec
+func (jsonCodec) Name() string {
+	return "json"
+}
+
+// GRPCVerifier verifies quotes calling VerifierMethod of a gRPC verification service
+type GRPCVerifier struct {
+	conn *grpc.ClientConn
+}
+
+// NewGRPCVerifier returns a verifier calling the gRPC verification service of the endpoint provided.
+// Connection is established lazily, so an unreachable endpoint is only reported on verification
+// :param string endpoint: address of the verification service, e.g. verifier.keylime.svc:50051
+// :param bool plaintext: connect without TLS, e.g. for services in the same pod
+// :param ...grpc.DialOption options: additional dial options, e.g. custom dialers
+//
+// :return:
+//
+//	*GRPCVerifier: verifier of the service
+//	error: If any error has occurred otherwise `nil`
+func NewGRPCVerifier(endpoint string, plaintext bool, options ...grpc.DialOption) (*GRPCVerifier, error) {
+	if endpoint == "" {
+		return nil, errors.New("verifier endpoint must be specified")
+	}
+	transport := credentials.NewClientTLSFromCert(nil, "")
+	if plaintext {
+		transport = insecure.NewCredentials()
+	}
+	options = append([]grpc.DialOption{grpc.WithTransportCredentials(transport)}, options...)
+	conn, err := grpc.Dial(endpoint, options...)
+	if err != nil {
+		return nil, fmt.Errorf("unable to dial verifier %s: %w", endpoint, err)
+	}
+	return &GRPCVerifier{conn: conn}, nil
+}
+
+// Verify calls the verification service with the quote provided. Connection errors and deadlines are
+// reported as ErrVerifierUnavailable
+func (v *GRPCVerifier) Verify(ctx context.Context, quote, nonce []byte) (bool, string, error) {
+	response := &VerifyResponse{}
+	err := v.conn.Invoke(ctx, VerifierMethod, &VerifyRequest{Quote: quote, Nonce: nonce}, response,
+		grpc.ForceCodec(jsonCodec{}))
+	if err != nil {
+		switch status.Code(err) {
+		case codes.Unavailable, codes.DeadlineExceeded, codes.ResourceExhausted, codes.Aborted:
+			return false, "", wrapError(ErrVerifierUnavailable, err)
+		}
+		return false, "", fmt.Errorf("unable to verify quote: %w", err)
+	}
+	return response.Verified, response.Message, nil
+}
+
+// Close closes the connection to the verification service
+func (v *GRPCVerifier) Close() error {
+	return v.conn.Close()
+}
+
+// VerifierServer is the server side of the verification service called by GRPCVerifier
+type VerifierServer interface {
+	// Verify verifies the quote of the request
+	Verify(ctx context.Context, request *VerifyRequest) (*VerifyResponse, error)
+}
+
+// RegisterVerifierServer registers the verification service provided in the gRPC server. Server must be
+// created with grpc.ForceServerCodec(VerifierCodec()), as messages are encoded as JSON
+func RegisterVerifierServer(server *grpc.Server, verifier VerifierServer) {
+	server.RegisterService(&grpc.ServiceDesc{
+		ServiceName: "attestation.verifier.v1.Verifier",
+		HandlerType: (*VerifierServer)(nil),
+		Methods: []grpc.MethodDesc{{
+			MethodName: "Verify",
+			Handler: func(srv interface{}, ctx context.Context, decode func(interface{}) error,
+				_ grpc.UnaryServerInterceptor) (interface{}, error) {
+				request := &VerifyRequest{}
+				if err := decode(request); err != nil {
+					return nil, err
+				}
+				return srv.(VerifierServer).Verify(ctx, request)
+			},
+		}},
+	}, verifier)
+}
+
+// VerifierCodec returns the codec of the messages of the verification service
+func VerifierCodec() encoding.Codec {
+	return jsonCodec{}
+}
@@ -0,0 +1,191 @@
+/*
+Copyright 2023.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/go-logr/logr"
+	. "github.com/onsi/gomega"
+	keylimev1alpha1 "github.com/sarroutbi/osdk-attestation-operator/api/v1alpha1"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/remotecommand"
+)
+
+// fakeVerifierServer accepts the quotes containing the nonce of the request, recording the last request
+type fakeVerifierServer struct {
+	request *VerifyRequest
+	err     error
+}
+
+func (f *fakeVerifierServer) Verify(_ context.Context, request *VerifyRequest) (*VerifyResponse, error) {
+	f.request = request
+	if f.err != nil {
+		return nil, f.err
+	}
+	if string(request.Quote) != "quote "+string(request.Nonce) {
+		return &VerifyResponse{Message: "quote does not match its nonce"}, nil
+	}
+	return &VerifyResponse{Verified: true, Message: "quote verified"}, nil
+}
+
+// startFakeVerifier serves the fake verifier in process, returning a verifier connected to it and the
+// function stopping the server
+func startFakeVerifier(t *testing.T, server *fakeVerifierServer) (*GRPCVerifier, func()) {
+	listener := bufconn.Listen(1024 * 1024)
+	grpcServer := grpc.NewServer(grpc.ForceServerCodec(VerifierCodec()))
+	RegisterVerifierServer(grpcServer, server)
+	go func() { _ = grpcServer.Serve(listener) }()
+	t.Cleanup(grpcServer.Stop)
+	verifier, err := NewGRPCVerifier("bufnet", true, grpc.WithContextDialer(
+		func(ctx context.Context, _ string) (net.Conn, error) {
+			return listener.DialContext(ctx)
+		}))
+	if err != nil {
+		t.Fatalf("unable to create verifier: %v", err)
+	}
+	t.Cleanup(func() { _ = verifier.Close() })
+	return verifier, grpcServer.Stop
+}
+
+func TestGRPCVerifier(t *testing.T) {
+	g := NewWithT(t)
+	server := &fakeVerifierServer{}
+	verifier, _ := startFakeVerifier(t, server)
+
+	verified, message, err := verifier.Verify(context.Background(), []byte("quote 1234"), []byte("1234"))
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(verified).To(BeTrue())
+	g.Expect(message).To(Equal("quote verified"))
+	g.Expect(server.request).To(Equal(&VerifyRequest{Quote: []byte("quote 1234"), Nonce: []byte("1234")}))
+
+	verified, message, err = verifier.Verify(context.Background(), []byte("quote 1234"), []byte("5678"))
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(verified).To(BeFalse())
+	g.Expect(message).To(Equal("quote does not match its nonce"))
+}
+
+func TestGRPCVerifierErrors(t *testing.T) {
+	g := NewWithT(t)
+	server := &fakeVerifierServer{err: status.Error(codes.InvalidArgument, "malformed quote")}
+	verifier, stop := startFakeVerifier(t, server)
+
+	_, _, err := verifier.Verify(context.Background(), []byte("quote"), []byte("1234"))
+	g.Expect(err).To(MatchError(ContainSubstring("malformed quote")))
+	g.Expect(errors.Is(err, ErrVerifierUnavailable)).To(BeFalse())
+
+	// Connection errors are transient
+	stop()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	_, _, err = verifier.Verify(ctx, []byte("quote"), []byte("1234"))
+	g.Expect(errors.Is(err, ErrVerifierUnavailable)).To(BeTrue())
+}
+
+func TestNewGRPCVerifierRequiresEndpoint(t *testing.T) {
+	g := NewWithT(t)
+	_, err := NewGRPCVerifier("", true)
+	g.Expect(err).To(HaveOccurred())
+}
+
+func TestVerifyQuote(t *testing.T) {
+	g := NewWithT(t)
+	SetLogInstance(logr.Discard())
+	server := &fakeVerifierServer{}
+	verifier, stop := startFakeVerifier(t, server)
+	r := &AttestationReconciler{Verifier: verifier}
+
+	outcome := r.verifyQuote(context.Background(), podAttestationOutcome{quote: "quote 1234", nonce: "1234"})
+	g.Expect(outcome.err).NotTo(HaveOccurred())
+
+	outcome = r.verifyQuote(context.Background(), podAttestationOutcome{quote: "quote 1234", nonce: "5678"})
+	g.Expect(outcome.reason).To(Equal(ReasonVerificationFailed))
+	g.Expect(outcome.err).To(MatchError("quote rejected by verifier: quote does not match its nonce"))
+
+	stop()
+	outcome = r.verifyQuote(context.Background(), podAttestationOutcome{quote: "quote 1234", nonce: "1234"})
+	g.Expect(outcome.reason).To(Equal(ReasonVerifierUnavailable))
+	g.Expect(errors.Is(outcome.err, ErrVerifierUnavailable)).To(BeTrue())
+
+	// Quotes are accepted if no verifier is configured
+	r = &AttestationReconciler{}
+	outcome = r.verifyQuote(context.Background(), podAttestationOutcome{quote: "quote", nonce: "1234"})
+	g.Expect(outcome.err).NotTo(HaveOccurred())
+}
+
+// quotingExecutor returns a quote including the nonce read from its input
+type quotingExecutor struct{}
+
+func (e quotingExecutor) Stream(options remotecommand.StreamOptions) error {
+	return e.StreamWithContext(context.Background(), options)
+}
+
+func (quotingExecutor) StreamWithContext(_ context.Context, options remotecommand.StreamOptions) error {
+	nonce, err := io.ReadAll(options.Stdin)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(options.Stdout, "PCR quote\nnonce: %s", nonce)
+	return err
+}
+
+func TestVerificationPolicy(t *testing.T) {
+	useFakeConfig(t)
+	useExecutor(t, func(_ *rest.Config, _ string, _ *url.URL) (remotecommand.Executor, error) {
+		return quotingExecutor{}, nil
+	})
+	tests := []struct {
+		policy   string
+		verified bool
+	}{
+		{policy: "", verified: false},
+		{policy: keylimev1alpha1.VerificationPolicyVerifier, verified: false},
+		{policy: keylimev1alpha1.VerificationPolicyNonce, verified: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.policy, func(t *testing.T) {
+			g := NewWithT(t)
+			attestation := &keylimev1alpha1.Attestation{
+				ObjectMeta: metav1.ObjectMeta{Namespace: "keylime", Name: "attestation", UID: "1234"},
+				Spec: keylimev1alpha1.AttestationSpec{PodAttestationInfo: &keylimev1alpha1.PodAttestation{
+					PodName: "agent", ContainerName: "agent", Command: []string{"attest"}, VerificationPolicy: tt.policy}},
+			}
+			r := testReconciler(t, attestation, testPod("keylime", "agent", true))
+			// Verifier rejects every quote of the executor, as they do not match the format it expects
+			verifier, _ := startFakeVerifier(t, &fakeVerifierServer{})
+			r.Verifier = verifier
+
+			err := r.Attest(context.Background(), attestation)
+			g.Expect(err == nil).To(Equal(tt.verified))
+			g.Expect(meta.IsStatusConditionTrue(attestation.Status.Conditions, keylimev1alpha1.ConditionVerified)).
+				To(Equal(tt.verified))
+		})
+	}
+}
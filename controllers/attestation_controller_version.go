@@ -20,8 +20,15 @@ import (
 	keylimev1alpha1 "github.com/sarroutbi/osdk-attestation-operator/api/v1alpha1"
 )
 
+// VERSION can be overridden at build time through:
+// -ldflags "-X github.com/sarroutbi/osdk-attestation-operator/controllers.VERSION=<version>"
 var VERSION = "v0.0.1-202312181800"
 
+// UserAgent returns the user agent the operator uses on its requests to the API server
+func UserAgent() string {
+	return "attestation-operator/" + VERSION
+}
+
 type VersionUpdater struct {
 	AttestationInfo *keylimev1alpha1.Attestation
 }
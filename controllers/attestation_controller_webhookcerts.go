@@ -0,0 +1,103 @@
+/*
+Copyright 2023.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"path/filepath"
+	"sync"
+
+	"sigs.k8s.io/controller-runtime/pkg/certwatcher"
+)
+
+// DefaultWebhookCertDir is the directory where the serving certificate of the webhooks is mounted,
+// see config/default/manager_webhook_patch.yaml
+const DefaultWebhookCertDir = "/tmp/k8s-webhook-server/serving-certs"
+
+// WebhookCertName and WebhookKeyName are the files of the serving certificate and key of the webhooks in
+// their directory, as written by cert-manager in the Secret mounted
+const (
+	WebhookCertName = "tls.crt"
+	WebhookKeyName  = "tls.key"
+)
+
+// WebhookCertWatcher serves the certificate of the webhooks, reloading it when its files are rotated
+// (e.g. by cert-manager), so that the operator does not have to be restarted
+type WebhookCertWatcher struct {
+	watcher *certwatcher.CertWatcher
+	lock    sync.Mutex
+	current *tls.Certificate
+}
+
+// NewWebhookCertWatcher loads the serving certificate and key of the webhooks from the directory provided,
+// WebhookCertName and WebhookKeyName files, and watches them for rotations once started
+// :param string certDir: directory of the serving certificate and key
+//
+// :return:
+//
+//	*WebhookCertWatcher: watcher of the certificate
+//	error: If the certificate can not be loaded, otherwise `nil`
+func NewWebhookCertWatcher(certDir string) (*WebhookCertWatcher, error) {
+	watcher, err := certwatcher.New(filepath.Join(certDir, WebhookCertName), filepath.Join(certDir, WebhookKeyName))
+	if err != nil {
+		return nil, fmt.Errorf("unable to load webhook serving certificate from %s: %w", certDir, err)
+	}
+	w := &WebhookCertWatcher{watcher: watcher}
+	_, _ = w.GetCertificate(nil)
+	return w, nil
+}
+
+// Start watches the certificate files until the context is done
+func (w *WebhookCertWatcher) Start(ctx context.Context) error {
+	return w.watcher.Start(ctx)
+}
+
+// NeedLeaderElection returns false, as webhooks are served by every replica
+func (w *WebhookCertWatcher) NeedLeaderElection() bool {
+	return false
+}
+
+// GetCertificate returns the current serving certificate, logging when it has been reloaded
+func (w *WebhookCertWatcher) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	cert, err := w.watcher.GetCertificate(hello)
+	if err != nil || cert == nil {
+		return cert, err
+	}
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	if cert != w.current {
+		message := "Webhook serving certificate loaded"
+		if w.current != nil {
+			message = "Webhook serving certificate reloaded"
+		}
+		if leaf, err := x509.ParseCertificate(cert.Certificate[0]); err == nil {
+			GetLogInstance().Info(message, "Subject", leaf.Subject.String(), "Not After", leaf.NotAfter)
+		} else {
+			GetLogInstance().Info(message)
+		}
+		w.current = cert
+	}
+	return cert, nil
+}
+
+// TLSOpt configures the TLS config of the webhook server provided to serve the certificate of the watcher
+func (w *WebhookCertWatcher) TLSOpt(config *tls.Config) {
+	config.GetCertificate = w.GetCertificate
+}
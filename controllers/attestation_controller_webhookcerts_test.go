@@ -0,0 +1,88 @@
+/*
+Copyright 2023.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/pem"
+	"net/http"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/go-logr/logr"
+	. "github.com/onsi/gomega"
+)
+
+// servedCertificate returns the DER of the certificate served by the TLS server of the address provided
+func servedCertificate(g *WithT, address string) []byte {
+	conn, err := tls.Dial("tcp", address, &tls.Config{InsecureSkipVerify: true}) //nolint:gosec
+	g.Expect(err).NotTo(HaveOccurred())
+	defer conn.Close()
+	return conn.ConnectionState().PeerCertificates[0].Raw
+}
+
+// certificateFile returns the DER of the certificate of the PEM file provided
+func certificateFile(g *WithT, path string) []byte {
+	data, err := os.ReadFile(path)
+	g.Expect(err).NotTo(HaveOccurred())
+	block, _ := pem.Decode(data)
+	g.Expect(block).NotTo(BeNil())
+	return block.Bytes
+}
+
+func TestWebhookCertWatcherReloadsRotatedCertificate(t *testing.T) {
+	SetLogInstance(logr.Discard())
+	g := NewWithT(t)
+	dir := t.TempDir()
+	certFile, _ := writeTestKeyPair(t, dir)
+	watcher, err := NewWebhookCertWatcher(dir)
+	g.Expect(err).NotTo(HaveOccurred())
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() { _ = watcher.Start(ctx) }()
+
+	// Served as the webhook server does, with the TLS options provided
+	config := &tls.Config{} //nolint:gosec
+	watcher.TLSOpt(config)
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", config)
+	g.Expect(err).NotTo(HaveOccurred())
+	server := &http.Server{Handler: http.NotFoundHandler(), ReadHeaderTimeout: time.Second}
+	go func() { _ = server.Serve(listener) }()
+	defer server.Close()
+	address := listener.Addr().String()
+	original := certificateFile(g, certFile)
+	g.Expect(servedCertificate(g, address)).To(Equal(original))
+
+	// Files are rotated in place, as cert-manager does when renewing the certificate. They are rotated again
+	// until the watch is established, as it is started asynchronously
+	g.Eventually(func() []byte {
+		writeTestKeyPair(t, dir)
+		time.Sleep(50 * time.Millisecond)
+		return servedCertificate(g, address)
+	}, 5*time.Second).ShouldNot(Equal(original))
+	g.Eventually(func() []byte {
+		return servedCertificate(g, address)
+	}, 5*time.Second, 50*time.Millisecond).Should(Equal(certificateFile(g, certFile)))
+}
+
+func TestNewWebhookCertWatcherMissingCertificate(t *testing.T) {
+	g := NewWithT(t)
+	_, err := NewWebhookCertWatcher(t.TempDir())
+	g.Expect(err).To(MatchError(ContainSubstring("unable to load webhook serving certificate")))
+}
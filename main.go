@@ -17,8 +17,10 @@ limitations under the License.
 package main
 
 import (
+	"context"
 	"flag"
 	"os"
+	"time"
 
 	// Import all Kubernetes client auth plugins (e.g. Azure, GCP, OIDC, etc.)
 	// to ensure that exec-entrypoint and run can make use of them.
@@ -28,6 +30,7 @@ import (
 	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
 	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
 	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/cache"
 	"sigs.k8s.io/controller-runtime/pkg/healthz"
 	"sigs.k8s.io/controller-runtime/pkg/log/zap"
 
@@ -36,6 +39,13 @@ import (
 	//+kubebuilder:scaffold:imports
 )
 
+// enableWebhooksEnvVar disables the admission webhooks when set to "false", e.g. to run the manager locally
+// without serving certificates. Webhooks are enabled otherwise
+const enableWebhooksEnvVar = "ENABLE_WEBHOOKS"
+
+// metricsDisabledAddress disables the metrics endpoint when used as metrics bind address
+const metricsDisabledAddress = "0"
+
 var (
 	scheme   = runtime.NewScheme()
 	setupLog = ctrl.Log.WithName("setup")
@@ -49,29 +59,170 @@ func init() {
 }
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == attestSubcommand {
+		os.Exit(runAttest(os.Args[2:]))
+	}
+	if len(os.Args) > 1 && os.Args[1] == validateSubcommand {
+		os.Exit(runValidate(os.Args[2:]))
+	}
 	var metricsAddr string
 	var enableLeaderElection bool
 	var probeAddr string
-	flag.StringVar(&metricsAddr, "metrics-bind-address", ":8080", "The address the metric endpoint binds to.")
+	var dryRun bool
+	var disableEvidencePersistence bool
+	var leaseDuration time.Duration
+	var renewDeadline time.Duration
+	var retryPeriod time.Duration
+	var leaderElectionNamespace string
+	var staleReconcileThreshold time.Duration
+	var execDrainTimeout time.Duration
+	var reconcileBaseDelay time.Duration
+	var reconcileMaxDelay time.Duration
+	var maxConcurrentReconciles int
+	var kubeContext string
+	var maxExecTimeout time.Duration
+	var orphanSweepInterval time.Duration
+	var maxStatusOutputBytes int
+	var requeueJitterFactor float64
+	var execRetries int
+	var webhookCertDir string
+	var verifierEndpoint string
+	var verifierPlaintext bool
+	flag.StringVar(&metricsAddr, "metrics-bind-address", ":8080",
+		"The address the metric endpoint binds to. Use 0 to disable serving metrics.")
 	flag.StringVar(&probeAddr, "health-probe-bind-address", ":8081", "The address the probe endpoint binds to.")
 	flag.BoolVar(&enableLeaderElection, "leader-elect", false,
 		"Enable leader election for controller manager. "+
 			"Enabling this will ensure there is only one active controller manager.")
+	flag.DurationVar(&leaseDuration, "leader-elect-lease-duration", 15*time.Second,
+		"Duration that non-leader candidates will wait to force acquire leadership.")
+	flag.DurationVar(&renewDeadline, "leader-elect-renew-deadline", 10*time.Second,
+		"Duration that the acting leader will retry refreshing leadership before giving up. "+
+			"It must be less than the lease duration.")
+	flag.DurationVar(&retryPeriod, "leader-elect-retry-period", 2*time.Second,
+		"Duration the leader election clients should wait between tries of actions.")
+	flag.StringVar(&leaderElectionNamespace, "leader-election-namespace", "",
+		"Namespace where the leader election resource is created. "+
+			"Namespace where the controller manager runs is used if not specified.")
+	flag.DurationVar(&staleReconcileThreshold, "stale-reconcile-threshold", 0,
+		"Report the operator as not alive if reconciles are pending but none has completed in this duration. "+
+			"Disabled if zero.")
+	flag.DurationVar(&execDrainTimeout, "exec-drain-timeout", controllers.DefaultExecDrainTimeout,
+		"Time allowed on shutdown for the commands being executed in pods to complete before stopping them.")
+	flag.DurationVar(&reconcileBaseDelay, "reconcile-base-delay", controllers.DefaultReconcileBaseDelay,
+		"Delay of the first retry of a failed reconcile, doubled on each consecutive failure.")
+	flag.DurationVar(&reconcileMaxDelay, "reconcile-max-delay", controllers.DefaultReconcileMaxDelay,
+		"Maximum delay of the retries of a failed reconcile.")
+	flag.IntVar(&maxConcurrentReconciles, "max-concurrent-reconciles", controllers.DefaultMaxConcurrentReconciles,
+		"Number of attestations reconciled in parallel. Parallel reconciles share the client rate limits, "+
+			"so OPERATOR_CLIENT_QPS and OPERATOR_CLIENT_BURST should be raised accordingly.")
+	flag.StringVar(&kubeContext, "kube-context", "",
+		"Kubeconfig context used when not running in cluster, taking precedence over OPERATOR_KUBE_CONTEXT. "+
+			"Current context of the kubeconfig is used if not specified.")
+	flag.DurationVar(&maxExecTimeout, "max-exec-timeout", controllers.DefaultMaxExecTimeout,
+		"Maximum exec timeout attestations can specify through timeoutseconds.")
+	flag.DurationVar(&orphanSweepInterval, "orphan-sweep-interval", controllers.DefaultOrphanSweepInterval,
+		"Period of the sweeps deleting Secrets whose owning attestation no longer exists. "+
+			"Secrets are swept on startup only if zero.")
+	flag.IntVar(&maxStatusOutputBytes, "max-status-output-bytes", controllers.DefaultMaxStatusOutputBytes,
+		"Maximum size of the command output stored in the attestation status. Full output is kept in the evidence Secret.")
+	flag.Float64Var(&requeueJitterFactor, "requeue-jitter-factor", controllers.DefaultRequeueJitterFactor,
+		"Fraction of the interval by which periodic re-attestations are scattered around it, e.g. 0.1 for ±10%. "+
+			"Disabled if zero.")
+	flag.IntVar(&execRetries, "exec-retries", 0,
+		"Number of times the attestation command is executed again when its stream fails, before the attestation fails.")
+	flag.StringVar(&verifierEndpoint, "verifier-endpoint", "",
+		"Address of the gRPC service verifying the quotes collected, e.g. verifier.keylime.svc:50051. "+
+			"Only the nonce of the quotes is checked if not specified.")
+	flag.BoolVar(&verifierPlaintext, "verifier-plaintext", false,
+		"Connect to the verifier without TLS.")
+	flag.StringVar(&webhookCertDir, "webhook-cert-dir", controllers.DefaultWebhookCertDir,
+		"Directory of the serving certificate (tls.crt) and key (tls.key) of the webhooks, reloaded when rotated.")
+	flag.BoolVar(&disableEvidencePersistence, "disable-evidence-persistence", false,
+		"Do not store the evidence of successful attestations in a Secret named after the attestation.")
+	flag.BoolVar(&dryRun, "dry-run", false,
+		"Perform read operations only, logging the exec commands and writes that would be performed instead.")
 	opts := zap.Options{
 		Development: true,
 	}
+	// Log format and level are configured through environment first, so that --zap-* flags can override them
+	logConfigErr := controllers.ConfigureLogOptions(&opts)
 	opts.BindFlags(flag.CommandLine)
 	flag.Parse()
 
 	ctrl.SetLogger(zap.New(zap.UseFlagOptions(&opts)))
+	if logConfigErr != nil {
+		setupLog.Error(logConfigErr, "invalid log configuration")
+	}
+
+	if enableLeaderElection && (renewDeadline >= leaseDuration || retryPeriod >= renewDeadline) {
+		setupLog.Info("invalid leader election configuration: retry period must be less than renew deadline, "+
+			"and renew deadline less than lease duration", "Lease Duration", leaseDuration,
+			"Renew Deadline", renewDeadline, "Retry Period", retryPeriod)
+		os.Exit(1)
+	}
+
+	if err := controllers.ValidateRequeueJitterFactor(requeueJitterFactor); err != nil {
+		setupLog.Error(err, "invalid requeue jitter factor")
+		os.Exit(1)
+	}
+
+	// --kubeconfig flag is registered by controller-runtime, use it for the attestation clients as well
+	if kubeconfig := flag.Lookup("kubeconfig"); kubeconfig != nil && kubeconfig.Value.String() != "" {
+		controllers.SetKubeconfigPath(kubeconfig.Value.String())
+	}
+	if kubeContext != "" {
+		controllers.SetKubeContext(kubeContext)
+	}
+	signalCtx := ctrl.SetupSignalHandler()
+	// On shutdown, execs in flight are allowed to complete, so manager is stopped once they ignore cancellation
+	ctx, stopManager := context.WithCancel(context.Background())
+	defer stopManager()
+	go func() {
+		<-signalCtx.Done()
+		controllers.BeginExecDrain()
+		stopManager()
+	}()
+	// API server may not be reachable yet on startup, retry before giving up
+	if _, err := controllers.GetClusterClientsetWithRetry(ctx, 5, time.Second); err != nil {
+		setupLog.Error(err, "unable to get cluster clientset")
+		os.Exit(1)
+	}
+	// Manager uses the same config as the attestation clients, so that its client, cache and leader election
+	// honor the OPERATOR_* environment variables (proxy, CA bundle, client certificate, API server host)
+	restConfig, err := controllers.GetClusterClientConfigWithContext(ctx)
+	if err != nil {
+		setupLog.Error(err, "unable to get cluster config", "Context", controllers.GetKubeContext())
+		os.Exit(1)
+	}
+	setupLog.Info("Connecting to API server", "Host", restConfig.Host)
 
-	mgr, err := ctrl.NewManager(ctrl.GetConfigOrDie(), ctrl.Options{
-		Scheme:                 scheme,
-		MetricsBindAddress:     metricsAddr,
-		Port:                   9443,
-		HealthProbeBindAddress: probeAddr,
-		LeaderElection:         enableLeaderElection,
-		LeaderElectionID:       "92ed29df.redhat.com",
+	watchNamespaces, err := controllers.GetWatchNamespaces()
+	if err != nil {
+		setupLog.Error(err, "unable to get watch namespaces")
+		os.Exit(1)
+	}
+	var newCache cache.NewCacheFunc
+	if len(watchNamespaces) > 0 {
+		setupLog.Info("Watching namespaces", "Namespaces", watchNamespaces)
+		newCache = cache.MultiNamespacedCacheBuilder(watchNamespaces)
+	} else {
+		setupLog.Info("Watching all namespaces")
+	}
+
+	mgr, err := ctrl.NewManager(restConfig, ctrl.Options{
+		NewCache:                newCache,
+		Scheme:                  scheme,
+		MetricsBindAddress:      metricsAddr,
+		Port:                    9443,
+		HealthProbeBindAddress:  probeAddr,
+		GracefulShutdownTimeout: &execDrainTimeout,
+		LeaderElection:          enableLeaderElection,
+		LeaderElectionID:        "92ed29df.redhat.com",
+		LeaderElectionNamespace: leaderElectionNamespace,
+		LeaseDuration:           &leaseDuration,
+		RenewDeadline:           &renewDeadline,
+		RetryPeriod:             &retryPeriod,
 		// LeaderElectionReleaseOnCancel defines if the leader should step down voluntarily
 		// when the Manager ends. This requires the binary to immediately end when the
 		// Manager is stopped, otherwise, this setting is unsafe. Setting this significantly
@@ -88,28 +239,95 @@ func main() {
 		setupLog.Error(err, "unable to start manager")
 		os.Exit(1)
 	}
+	// Metrics are registered even if not served, so that enabling them later only requires a restart
+	if metricsAddr == metricsDisabledAddress {
+		setupLog.Info("Metrics disabled, metrics endpoint not served")
+	} else {
+		setupLog.Info("Serving metrics", "Address", metricsAddr)
+	}
 
-	if err = (&controllers.AttestationReconciler{
-		Client: mgr.GetClient(),
-		Scheme: mgr.GetScheme(),
-	}).SetupWithManager(mgr); err != nil {
+	reconciler := &controllers.AttestationReconciler{
+		Client:                     mgr.GetClient(),
+		Scheme:                     mgr.GetScheme(),
+		DryRun:                     dryRun,
+		DisableEvidencePersistence: disableEvidencePersistence,
+		RateLimiter:                controllers.NewRateLimiter(reconcileBaseDelay, reconcileMaxDelay),
+		MaxConcurrentReconciles:    maxConcurrentReconciles,
+		MaxExecTimeout:             maxExecTimeout,
+		MaxStatusOutputBytes:       maxStatusOutputBytes,
+		RequeueJitterFactor:        requeueJitterFactor,
+		ExecRetries:                execRetries,
+	}
+	if verifierEndpoint != "" {
+		verifier, err := controllers.NewGRPCVerifier(verifierEndpoint, verifierPlaintext)
+		if err != nil {
+			setupLog.Error(err, "unable to set up verifier", "Endpoint", verifierEndpoint)
+			os.Exit(1)
+		}
+		defer verifier.Close()
+		setupLog.Info("Verifying quotes", "Endpoint", verifierEndpoint)
+		reconciler.Verifier = verifier
+	}
+	if err = reconciler.SetupWithManager(mgr); err != nil {
 		setupLog.Error(err, "unable to create controller", "controller", "Attestation")
 		os.Exit(1)
 	}
+	if err = reconciler.SetupOrphanSweepWithManager(mgr, orphanSweepInterval); err != nil {
+		setupLog.Error(err, "unable to set up orphaned secrets sweep")
+		os.Exit(1)
+	}
+	// Webhooks require serving certificates, mounted by config/default/manager_webhook_patch.yaml
+	if os.Getenv(enableWebhooksEnvVar) != "false" {
+		certWatcher, err := controllers.NewWebhookCertWatcher(webhookCertDir)
+		if err != nil {
+			setupLog.Error(err, "unable to set up webhook certificate watcher")
+			os.Exit(1)
+		}
+		if err = mgr.Add(certWatcher); err != nil {
+			setupLog.Error(err, "unable to start webhook certificate watcher")
+			os.Exit(1)
+		}
+		webhookServer := mgr.GetWebhookServer()
+		webhookServer.CertDir = webhookCertDir
+		webhookServer.TLSOpts = append(webhookServer.TLSOpts, certWatcher.TLSOpt)
+		if err = (&keylimev1alpha1.Attestation{}).SetupWebhookWithManager(mgr); err != nil {
+			setupLog.Error(err, "unable to create webhook", "webhook", "Attestation")
+			os.Exit(1)
+		}
+	}
 	//+kubebuilder:scaffold:builder
 
 	if err := mgr.AddHealthzCheck("healthz", healthz.Ping); err != nil {
 		setupLog.Error(err, "unable to set up health check")
 		os.Exit(1)
 	}
+	if staleReconcileThreshold > 0 {
+		if err := mgr.AddHealthzCheck("reconcile", controllers.StaleReconcileChecker(staleReconcileThreshold)); err != nil {
+			setupLog.Error(err, "unable to set up stale reconcile health check")
+			os.Exit(1)
+		}
+	}
 	if err := mgr.AddReadyzCheck("readyz", healthz.Ping); err != nil {
 		setupLog.Error(err, "unable to set up ready check")
 		os.Exit(1)
 	}
+	if err := mgr.AddReadyzCheck("api", controllers.APIServerChecker(controllers.DefaultAPIServerCheckTimeout)); err != nil {
+		setupLog.Error(err, "unable to set up API server ready check")
+		os.Exit(1)
+	}
 
 	setupLog.Info("starting manager")
-	if err := mgr.Start(ctrl.SetupSignalHandler()); err != nil {
-		setupLog.Error(err, "problem running manager")
+	startErr := mgr.Start(ctx)
+	if startErr != nil {
+		setupLog.Error(startErr, "problem running manager")
+	}
+	// Graceful shutdown of the manager and exec drain share the deadline counted from the shutdown signal, and
+	// execs are drained even if the manager failed, e.g. when its graceful shutdown timed out
+	if running := controllers.DrainExecs(controllers.RemainingDrainTimeout(execDrainTimeout)); running > 0 {
+		setupLog.Info("execs still running at shutdown were stopped", "Running", running)
+		os.Exit(1)
+	}
+	if startErr != nil {
 		os.Exit(1)
 	}
 }
@@ -0,0 +1,95 @@
+/*
+Copyright 2023.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	core_v1 "k8s.io/api/core/v1"
+	utilerrors "k8s.io/apimachinery/pkg/util/errors"
+	"sigs.k8s.io/yaml"
+
+	"github.com/sarroutbi/osdk-attestation-operator/controllers"
+)
+
+// validateSubcommand validates an attestation policy, so that policy ConfigMaps can be checked before
+// being applied
+const validateSubcommand = "validate"
+
+// runValidate runs the validate subcommand with the arguments provided, returning the exit code of the
+// operator: 0 if the policy is valid, or 1 otherwise, printing all the validation errors
+func runValidate(args []string) int {
+	var file string
+	flags := flag.NewFlagSet(validateSubcommand, flag.ContinueOnError)
+	flags.StringVar(&file, "file", "",
+		"Attestation policy validated, either the policy itself or a ConfigMap manifest storing it in its "+
+			controllers.PolicyConfigMapKey+" key. Policy is read from the standard input if set to -.")
+	if err := flags.Parse(args); err != nil {
+		return 1
+	}
+	if file == "" {
+		fmt.Fprintf(os.Stderr, "usage: %s %s --file FILE\n", os.Args[0], validateSubcommand)
+		return 1
+	}
+	data, err := readPolicy(file)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", file, err)
+		return 1
+	}
+	if err := controllers.ValidatePolicy(data); err != nil {
+		var aggregate utilerrors.Aggregate
+		if !errors.As(err, &aggregate) {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", file, err)
+			return 1
+		}
+		for _, validationErr := range aggregate.Errors() {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", file, validationErr)
+		}
+		return 1
+	}
+	fmt.Fprintf(os.Stdout, "%s: attestation policy is valid\n", file)
+	return 0
+}
+
+// readPolicy reads the attestation policy of the file provided, or of the standard input if file is -.
+// If the file contains a ConfigMap manifest, the policy stored in it is returned
+func readPolicy(file string) ([]byte, error) {
+	var data []byte
+	var err error
+	if file == "-" {
+		data, err = io.ReadAll(os.Stdin)
+	} else {
+		data, err = os.ReadFile(file)
+	}
+	if err != nil {
+		return nil, err
+	}
+	manifest := &core_v1.ConfigMap{}
+	if err := yaml.Unmarshal(data, manifest); err != nil || manifest.Kind != "ConfigMap" {
+		// Not a ConfigMap manifest, so policy parsing reports any error
+		return data, nil
+	}
+	policy, found := manifest.Data[controllers.PolicyConfigMapKey]
+	if !found {
+		return nil, fmt.Errorf("key %q not found in ConfigMap %s", controllers.PolicyConfigMapKey, manifest.Name)
+	}
+	return []byte(policy), nil
+}